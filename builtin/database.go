@@ -27,9 +27,15 @@ var databaseMethods = Methods{
 	"Auth": method("(data)", func(t *Thread, this Value, args []Value) Value {
 		return SuBool(t.Dbms().Auth(ToStr(args[0])))
 	}),
+	"Backup": method("(to)", func(t *Thread, this Value, args []Value) Value {
+		return SuStr(t.Dbms().Backup(ToStr(args[0])))
+	}),
 	"Check": method("()", func(t *Thread, this Value, args []Value) Value {
 		return SuStr(t.Dbms().Check())
 	}),
+	"Compact": method("()", func(t *Thread, this Value, args []Value) Value {
+		return SuStr(t.Dbms().Compact())
+	}),
 	"Connections": method("()", func(t *Thread, this Value, args []Value) Value {
 		return t.Dbms().Connections()
 	}),
@@ -0,0 +1,20 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package builtin
+
+import (
+	"github.com/apmckinlay/gsuneido/dbms/csio"
+	. "github.com/apmckinlay/gsuneido/runtime"
+)
+
+// ProtocolProfile returns the per command summary of the client-server
+// round trips, see options.TraceProtocol
+var _ = builtin1("ProtocolProfile(reset = false)",
+	func(arg Value) Value {
+		s := csio.ProfileSummary()
+		if arg == True {
+			csio.ProfileReset()
+		}
+		return SuStr(s)
+	})
@@ -5,41 +5,50 @@ package builtin
 
 import (
 	"bufio"
+	"crypto/tls"
 	"io"
 	"net"
 	"strconv"
 	"time"
 
+	"github.com/apmckinlay/gsuneido/options"
 	. "github.com/apmckinlay/gsuneido/runtime"
 	"github.com/apmckinlay/gsuneido/runtime/types"
+	"github.com/apmckinlay/gsuneido/util/tlsconf"
 )
 
 type suSocketClient struct {
 	CantConvert
-	conn    *net.TCPConn
+	conn    net.Conn
 	rdr     *bufio.Reader
 	timeout time.Duration
 }
 
 var nSocketClient = 0
 
-var _ = builtin("SocketClient(ipaddress, port, timeout=60, timeoutConnect=0, block=false)",
+// If tls is true the connection uses TLS,
+// verifying the server with options.TLSCA or the system certificate authorities
+var _ = builtin("SocketClient(ipaddress, port, timeout=60, timeoutConnect=0, block=false, tls=false)",
 	func(t *Thread, args []Value) Value {
-		ipaddr := ToStr(args[0])
+		host := ToStr(args[0])
 		port := ToInt(args[1])
-		ipaddr += ":" + strconv.Itoa(port)
+		ipaddr := host + ":" + strconv.Itoa(port)
+		toc := time.Duration(ToInt(OpMul(args[3], SuInt(1000)))) * 1000 * 1000
+		dialer := &net.Dialer{Timeout: toc} // zero means no timeout
 		var c net.Conn
 		var e error
-		toc := time.Duration(ToInt(OpMul(args[3], SuInt(1000)))) * 1000 * 1000
-		if toc <= 0 {
-			c, e = net.Dial("tcp", ipaddr)
+		if ToBool(args[5]) {
+			var config *tls.Config
+			if config, e = tlsconf.Client(options.TLSCA, host); e == nil {
+				c, e = tls.DialWithDialer(dialer, "tcp", ipaddr, config)
+			}
 		} else {
-			c, e = net.DialTimeout("tcp", ipaddr, toc)
+			c, e = dialer.Dial("tcp", ipaddr)
 		}
 		if e != nil {
 			panic("SocketClient: " + e.Error())
 		}
-		sc := &suSocketClient{conn: c.(*net.TCPConn), rdr: bufio.NewReader(c),
+		sc := &suSocketClient{conn: c, rdr: bufio.NewReader(c),
 			timeout: time.Duration(ToInt(args[2])) * time.Second}
 		nSocketClient++
 		if args[4] == False {
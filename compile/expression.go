@@ -30,6 +30,9 @@ func (p *parser) pcExpr(minprec int8) ast.Expr {
 	// fmt.Println("pcExpr minprec", minprec, "atom", e)
 	for p.Token != tok.Eof {
 		token := p.Token
+		if p.query && token == tok.Eq {
+			token = tok.Is
+		}
 		prec := precedence[token]
 		// fmt.Println("loop ", p.Item, "prec", prec)
 		if prec < minprec {
@@ -87,6 +90,9 @@ func (p *parser) pcExpr(minprec int8) ast.Expr {
 			}
 			p.match(tok.RBracket)
 		case tok.AssignStart < token && token < tok.AssignEnd:
+			if p.query {
+				p.error("assignment operators are not allowed in queries")
+			}
 			p.ckLvalue(e)
 			if id, ok := e.(*ast.Ident); ok {
 				name := id.Name
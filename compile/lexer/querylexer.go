@@ -52,6 +52,7 @@ var queryKeywords = map[string]tok.Token{
 	"not":       tok.Not,
 	"or":        tok.Or,
 	"project":   tok.Project,
+	"rebuild":   tok.Rebuild,
 	"remove":    tok.Remove,
 	"rename":    tok.Rename,
 	"reverse":   tok.Reverse,
@@ -36,6 +36,10 @@ type parserBase struct {
 
 	// newline is true if the current token was preceeded by a newline
 	newline bool
+
+	// query is true when parsing query expressions,
+	// newlines are not significant and = is treated as is
+	query bool
 }
 
 type parser struct {
@@ -119,7 +123,7 @@ func (p *parserBase) next() {
 	for {
 		p.Item = p.lxr.Next()
 		if p.Token == tok.Newline {
-			if p.lxr.AheadSkip(0).Token != tok.QMark {
+			if !p.query && p.lxr.AheadSkip(0).Token != tok.QMark {
 				p.newline = true
 			}
 		} else if p.Token != tok.Comment && p.Token != tok.Whitespace {
@@ -0,0 +1,307 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+// Package qast defines the node types
+// used by the query parser to build query trees.
+// Where and extend expressions use the language ast.
+package qast
+
+import (
+	"strings"
+
+	"github.com/apmckinlay/gsuneido/compile/ast"
+	. "github.com/apmckinlay/gsuneido/runtime"
+)
+
+// Query is implemented by all query nodes
+type Query interface {
+	qnode()
+	String() string
+}
+
+type qnodeT struct{}
+
+func (*qnodeT) qnode() {}
+
+// Table is a database table, the leaf of a query tree
+type Table struct {
+	qnodeT
+	Name string
+}
+
+func (q *Table) String() string {
+	return q.Name
+}
+
+// Single is the common base for the single source operations
+type Single struct {
+	Source Query
+}
+
+// Where selects the rows for which Expr is true
+type Where struct {
+	qnodeT
+	Single
+	Expr ast.Expr
+}
+
+func (q *Where) String() string {
+	return sourceString(q.Source) + " where " + q.Expr.String()
+}
+
+// Project keeps only the given columns, removing duplicates if required
+type Project struct {
+	qnodeT
+	Single
+	Columns []string
+}
+
+func (q *Project) String() string {
+	return sourceString(q.Source) + " project " + strings.Join(q.Columns, ", ")
+}
+
+// Remove is the opposite of Project, it removes the given columns
+type Remove struct {
+	qnodeT
+	Single
+	Columns []string
+}
+
+func (q *Remove) String() string {
+	return sourceString(q.Source) + " remove " + strings.Join(q.Columns, ", ")
+}
+
+// Rename renames columns, From and To are parallel lists
+type Rename struct {
+	qnodeT
+	Single
+	From []string
+	To   []string
+}
+
+func (q *Rename) String() string {
+	s := sourceString(q.Source) + " rename "
+	sep := ""
+	for i, from := range q.From {
+		s += sep + from + " to " + q.To[i]
+		sep = ", "
+	}
+	return s
+}
+
+// Extend adds calculated columns.
+// Cols and Exprs are parallel lists,
+// a nil Expr means the column is a rule
+type Extend struct {
+	qnodeT
+	Single
+	Cols  []string
+	Exprs []ast.Expr
+}
+
+func (q *Extend) String() string {
+	s := sourceString(q.Source) + " extend "
+	sep := ""
+	for i, col := range q.Cols {
+		s += sep + col
+		if q.Exprs[i] != nil {
+			s += " = " + q.Exprs[i].String()
+		}
+		sep = ", "
+	}
+	return s
+}
+
+// Summarize groups by the By columns and calculates the aggregates.
+// Cols, Ops, and Ons are parallel lists.
+// Ops are count, total, average, max, min, or list.
+// On is "" for count.
+type Summarize struct {
+	qnodeT
+	Single
+	By   []string
+	Cols []string
+	Ops  []string
+	Ons  []string
+}
+
+func (q *Summarize) String() string {
+	s := sourceString(q.Source) + " summarize "
+	if len(q.By) > 0 {
+		s += strings.Join(q.By, ", ") + ", "
+	}
+	sep := ""
+	for i, col := range q.Cols {
+		s += sep
+		if col != "" {
+			s += col + " = "
+		}
+		s += q.Ops[i]
+		if q.Ons[i] != "" {
+			s += " " + q.Ons[i]
+		}
+		sep = ", "
+	}
+	return s
+}
+
+// Sort orders the result, it is only allowed at the end of a query
+type Sort struct {
+	qnodeT
+	Single
+	Reverse bool
+	Columns []string
+}
+
+func (q *Sort) String() string {
+	s := sourceString(q.Source) + " sort "
+	if q.Reverse {
+		s += "reverse "
+	}
+	return s + strings.Join(q.Columns, ", ")
+}
+
+// Compatible is the common base for Union, Minus, and Intersect
+type Compatible struct {
+	Left  Query
+	Right Query
+}
+
+type Union struct {
+	qnodeT
+	Compatible
+}
+
+func (q *Union) String() string {
+	return binaryString(q.Left, "union", q.Right)
+}
+
+type Minus struct {
+	qnodeT
+	Compatible
+}
+
+func (q *Minus) String() string {
+	return binaryString(q.Left, "minus", q.Right)
+}
+
+type Intersect struct {
+	qnodeT
+	Compatible
+}
+
+func (q *Intersect) String() string {
+	return binaryString(q.Left, "intersect", q.Right)
+}
+
+type Times struct {
+	qnodeT
+	Left  Query
+	Right Query
+}
+
+func (q *Times) String() string {
+	return binaryString(q.Left, "times", q.Right)
+}
+
+// Join is a natural join on the By columns.
+// By is nil if it was not specified.
+type Join struct {
+	qnodeT
+	Left  Query
+	Right Query
+	By    []string
+}
+
+func (q *Join) String() string {
+	return binaryString(q.Left, "join"+byString(q.By), q.Right)
+}
+
+// LeftJoin is like Join but it includes the left rows with no match
+type LeftJoin struct {
+	qnodeT
+	Left  Query
+	Right Query
+	By    []string
+}
+
+func (q *LeftJoin) String() string {
+	return binaryString(q.Left, "leftjoin"+byString(q.By), q.Right)
+}
+
+func byString(by []string) string {
+	if by == nil {
+		return ""
+	}
+	return " by(" + strings.Join(by, ",") + ")"
+}
+
+// sourceString parenthesizes the source of a single source operation
+// if it is a binary operation, otherwise the operation
+// would appear to apply to just the right side
+func sourceString(q Query) string {
+	switch q.(type) {
+	case *Table, *Where, *Project, *Remove, *Rename, *Extend, *Summarize, *Sort:
+		return q.String()
+	}
+	return "(" + q.String() + ")"
+}
+
+// binaryString parenthesizes the right side if it is not a table
+// since operations are left associative
+func binaryString(left Query, op string, right Query) string {
+	r := right.String()
+	if _, ok := right.(*Table); !ok {
+		r = "(" + r + ")"
+	}
+	return left.String() + " " + op + " " + r
+}
+
+// actions ----------------------------------------------------------
+
+// Insert is either a record (Record) or a query (Source) into a query
+type Insert struct {
+	qnodeT
+	Record Value
+	Source Query
+	Into   Query
+}
+
+func (q *Insert) String() string {
+	s := "insert "
+	if q.Record != nil {
+		s += q.Record.String()
+	} else {
+		s += q.Source.String()
+	}
+	return s + " into " + q.Into.String()
+}
+
+// Update sets the Cols to the Exprs for each row of Query.
+// Cols and Exprs are parallel lists
+type Update struct {
+	qnodeT
+	Query Query
+	Cols  []string
+	Exprs []ast.Expr
+}
+
+func (q *Update) String() string {
+	s := "update " + q.Query.String() + " set "
+	sep := ""
+	for i, col := range q.Cols {
+		s += sep + col + " = " + q.Exprs[i].String()
+		sep = ", "
+	}
+	return s
+}
+
+// Delete deletes the rows of Query
+type Delete struct {
+	qnodeT
+	Query Query
+}
+
+func (q *Delete) String() string {
+	return "delete " + q.Query.String()
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/apmckinlay/gsuneido/compile/ast"
 	"github.com/apmckinlay/gsuneido/compile/lexer"
+	"github.com/apmckinlay/gsuneido/compile/qast"
 	tok "github.com/apmckinlay/gsuneido/compile/tokens"
 	"github.com/apmckinlay/gsuneido/db19/meta/schema"
 	"github.com/apmckinlay/gsuneido/util/str"
@@ -16,13 +17,17 @@ import (
 type Schema = schema.Schema
 type Index = schema.Index
 
+// qparser embeds parser so it can use the expression parsing
 type qparser struct {
-	parserBase
+	parser
 }
 
 func NewQueryParser(src string) *qparser {
 	lxr := lexer.NewQueryLexer(src)
-	p := &qparser{parserBase{lxr: lxr, Factory: ast.Builder{}}} //TODO query factory
+	factory := ast.Folder{Factory: ast.Builder{}}
+	p := &qparser{parser{
+		parserBase: parserBase{lxr: lxr, Factory: factory, query: true},
+		funcInfo:   funcInfo{final: map[string]int{}}}}
 	p.next()
 	return p
 }
@@ -62,6 +67,8 @@ func (p *qparser) request() *Request {
 		return &Request{Action: "rename", Renames: []Rename{rename}}
 	case p.matchIf(tok.Alter):
 		return p.alter()
+	case p.matchIf(tok.Rebuild):
+		return &Request{Action: "rebuild", Schema: p.schema2(p.matchIdent(), false)}
 	//TODO: View, Sview
 	default:
 		panic("invalid request")
@@ -216,17 +223,232 @@ func (p *qparser) foreignKey() (table string, columns []string, mode int) {
 	return table, columns, mode
 }
 
+// queries ----------------------------------------------------------
+
+// ParseQuery parses a query (including insert, update, and delete)
+// and returns a query tree
+func ParseQuery(src string) qast.Query {
+	p := NewQueryParser(src)
+	result := p.query()
+	if p.Token != tok.Eof {
+		p.error("did not parse all input")
+	}
+	return result
+}
+
+func (p *qparser) query() qast.Query {
+	switch {
+	case p.matchIf(tok.Insert):
+		return p.insert()
+	case p.matchIf(tok.Update):
+		return p.update()
+	case p.matchIf(tok.Delete):
+		return &qast.Delete{Query: p.query2()}
+	}
+	return p.sortQuery()
+}
+
+func (p *qparser) insert() qast.Query {
+	q := &qast.Insert{}
+	switch p.Token {
+	case tok.LCurly, tok.LBracket, tok.Hash:
+		q.Record = p.constant()
+	default:
+		q.Source = p.query2()
+	}
+	p.match(tok.Into)
+	q.Into = p.query2()
+	return q
+}
+
+func (p *qparser) update() qast.Query {
+	q := &qast.Update{Query: p.query2()}
+	p.match(tok.Set)
+	for {
+		q.Cols = append(q.Cols, p.matchIdent())
+		p.match(tok.Eq)
+		q.Exprs = append(q.Exprs, p.expr())
+		if !p.matchIf(tok.Comma) {
+			return q
+		}
+	}
+}
+
+// sortQuery handles sort which is only allowed at the end of a query
+func (p *qparser) sortQuery() qast.Query {
+	q := p.query2()
+	if p.matchIf(tok.Sort) {
+		reverse := p.matchIf(tok.Reverse)
+		q = &qast.Sort{Single: qast.Single{Source: q}, Reverse: reverse,
+			Columns: p.commaList()}
+	}
+	return q
+}
+
+// query2 handles the left associative query operations
+func (p *qparser) query2() qast.Query {
+	q := p.source()
+	for {
+		single := qast.Single{Source: q}
+		switch {
+		case p.matchIf(tok.Where):
+			q = &qast.Where{Single: single, Expr: p.expr()}
+		case p.matchIf(tok.Project):
+			q = &qast.Project{Single: single, Columns: p.commaList()}
+		case p.matchIf(tok.Remove):
+			q = &qast.Remove{Single: single, Columns: p.commaList()}
+		case p.matchIf(tok.Rename):
+			q = p.qrename(single)
+		case p.matchIf(tok.Extend):
+			q = p.extend(single)
+		case p.matchIf(tok.Summarize):
+			q = p.summarize(single)
+		case p.matchIf(tok.Join):
+			by := p.joinBy()
+			q = &qast.Join{Left: q, By: by, Right: p.source()}
+		case p.matchIf(tok.Leftjoin):
+			by := p.joinBy()
+			q = &qast.LeftJoin{Left: q, By: by, Right: p.source()}
+		case p.matchIf(tok.Times):
+			q = &qast.Times{Left: q, Right: p.source()}
+		case p.matchIf(tok.Union):
+			q = &qast.Union{Compatible: p.compatible(q)}
+		case p.matchIf(tok.Minus):
+			q = &qast.Minus{Compatible: p.compatible(q)}
+		case p.matchIf(tok.Intersect):
+			q = &qast.Intersect{Compatible: p.compatible(q)}
+		default:
+			return q
+		}
+	}
+}
+
+// source is either a table or a parenthesized query
+func (p *qparser) source() qast.Query {
+	if p.matchIf(tok.LParen) {
+		q := p.query2()
+		p.match(tok.RParen)
+		return q
+	}
+	return &qast.Table{Name: p.matchIdent()}
+}
+
+func (p *qparser) compatible(left qast.Query) qast.Compatible {
+	return qast.Compatible{Left: left, Right: p.source()}
+}
+
+func (p *qparser) commaList() []string {
+	list := []string{p.matchIdent()}
+	for p.matchIf(tok.Comma) {
+		list = append(list, p.matchIdent())
+	}
+	return list
+}
+
+func (p *qparser) qrename(single qast.Single) qast.Query {
+	q := &qast.Rename{Single: single}
+	for {
+		q.From = append(q.From, p.matchIdent())
+		p.match(tok.To)
+		q.To = append(q.To, p.matchIdent())
+		if !p.matchIf(tok.Comma) {
+			return q
+		}
+	}
+}
+
+func (p *qparser) extend(single qast.Single) qast.Query {
+	q := &qast.Extend{Single: single}
+	for {
+		q.Cols = append(q.Cols, p.matchIdent())
+		var expr ast.Expr
+		if p.matchIf(tok.Eq) {
+			expr = p.expr()
+		}
+		q.Exprs = append(q.Exprs, expr)
+		if !p.matchIf(tok.Comma) {
+			return q
+		}
+	}
+}
+
+func (p *qparser) summarize(single qast.Single) qast.Query {
+	q := &qast.Summarize{Single: single}
+	for {
+		if isSummarizeOp(p.Token) {
+			p.summarizeOp(q, "")
+		} else {
+			col := p.matchIdent()
+			if p.matchIf(tok.Eq) {
+				p.summarizeOp(q, col)
+			} else if len(q.Ops) == 0 {
+				q.By = append(q.By, col)
+			} else {
+				p.error("summarize by columns must come first")
+			}
+		}
+		if !p.matchIf(tok.Comma) {
+			break
+		}
+	}
+	if len(q.Ops) == 0 {
+		p.error("summarize requires count, total, average, max, min, or list")
+	}
+	return q
+}
+
+func isSummarizeOp(token tok.Token) bool {
+	switch token {
+	case tok.Count, tok.Total, tok.Average, tok.Max, tok.Min, tok.List:
+		return true
+	}
+	return false
+}
+
+func (p *qparser) summarizeOp(q *qast.Summarize, col string) {
+	if !isSummarizeOp(p.Token) {
+		p.error("expecting count, total, average, max, min, or list")
+	}
+	op := p.Text
+	p.next()
+	on := ""
+	if op != "count" {
+		on = p.matchIdent()
+	}
+	q.Cols = append(q.Cols, col)
+	q.Ops = append(q.Ops, op)
+	q.Ons = append(q.Ons, on)
+}
+
+// joinBy returns nil if there is no by
+func (p *qparser) joinBy() []string {
+	if !p.matchIf(tok.By) {
+		return nil
+	}
+	p.match(tok.LParen)
+	by := []string{}
+	if p.Token != tok.RParen {
+		by = p.commaList()
+	}
+	p.match(tok.RParen)
+	return by
+}
+
 //--------------------------------------------------------------------
 
 func (rq *Request) String() string {
 	s := rq.Action
 	switch rq.Action {
-	case "drop", "create", "ensure", "alter":
+	case "drop", "create", "ensure", "alter", "rebuild":
 		s += " " + rq.Table
 	}
 	switch rq.Action {
 	case "create", "ensure":
 		s += " " + rq.Schema.String()
+	case "rebuild":
+		if len(rq.Indexes) > 0 {
+			s += " " + rq.Schema.String()
+		}
 	}
 	switch rq.Action {
 	case "rename":
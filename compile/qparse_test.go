@@ -41,6 +41,10 @@ func TestQueryParserCreate(t *testing.T) {
 	test("alter mytable create (one,two,three) index(two)")
 	test("alter mytable rename one to two, three to four")
 
+	test("rebuild mytable")
+	test("rebuild mytable key(one)")
+	test("rebuild mytable index(two) index(three,one)")
+
 	xtest := func(qs, err string) {
 		fn := func() { ParseRequest(qs) }
 		assert.T(t).This(fn).Panics(err)
@@ -51,3 +55,57 @@ func TestQueryParserCreate(t *testing.T) {
 	xtest("create mytable (one,two,three_lower!) key(one)",
 		"_lower! base column not found")
 }
+
+func TestQueryParser(t *testing.T) {
+	test := func(qs, expected string) {
+		t.Helper()
+		if expected == "" {
+			expected = qs
+		}
+		q := ParseQuery(qs)
+		assert.T(t).This(q.String()).Is(expected)
+	}
+	test("tbl", "")
+	test("(tbl)", "tbl")
+	test("tbl where a = 1", "tbl where Binary(Is a 1)")
+	test("tbl where a is 1 and\n b < 2", "tbl where Nary(And Binary(Is a 1) Binary(Lt b 2))")
+	test("tbl where a in (1,2)", "tbl where In(a [1 2])")
+	test("tbl project a, b", "")
+	test("tbl remove a", "")
+	test("tbl rename a to b, c to d", "")
+	test("tbl extend a = b + 1, c", "tbl extend a = Nary(Add b 1), c")
+	test("tbl summarize count", "")
+	test("tbl summarize a, b, count, total x, y = max z", "")
+	test("tbl sort a", "")
+	test("tbl sort reverse a, b", "")
+	test("tbl where a > 1 project a sort a", "tbl where Binary(Gt a 1) project a sort a")
+	test("one join two", "")
+	test("one join by(a,b) two", "")
+	test("one leftjoin by() two", "")
+	test("one times two", "")
+	test("one union two minus three", "")
+	test("one intersect (two where a)", "")
+	test("(one union two) where a", "")
+	test("(one join two) sort a", "")
+	test("one union two where a", "(one union two) where a")
+	test("one union (two union three)", "")
+	test("insert { a: 1 } into tbl", "insert [a: 1] into tbl")
+	test("insert tbl where a into tbl2", "")
+	test("update tbl where a set b = 1, c = d $ 'x'",
+		`update tbl where a set b = 1, c = Nary(Cat d "x")`)
+	test("delete tbl where a", "")
+
+	xtest := func(qs, err string) {
+		t.Helper()
+		fn := func() { ParseQuery(qs) }
+		assert.T(t).This(fn).Panics(err)
+	}
+	xtest("tbl where a += 1", "assignment operators are not allowed")
+	xtest("tbl sort a where b", "did not parse all input")
+	xtest("tbl summarize count, a", "summarize by columns must come first")
+	xtest("tbl summarize a, b", "summarize requires")
+	xtest("tbl summarize x = a", "expecting count")
+	xtest("tbl project", "expecting identifier")
+	xtest("tbl rename a b", "expecting To")
+	xtest("one join by(a b) two", "expecting RParen")
+}
@@ -126,26 +126,27 @@ func _() {
 	_ = x[Min-115]
 	_ = x[Minus-116]
 	_ = x[Project-117]
-	_ = x[Remove-118]
-	_ = x[Rename-119]
-	_ = x[Reverse-120]
-	_ = x[Set-121]
-	_ = x[Sort-122]
-	_ = x[Summarize-123]
-	_ = x[Sview-124]
-	_ = x[Times-125]
-	_ = x[To-126]
-	_ = x[Total-127]
-	_ = x[Union-128]
-	_ = x[Unique-129]
-	_ = x[Update-130]
-	_ = x[View-131]
-	_ = x[Where-132]
+	_ = x[Rebuild-118]
+	_ = x[Remove-119]
+	_ = x[Rename-120]
+	_ = x[Reverse-121]
+	_ = x[Set-122]
+	_ = x[Sort-123]
+	_ = x[Summarize-124]
+	_ = x[Sview-125]
+	_ = x[Times-126]
+	_ = x[To-127]
+	_ = x[Total-128]
+	_ = x[Union-129]
+	_ = x[Unique-130]
+	_ = x[Update-131]
+	_ = x[View-132]
+	_ = x[Where-133]
 }
 
-const _Token_name = "NilEofErrorIdentifierNumberStringWhitespaceCommentNewlineHashCommaSemicolonAtLParenRParenLBracketRBracketLCurlyRCurlyRangeToRangeLenOpsStartNotBitNotNewDotCompareStartIsIsntMatchMatchNotLtLteGtGteCompareEndQMarkColonAssocStartAndOrBitOrBitAndBitXorAddSubCatMulDivAssocEndModLShiftRShiftIncPostIncDecPostDecAssignStartEqAddEqSubEqCatEqMulEqDivEqModEqLShiftEqRShiftEqBitOrEqBitAndEqBitXorEqAssignEndInBreakCaseCatchClassContinueDefaultDoElseFalseForForeverFunctionIfReturnSwitchSuperThisThrowTrueTryWhileQueryStartAlterAverageByCascadeCountCreateDeleteDropEnsureExtendHistoryIndexInsertIntersectIntoJoinKeyLeftjoinListLowerMaxMinMinusProjectRemoveRenameReverseSetSortSummarizeSviewTimesToTotalUnionUniqueUpdateViewWhere"
+const _Token_name = "NilEofErrorIdentifierNumberStringWhitespaceCommentNewlineHashCommaSemicolonAtLParenRParenLBracketRBracketLCurlyRCurlyRangeToRangeLenOpsStartNotBitNotNewDotCompareStartIsIsntMatchMatchNotLtLteGtGteCompareEndQMarkColonAssocStartAndOrBitOrBitAndBitXorAddSubCatMulDivAssocEndModLShiftRShiftIncPostIncDecPostDecAssignStartEqAddEqSubEqCatEqMulEqDivEqModEqLShiftEqRShiftEqBitOrEqBitAndEqBitXorEqAssignEndInBreakCaseCatchClassContinueDefaultDoElseFalseForForeverFunctionIfReturnSwitchSuperThisThrowTrueTryWhileQueryStartAlterAverageByCascadeCountCreateDeleteDropEnsureExtendHistoryIndexInsertIntersectIntoJoinKeyLeftjoinListLowerMaxMinMinusProjectRebuildRemoveRenameReverseSetSortSummarizeSviewTimesToTotalUnionUniqueUpdateViewWhere"
 
-var _Token_index = [...]uint16{0, 3, 6, 11, 21, 27, 33, 43, 50, 57, 61, 66, 75, 77, 83, 89, 97, 105, 111, 117, 124, 132, 140, 143, 149, 152, 155, 167, 169, 173, 178, 186, 188, 191, 193, 196, 206, 211, 216, 226, 229, 231, 236, 242, 248, 251, 254, 257, 260, 263, 271, 274, 280, 286, 289, 296, 299, 306, 317, 319, 324, 329, 334, 339, 344, 349, 357, 365, 372, 380, 388, 397, 399, 404, 408, 413, 418, 426, 433, 435, 439, 444, 447, 454, 462, 464, 470, 476, 481, 485, 490, 494, 497, 502, 512, 517, 524, 526, 533, 538, 544, 550, 554, 560, 566, 573, 578, 584, 593, 597, 601, 604, 612, 616, 621, 624, 627, 632, 639, 645, 651, 658, 661, 665, 674, 679, 684, 686, 691, 696, 702, 708, 712, 717}
+var _Token_index = [...]uint16{0, 3, 6, 11, 21, 27, 33, 43, 50, 57, 61, 66, 75, 77, 83, 89, 97, 105, 111, 117, 124, 132, 140, 143, 149, 152, 155, 167, 169, 173, 178, 186, 188, 191, 193, 196, 206, 211, 216, 226, 229, 231, 236, 242, 248, 251, 254, 257, 260, 263, 271, 274, 280, 286, 289, 296, 299, 306, 317, 319, 324, 329, 334, 339, 344, 349, 357, 365, 372, 380, 388, 397, 399, 404, 408, 413, 418, 426, 433, 435, 439, 444, 447, 454, 462, 464, 470, 476, 481, 485, 490, 494, 497, 502, 512, 517, 524, 526, 533, 538, 544, 550, 554, 560, 566, 573, 578, 584, 593, 597, 601, 604, 612, 616, 621, 624, 627, 632, 639, 646, 652, 658, 665, 668, 672, 681, 686, 691, 693, 698, 703, 709, 715, 719, 724}
 
 func (i Token) String() string {
 	if i >= Token(len(_Token_index)-1) {
@@ -133,6 +133,7 @@ const (
 	Min
 	Minus
 	Project
+	Rebuild
 	Remove
 	Rename
 	Reverse
@@ -150,7 +151,7 @@ const (
 	Where
 )
 
-const Ntokens = int(While + 1)
+const Ntokens = int(Where + 1)
 
 var isIdent = [Ntokens]bool{ // note: array rather than map
 	Identifier: true,
@@ -0,0 +1,96 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19/stor"
+)
+
+// The store is append only so the previous persisted states are still there.
+// Opening a previous state gives a read-only view of the database
+// as of that point in time, e.g. to recover deleted data.
+
+// OpenDatabaseAsOf opens a database read-only
+// as of the last state persisted at or before the given time
+func OpenDatabaseAsOf(filename string, asof time.Time) (*Database, error) {
+	store, err := openStore(filename, stor.READ)
+	if err != nil {
+		return nil, err
+	}
+	off := store.Size()
+	for {
+		var state *DbState
+		var t time.Time
+		off, state, t = prevState(store, off)
+		if off == 0 {
+			store.Close()
+			return nil, errors.New("no database state as of " +
+				asof.Format(dtfmt))
+		}
+		if state != nil && !t.After(asof) {
+			return openAsOf(store, off)
+		}
+	}
+}
+
+// OpenDatabaseAt opens a database read-only
+// as of the state at the given offset (as output by Repair)
+func OpenDatabaseAt(filename string, off uint64) (*Database, error) {
+	store, err := openStore(filename, stor.READ)
+	if err != nil {
+		return nil, err
+	}
+	if off < uint64(len(magic)) || off+uint64(stateLen) > store.Size() ||
+		!validState(store, off) {
+		store.Close()
+		return nil, errors.New("no database state at " +
+			strconv.FormatUint(off, 10))
+	}
+	return openAsOf(store, off)
+}
+
+// OpenAsOf opens a database read-only as of either a date-time
+// (yyyymmdd.hhmmss, local time) or a state offset
+func OpenAsOf(filename string, asof string) (*Database, error) {
+	if off, err := strconv.ParseUint(asof, 10, 64); err == nil {
+		return OpenDatabaseAt(filename, off)
+	}
+	t, err := time.ParseInLocation(dtfmt, asof, time.Local)
+	if err != nil {
+		return nil, errors.New("invalid as of: " + asof +
+			" (should be yyyymmdd.hhmmss or a state offset)")
+	}
+	return OpenDatabaseAsOf(filename, t)
+}
+
+func openAsOf(store *stor.Stor, off uint64) (*Database, error) {
+	db, err := openState(store, stor.READ, off, true)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	db.asof = off
+	return db, nil
+}
+
+// validState returns whether there is a good state at the offset
+func validState(store *stor.Stor, off uint64) (ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			ok = false
+		}
+	}()
+	ReadState(store, off)
+	return true
+}
+
+// AsOf returns the offset of the state if the database was opened
+// as of a previous state, otherwise 0
+func (db *Database) AsOf() uint64 {
+	return db.asof
+}
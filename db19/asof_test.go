@@ -0,0 +1,72 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestAsOf(t *testing.T) {
+	assert := assert.T(t)
+	db := createDb()
+	StartConcur(db, 50*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		output1(db).Commit()
+	}
+	db.Close()
+	defer os.Remove("tmp.db")
+	fi, err := os.Stat("tmp.db")
+	assert.That(err == nil)
+	off := uint64(fi.Size()) - uint64(stateLen)
+
+	db, err = OpenDatabase("tmp.db")
+	assert.That(err == nil)
+	StartConcur(db, 50*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		output1(db).Commit()
+	}
+	db.Close()
+
+	nrows := func(db *Database) int {
+		return db.GetState().meta.GetRoInfo("mytable").Nrows
+	}
+	db, err = OpenDatabaseAt("tmp.db", off)
+	assert.That(err == nil)
+	assert.This(db.AsOf()).Is(off)
+	assert.This(nrows(db)).Is(10)
+	assert.That(db.Check() == nil)
+	_, err = db.Backup("tmp.bak.db")
+	assert.That(err == nil)
+	db.Close()
+	defer os.Remove("tmp.bak.db")
+	bak, err := OpenDatabase("tmp.bak.db")
+	assert.That(err == nil)
+	assert.This(nrows(bak)).Is(10)
+	assert.That(bak.Check() == nil)
+	bak.Close()
+
+	_, err = OpenDatabaseAt("tmp.db", off+1)
+	assert.That(strings.Contains(err.Error(), "no database state at"))
+
+	db, err = OpenAsOf("tmp.db", strconv.FormatUint(off, 10))
+	assert.That(err == nil)
+	assert.This(nrows(db)).Is(10)
+	db.Close()
+
+	db, err = OpenDatabaseAsOf("tmp.db", time.Now())
+	assert.That(err == nil)
+	assert.This(nrows(db)).Is(15)
+	db.Close()
+
+	_, err = OpenDatabaseAsOf("tmp.db", time.Now().Add(-time.Hour))
+	assert.That(strings.Contains(err.Error(), "no database state as of"))
+	_, err = OpenAsOf("tmp.db", "yesterday")
+	assert.That(strings.Contains(err.Error(), "invalid as of"))
+}
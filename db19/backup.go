@@ -0,0 +1,89 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apmckinlay/gsuneido/db19/meta"
+	"github.com/apmckinlay/gsuneido/db19/stor"
+)
+
+// Backup copies the database to a file while it continues to be used.
+// The store is append only, so after persisting a state,
+// everything up to the end of that state is immutable
+// and is a consistent database, except for the size at the start.
+// For a database opened as of a previous state,
+// the backup is of that state.
+// It returns the size of the backup.
+func (db *Database) Backup(to string) (size uint64, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("backup failed: %v", e)
+		}
+	}()
+	var off uint64
+	var store *stor.Stor
+	if db.asof != 0 {
+		store = db.store
+		off = db.asof
+	} else if db.mode == stor.READ {
+		store = db.store
+		off = store.Size() - uint64(stateLen)
+	} else {
+		run := func() {
+			off = db.persistAll(true)
+			store = db.startTran().store // so Compact does not close it
+		}
+		if db.ck != nil {
+			// serialized with commits (and with switching stores by Compact)
+			db.ck.Exclusive(nil, run)
+		} else {
+			run()
+		}
+		defer db.endTran(store)
+	}
+	size = off + uint64(stateLen)
+	f, err := ioutil.TempFile(filepath.Dir(to), "gs*.tmp")
+	ck(err)
+	tmpfile := f.Name()
+	defer func() { f.Close(); os.Remove(tmpfile) }()
+	for pos := uint64(0); pos < size; {
+		buf := store.Data(pos)
+		if uint64(len(buf)) > size-pos {
+			buf = buf[:size-pos]
+		}
+		_, err := f.Write(buf)
+		ck(err)
+		pos += uint64(len(buf))
+	}
+	buf := make([]byte, stor.SmallOffsetLen)
+	stor.WriteSmallOffset(buf, size)
+	_, err = f.WriteAt(buf, int64(len(magic)))
+	ck(err)
+	ck(f.Sync())
+	ck(f.Close())
+	ck(renameBak(tmpfile, to))
+	return size, nil
+}
+
+// persistAll merges all the committed transactions and persists the state,
+// returning the offset of the state.
+// Persist only saves what has been merged,
+// so this is required for the row counts to match the indexes.
+// It must not run concurrently with commits.
+func (db *Database) persistAll(flatten bool) uint64 {
+	merges := &mergeList{}
+	db.GetState().meta.ForEachInfo(func(ti *meta.Info) {
+		if len(ti.Indexes) > 0 && ti.Indexes[0].Nlayers() > 1 {
+			merges.tn = append(merges.tn,
+				tableCount{table: ti.Table, nmerge: ti.Indexes[0].Nlayers() - 1})
+		}
+	})
+	db.Merge(mergeSingle, merges)
+	return db.Persist(&execPersistSingle{}, flatten)
+}
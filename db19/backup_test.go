@@ -0,0 +1,55 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestBackup(t *testing.T) {
+	assert := assert.T(t)
+	db := createDb()
+	StartConcur(db, 50*time.Millisecond)
+	defer func() { db.Close(); os.Remove("tmp.db") }()
+	const nbefore = 100
+	for i := 0; i < nbefore; i++ {
+		output1(db).Commit()
+	}
+	// commits continue during the backup
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				output1(db).Commit()
+			}
+		}
+	}()
+	size, err := db.Backup("tmp.bak.db")
+	close(stop)
+	wg.Wait()
+	defer os.Remove("tmp.bak.db")
+	assert.That(err == nil)
+	fi, err := os.Stat("tmp.bak.db")
+	assert.That(err == nil)
+	assert.This(fi.Size()).Is(int64(size))
+
+	bak, err := OpenDatabase("tmp.bak.db")
+	assert.That(err == nil)
+	defer bak.Close()
+	assert.That(bak.Check() == nil)
+	n := bak.GetState().meta.GetRoInfo("mytable").Nrows
+	assert.That(n >= nbefore)
+	assert.That(n <= db.GetState().meta.GetRoInfo("mytable").Nrows)
+}
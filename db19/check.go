@@ -39,6 +39,9 @@ type Check struct {
 	clock int
 	// trans hold the outstanding/overlapping update transactions
 	trans map[int]*CkTran
+	// schema holds the sequence number of the last schema change per table.
+	// Transactions that started before this can not access the table.
+	schema map[string]int
 }
 
 type CkTran struct {
@@ -59,7 +62,8 @@ type ckwrites []*Set
 type ckreads []*Ranges
 
 func NewCheck() *Check {
-	return &Check{trans: make(map[int]*CkTran), oldest: ints.MaxInt}
+	return &Check{trans: make(map[int]*CkTran), oldest: ints.MaxInt,
+		schema: make(map[string]int)}
 }
 
 func (ck *Check) StartTran() *CkTran {
@@ -87,6 +91,9 @@ func (ck *Check) Read(t *CkTran, table string, index int, from, to string) bool
 		return false // it's gone, presumably aborted
 	}
 	assert.That(!t.isEnded())
+	if ck.schemaChanged(t, table) {
+		return false
+	}
 	// check against overlapping transactions
 	for _, t2 := range ck.trans {
 		if t2 != t && overlap(t, t2) {
@@ -138,6 +145,9 @@ func (ck *Check) Write(t *CkTran, table string, keys []string) bool {
 		return false // it's gone, presumably aborted
 	}
 	assert.That(!t.isEnded())
+	if ck.schemaChanged(t, table) {
+		return false
+	}
 	// check against overlapping transactions
 	for _, t2 := range ck.trans {
 		if t2 != t && overlap(t, t2) {
@@ -195,6 +205,37 @@ func (cw ckwrites) with(index int, key string) ckwrites {
 	return cw
 }
 
+// schemaChanged aborts the transaction and returns true
+// if the schema of the table has changed since the transaction started
+func (ck *Check) schemaChanged(t *CkTran, table string) bool {
+	if seq, ok := ck.schema[table]; ok && t.start < seq {
+		ck.abort(t.start, "schema changed: "+table)
+		return true
+	}
+	return false
+}
+
+// Exclusive runs a schema change (fn) serialized with commits.
+// Outstanding transactions that have accessed any of the tables are aborted,
+// as are outstanding transactions that access the tables later.
+func (ck *Check) Exclusive(tables []string, fn func()) {
+	seq := ck.next()
+	for tn, t := range ck.trans {
+		if !t.isEnded() {
+			for _, table := range tables {
+				if _, ok := t.tables[table]; ok {
+					ck.abort(tn, "schema changed: "+table)
+					break
+				}
+			}
+		}
+	}
+	for _, table := range tables {
+		ck.schema[table] = seq
+	}
+	fn()
+}
+
 // checkerAbortT1 is used by tests to avoid randomness
 var checkerAbortT1 = false
 
@@ -252,6 +293,17 @@ func (ck *Check) commit(ut *UpdateTran) []string {
 	if !ok {
 		return nil // it's gone, presumably aborted
 	}
+	if ut.db != nil { // db is nil when testing
+		if ut.store != ut.db.store {
+			// its records were written to the file replaced by Compact
+			ck.abort(tn, "database compacted")
+			return nil
+		}
+		if ut.db.stopped != "" {
+			ck.abort(tn, ut.db.stopped)
+			return nil
+		}
+	}
 	t.end = ck.next()
 	if t.start == ck.oldest {
 		ck.oldest = ints.MaxInt // need to find the new oldest
@@ -44,6 +44,12 @@ type ckAbort struct {
 	t *CkTran
 }
 
+type ckExclusive struct {
+	tables []string
+	fn     func()
+	ret    chan interface{}
+}
+
 func (ck *CheckCo) StartTran() *CkTran {
 	ret := make(chan *CkTran, 1)
 	ck.c <- &ckStart{ret: ret}
@@ -80,15 +86,28 @@ func (ck *CheckCo) Abort(t *CkTran) bool {
 	return true
 }
 
+// Exclusive runs fn in the checker goroutine so it is serialized with commits.
+// A panic from fn is passed back to the caller.
+func (ck *CheckCo) Exclusive(tables []string, fn func()) {
+	ret := make(chan interface{}, 1)
+	ck.c <- &ckExclusive{tables: tables, fn: fn, ret: ret}
+	if e := <-ret; e != nil {
+		panic(e)
+	}
+}
+
 func (t *CkTran) Aborted() bool {
 	return t.conflict.Load() != nil
 }
 
 //-------------------------------------------------------------------
 
-func StartCheckCo(mergeChan chan merge, allDone chan void) *CheckCo {
+// StartCheckCo starts the checker goroutine.
+// sy is nil for DurAsync (see Durability)
+func StartCheckCo(mergeChan chan merge, allDone chan void,
+	sy *syncer) *CheckCo {
 	c := make(chan interface{}, 4)
-	go checker(c, mergeChan)
+	go checker(c, mergeChan, sy)
 	return &CheckCo{c: c, allDone: allDone}
 }
 
@@ -97,7 +116,7 @@ func (ck *CheckCo) Stop() {
 	<-ck.allDone // wait
 }
 
-func checker(c chan interface{}, mergeChan chan merge) {
+func checker(c chan interface{}, mergeChan chan merge, sy *syncer) {
 	ck := NewCheck()
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
@@ -105,12 +124,18 @@ func checker(c chan interface{}, mergeChan chan merge) {
 		select {
 		case msg := <-c:
 			if msg == nil { // channel closed
+				if sy != nil {
+					sy.after(0)
+				}
 				if mergeChan != nil { // no channel when testing
 					close(mergeChan)
 				}
 				return
 			}
-			ck.dispatch(msg, mergeChan)
+			ck.dispatch(msg, mergeChan, sy)
+			if sy != nil {
+				sy.after(len(c))
+			}
 		case <-ticker.C:
 			// fmt.Println("checker chan", len(c), "merge chan", len(mergeChan))
 			ck.tick()
@@ -119,7 +144,7 @@ func checker(c chan interface{}, mergeChan chan merge) {
 }
 
 // dispatch runs in the checker goroutine
-func (ck *Check) dispatch(msg interface{}, mergeChan chan merge) {
+func (ck *Check) dispatch(msg interface{}, mergeChan chan merge, sy *syncer) {
 	switch msg := msg.(type) {
 	case *ckStart:
 		msg.ret <- ck.StartTran()
@@ -129,8 +154,17 @@ func (ck *Check) dispatch(msg interface{}, mergeChan chan merge) {
 		ck.Write(msg.t, msg.table, msg.keys)
 	case *ckAbort:
 		ck.Abort(msg.t)
+	case *ckExclusive:
+		msg.ret <- ck.exclusive(msg.tables, msg.fn)
 	case *ckCommit:
 		result := ck.commit(msg.t)
+		if result != nil && sy != nil {
+			// durable, the result is sent after the flush (see syncer)
+			// persistAll does the merge
+			msg.t.commit()
+			sy.wait(msg.ret)
+			return
+		}
 		// checking complete so we can send result and let client code continue
 		msg.ret <- result != nil
 		if result != nil && mergeChan != nil { // no channel when testing
@@ -147,6 +181,15 @@ func (ck *Check) dispatch(msg interface{}, mergeChan chan merge) {
 	}
 }
 
+// exclusive runs Exclusive, returning any panic value
+func (ck *Check) exclusive(tables []string, fn func()) (err interface{}) {
+	defer func() {
+		err = recover()
+	}()
+	ck.Exclusive(tables, fn)
+	return nil
+}
+
 // Checker is the interface for Check and CheckCo
 type Checker interface {
 	StartTran() *CkTran
@@ -154,6 +197,7 @@ type Checker interface {
 	Write(t *CkTran, table string, keys []string) bool
 	Abort(t *CkTran) bool
 	Commit(t *UpdateTran) bool
+	Exclusive(tables []string, fn func())
 	Stop()
 }
 
@@ -59,7 +59,9 @@ func (db *Database) Check() (ec error) {
 		}
 	}()
 
-	runParallel(db.GetState(), checkTable)
+	state := db.startTran()
+	defer db.endTran(state.store)
+	runParallel(state, checkTable)
 	return nil // may be overridden by defer/recover
 }
 
@@ -182,7 +184,7 @@ func (tcs *tableCheckers) worker() {
 		}
 		tcs.wg.Done()
 	}()
-	for table := range tcs.work {
+	for table = range tcs.work {
 		tcs.fn(tcs.state, table)
 	}
 }
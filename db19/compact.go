@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 
 	"github.com/apmckinlay/gsuneido/db19/meta"
 	"github.com/apmckinlay/gsuneido/db19/stor"
@@ -35,7 +36,7 @@ func Compact(dbfile string) (ntables int, err error) {
 
 	state := src.GetState()
 	state.meta.ForEachSchema(func(sc *meta.Schema) {
-		compactTable(state, src, sc, dst, ics)
+		compactTable(state, sc, dst, ics)
 		ntables++
 	})
 	dst.GetState().Write(true)
@@ -56,7 +57,10 @@ func tmpdb() (*Database, string) {
 	return db, tmpfile
 }
 
-func compactTable(state *DbState, src *Database, ts *meta.Schema, dst *Database,
+// compactTable copies the records of a table from a flat state to dst
+// and builds its indexes.
+// ics may be nil to skip checking the other indexes.
+func compactTable(state *DbState, ts *meta.Schema, dst *Database,
 	ics *indexCheckers) {
 	info := state.meta.GetRoInfo(ts.Table)
 	before := dst.store.Size()
@@ -64,7 +68,7 @@ func compactTable(state *DbState, src *Database, ts *meta.Schema, dst *Database,
 	sum := uint64(0)
 	count := info.Indexes[0].Check(func(off uint64) {
 		sum += off // addition so order doesn't matter
-		rec := src.store.Data(off)
+		rec := state.store.Data(off)
 		size := runtime.RecLen(rec)
 		rec = rec[:size+cksum.Len]
 		cksum.MustCheck(rec)
@@ -75,9 +79,290 @@ func compactTable(state *DbState, src *Database, ts *meta.Schema, dst *Database,
 	})
 	list.Finish()
 	assert.This(count).Is(info.Nrows)
-	ics.checkOtherIndexes(info, count, sum) // concurrent
+	if ics != nil {
+		ics.checkOtherIndexes(info, count, sum) // concurrent
+	}
 	dataSize := dst.store.Size() - before
+	ts = dstSchema(ts)
 	ov := buildIndexes(ts, list, dst.store, count) // same as load
 	ti := &meta.Info{Table: ts.Table, Nrows: count, Size: dataSize, Indexes: ov}
 	dst.LoadedTable(ts, ti)
 }
+
+//-------------------------------------------------------------------
+
+// maxCatchup is the number of times Compact will catch up
+// before it blocks commits to finish
+const maxCatchup = 3
+
+// Compact is like the Compact function, but for a database that is in use.
+// It copies a snapshot of the database to a new file
+// and then catches up on the tables changed by commits during the copy.
+// Commits are only blocked while it copies the last changes
+// and switches to the new file.
+// Outstanding update transactions are aborted by the switch.
+// Read transactions that started before the switch
+// continue to use the old file.
+// It is not supported on Windows (see onlineCompact).
+func (db *Database) Compact() (ntables int, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("compact failed: %v", e)
+		}
+	}()
+	if db.mode == stor.READ || db.asof != 0 {
+		panic("can't compact a read-only database")
+	}
+	if db.filename == "" {
+		panic("can't compact a database without a file")
+	}
+	if !onlineCompact {
+		panic("can't compact a database while it is in use on this platform")
+	}
+	dst, tmpfile := tmpdb()
+	defer func() { dst.Close(); os.Remove(tmpfile) }()
+	ics := newIndexCheckers()
+	defer ics.finish()
+
+	state := db.snapshot()
+	state.meta.ForEachSchema(func(ts *meta.Schema) {
+		compactTable(state, ts, dst, ics)
+	})
+	ics.finish()
+	for i := 0; i < maxCatchup; i++ {
+		prev := state
+		state = db.snapshot()
+		if catchup(prev, state, dst) == 0 {
+			break
+		}
+	}
+	// write and flush the bulk of dst (and db) before blocking commits
+	// so only the final changes are flushed while they are blocked
+	dst.Persist(&execPersistSingle{}, true)
+	dst.store.Flush()
+	db.store.Flush()
+	var tables []string
+	state.meta.ForEachSchema(func(ts *meta.Schema) {
+		tables = append(tables, ts.Table)
+	})
+	run := func() {
+		prev := state
+		db.persistAll(true)
+		// hold off merge and persist until we have switched
+		db.schemaLock.Lock()
+		defer db.schemaLock.Unlock()
+		state = db.GetState()
+		catchup(prev, state, dst)
+		state.meta.ForEachSchema(func(*meta.Schema) { ntables++ })
+		dst.Close()
+		writeStoreSize(db.store) // so the .bak is a valid database
+		ck(renameBak(tmpfile, db.filename))
+		db.switchStore(tmpfile)
+	}
+	if db.ck != nil {
+		// abort outstanding update transactions since they use the old file
+		db.ck.Exclusive(tables, run)
+	} else {
+		run()
+	}
+	return ntables, nil
+}
+
+// snapshot merges and persists all the committed transactions
+// and returns the resulting flat state
+func (db *Database) snapshot() *DbState {
+	var state *DbState
+	run := func() {
+		db.persistAll(true)
+		state = db.GetState()
+	}
+	if db.ck != nil {
+		db.ck.Exclusive(nil, run) // serialized with commits
+	} else {
+		run()
+	}
+	return state
+}
+
+// catchup updates dst with the changes to the tables from prev to cur.
+// It returns the number of tables that were changed.
+// Any change to a table replaces its schema or its info
+// so unchanged tables can be skipped by comparing pointers.
+func catchup(prev, cur *DbState, dst *Database) int {
+	n := 0
+	prev.meta.ForEachSchema(func(ts *meta.Schema) {
+		if cur.meta.GetRoSchema(ts.Table) == nil {
+			dst.DropTable(ts.Table)
+			n++
+		}
+	})
+	cur.meta.ForEachSchema(func(ts *meta.Schema) {
+		prevts := prev.meta.GetRoSchema(ts.Table)
+		if prevts == ts &&
+			prev.meta.GetRoInfo(ts.Table) == cur.meta.GetRoInfo(ts.Table) {
+			return // unchanged
+		}
+		if prevts == ts {
+			catchupTable(prev, cur, ts, dst)
+		} else { // new table or schema change
+			compactTable(cur, ts, dst, nil)
+		}
+		n++
+	})
+	return n
+}
+
+// catchupTable updates the copy of a table in dst from prev to cur.
+// It only copies the new records, the unchanged records are reused.
+// It iterates through the first index of prev, cur, and dst together.
+// prev and dst have the same keys since dst was copied from prev.
+// The indexes in dst are rebuilt.
+func catchupTable(prev, cur *DbState, ts *meta.Schema, dst *Database) {
+	dstate := dst.GetState()
+	dinfo := dstate.meta.GetRoInfo(ts.Table)
+	pit := prev.meta.GetRoInfo(ts.Table).Indexes[0].Iterator()
+	dit := dinfo.Indexes[0].Iterator()
+	cit := cur.meta.GetRoInfo(ts.Table).Indexes[0].Iterator()
+	list := sortlist.NewUnsorted()
+	nrecs := 0
+	size := dinfo.Size
+	recSize := func(store *stor.Stor, off uint64) uint64 {
+		return uint64(runtime.RecLen(store.Data(off)) + cksum.Len)
+	}
+	pit.Next()
+	dit.Next()
+	for cit.Next(); !cit.Eof(); cit.Next() {
+		key, off := cit.Cur()
+		pkey, poff := pit.Cur()
+		for !pit.Eof() && pkey < key { // deleted
+			_, doff := dit.Cur()
+			size -= recSize(dstate.store, doff)
+			pit.Next()
+			dit.Next()
+			pkey, poff = pit.Cur()
+		}
+		_, doff := dit.Cur()
+		if !pit.Eof() && pkey == key && poff == off {
+			list.Add(doff) // unchanged
+		} else {
+			if !pit.Eof() && pkey == key { // updated
+				size -= recSize(dstate.store, doff)
+			}
+			rec := cur.store.Data(off)
+			rec = rec[:runtime.RecLen(rec)+cksum.Len]
+			cksum.MustCheck(rec)
+			off2, buf := dstate.store.Alloc(len(rec))
+			copy(buf, rec)
+			list.Add(off2)
+			size += uint64(len(rec))
+		}
+		if !pit.Eof() && pkey == key {
+			pit.Next()
+			dit.Next()
+		}
+		nrecs++
+	}
+	for ; !pit.Eof(); pit.Next() { // deleted
+		_, doff := dit.Cur()
+		size -= recSize(dstate.store, doff)
+		dit.Next()
+	}
+	list.Finish()
+	ts = dstSchema(ts)
+	ov := buildIndexes(ts, list, dstate.store, nrecs)
+	ti := &meta.Info{Table: ts.Table, Nrows: nrecs, Size: size, Indexes: ov}
+	dst.LoadedTable(ts, ti)
+}
+
+// dstSchema returns a copy of a schema for dst
+// since buildIndexes and LoadedTable modify it
+func dstSchema(ts *meta.Schema) *meta.Schema {
+	ts2 := *ts
+	ts2.Indexes = append(ts.Indexes[:0:0], ts.Indexes...)
+	return &ts2
+}
+
+// switchStore replaces the store with the compacted file
+// that has been renamed to the database filename.
+// The old store is kept open for transactions that are still using it.
+// If it fails, the files are renamed back
+// so commits continue to go to the database file.
+// If that fails, commits are stopped so they are not lost.
+func (db *Database) switchStore(tmpfile string) {
+	var store *stor.Stor
+	defer func() {
+		if e := recover(); e != nil {
+			if store != nil {
+				store.Close()
+			}
+			if os.Rename(db.filename, tmpfile) != nil ||
+				os.Rename(db.filename+".bak", db.filename) != nil {
+				db.stopped = fmt.Sprint("compact failed: ", e)
+			}
+			panic(e)
+		}
+	}()
+	store, err := openStore(db.filename, stor.UPDATE)
+	ck(err)
+	state, _ := ReadState(store, store.Size()-uint64(stateLen))
+	su := &db.storeUsers
+	su.lock.Lock()
+	defer su.lock.Unlock()
+	prev := db.store
+	su.prev = append(su.prev, prev)
+	db.store = store
+	db.state.set(state)
+	if su.count[prev] == 0 {
+		su.close(prev)
+	}
+}
+
+// storeUsers counts the transactions using each store
+// so the stores replaced by Compact can be closed
+// when the last transaction using them ends.
+// NOTE: Closing does not unmap the file (see stor.mmapStor)
+// since records are not copied and may be referenced after a transaction.
+type storeUsers struct {
+	lock  sync.Mutex
+	count map[*stor.Stor]int
+	// prev are the stores replaced by Compact that have not been closed
+	prev []*stor.Stor
+}
+
+// startTran returns the current state
+// and counts a transaction as using its store.
+// It must be followed by endTran.
+func (db *Database) startTran() *DbState {
+	su := &db.storeUsers
+	su.lock.Lock()
+	defer su.lock.Unlock()
+	state := db.GetState() // inside the lock, see switchStore
+	if su.count == nil {
+		su.count = make(map[*stor.Stor]int)
+	}
+	su.count[state.store]++
+	return state
+}
+
+// endTran closes the store if it was replaced by Compact
+// and this was the last transaction using it
+func (db *Database) endTran(store *stor.Stor) {
+	su := &db.storeUsers
+	su.lock.Lock()
+	defer su.lock.Unlock()
+	if su.count[store]--; su.count[store] <= 0 {
+		delete(su.count, store)
+		su.close(store)
+	}
+}
+
+// close closes the store if it is one of the prev stores
+func (su *storeUsers) close(store *stor.Stor) {
+	for i, s := range su.prev {
+		if s == store {
+			su.prev = append(su.prev[:i], su.prev[i+1:]...)
+			store.Close()
+			return
+		}
+	}
+}
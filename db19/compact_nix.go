@@ -0,0 +1,9 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+// +build !windows
+
+package db19
+
+// onlineCompact is whether the database file can be replaced while it is open
+const onlineCompact = true
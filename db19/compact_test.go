@@ -0,0 +1,156 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestCompactOnline(t *testing.T) {
+	assert := assert.T(t)
+	db, err := CreateDatabase("tmp.db")
+	ck(err)
+	StartConcur(db, 5*time.Millisecond)
+	defer func() { os.Remove("tmp.db"); os.Remove("tmp.db.bak") }()
+	DoAdmin(db, "create tbl (a,b) key(a) index(b)")
+
+	// data maps keys to values for the committed transactions
+	data := map[string]string{}
+	var lock sync.Mutex
+	commit := func(fn func(ut *UpdateTran) func()) (ok bool) {
+		ut := db.NewUpdateTran()
+		defer func() {
+			if e := recover(); e != nil {
+				ut.Abort()
+				ok = false
+			}
+		}()
+		apply := fn(ut)
+		ut.Commit()
+		lock.Lock()
+		apply()
+		lock.Unlock()
+		return true
+	}
+	output := func(key, val string) bool {
+		return commit(func(ut *UpdateTran) func() {
+			ut.Output("tbl", mkrec(key, val))
+			return func() { data[key] = val }
+		})
+	}
+	update := func(key, val string) bool {
+		return commit(func(ut *UpdateTran) func() {
+			off := ut.Lookup("tbl", 0, mkrec(key).GetRaw(0))
+			ut.Update("tbl", off, mkrec(key, val))
+			return func() { data[key] = val }
+		})
+	}
+	erase := func(key string) bool {
+		return commit(func(ut *UpdateTran) func() {
+			off := ut.Lookup("tbl", 0, mkrec(key).GetRaw(0))
+			ut.Delete("tbl", off)
+			return func() { delete(data, key) }
+		})
+	}
+
+	const nrecs = 40
+	for i := 0; i < nrecs; i++ {
+		assert.That(output("k"+strconv.Itoa(i), "v"))
+	}
+	for i := 0; i < nrecs; i += 2 {
+		assert.That(update("k"+strconv.Itoa(i), "old"))
+	}
+	rt := db.NewReadTran()
+
+	// commits continue during the compaction
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < nrecs; i++ {
+			s := strconv.Itoa(i)
+			output("n"+s, s)
+			update("k"+s, s)
+			if i%3 == 0 {
+				erase("k" + s)
+			}
+		}
+	}()
+	ntables, err := db.Compact()
+
+	wg.Wait()
+	assert.That(err == nil)
+	assert.This(ntables).Is(1)
+
+	// read transactions that started before continue to work
+	n := 0
+	it := rt.RangeIter("tbl", 1, ixkey.All)
+	for it.Next(); !it.Eof(); it.Next() {
+		_, off := it.Cur()
+		assert.This(rt.GetRecord(off).GetRaw(1)).Isnt("")
+		n++
+	}
+	assert.This(n).Is(nrecs)
+	// the old file is closed when the last transaction using it ends
+	assert.This(len(db.storeUsers.prev)).Is(1)
+	rt.Complete()
+	assert.This(len(db.storeUsers.prev)).Is(0)
+
+	assert.That(output("after", "compact"))
+	size := db.store.Size()
+	_, err = db.Compact()
+	assert.That(err == nil)
+	assert.That(db.store.Size() < size)
+	db.Close()
+
+	db, err = OpenDatabase("tmp.db")
+	ck(err)
+	defer db.Close()
+	assert.That(db.Check() == nil)
+	assert.This(db.GetState().meta.GetRoInfo("tbl").Nrows).Is(len(data))
+	rt = db.NewReadTran()
+	for key, val := range data {
+		off := rt.Lookup("tbl", 0, mkrec(key).GetRaw(0))
+		assert.Msg(key).That(off != 0)
+		assert.This(rt.GetRecord(off).GetRaw(1)).Is(mkrec(val).GetRaw(0))
+	}
+}
+
+func TestCompactSwitchFails(t *testing.T) {
+	assert := assert.T(t)
+	db, err := CreateDatabase("tmp.db")
+	ck(err)
+	StartConcur(db, 5*time.Millisecond)
+	defer func() { os.Remove("tmp.db"); os.Remove("tmp.tmp") }()
+	DoAdmin(db, "create tbl (a,b) key(a)")
+	ut := db.NewUpdateTran()
+	ut.Output("tbl", mkrec("k1", "v"))
+	ut.Commit()
+
+	// as if Compact renamed an invalid file to the database filename
+	ck(os.Rename("tmp.db", "tmp.db.bak"))
+	ck(ioutil.WriteFile("tmp.db", []byte("invalid"), 0666))
+	assert.This(func() { db.switchStore("tmp.tmp") }).Panics("")
+	// the files are renamed back and commits continue
+	_, err = os.Stat("tmp.db.bak")
+	assert.That(os.IsNotExist(err))
+	assert.This(db.stopped).Is("")
+	ut = db.NewUpdateTran()
+	ut.Output("tbl", mkrec("k2", "v"))
+	ut.Commit()
+	db.Close()
+
+	db, err = OpenDatabase("tmp.db")
+	ck(err)
+	defer db.Close()
+	assert.This(db.GetState().meta.GetRoInfo("tbl").Nrows).Is(2)
+}
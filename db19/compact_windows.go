@@ -0,0 +1,9 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+// onlineCompact is false because Windows does not allow renaming
+// the database file while it is open and mapped
+// (Go does not open files with FILE_SHARE_DELETE)
+const onlineCompact = false
@@ -21,6 +21,7 @@ const chanBuffers = 4 // ???
 // checker -> merger
 //
 // persist is called by merger every persistInterval
+// (for DurAsync, see Durability)
 //
 // Concurrency is separate so we can test functionality
 // without any goroutines or channels.
@@ -33,7 +34,7 @@ func StartConcur(db *Database, persistInterval time.Duration) {
 	mergeChan := make(chan merge, chanBuffers)
 	allDone := make(chan void)
 	go merger(db, mergeChan, persistInterval, allDone)
-	db.ck = StartCheckCo(mergeChan, allDone)
+	db.ck = StartCheckCo(mergeChan, allDone, newSyncer(db))
 }
 
 func merger(db *Database, mergeChan chan merge,
@@ -59,7 +60,7 @@ loop:
 			// db.Merge(mergeSingle, merges)
 		case <-ticker.C:
 			state := db.GetState()
-			if state != prevState {
+			if state != prevState && db.durability == DurAsync {
 				db.Persist(ep, false)
 				prevState = state
 			}
@@ -235,7 +236,9 @@ func (ep *execPersistMulti) Results() []meta.PersistUpdate {
 		result := <-ep.resultChan
 		ep.results = append(ep.results, result)
 	}
-	return ep.results
+	results := ep.results
+	ep.results = nil // don't reapply these on the next Persist
+	return results
 }
 
 func persistWorker(
@@ -4,6 +4,8 @@
 package db19
 
 import (
+	"sync"
+
 	"github.com/apmckinlay/gsuneido/db19/index/fbtree"
 	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
 	"github.com/apmckinlay/gsuneido/db19/meta"
@@ -17,11 +19,29 @@ type Database struct {
 	mode  stor.Mode
 	store *stor.Stor
 
+	// filename is used by Compact to replace the file
+	filename string
+	// storeUsers tracks the transactions using each store
+	// so the stores replaced by Compact can be closed (see startTran)
+	storeUsers storeUsers
+	// stopped is set (to the reason) to stop commits,
+	// e.g. if Compact fails after renaming the database file
+	stopped string
+
 	// state is the central immutable state of the database.
 	// It must be accessed atomically and only updated via UpdateState.
 	state stateHolder
 
+	// schemaLock serializes schema changes with Merge and Persist
+	schemaLock sync.Mutex
+
 	ck Checker
+
+	// asof is the offset of the state if opened as of a previous state
+	asof uint64
+
+	// durability is when commits are flushed, see SetDurability
+	durability Durability
 }
 
 const magic = "gsndo001"
@@ -31,7 +51,11 @@ func CreateDatabase(filename string) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
-	return createDatabase(store)
+	db, err := createDatabase(store)
+	if err == nil {
+		db.filename = filename
+	}
+	return db, err
 }
 
 func createDatabase(store *stor.Stor) (*Database, error) {
@@ -56,6 +80,19 @@ func OpenDatabaseRead(filename string) (*Database, error) {
 }
 
 func openDatabase(filename string, mode stor.Mode, check bool) (db *Database, err error) {
+	store, err := openStore(filename, mode)
+	if err != nil {
+		return nil, err
+	}
+	db, err = openState(store, mode, store.Size()-uint64(stateLen), check)
+	if err == nil {
+		db.filename = filename
+	}
+	return db, err
+}
+
+// openStore opens the store and verifies the magic and the size
+func openStore(filename string, mode stor.Mode) (*stor.Stor, error) {
 	store, err := stor.MmapStor(filename, mode)
 	if err != nil {
 		return nil, err
@@ -68,7 +105,12 @@ func openDatabase(filename string, mode stor.Mode, check bool) (db *Database, er
 	if size != store.Size() {
 		return nil, &ErrCorrupt{}
 	}
+	return store, nil
+}
 
+// openState returns a Database with the state at the given offset
+func openState(store *stor.Stor, mode stor.Mode, off uint64, check bool) (
+	db *Database, err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			err = newErrCorrupt(e)
@@ -76,7 +118,7 @@ func openDatabase(filename string, mode stor.Mode, check bool) (db *Database, er
 		}
 	}()
 	db = &Database{store: store, mode: mode}
-	state, _ := ReadState(db.store, size-uint64(stateLen))
+	state, _ := ReadState(db.store, off)
 	db.state.set(state)
 	if check {
 		if err := db.QuickCheck(); err != nil {
@@ -93,17 +135,6 @@ func (db *Database) LoadedTable(ts *meta.Schema, ti *meta.Info) {
 	})
 }
 
-func (db *Database) DropTable(table string) bool {
-	result := false
-	db.UpdateState(func(state *DbState) {
-		if m := state.meta.DropTable(table); m != nil {
-			state.meta = m
-			result = true
-		}
-	})
-	return result
-}
-
 // Close closes the database store, writing the current size to the start.
 // NOTE: The state must already be written.
 func (db *Database) Close() {
@@ -116,13 +147,23 @@ func (db *Database) Close() {
 		db.Persist(&execPersistSingle{}, true)
 	}
 	if db.mode != stor.READ {
-		// need to use Write because all but last chunk are read-only
-		buf := make([]byte, stor.SmallOffsetLen)
-		stor.WriteSmallOffset(buf, db.store.Size())
-		db.store.Write(uint64(len(magic)), buf)
+		writeStoreSize(db.store)
 	}
 	db.store.Close()
 	db.store = nil
+	for _, store := range db.storeUsers.prev {
+		store.Close()
+	}
+}
+
+// writeStoreSize writes the current size to the start of the store
+// and flushes it to disk
+func writeStoreSize(store *stor.Stor) {
+	// need to use Write because all but last chunk are read-only
+	buf := make([]byte, stor.SmallOffsetLen)
+	stor.WriteSmallOffset(buf, store.Size())
+	store.Write(uint64(len(magic)), buf)
+	store.Flush()
 }
 
 //-------------------------------------------------------------------
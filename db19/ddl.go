@@ -0,0 +1,528 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import (
+	"strings"
+
+	"github.com/apmckinlay/gsuneido/compile"
+	"github.com/apmckinlay/gsuneido/db19/index"
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+	"github.com/apmckinlay/gsuneido/db19/meta"
+	"github.com/apmckinlay/gsuneido/db19/meta/schema"
+	"github.com/apmckinlay/gsuneido/util/ints"
+	"github.com/apmckinlay/gsuneido/util/sortlist"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// DoAdmin executes a schema change request
+// i.e. create, ensure, drop, rename, alter, or rebuild
+func DoAdmin(db *Database, cmd string) {
+	rq := compile.ParseRequest(cmd)
+	switch rq.Action {
+	case "create":
+		db.CreateTable(&rq.Schema)
+	case "ensure":
+		db.EnsureTable(&rq.Schema)
+	case "drop":
+		if !db.DropTable(rq.Table) {
+			panic("can't drop nonexistent table: " + rq.Table)
+		}
+	case "rename":
+		db.RenameTable(rq.Renames[0].From, rq.Renames[0].To)
+	case "alter":
+		switch rq.SubAction {
+		case "create":
+			db.AlterCreate(&rq.Schema)
+		case "drop":
+			db.AlterDrop(&rq.Schema)
+		case "rename":
+			from := make([]string, len(rq.Renames))
+			to := make([]string, len(rq.Renames))
+			for i, rn := range rq.Renames {
+				from[i], to[i] = rn.From, rn.To
+			}
+			db.AlterRename(rq.Table, from, to)
+		default:
+			panic("invalid request")
+		}
+	case "rebuild":
+		db.Rebuild(&rq.Schema)
+	default:
+		panic("invalid request")
+	}
+}
+
+// schemaChange applies fn to the meta data.
+// It is serialized with commits (via the checker) and with merge and persist.
+// Outstanding update transactions that use the tables will be aborted.
+func (db *Database) schemaChange(tables []string, fn func(*meta.Meta) *meta.Meta) {
+	run := func() {
+		db.schemaLock.Lock()
+		defer db.schemaLock.Unlock()
+		db.UpdateState(func(state *DbState) {
+			state.meta = fn(state.meta)
+		})
+	}
+	if db.ck != nil {
+		db.ck.Exclusive(tables, run)
+	} else {
+		run()
+	}
+}
+
+// schemaBuild is schemaChange for changes to a table that build indexes.
+// To avoid blocking commits while the indexes are built,
+// fn is first applied to a snapshot, outside the checker, and the result
+// is discarded. Then fn is applied by schemaChange
+// and ib reuses the indexes from the snapshot,
+// only adding the changes that were committed since the snapshot.
+func (db *Database) schemaBuild(table string, fn buildFn) {
+	ib := &indexBuilder{db: db}
+	if db.ck != nil {
+		ib.prebuild(fn)
+	}
+	db.finishBuild(table, fn, ib)
+}
+
+type buildFn = func(m *meta.Meta, ib *indexBuilder) *meta.Meta
+
+// prebuild applies fn to a snapshot to build the indexes
+func (ib *indexBuilder) prebuild(fn buildFn) {
+	ib.snap = ib.db.GetState()
+	fn(ib.snap.meta, ib)
+	ib.prebuilt, ib.built = ib.built, nil
+}
+
+// finishBuild applies fn with schemaChange,
+// reusing the indexes from prebuild if the table has not been changed
+func (db *Database) finishBuild(table string, fn buildFn, ib *indexBuilder) {
+	db.schemaChange([]string{table}, func(m *meta.Meta) *meta.Meta {
+		ib.list = nil
+		if ib.snap != nil && (ib.snap.store != db.store ||
+			ib.snap.meta.GetRoSchema(table) != m.GetRoSchema(table)) {
+			ib.prebuilt = nil // the table has changed, build it here
+		}
+		return fn(m, ib)
+	})
+}
+
+// indexBuilder builds indexes for schemaBuild
+type indexBuilder struct {
+	db *Database
+	// snap is the state that prebuilt was built from
+	snap *DbState
+	// built are the indexes built by the current pass,
+	// prebuilt are the indexes built from snap
+	built    []*index.Overlay
+	prebuilt []*index.Overlay
+	// list is the records of the table, it is created when needed
+	list *sortlist.Builder
+	// deleted and added are the changes since snap
+	deleted []uint64
+	added   []uint64
+	changes bool
+}
+
+// build returns an index for ix with the records from ti,
+// reusing an index built from the snapshot if there is one
+func (ib *indexBuilder) build(ix *schema.Index,
+	ts *meta.Schema, ti *meta.Info) *index.Overlay {
+	for _, ov := range ib.prebuilt {
+		if sameIxspec(ov.GetIxspec(), &ix.Ixspec) {
+			ov = ib.catchup(ov, ix, ti)
+			ov.SetIxspec(&ix.Ixspec)
+			return ov
+		}
+	}
+	if ib.list == nil {
+		ib.list = recordList(ts, ti)
+	}
+	ov := buildIndex(ix, true, ib.list, ib.db.store, ti.Nrows)
+	ib.built = append(ib.built, ov)
+	return ov
+}
+
+// catchup returns ov with the changes to the table
+// since the snapshot it was built from
+func (ib *indexBuilder) catchup(ov *index.Overlay, ix *schema.Index,
+	ti *meta.Info) *index.Overlay {
+	if !ib.changes {
+		ib.deleted, ib.added = tableChanges(
+			ib.snap.meta.GetRoInfo(ti.Table), ti)
+		ib.changes = true
+	}
+	if len(ib.deleted) == 0 && len(ib.added) == 0 {
+		return ov
+	}
+	is := &ix.Ixspec
+	ov = ov.Mutable()
+	// deletes first so a delete and add of the same key combine
+	for _, off := range ib.deleted {
+		ov.Delete(is.Key(offToRec(ib.db.store, off)), off)
+	}
+	for _, off := range ib.added {
+		key := is.Key(offToRec(ib.db.store, off))
+		if ov.Lookup(key) != 0 { // same as buildIndex
+			panic("duplicate key: " + strings.Join(ix.Columns, ","))
+		}
+		ov.Insert(key, off)
+	}
+	return ov.Freeze()
+}
+
+// tableChanges returns the offsets of the records
+// that were deleted and added from ti0 to ti,
+// an updated record is both deleted and added.
+// It iterates through the first index of both.
+func tableChanges(ti0, ti *meta.Info) (deleted, added []uint64) {
+	if ti0 == ti {
+		return
+	}
+	it0 := ti0.Indexes[0].Iterator()
+	it := ti.Indexes[0].Iterator()
+	it0.Next()
+	it.Next()
+	for !it0.Eof() || !it.Eof() {
+		key0, off0 := it0.Cur()
+		key, off := it.Cur()
+		switch {
+		case it.Eof() || (!it0.Eof() && key0 < key):
+			deleted = append(deleted, off0)
+			it0.Next()
+		case it0.Eof() || key < key0:
+			added = append(added, off)
+			it.Next()
+		default:
+			if off0 != off {
+				deleted = append(deleted, off0)
+				added = append(added, off)
+			}
+			it0.Next()
+			it.Next()
+		}
+	}
+	return
+}
+
+// CreateTable adds a new empty table
+func (db *Database) CreateTable(sch *schema.Schema) {
+	db.schemaChange([]string{sch.Table}, func(m *meta.Meta) *meta.Meta {
+		if m.GetRoSchema(sch.Table) != nil {
+			panic("can't create existing table: " + sch.Table)
+		}
+		return m.Put(db.newTable(sch))
+	})
+}
+
+func (db *Database) newTable(sch *schema.Schema) (*meta.Schema, *meta.Info) {
+	if !hasKey(sch.Indexes) {
+		panic("key required: " + sch.Table)
+	}
+	ts := &meta.Schema{Schema: *sch}
+	ts.Ixspecs()
+	ov := make([]*index.Overlay, len(ts.Indexes))
+	for i := range ts.Indexes {
+		ov[i] = index.NewOverlay(db.store, &ts.Indexes[i].Ixspec)
+	}
+	return ts, &meta.Info{Table: sch.Table, Indexes: ov}
+}
+
+// EnsureTable creates the table if it doesn't exist,
+// otherwise it adds any columns and indexes that don't already exist.
+func (db *Database) EnsureTable(sch *schema.Schema) {
+	db.schemaBuild(sch.Table, func(m *meta.Meta, ib *indexBuilder) *meta.Meta {
+		if m.GetRoSchema(sch.Table) == nil {
+			return m.Put(db.newTable(sch))
+		}
+		ts, ti := alterStart(m, sch.Table)
+		for _, col := range sch.Columns {
+			if !hasColumn(&ts.Schema, col) {
+				ts.Columns = append(ts.Columns, col)
+			}
+		}
+		for _, col := range sch.Derived {
+			if !hasColumn(&ts.Schema, col) {
+				ts.Derived = append(ts.Derived, col)
+			}
+		}
+		for _, ix := range sch.Indexes {
+			if findIndex(&ts.Schema, ix.Columns) == -1 {
+				ts.Indexes = append(ts.Indexes, db.newIndex(&ts.Schema, &ix))
+			}
+		}
+		return alterFinish(m, ts, ti, ib)
+	})
+}
+
+// DropTable removes a table. It returns false if the table does not exist.
+func (db *Database) DropTable(table string) bool {
+	result := false
+	db.schemaChange([]string{table}, func(m *meta.Meta) *meta.Meta {
+		if m2 := m.DropTable(table); m2 != nil {
+			result = true
+			return m2
+		}
+		return m
+	})
+	return result
+}
+
+// RenameTable changes the name of a table
+func (db *Database) RenameTable(from, to string) {
+	db.schemaChange([]string{from, to}, func(m *meta.Meta) *meta.Meta {
+		if m.GetRoSchema(from) == nil {
+			panic("can't rename nonexistent table: " + from)
+		}
+		if m.GetRoSchema(to) != nil {
+			panic("can't rename to existing table: " + to)
+		}
+		ts, ti := alterStart(m, from)
+		ts.Table = to
+		ti.Table = to
+		return m.Put(ts, ti).DropTable(from)
+	})
+}
+
+// AlterCreate adds columns and indexes to an existing table.
+// New indexes are built from the existing data.
+func (db *Database) AlterCreate(sch *schema.Schema) {
+	db.schemaBuild(sch.Table, func(m *meta.Meta, ib *indexBuilder) *meta.Meta {
+		ts, ti := alterStart(m, sch.Table)
+		for _, col := range sch.Columns {
+			if hasColumn(&ts.Schema, col) {
+				panic("can't create existing column: " + col)
+			}
+			ts.Columns = append(ts.Columns, col)
+		}
+		for _, col := range sch.Derived {
+			if hasColumn(&ts.Schema, col) {
+				panic("can't create existing column: " + col)
+			}
+			ts.Derived = append(ts.Derived, col)
+		}
+		for _, ix := range sch.Indexes {
+			if findIndex(&ts.Schema, ix.Columns) != -1 {
+				panic("can't create existing index: " + ix.String())
+			}
+			ts.Indexes = append(ts.Indexes, db.newIndex(&ts.Schema, &ix))
+		}
+		return alterFinish(m, ts, ti, ib)
+	})
+}
+
+// newIndex validates the columns of a new index
+func (db *Database) newIndex(ts *schema.Schema, ix *schema.Index) schema.Index {
+	for _, col := range ix.Columns {
+		if !str.List(ts.Columns).Has(col) &&
+			(!strings.HasSuffix(col, "_lower!") || !str.List(ts.Derived).Has(col)) {
+			panic("invalid index column: " + col)
+		}
+	}
+	return schema.Index{Columns: ix.Columns, Mode: ix.Mode,
+		Fktable: ix.Fktable, Fkmode: ix.Fkmode, Fkcolumns: ix.Fkcolumns}
+}
+
+// AlterDrop removes columns and indexes from a table.
+// Dropping a column also drops any indexes that use it.
+// Dropped physical columns are replaced with "-"
+// since the existing records still contain them.
+func (db *Database) AlterDrop(sch *schema.Schema) {
+	db.schemaBuild(sch.Table, func(m *meta.Meta, ib *indexBuilder) *meta.Meta {
+		ts, ti := alterStart(m, sch.Table)
+		for _, ix := range sch.Indexes {
+			i := findIndex(&ts.Schema, ix.Columns)
+			if i == -1 {
+				panic("can't drop nonexistent index: " + ix.String())
+			}
+			ts.Indexes, ti.Indexes = dropIndex(ts.Indexes, ti.Indexes, i)
+		}
+		for _, col := range sch.Columns {
+			i := str.List(ts.Columns).Index(col)
+			if i == -1 || col == "-" {
+				panic("can't drop nonexistent column: " + col)
+			}
+			ts.Columns[i] = "-"
+			ts.Indexes, ti.Indexes = dropColumnIndexes(ts.Indexes, ti.Indexes, col)
+			ts.Derived = str.List(ts.Derived).Without(col + "_lower!")
+		}
+		for _, col := range sch.Derived {
+			if !str.List(ts.Derived).Has(col) {
+				panic("can't drop nonexistent column: " + col)
+			}
+			ts.Derived = str.List(ts.Derived).Without(col)
+			ts.Indexes, ti.Indexes = dropColumnIndexes(ts.Indexes, ti.Indexes, col)
+		}
+		if !hasKey(ts.Indexes) {
+			panic("key required: " + ts.Table)
+		}
+		return alterFinish(m, ts, ti, ib)
+	})
+}
+
+func dropColumnIndexes(ixs []schema.Index, ovs []*index.Overlay,
+	col string) ([]schema.Index, []*index.Overlay) {
+	for i := len(ixs) - 1; i >= 0; i-- {
+		if str.List(ixs[i].Columns).Has(col) ||
+			str.List(ixs[i].Columns).Has(col+"_lower!") {
+			ixs, ovs = dropIndex(ixs, ovs, i)
+		}
+	}
+	return ixs, ovs
+}
+
+func dropIndex(ixs []schema.Index, ovs []*index.Overlay,
+	i int) ([]schema.Index, []*index.Overlay) {
+	return append(ixs[:i], ixs[i+1:]...), append(ovs[:i], ovs[i+1:]...)
+}
+
+// AlterRename renames columns in a table, including in its indexes
+func (db *Database) AlterRename(table string, from, to []string) {
+	db.schemaBuild(table, func(m *meta.Meta, ib *indexBuilder) *meta.Meta {
+		ts, ti := alterStart(m, table)
+		for i := range from {
+			if !hasColumn(&ts.Schema, from[i]) || from[i] == "-" {
+				panic("can't rename nonexistent column: " + from[i])
+			}
+			if hasColumn(&ts.Schema, to[i]) {
+				panic("can't rename to existing column: " + to[i])
+			}
+			renameColumn(&ts.Schema, from[i], to[i])
+			renameColumn(&ts.Schema, from[i]+"_lower!", to[i]+"_lower!")
+		}
+		return alterFinish(m, ts, ti, ib)
+	})
+}
+
+// Rebuild replaces the indexes of a table, or just the specified indexes,
+// with new ones built from the records in the first key index.
+// This compacts indexes that have become fragmented by updates.
+func (db *Database) Rebuild(sch *schema.Schema) {
+	db.schemaBuild(sch.Table, func(m *meta.Meta, ib *indexBuilder) *meta.Meta {
+		ts, ti := alterStart(m, sch.Table)
+		ts.Ixspecs()
+		rebuild := make([]bool, len(ts.Indexes))
+		for _, ix := range sch.Indexes {
+			i := findIndex(&ts.Schema, ix.Columns)
+			if i == -1 {
+				panic("can't rebuild nonexistent index: " + ix.String())
+			}
+			rebuild[i] = true
+		}
+		for i := range ts.Indexes {
+			if rebuild[i] || len(sch.Indexes) == 0 {
+				ti.Indexes[i] = ib.build(&ts.Indexes[i], ts, ti)
+			}
+		}
+		return m.Put(ts, ti)
+	})
+}
+
+func renameColumn(ts *schema.Schema, from, to string) {
+	rename := func(cols []string) []string {
+		if i := str.List(cols).Index(from); i != -1 {
+			cols = append(cols[:0:0], cols...) // copy
+			cols[i] = to
+		}
+		return cols
+	}
+	ts.Columns = rename(ts.Columns)
+	ts.Derived = rename(ts.Derived)
+	for i := range ts.Indexes {
+		ts.Indexes[i].Columns = rename(ts.Indexes[i].Columns)
+	}
+}
+
+// alterStart returns copies of the schema and info for a table
+// that can be safely modified.
+// The index overlays are flattened so any outstanding merges
+// for the table are no longer required.
+func alterStart(m *meta.Meta, table string) (*meta.Schema, *meta.Info) {
+	oldts := m.GetRoSchema(table)
+	if oldts == nil {
+		panic("can't alter nonexistent table: " + table)
+	}
+	ts := *oldts // copy
+	ts.Columns = append(ts.Columns[:0:0], ts.Columns...)
+	ts.Derived = append(ts.Derived[:0:0], ts.Derived...)
+	ts.Indexes = append(ts.Indexes[:0:0], ts.Indexes...)
+	ti := *m.GetRoInfo(table) // copy
+	ti.Indexes = make([]*index.Overlay, len(ti.Indexes))
+	for i, ov := range m.GetRoInfo(table).Indexes {
+		ti.Indexes[i] = ov.Flatten()
+	}
+	return &ts, &ti
+}
+
+// alterFinish builds any new indexes (or existing indexes whose ixspec
+// has changed) and returns a new Meta with the updated schema and info.
+func alterFinish(m *meta.Meta, ts *meta.Schema, ti *meta.Info,
+	ib *indexBuilder) *meta.Meta {
+	ts.Ixspecs()
+	for i := range ts.Indexes {
+		ix := &ts.Indexes[i]
+		if i < len(ti.Indexes) && sameIxspec(ti.Indexes[i].GetIxspec(), &ix.Ixspec) {
+			continue
+		}
+		ov := ib.build(ix, ts, ti)
+		if i < len(ti.Indexes) {
+			ti.Indexes[i] = ov
+		} else {
+			ti.Indexes = append(ti.Indexes, ov)
+		}
+	}
+	return m.Put(ts, ti)
+}
+
+func sameIxspec(is1, is2 *ixkey.Spec) bool {
+	return is1 != nil &&
+		ints.Equal(is1.Fields, is2.Fields) &&
+		ints.Equal(is1.Fields2, is2.Fields2)
+}
+
+// recordList returns a list of the record offsets in the table
+// from its first key index
+func recordList(ts *meta.Schema, ti *meta.Info) *sortlist.Builder {
+	list := sortlist.NewUnsorted()
+	it := ti.Indexes[keyIndex(ts, ti)].Iterator()
+	for it.Next(); !it.Eof(); it.Next() {
+		_, off := it.Cur()
+		list.Add(off)
+	}
+	list.Finish()
+	return list
+}
+
+// keyIndex returns the position of the first key index in ti.
+// ts may have additional (new) indexes.
+func keyIndex(ts *meta.Schema, ti *meta.Info) int {
+	for i := range ti.Indexes {
+		if ts.Indexes[i].Mode == 'k' {
+			return i
+		}
+	}
+	panic("key required: " + ts.Table)
+}
+
+func hasColumn(ts *schema.Schema, col string) bool {
+	return str.List(ts.Columns).Has(col) || str.List(ts.Derived).Has(col)
+}
+
+func findIndex(ts *schema.Schema, cols []string) int {
+	for i := range ts.Indexes {
+		if str.List(ts.Indexes[i].Columns).Equal(cols) {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasKey(ixs []schema.Index) bool {
+	for i := range ixs {
+		if ixs[i].Mode == 'k' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+	"github.com/apmckinlay/gsuneido/db19/meta"
+	"github.com/apmckinlay/gsuneido/db19/meta/schema"
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestDoAdmin(t *testing.T) {
+	assert := assert.T(t)
+	db, err := CreateDatabase("tmp.db")
+	ck(err)
+	defer os.Remove("tmp.db")
+	db.ck = NewCheck()
+	schema := func(table string) string {
+		ts := db.GetState().meta.GetRoSchema(table)
+		if ts == nil {
+			return ""
+		}
+		return ts.String()
+	}
+	admin := func(cmd string) { DoAdmin(db, cmd) }
+
+	admin("create tbl (a,b,c) key(a)")
+	assert.This(schema("tbl")).Is("(a,b,c) key(a)")
+	assert.This(func() { admin("create tbl (x) key(x)") }).
+		Panics("can't create existing table")
+
+	const nrecs = 100
+	ut := db.NewUpdateTran()
+	for i := 0; i < nrecs; i++ {
+		s := strconv.Itoa(i)
+		ut.Output("tbl", mkrec(s, s+s, strconv.Itoa(i%10)))
+	}
+	db.ck.(*Check).commit(ut)
+	ut.commit()
+
+	admin("ensure tbl (c,d) index(c) key(b)")
+	assert.This(schema("tbl")).Is("(a,b,c,d) key(a) index(c) key(b)")
+	admin("alter tbl create (e) index(c,b)")
+	assert.This(schema("tbl")).Is("(a,b,c,d,e) key(a) index(c) key(b) index(c,b)")
+	assert.This(func() { admin("alter tbl create key(c,d)") }).
+		Panics("duplicate key")
+	assert.This(func() { admin("alter tbl create index(c)") }).
+		Panics("can't create existing index")
+
+	// the new indexes contain the existing data
+	rt := db.NewReadTran()
+	n := 0
+	it := rt.RangeIter("tbl", 2, ixkey.All)
+	for it.Next(); !it.Eof(); it.Next() {
+		n++
+	}
+	assert.This(n).Is(nrecs)
+	ix := &rt.meta.GetRoSchema("tbl").Indexes[2]
+	off := rt.Lookup("tbl", 2, ix.Ixspec.Key(mkrec("", "77")))
+	assert.This(rt.GetRecord(off).GetRaw(0)).Is(mkrec("7").GetRaw(0))
+
+	admin("alter tbl rename b to bb")
+	assert.This(schema("tbl")).
+		Is("(a,bb,c,d,e) key(a) index(c) key(bb) index(c,bb)")
+	admin("alter tbl drop (bb)")
+	assert.This(schema("tbl")).Is("(a,-,c,d,e) key(a) index(c)")
+	admin("alter tbl drop index(c)")
+	assert.This(schema("tbl")).Is("(a,-,c,d,e) key(a)")
+	assert.This(func() { admin("alter tbl drop key(a)") }).
+		Panics("key required")
+	assert.This(func() { admin("alter tbl drop (x)") }).
+		Panics("can't drop nonexistent column")
+
+	admin("rename tbl to tbl2")
+	assert.This(schema("tbl")).Is("")
+	assert.This(schema("tbl2")).Is("(a,-,c,d,e) key(a)")
+	assert.This(db.GetState().meta.GetRoInfo("tbl2").Nrows).Is(nrecs)
+	admin("drop tbl2")
+	assert.This(schema("tbl2")).Is("")
+	assert.This(func() { admin("drop tbl2") }).
+		Panics("can't drop nonexistent table")
+
+	// outstanding transactions that use a changed table are aborted
+	admin("create tbl (a,b) key(a)")
+	ut = db.NewUpdateTran()
+	ut.Output("tbl", mkrec("1", "2"))
+	ut2 := db.NewUpdateTran()
+	admin("alter tbl create index(b)")
+	assert.This(func() { ut.Output("tbl", mkrec("3", "4")) }).
+		Panics("schema changed")
+	assert.This(func() { ut2.Output("tbl", mkrec("3", "4")) }).
+		Panics("schema changed")
+
+	db.Persist(&execPersistSingle{}, true)
+	ck(db.Check())
+	db.Close()
+	ck(CheckDatabase("tmp.db"))
+}
+
+func TestRebuild(t *testing.T) {
+	assert := assert.T(t)
+	db, err := CreateDatabase("tmp.db")
+	ck(err)
+	defer os.Remove("tmp.db")
+	db.ck = NewCheck()
+	admin := func(cmd string) { DoAdmin(db, cmd) }
+	count := func(ix int) int {
+		rt := db.NewReadTran()
+		n := 0
+		it := rt.RangeIter("tbl", ix, ixkey.All)
+		for it.Next(); !it.Eof(); it.Next() {
+			n++
+		}
+		return n
+	}
+
+	admin("create tbl (a,b,c) key(a) index(c)")
+	const nrecs = 100
+	for i := 0; i < nrecs; i++ {
+		ut := db.NewUpdateTran()
+		s := strconv.Itoa(i)
+		ut.Output("tbl", mkrec(s, s+s, strconv.Itoa(i%10)))
+		db.ck.(*Check).commit(ut)
+		ut.commit()
+	}
+	db.Persist(&execPersistSingle{}, true)
+	ut := db.NewUpdateTran() // not merged
+	ut.Output("tbl", mkrec("x", "y", "z"))
+	db.ck.(*Check).commit(ut)
+	ut.commit()
+
+	size := db.store.Size()
+	admin("rebuild tbl")
+	assert.That(db.store.Size() > size)
+	assert.This(count(0)).Is(nrecs + 1)
+	assert.This(count(1)).Is(nrecs + 1)
+
+	admin("rebuild tbl index(c)")
+	assert.This(count(1)).Is(nrecs + 1)
+	assert.This(func() { admin("rebuild tbl index(b)") }).
+		Panics("can't rebuild nonexistent index")
+	assert.This(func() { admin("rebuild nonexistent") }).
+		Panics("nonexistent table")
+
+	// the records come from the first key index
+	admin("create tbl2 (a,b) index(b) key(a)")
+	state := db.GetState()
+	assert.This(keyIndex(state.meta.GetRoSchema("tbl2"),
+		state.meta.GetRoInfo("tbl2"))).Is(1)
+	ut = db.NewUpdateTran()
+	ut.Output("tbl2", mkrec("1", "2"))
+	db.ck.(*Check).commit(ut)
+	ut.commit()
+	admin("rebuild tbl2")
+	rt := db.NewReadTran()
+	for i := 0; i < 2; i++ {
+		it := rt.RangeIter("tbl2", i, ixkey.All)
+		it.Next()
+		assert.That(!it.Eof())
+	}
+
+	db.Persist(&execPersistSingle{}, true)
+	ck(db.Check())
+	db.Close()
+	ck(CheckDatabase("tmp.db"))
+}
+
+func TestSchemaBuild(t *testing.T) {
+	assert := assert.T(t)
+	db, err := CreateDatabase("tmp.db")
+	ck(err)
+	defer os.Remove("tmp.db")
+	db.ck = NewCheck()
+	commit := func(fn func(ut *UpdateTran)) {
+		ut := db.NewUpdateTran()
+		fn(ut)
+		db.ck.(*Check).commit(ut)
+		ut.commit()
+	}
+	lookup := func(ut *UpdateTran, a string) uint64 {
+		ix := &ut.getSchema("tbl").Indexes[0]
+		return ut.Lookup("tbl", 0, ix.Ixspec.Key(mkrec(a)))
+	}
+	DoAdmin(db, "create tbl (a,b,c) key(a)")
+	for i := 0; i < 10; i++ {
+		s := strconv.Itoa(i)
+		commit(func(ut *UpdateTran) { ut.Output("tbl", mkrec(s, s+s, s)) })
+	}
+	createKey := func(col string) buildFn {
+		return func(m *meta.Meta, ib *indexBuilder) *meta.Meta {
+			ts, ti := alterStart(m, "tbl")
+			ts.Indexes = append(ts.Indexes,
+				schema.Index{Columns: []string{col}, Mode: 'k'})
+			return alterFinish(m, ts, ti, ib)
+		}
+	}
+	keys := func() string {
+		rt := db.NewReadTran()
+		defer rt.Complete()
+		s := ""
+		it := rt.RangeIter("tbl", 1, ixkey.All)
+		for it.Next(); !it.Eof(); it.Next() {
+			_, off := it.Cur()
+			s += rt.GetRecord(off).GetVal(1).String() + " "
+		}
+		return s
+	}
+
+	// commits after the snapshot are added to the prebuilt index
+	ib := &indexBuilder{db: db}
+	fn := createKey("b")
+	ib.prebuild(fn)
+	assert.This(len(ib.prebuilt)).Is(1)
+	commit(func(ut *UpdateTran) {
+		ut.Output("tbl", mkrec("10", "1010", "10"))
+		ut.Delete("tbl", lookup(ut, "3"))
+		ut.Update("tbl", lookup(ut, "5"), mkrec("5", "x", "5"))
+		ut.Update("tbl", lookup(ut, "6"), mkrec("6", "66", "x"))
+		ut.Update("tbl", lookup(ut, "7"), mkrec("77", "77", "7"))
+	})
+	db.finishBuild("tbl", fn, ib)
+	assert.This(len(ib.built)).Is(0) // reused the prebuilt index
+	assert.This(keys()).Is(`"00" "1010" "11" "22" "44" "66" "77" "88" "99" "x" `)
+
+	// a duplicate committed after the snapshot is detected
+	ib = &indexBuilder{db: db}
+	fn = createKey("c")
+	ib.prebuild(fn)
+	commit(func(ut *UpdateTran) { ut.Output("tbl", mkrec("11", "1111", "10")) })
+	assert.This(func() { db.finishBuild("tbl", fn, ib) }).
+		Panics("duplicate key")
+
+	// if the table schema changes after the snapshot it is built again
+	DoAdmin(db, "alter tbl drop key(b)")
+	commit(func(ut *UpdateTran) { ut.Delete("tbl", lookup(ut, "11")) })
+	ib = &indexBuilder{db: db}
+	fn = createKey("b")
+	ib.prebuild(fn)
+	DoAdmin(db, "alter tbl create (d)")
+	db.finishBuild("tbl", fn, ib)
+	assert.This(len(ib.built)).Is(1)
+	assert.This(keys()).Is(`"00" "1010" "11" "22" "44" "66" "77" "88" "99" "x" `)
+
+	db.Persist(&execPersistSingle{}, true)
+	ck(db.Check())
+	db.Close()
+	ck(CheckDatabase("tmp.db"))
+}
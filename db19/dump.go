@@ -99,7 +99,8 @@ func dumpOpen() (*os.File, *bufio.Writer) {
 
 func dumpTable(db *Database, schema *meta.Schema, multi bool, w *bufio.Writer,
 	ics *indexCheckers) int {
-	state := db.GetState()
+	state := db.startTran()
+	defer db.endTran(state.store)
 	w.WriteString("====== ")
 	if multi {
 		w.WriteString(schema.Table + " ")
@@ -108,8 +109,8 @@ func dumpTable(db *Database, schema *meta.Schema, multi bool, w *bufio.Writer,
 	info := state.meta.GetRoInfo(schema.Table)
 	sum := uint64(0)
 	count := info.Indexes[0].Check(func(off uint64) {
-		sum += off                       // addition so order doesn't matter
-		rec := offToRecCk(db.store, off) // verify data checksums
+		sum += off                          // addition so order doesn't matter
+		rec := offToRecCk(state.store, off) // verify data checksums
 		writeInt(w, len(rec))
 		w.WriteString(string(rec))
 	})
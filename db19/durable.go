@@ -0,0 +1,93 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import "errors"
+
+// Durability determines when commits are flushed to permanent storage.
+//
+// Recovery after a crash is from the last persisted state (see Repair)
+// so a commit is only durable once a state including it
+// has been persisted and flushed.
+// Persist only saves what has been merged,
+// so for the durable modes the checker merges and persists
+// (see persistAll) which also serializes it with commits.
+type Durability int
+
+const (
+	// DurAsync persists the state every persistInterval (see StartConcur)
+	// and leaves flushing to the operating system.
+	// After a crash (e.g. power loss) recent commits may be lost.
+	DurAsync Durability = iota
+	// DurGroup persists and flushes before commits return.
+	// Commits that arrive during a flush share the next one.
+	DurGroup
+	// DurSync persists and flushes for each commit
+	DurSync
+)
+
+var durNames = []string{"async", "group", "sync"}
+
+func (dur Durability) String() string {
+	return durNames[dur]
+}
+
+// ParseDurability returns the Durability for async, group, or sync
+func ParseDurability(s string) (Durability, error) {
+	for i, name := range durNames {
+		if s == name {
+			return Durability(i), nil
+		}
+	}
+	return DurAsync, errors.New("invalid durability: " + s +
+		" (should be async, group, or sync)")
+}
+
+// SetDurability sets when commits are flushed, the default is DurAsync.
+// It must be called before StartConcur.
+func (db *Database) SetDurability(dur Durability) {
+	db.durability = dur
+}
+
+// maxGroup limits how many commits wait for one flush
+// so a steady stream of commits can't delay it indefinitely
+const maxGroup = 100
+
+// syncer is used by the checker to make commits durable
+type syncer struct {
+	dur Durability
+	// sync persists and flushes the state
+	sync    func()
+	waiting []chan bool
+}
+
+func newSyncer(db *Database) *syncer {
+	if db.durability == DurAsync {
+		return nil
+	}
+	return &syncer{dur: db.durability, sync: func() {
+		db.persistAll(false)
+		db.store.Flush()
+	}}
+}
+
+// wait adds a commit to wait for the next flush
+func (sy *syncer) wait(ret chan bool) {
+	sy.waiting = append(sy.waiting, ret)
+}
+
+// after is called by the checker after each message.
+// For DurGroup, it only flushes when there are no more messages queued
+// so the commits that arrive during a flush are grouped.
+func (sy *syncer) after(nqueued int) {
+	if len(sy.waiting) == 0 ||
+		(sy.dur == DurGroup && nqueued > 0 && len(sy.waiting) < maxGroup) {
+		return
+	}
+	sy.sync()
+	for _, ret := range sy.waiting {
+		ret <- true
+	}
+	sy.waiting = sy.waiting[:0]
+}
@@ -0,0 +1,124 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19/stor"
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestParseDurability(t *testing.T) {
+	assert := assert.T(t)
+	for _, dur := range []Durability{DurAsync, DurGroup, DurSync} {
+		d, err := ParseDurability(dur.String())
+		assert.That(err == nil)
+		assert.This(d).Is(dur)
+	}
+	_, err := ParseDurability("fast")
+	assert.That(err != nil)
+}
+
+func TestDurableConcurrent(t *testing.T) {
+	// less than maxTrans in total so starving a client can't exceed it
+	const nclients = 4
+	const ntrans = 40
+	for _, dur := range []Durability{DurGroup, DurSync} {
+		db := createDb()
+		db.SetDurability(dur)
+		StartConcur(db, 50*time.Millisecond)
+		var wg sync.WaitGroup
+		for i := 0; i < nclients; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < ntrans; j++ {
+					output1(db).Commit()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.T(t).This(db.GetState().meta.GetRoInfo("mytable").Nrows).
+			Is(nclients * ntrans)
+		db.Close()
+		ck(CheckDatabase("tmp.db"))
+	}
+	os.Remove("tmp.db")
+}
+
+// TestCrash simulates crashes at arbitrary points (see stor.FaultStor)
+// and checks that recovery gives a consistent database
+// that includes the durable commits.
+func TestCrash(t *testing.T) {
+	n := 5
+	if testing.Short() {
+		n = 3
+	}
+	for _, dur := range []Durability{DurAsync, DurGroup, DurSync} {
+		for i := 0; i < n; i++ {
+			crashTest(t, dur)
+		}
+	}
+	os.Remove("tmp.db")
+	os.Remove("tmp.db.bak")
+}
+
+func crashTest(t *testing.T, dur Durability) {
+	assert := assert.T(t).Msg(dur)
+	store := stor.FaultStor(64 * 1024)
+	db, err := createDatabase(store)
+	ck(err)
+	createTable(db)
+	db.Persist(&execPersistSingle{}, true)
+	store.Flush()
+	db.SetDurability(dur)
+	StartConcur(db, 5*time.Millisecond)
+
+	// a single client so the flushes don't race with writing records
+	var started, committed int32
+	stop := make(chan void)
+	done := make(chan void)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			atomic.AddInt32(&started, 1)
+			output1(db).Commit()
+			atomic.AddInt32(&committed, 1)
+		}
+	}()
+	time.Sleep(time.Duration(rand.Intn(10000)) * time.Microsecond)
+	durable := int(atomic.LoadInt32(&committed))
+	image := store.Crash()
+	max := int(atomic.LoadInt32(&started))
+	close(stop)
+	<-done
+	db.Close()
+
+	ck(ioutil.WriteFile("tmp.db", image, 0666))
+	db, err = OpenDatabase("tmp.db")
+	if err != nil {
+		ck(Repair("tmp.db", err))
+		db, err = OpenDatabase("tmp.db")
+	}
+	assert.That(err == nil)
+	defer db.Close()
+	assert.That(db.Check() == nil)
+	nrows := db.GetState().meta.GetRoInfo("mytable").Nrows
+	assert.That(nrows <= max)
+	if dur != DurAsync {
+		assert.That(nrows >= durable)
+	}
+}
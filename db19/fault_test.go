@@ -0,0 +1,118 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+// Flushing copies data that other goroutines may be writing,
+// the same as msync of a memory map, which the race detector reports.
+
+// +build !race
+
+package db19
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19/stor"
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+// TestFaults runs transactions from several workers
+// on a stor.FaultStor that crashes part way through a random flush
+// and sometimes corrupts bytes.
+// It then checks that opening, checking, and repairing
+// always recovers a consistent database,
+// and that (without corruption) it includes the durable commits.
+func TestFaults(t *testing.T) {
+	n := 20
+	if testing.Short() {
+		n = 5
+	}
+	for i := 0; i < n; i++ {
+		faultTest(t, time.Now().UnixNano())
+	}
+	os.Remove("tmp.db")
+	os.Remove("tmp.db.bak")
+}
+
+func faultTest(t *testing.T, seed int64) {
+	assert := assert.T(t).Msg("seed", seed)
+	r := rand.New(rand.NewSource(seed))
+	dur := []Durability{DurGroup, DurSync}[r.Intn(2)]
+	store := stor.FaultStor(64 * 1024)
+	db, err := createDatabase(store)
+	ck(err)
+	createTable(db)
+	db.Persist(&execPersistSingle{}, true)
+	initial := store.Flush()
+	db.SetDurability(dur)
+	StartConcur(db, 5*time.Millisecond)
+	store.CrashDuring(1+r.Intn(30), r.Intn(16*1024))
+
+	// less than maxTrans in total so starving a worker can't exceed it
+	const nworkers = 4
+	const ntrans = 40
+	var started int32
+	var lock sync.Mutex
+	var durable []string
+	var wg sync.WaitGroup
+	for w := 0; w < nworkers; w++ {
+		wg.Add(1)
+		go func(w int, seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < ntrans && !store.Crashed(); i++ {
+				key := fmt.Sprint("w", w, "-", i)
+				atomic.AddInt32(&started, 1)
+				ut := db.NewUpdateTran()
+				ut.Output("mytable", mkrec(key, "data"))
+				ut.Commit()
+				if !store.Crashed() {
+					// the flush for the commit completed
+					lock.Lock()
+					durable = append(durable, key)
+					lock.Unlock()
+				}
+				time.Sleep(time.Duration(r.Intn(500)) * time.Microsecond)
+			}
+		}(w, r.Int63())
+	}
+	wg.Wait()
+	corrupt := r.Intn(3) == 0
+	if corrupt {
+		for i := 0; i < 1+r.Intn(4); i++ {
+			size := store.Size()
+			store.Corrupt(initial + uint64(r.Int63n(int64(size-initial))))
+		}
+	}
+	image := store.Crash()
+	db.Close()
+
+	ck(ioutil.WriteFile("tmp.db", image, 0666))
+	db, err = OpenDatabaseRead("tmp.db")
+	if err == nil {
+		err = db.Check()
+		db.Close()
+	}
+	if err != nil {
+		ck(Repair("tmp.db", err))
+	}
+	db, err = OpenDatabaseRead("tmp.db")
+	assert.That(err == nil)
+	defer db.Close()
+	assert.That(db.Check() == nil)
+	nrows := db.GetState().meta.GetRoInfo("mytable").Nrows
+	assert.That(nrows <= int(atomic.LoadInt32(&started)))
+	if !corrupt {
+		assert.That(nrows >= len(durable))
+		rt := db.NewReadTran()
+		for _, key := range durable {
+			assert.Msg(key).That(rt.Lookup("mytable", 0, mkrec(key).GetRaw(0)) != 0)
+		}
+	}
+}
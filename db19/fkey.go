@@ -0,0 +1,240 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import (
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+	"github.com/apmckinlay/gsuneido/db19/meta"
+	"github.com/apmckinlay/gsuneido/db19/meta/schema"
+	rt "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Foreign keys
+//
+// An index with an Fktable references the rows of that table
+// with matching Fkcolumns (by default the same as the index columns).
+// Output and update check that the referenced row exists.
+// Deleting or changing a referenced row is blocked,
+// or is cascaded according to the Fkmode.
+// Cascades are done with Update and Delete
+// so they go through the conflict checker like any other write.
+// Empty foreign key values do not reference anything.
+
+// fkref is an index in another table that references a table
+type fkref struct {
+	table  string
+	iIndex int
+	// columns are the index columns in the referencing table
+	columns []string
+	// fkcolumns are the corresponding columns in the referenced table
+	fkcolumns []string
+	mode      int
+}
+
+// fkcolumns returns the columns in the referenced table
+func fkcolumns(ix *schema.Index) []string {
+	if len(ix.Fkcolumns) > 0 {
+		return ix.Fkcolumns
+	}
+	return ix.Columns
+}
+
+// fkOutput checks that the rows referenced by rec exist.
+// For update, oldrec is the previous record (otherwise "")
+// and only the foreign keys that changed are checked.
+func (t *UpdateTran) fkOutput(op string, ts *meta.Schema, rec, oldrec rt.Record) {
+	for i := range ts.Indexes {
+		ix := &ts.Indexes[i]
+		if ix.Fktable == "" {
+			continue
+		}
+		vals := fieldVals(ts, ix.Columns, rec)
+		if allEmpty(vals) ||
+			(oldrec != "" && str.List(vals).Equal(fieldVals(ts, ix.Columns, oldrec))) {
+			continue
+		}
+		if !t.fkExists(ix.Fktable, fkcolumns(ix), vals) {
+			panic(op + " record in " + ts.Table +
+				" blocked by foreign key to " + ix.Fktable)
+		}
+	}
+}
+
+// fkExists returns whether table has a row with the values for cols
+func (t *UpdateTran) fkExists(table string, cols, vals []string) bool {
+	fs := t.meta.GetRoSchema(table)
+	if fs == nil {
+		return false
+	}
+	i := findIndex(&fs.Schema, cols)
+	if i == -1 {
+		return false
+	}
+	return len(t.fkScan(fs, i, cols, vals)) > 0
+}
+
+// fkBlock panics if rec is referenced by an index that does not cascade.
+// For update, newrec is the new record (otherwise "")
+// and only references to values that changed are considered.
+func (t *UpdateTran) fkBlock(op string, ts *meta.Schema, rec, newrec rt.Record) {
+	cascade := schema.CascadeDeletes
+	if newrec != "" {
+		cascade = schema.CascadeUpdates
+	}
+	for _, ref := range t.fkRefs(ts.Table) {
+		if ref.mode&cascade != 0 {
+			continue
+		}
+		vals, ok := fkChanged(ts, ref, rec, newrec)
+		if !ok {
+			continue
+		}
+		if len(t.fkScan(t.getSchema(ref.table), ref.iIndex,
+			ref.columns, vals)) > 0 {
+			panic(op + " record in " + ts.Table +
+				" blocked by foreign key from " + ref.table)
+		}
+	}
+}
+
+// fkCascade deletes or updates the rows that referenced rec.
+// It is called after rec has been deleted or updated to newrec.
+// Blocking references have already been checked by fkBlock,
+// but a cascaded write can still fail,
+// e.g. blocked by a reference to the row it deletes.
+// The changes so far can't be undone so the transaction is aborted.
+func (t *UpdateTran) fkCascade(ts *meta.Schema, rec, newrec rt.Record) {
+	defer func() {
+		if e := recover(); e != nil {
+			t.Abort()
+			panic(e)
+		}
+	}()
+	for _, ref := range t.fkRefs(ts.Table) {
+		vals, ok := fkChanged(ts, ref, rec, newrec)
+		if !ok {
+			continue
+		}
+		rs := t.getSchema(ref.table)
+		for _, off := range t.fkScan(rs, ref.iIndex, ref.columns, vals) {
+			if newrec == "" {
+				t.Delete(ref.table, off)
+			} else {
+				newvals := fieldVals(ts, ref.fkcolumns, newrec)
+				t.Update(ref.table, off,
+					replaceFields(rs, t.GetRecord(off), ref.columns, newvals))
+			}
+		}
+	}
+}
+
+// fkChanged returns the values of rec referenced by ref,
+// and false if they are empty or (for update) unchanged in newrec
+func fkChanged(ts *meta.Schema, ref fkref, rec, newrec rt.Record) ([]string, bool) {
+	vals := fieldVals(ts, ref.fkcolumns, rec)
+	if allEmpty(vals) ||
+		(newrec != "" && str.List(vals).Equal(fieldVals(ts, ref.fkcolumns, newrec))) {
+		return nil, false
+	}
+	return vals, true
+}
+
+// fkRefs returns the indexes that reference a table.
+// They are found by scanning the schemas, and cached for the transaction.
+func (t *UpdateTran) fkRefs(table string) []fkref {
+	if t.fkrefs == nil {
+		t.fkrefs = make(map[string][]fkref)
+		t.meta.ForEachSchema(func(ts *meta.Schema) {
+			for i := range ts.Indexes {
+				ix := &ts.Indexes[i]
+				if ix.Fktable != "" {
+					t.fkrefs[ix.Fktable] = append(t.fkrefs[ix.Fktable],
+						fkref{table: ts.Table, iIndex: i, columns: ix.Columns,
+							fkcolumns: fkcolumns(ix), mode: ix.Fkmode})
+				}
+			}
+		})
+	}
+	return t.fkrefs[table]
+}
+
+// fkScan returns the offsets of the records in an index
+// whose cols have the given values
+func (t *UpdateTran) fkScan(ts *meta.Schema, iIndex int,
+	cols, vals []string) []uint64 {
+	var offs []uint64
+	it := t.RangeIter(ts.Table, iIndex, fkRange(&ts.Indexes[iIndex], vals))
+	for it.Next(); !it.Eof(); it.Next() {
+		_, off := it.Cur()
+		// the range may include extra keys so the values must be checked
+		if str.List(fieldVals(ts, cols, t.GetRecord(off))).Equal(vals) {
+			offs = append(offs, off)
+		}
+	}
+	return offs
+}
+
+// fkRange returns a range of an index that includes
+// all the keys that start with the given (not all empty) values.
+// It may also include other keys.
+func fkRange(ix *schema.Index, vals []string) ixkey.Range {
+	if len(ix.Ixspec.Fields) == 1 && len(ix.Ixspec.Fields2) == 0 {
+		// single field keys are not encoded
+		return ixkey.Range{Org: vals[0], End: vals[0] + "\x00"}
+	}
+	var rb rt.RecordBuilder
+	fields := make([]int, len(vals))
+	for i, v := range vals {
+		rb.AddRaw(v)
+		fields[i] = i
+	}
+	// Fields2 forces encoding, it is not used since vals are not all empty
+	spec := ixkey.Spec{Fields: fields, Fields2: []int{0}}
+	key := spec.Key(rb.Build())
+	return ixkey.Range{Org: key, End: key + "\x00\x01"}
+}
+
+// fieldVals returns the packed values of cols from rec
+func fieldVals(ts *meta.Schema, cols []string, rec rt.Record) []string {
+	vals := make([]string, len(cols))
+	for i, col := range cols {
+		if f := str.List(ts.Columns).Index(col); f >= 0 {
+			vals[i] = rec.GetRaw(f)
+		}
+	}
+	return vals
+}
+
+func allEmpty(vals []string) bool {
+	for _, v := range vals {
+		if v != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceFields returns a copy of rec with the values of cols replaced
+func replaceFields(ts *meta.Schema, rec rt.Record, cols, vals []string) rt.Record {
+	n := rec.Count()
+	flds := make([]int, len(cols))
+	for i, col := range cols {
+		flds[i] = str.List(ts.Columns).Index(col)
+		if flds[i] >= n {
+			n = flds[i] + 1
+		}
+	}
+	var rb rt.RecordBuilder
+	for f := 0; f < n; f++ {
+		v := rec.GetRaw(f)
+		for i, fld := range flds {
+			if fld == f {
+				v = vals[i]
+			}
+		}
+		rb.AddRaw(v)
+	}
+	return rb.Build()
+}
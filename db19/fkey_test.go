@@ -0,0 +1,115 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package db19
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+	rt "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestForeignKey(t *testing.T) {
+	assert := assert.T(t)
+	db, err := CreateDatabase("tmp.db")
+	ck(err)
+	defer os.Remove("tmp.db")
+	db.ck = NewCheck()
+	DoAdmin(db, "create cus (ck, name) key(ck)")
+	DoAdmin(db, "create inv (ik, ck) key(ik) index(ck) in cus")
+	DoAdmin(db, "create ord (ok, ck) key(ok) index(ck) in cus cascade")
+	DoAdmin(db, "create ln (lk, ik) key(lk) index(ik) in inv cascade update")
+
+	ut := db.NewUpdateTran()
+	lookup := func(table, key string) uint64 {
+		return ut.Lookup(table, 0, key)
+	}
+	// values returns the first field of all the records in a table
+	values := func(table string) string {
+		s := ""
+		it := ut.RangeIter(table, 0, ixkey.All)
+		for it.Next(); !it.Eof(); it.Next() {
+			_, off := it.Cur()
+			rec := ut.GetRecord(off)
+			s += rt.ToStr(rec.GetVal(0)) + rt.ToStr(rec.GetVal(1)) + " "
+		}
+		return s
+	}
+	ut.Output("cus", mkrec("c1", "joe"))
+	ut.Output("cus", mkrec("c2", "sue"))
+	ut.Output("inv", mkrec("i1", "c1"))
+	ut.Output("inv", mkrec("i2", ""))
+	assert.This(func() { ut.Output("inv", mkrec("i3", "c9")) }).
+		Panics("output record in inv blocked by foreign key to cus")
+	ut.Output("ord", mkrec("o1", "c1"))
+	ut.Output("ord", mkrec("o2", "c2"))
+	ut.Output("ln", mkrec("l1", "i1"))
+	ut.Output("ln", mkrec("l2", "i1"))
+
+	// block
+	assert.This(func() { ut.Delete("cus", lookup("cus", mkrec("c1").GetRaw(0))) }).
+		Panics("delete record in cus blocked by foreign key from inv")
+	assert.This(func() {
+		ut.Update("cus", lookup("cus", mkrec("c1").GetRaw(0)), mkrec("c3", "joe"))
+	}).Panics("update record in cus blocked by foreign key from inv")
+	assert.This(func() {
+		ut.Update("inv", lookup("inv", mkrec("i1").GetRaw(0)), mkrec("i1", "c9"))
+	}).Panics("update record in inv blocked by foreign key to cus")
+	// changing a non-key field is not blocked
+	ut.Update("cus", lookup("cus", mkrec("c1").GetRaw(0)), mkrec("c1", "joey"))
+
+	// cascade delete
+	ut.Delete("cus", lookup("cus", mkrec("c2").GetRaw(0)))
+	assert.This(values("cus")).Is("c1joey ")
+	assert.This(values("ord")).Is("o1c1 ")
+
+	// cascade update
+	ut.Update("inv", lookup("inv", mkrec("i1").GetRaw(0)), mkrec("i5", "c1"))
+	assert.This(values("ln")).Is("l1i5 l2i5 ")
+
+	// cascade update only, delete is blocked
+	assert.This(func() { ut.Delete("inv", lookup("inv", mkrec("i5").GetRaw(0))) }).
+		Panics("delete record in inv blocked by foreign key from ln")
+	db.Close()
+}
+
+func TestForeignKeyCascadeBlock(t *testing.T) {
+	assert := assert.T(t)
+	db, err := CreateDatabase("tmp.db")
+	ck(err)
+	defer os.Remove("tmp.db")
+	StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	DoAdmin(db, "create a (ak) key(ak)")
+	DoAdmin(db, "create b (bk, ak) key(bk) index(ak) in a cascade")
+	DoAdmin(db, "create c (ck, bk) key(ck) index(bk) in b")
+	ut := db.NewUpdateTran()
+	ut.Output("a", mkrec("a1"))
+	ut.Output("b", mkrec("b1", "a1"))
+	ut.Output("b", mkrec("b2", "a1"))
+	ut.Output("c", mkrec("c1", "b2"))
+	ut.Commit()
+	nrows := func(tran *ReadTran, table string) int {
+		return tran.meta.GetRoInfo(table).Nrows
+	}
+
+	// deleting a cascades to b which is blocked by c
+	// after a and b1 have been deleted
+	ut = db.NewUpdateTran()
+	off := ut.Lookup("a", 0, mkrec("a1").GetRaw(0))
+	assert.This(func() { ut.Delete("a", off) }).
+		Panics("delete record in b blocked by foreign key from c")
+	assert.This(ut.tran.Lookup("b", 0, mkrec("b1").GetRaw(0))).Is(0)
+	// so the transaction is aborted
+	assert.This(func() { ut.Commit() }).Panics("transaction aborted")
+
+	tran := db.NewReadTran()
+	defer tran.Complete()
+	assert.This(nrows(tran, "a")).Is(1)
+	assert.This(nrows(tran, "b")).Is(2)
+	assert.This(nrows(tran, "c")).Is(1)
+}
@@ -75,6 +75,71 @@ func (fb *fbtree) Search(key string) uint64 {
 	return off
 }
 
+// Lookup returns the offset for a key, or 0 if the key is not found.
+// Unlike Search, it verifies the complete key.
+func (fb *fbtree) Lookup(key string) uint64 {
+	off := fb.root
+	for i := 0; i <= fb.treeLevels; i++ {
+		node := fb.getNode(off)
+		if len(node) == 0 {
+			return 0
+		}
+		off, _, _ = node.search(key)
+	}
+	if fb.getLeafKey(off) != key {
+		return 0
+	}
+	return off
+}
+
+// RangeFrac returns an estimate of the fraction of the keys
+// that are in the range from org (inclusive) to end (exclusive).
+// It only samples the top levels of the tree.
+func (fb *fbtree) RangeFrac(org, end string) float64 {
+	frac := fb.fracBelow(end) - fb.fracBelow(org)
+	if frac < 0 {
+		return 0
+	}
+	return frac
+}
+
+// fracLevels is the number of levels of the tree that RangeFrac reads
+const fracLevels = 2
+
+// fracBelow returns the approximate fraction of the keys less than key.
+// At each level the entries are assumed to have equal numbers of keys.
+func (fb *fbtree) fracBelow(key string) float64 {
+	frac := 0.0
+	span := 1.0
+	off := fb.root
+	for level := 0; ; level++ {
+		node := fb.getNode(off)
+		n := 0
+		i := 0 // the entry that could contain key
+		below := 0
+		for it := node.iter(); it.next(); n++ {
+			if string(it.known) <= key {
+				i = n
+				off = it.offset
+			}
+			if string(it.known) < key {
+				below++
+			}
+		}
+		if n == 0 {
+			return frac
+		}
+		if level == fb.treeLevels { // leaf
+			return frac + float64(below)/float64(n)*span
+		}
+		frac += float64(i) / float64(n) * span
+		span /= float64(n)
+		if level+1 >= fracLevels {
+			return frac + span/2
+		}
+	}
+}
+
 // putNode stores the node
 func (node fnode) putNode(store *stor.Stor) uint64 {
 	n := len(node)
@@ -54,6 +54,31 @@ func TestFbtreeIter(t *testing.T) {
 	assert.T(t).This(i).Is(n)
 }
 
+func TestFbtreeRangeFrac(t *testing.T) {
+	assert := assert.T(t)
+	const n = 1000
+	var data [n]string
+	GetLeafKey = func(_ *stor.Stor, _ *ixkey.Spec, i uint64) string { return data[i] }
+	defer func(mns int) { MaxNodeSize = mns }(MaxNodeSize)
+	MaxNodeSize = 440
+	for i := 0; i < n; i++ {
+		data[i] = strconv.Itoa(1000 + i)
+	}
+	store := stor.HeapStor(8192)
+	bldr := Builder(store)
+	for i, k := range data {
+		bldr.Add(k, uint64(i))
+	}
+	fb := bldr.Finish()
+	assert.That(fb.treeLevels > 0)
+	near := func(x, y float64) bool { return x-y < .05 && y-x < .05 }
+	assert.That(near(fb.RangeFrac("", "\xff"), 1))
+	assert.That(near(fb.RangeFrac("1000", "1500"), .5))
+	assert.That(near(fb.RangeFrac("1250", "1500"), .25))
+	assert.That(near(fb.RangeFrac("1500", "1250"), 0))
+	assert.That(near(fb.RangeFrac("3", "4"), 0))
+}
+
 func TestFbtreeBuilder(t *testing.T) {
 	assert := assert.T(t)
 	GetLeafKey = func(_ *stor.Stor, _ *ixkey.Spec, i uint64) string {
@@ -0,0 +1,211 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package fbtree
+
+import (
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+)
+
+// Iterator is a bidirectional iterator over an fbtree
+// limited to a Range.
+// Unlike Iter, it returns complete keys (from GetLeafKey)
+// Since an fbtree is immutable, no modification handling is required.
+type Iterator struct {
+	fb  *fbtree
+	rng ixkey.Range
+	iterState
+	// stack is the path from the root to the current leaf
+	stack []*nodeIter
+	// curKey and curOff are the current item
+	curKey string
+	curOff uint64
+}
+
+type iterState byte
+
+const (
+	rewound iterState = iota
+	within
+	eof
+)
+
+// nodeIter is an expanded (random access) version of an fnode
+type nodeIter struct {
+	knowns []string
+	offs   []uint64
+	i      int
+}
+
+func (fb *fbtree) Iterator() *Iterator {
+	return &Iterator{fb: fb, rng: ixkey.All,
+		stack: make([]*nodeIter, 0, fb.treeLevels+1)}
+}
+
+// Range sets the range for the iterator and rewinds it
+func (it *Iterator) Range(rng ixkey.Range) {
+	it.rng = rng
+	it.Rewind()
+}
+
+func (it *Iterator) Rewind() {
+	it.iterState = rewound
+}
+
+func (it *Iterator) Eof() bool {
+	return it.iterState == eof
+}
+
+func (it *Iterator) Cur() (string, uint64) {
+	return it.curKey, it.curOff
+}
+
+func (it *Iterator) Next() {
+	if it.iterState == eof {
+		return // stick at eof
+	}
+	if it.iterState == rewound {
+		it.iterState = within
+		it.descend(it.rng.Org, false)
+		if it.leaf().empty() || it.leafKey() < it.rng.Org {
+			if !it.next1() {
+				it.iterState = eof
+				return
+			}
+		}
+	} else if !it.next1() {
+		it.iterState = eof
+		return
+	}
+	it.setCur()
+	if it.curKey >= it.rng.End {
+		it.iterState = eof
+	}
+}
+
+func (it *Iterator) Prev() {
+	if it.iterState == eof {
+		return // stick at eof
+	}
+	if it.iterState == rewound {
+		it.iterState = within
+		it.descend(it.rng.End, true)
+		if it.leaf().empty() || it.leafKey() >= it.rng.End {
+			if !it.prev1() {
+				it.iterState = eof
+				return
+			}
+		}
+	} else if !it.prev1() {
+		it.iterState = eof
+		return
+	}
+	it.setCur()
+	if it.curKey < it.rng.Org {
+		it.iterState = eof
+	}
+}
+
+func (it *Iterator) setCur() {
+	it.curOff = it.leaf().off()
+	it.curKey = it.fb.getLeafKey(it.curOff)
+}
+
+func (it *Iterator) leaf() *nodeIter {
+	return it.stack[len(it.stack)-1]
+}
+
+func (it *Iterator) leafKey() string {
+	return it.fb.getLeafKey(it.leaf().off())
+}
+
+// descend builds the stack from the root to the leaf
+// that contains the last entry whose known is <= key (< key if strict)
+func (it *Iterator) descend(key string, strict bool) {
+	it.stack = it.stack[:0]
+	off := it.fb.root
+	for level := 0; ; level++ {
+		ni := it.fb.nodeIter(off)
+		ni.search(key, strict)
+		it.stack = append(it.stack, ni)
+		if level >= it.fb.treeLevels {
+			break
+		}
+		off = ni.off()
+	}
+}
+
+// next1 advances to the next leaf entry, moving to following leaves
+// as necessary. It returns false if there are no more entries.
+func (it *Iterator) next1() bool {
+	for {
+		level := len(it.stack) - 1
+		for level >= 0 && it.stack[level].i+1 >= len(it.stack[level].offs) {
+			level--
+		}
+		if level < 0 {
+			return false
+		}
+		it.stack[level].i++
+		for level++; level < len(it.stack); level++ {
+			ni := it.fb.nodeIter(it.stack[level-1].off())
+			ni.i = 0
+			it.stack[level] = ni
+		}
+		if !it.leaf().empty() {
+			return true
+		}
+	}
+}
+
+// prev1 moves to the previous leaf entry, moving to preceding leaves
+// as necessary. It returns false if there are no more entries.
+func (it *Iterator) prev1() bool {
+	for {
+		level := len(it.stack) - 1
+		for level >= 0 && it.stack[level].i <= 0 {
+			level--
+		}
+		if level < 0 {
+			return false
+		}
+		it.stack[level].i--
+		for level++; level < len(it.stack); level++ {
+			ni := it.fb.nodeIter(it.stack[level-1].off())
+			ni.i = len(ni.offs) - 1
+			it.stack[level] = ni
+		}
+		if !it.leaf().empty() {
+			return true
+		}
+	}
+}
+
+func (fb *fbtree) nodeIter(off uint64) *nodeIter {
+	node := fb.getNode(off)
+	ni := &nodeIter{}
+	for it := node.iter(); it.next(); {
+		ni.knowns = append(ni.knowns, string(it.known))
+		ni.offs = append(ni.offs, it.offset)
+	}
+	return ni
+}
+
+// search sets i to the last entry whose known is <= key (< key if strict)
+func (ni *nodeIter) search(key string, strict bool) {
+	ni.i = 0
+	for i := 1; i < len(ni.knowns); i++ {
+		if ni.knowns[i] > key || (strict && ni.knowns[i] == key) {
+			break
+		}
+		ni.i = i
+	}
+}
+
+func (ni *nodeIter) empty() bool {
+	return len(ni.offs) == 0
+}
+
+func (ni *nodeIter) off() uint64 {
+	return ni.offs[ni.i]
+}
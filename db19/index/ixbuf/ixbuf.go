@@ -9,6 +9,7 @@
 package ixbuf
 
 import (
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
 	"github.com/apmckinlay/gsuneido/util/assert"
 	"github.com/apmckinlay/gsuneido/util/ints"
 )
@@ -148,6 +149,25 @@ func search(c chunk, key string) int {
 	return i
 }
 
+// RangeCount returns the number of entries in the range
+// from org (inclusive) to end (exclusive)
+func (ib *ixbuf) RangeCount(org, end string) int {
+	if ib.size == 0 {
+		return 0
+	}
+	return ints.Max(0, ib.rank(end)-ib.rank(org))
+}
+
+// rank returns the number of entries less than key
+func (ib *ixbuf) rank(key string) int {
+	ci, _, i := ib.search(key)
+	n := i
+	for _, c2 := range ib.chunks[:ci] {
+		n += len(c2)
+	}
+	return n
+}
+
 // Update combines if the key exists, otherwise it adds an update entry
 func (ib *ixbuf) Update(key string, off uint64) {
 	ib.Insert(key, off|Update)
@@ -158,6 +178,19 @@ func (ib *ixbuf) Delete(key string, off uint64) {
 	ib.Insert(key, off|Delete)
 }
 
+// Lookup returns the offset (including any Update or Delete flags)
+// for a key, or 0 if the key is not found.
+func (ib *ixbuf) Lookup(key string) uint64 {
+	if ib.size == 0 {
+		return 0
+	}
+	_, c, i := ib.search(key)
+	if i < len(c) && c[i].key == key {
+		return c[i].off
+	}
+	return 0
+}
+
 //-------------------------------------------------------------------
 
 // Merge combines several ixbuf's into a new one.
@@ -375,8 +408,9 @@ func (ib *ixbuf) ForEach(fn Visitor) {
 //-------------------------------------------------------------------
 
 type Iterator struct {
-	ib *ixbuf
+	ib       *ixbuf
 	modCount int32
+	rng      ixkey.Range
 	state
 	// ci, i, and c point to the current slot = ib.chunks[ci][i]
 	ci int
@@ -396,7 +430,14 @@ const (
 )
 
 func (ib *ixbuf) Iterator() *Iterator {
-	return &Iterator{ib: ib, modCount: ib.modCount, state: rewound}
+	return &Iterator{ib: ib, modCount: ib.modCount, state: rewound,
+		rng: ixkey.All}
+}
+
+// Range sets the range for the iterator and rewinds it
+func (it *Iterator) Range(rng ixkey.Range) {
+	it.rng = rng
+	it.Rewind()
 }
 
 func (it *Iterator) Eof() bool {
@@ -411,18 +452,21 @@ func (it *Iterator) Next() {
 	if it.state == eof {
 		return // stick at eof
 	}
+	if it.ib.size == 0 {
+		it.state = eof
+		return
+	}
 	if it.state == rewound {
-		if it.ib.size == 0 {
-			it.state = eof
-			return
-		}
 		it.state = within
-		it.ci = 0
-		it.i = -1
-		it.c = it.ib.chunks[0]
+		it.ci, it.c, it.i = it.ib.search(it.rng.Org)
+		it.i-- // so increment below gets first slot >= Org
+		it.modCount = it.ib.modCount
 	} else if it.modCount != it.ib.modCount {
 		// ixbuf has been modified
 		it.ci, it.c, it.i = it.ib.search(it.cur.key)
+		if it.i >= len(it.c) || it.c[it.i].key != it.cur.key {
+			it.i-- // current key was removed
+		}
 		it.modCount = it.ib.modCount
 	}
 	it.i++
@@ -436,21 +480,24 @@ func (it *Iterator) Next() {
 		it.i = 0
 	}
 	it.cur = it.c[it.i]
+	if it.cur.key >= it.rng.End {
+		it.state = eof
+	}
 }
 
 func (it *Iterator) Prev() {
 	if it.state == eof {
 		return // stick at eof
 	}
+	if it.ib.size == 0 {
+		it.state = eof
+		return
+	}
 	if it.state == rewound {
-		if it.ib.size == 0 {
-			it.state = eof
-			return
-		}
 		it.state = within
-		it.ci = len(it.ib.chunks) - 1
-		it.c = it.ib.chunks[it.ci]
-		it.i = len(it.c)
+		// search gives first slot >= End, decrement below gets previous
+		it.ci, it.c, it.i = it.ib.search(it.rng.End)
+		it.modCount = it.ib.modCount
 	} else if it.modCount != it.ib.modCount {
 		// ixbuf has been modified
 		it.ci, it.c, it.i = it.ib.search(it.cur.key)
@@ -467,6 +514,9 @@ func (it *Iterator) Prev() {
 		it.i = len(it.c) - 1
 	}
 	it.cur = it.c[it.i]
+	if it.cur.key < it.rng.Org {
+		it.state = eof
+	}
 }
 
 func (it *Iterator) Rewind() {
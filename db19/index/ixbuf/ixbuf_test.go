@@ -229,6 +229,20 @@ func BenchmarkMerge(b *testing.B) {
 	})
 }
 
+func TestRangeCount(t *testing.T) {
+	assert := assert.T(t)
+	ib := &ixbuf{}
+	assert.This(ib.RangeCount("", "z")).Is(0)
+	for i := 0; i < 1000; i++ {
+		ib.Insert(strconv.Itoa(1000+i), uint64(i))
+	}
+	assert.This(ib.RangeCount("", "z")).Is(1000)
+	assert.This(ib.RangeCount("1000", "1500")).Is(500)
+	assert.This(ib.RangeCount("1250", "1251")).Is(1)
+	assert.This(ib.RangeCount("1500", "1250")).Is(0)
+	assert.This(ib.RangeCount("3", "4")).Is(0)
+}
+
 func TestGoal(t *testing.T) {
 	assert.T(t).This(goal(0)).Is(24) // min
 	assert.T(t).This(goal(100)).Is(24)
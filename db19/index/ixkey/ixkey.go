@@ -150,3 +150,16 @@ func (spec *Spec) raw() bool {
 	return len(spec.Fields) == 0 ||
 		(len(spec.Fields) == 1 && len(spec.Fields2) == 0)
 }
+
+// Max is a key value greater than any real key
+const Max = "\xff\xff\xff\xff\xff\xff\xff\xff"
+
+// Range specifies a range of keys.
+// Org is inclusive, End is exclusive.
+type Range struct {
+	Org string
+	End string
+}
+
+// All is the range of all keys
+var All = Range{Org: "", End: Max}
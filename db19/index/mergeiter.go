@@ -3,20 +3,32 @@
 
 package index
 
+import (
+	"github.com/apmckinlay/gsuneido/db19/index/ixbuf"
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+)
+
 type iterator interface {
 	Eof() bool
 	Cur() (key string, off uint64)
 	Next()
 	Prev()
 	Rewind()
+	Range(rng ixkey.Range)
 }
 
+// MergeIter is a bidirectional iterator that merges several iterators.
+// The iterators must be ordered from oldest to newest
+// e.g. fbtree, ixbuf layers, mutable ixbuf.
+// Entries with the same key are combined (see ixbuf.Combine)
+// and deleted entries are skipped.
 type MergeIter struct {
 	iters []iterator
-	// curIter is the iterator containing the current item = iters[curIter]
-	curIter int
 	state
 	lastDir dir
+	// curKey and curOff are the current (combined) item
+	curKey string
+	curOff uint64
 }
 
 type state byte
@@ -40,6 +52,14 @@ func NewMergeIter(iters []iterator) *MergeIter {
 	return &MergeIter{iters: its}
 }
 
+// Range sets the range for all the iterators and rewinds
+func (mi *MergeIter) Range(rng ixkey.Range) {
+	for _, it := range mi.iters {
+		it.Range(rng)
+	}
+	mi.state = rewound
+}
+
 func (mi *MergeIter) Eof() bool {
 	return mi.state == eof
 }
@@ -48,7 +68,7 @@ func (mi *MergeIter) Cur() (string, uint64) {
 	if mi.state != within {
 		return "", 0
 	}
-	return mi.iters[mi.curIter].Cur()
+	return mi.curKey, mi.curOff
 }
 
 func (mi *MergeIter) Next() {
@@ -59,15 +79,22 @@ func (mi *MergeIter) Next() {
 		mi.all(iterator.Next)
 		mi.state = within
 	} else if mi.lastDir == next {
-		mi.iters[mi.curIter].Next()
+		mi.cur(iterator.Next)
 	} else { // switch direction
 		mi.all(nextRewind)
 	}
-	mi.curIter = mi.minIter()
-	if mi.curIter == -1 {
-		mi.state = eof
-	}
 	mi.lastDir = next
+	for {
+		key, ok := mi.minKey()
+		if !ok {
+			mi.state = eof
+			return
+		}
+		if mi.combine(key) {
+			return
+		}
+		mi.cur(iterator.Next) // skip deleted
+	}
 }
 
 func (mi *MergeIter) all(fn func(it iterator)) {
@@ -76,6 +103,17 @@ func (mi *MergeIter) all(fn func(it iterator)) {
 	}
 }
 
+// cur applies fn to the iterators positioned at the current key
+func (mi *MergeIter) cur(fn func(it iterator)) {
+	for _, it := range mi.iters {
+		if !it.Eof() {
+			if key, _ := it.Cur(); key == mi.curKey {
+				fn(it)
+			}
+		}
+	}
+}
+
 func nextRewind(it iterator) {
 	if it.Eof() {
 		it.Rewind()
@@ -83,20 +121,47 @@ func nextRewind(it iterator) {
 	it.Next()
 }
 
-// minIter returns the index of the iterator with the minimum current value
-func (mi *MergeIter) minIter() int {
-	itMin := -1
+// minKey returns the minimum current key of the iterators
+func (mi *MergeIter) minKey() (string, bool) {
 	var keyMin string
-	for i, it := range mi.iters {
+	found := false
+	for _, it := range mi.iters {
 		if !it.Eof() {
 			key, _ := it.Cur()
-			if itMin == -1 || key < keyMin {
-				itMin = i
+			if !found || key < keyMin {
 				keyMin = key
+				found = true
+			}
+		}
+	}
+	return keyMin, found
+}
+
+// combine sets curKey and combines the offsets of the iterators
+// that are positioned at key.
+// It returns false if the result is a deletion.
+func (mi *MergeIter) combine(key string) bool {
+	mi.curKey = key
+	off := uint64(0)
+	have := false
+	for _, it := range mi.iters {
+		if !it.Eof() {
+			if k, o := it.Cur(); k == key {
+				if !have {
+					off = o
+					have = true
+				} else {
+					off = ixbuf.Combine(off, o)
+					have = off != 0 // add + delete gives 0
+				}
 			}
 		}
 	}
-	return itMin
+	if !have || off&ixbuf.Delete != 0 {
+		return false
+	}
+	mi.curOff = off &^ ixbuf.Update
+	return true
 }
 
 func (mi *MergeIter) Prev() {
@@ -107,15 +172,22 @@ func (mi *MergeIter) Prev() {
 		mi.all(iterator.Prev)
 		mi.state = within
 	} else if mi.lastDir == prev {
-		mi.iters[mi.curIter].Prev()
+		mi.cur(iterator.Prev)
 	} else { // switch direction
 		mi.all(prevRewind)
 	}
-	mi.curIter = mi.maxIter()
-	if mi.curIter == -1 {
-		mi.state = eof
-	}
 	mi.lastDir = prev
+	for {
+		key, ok := mi.maxKey()
+		if !ok {
+			mi.state = eof
+			return
+		}
+		if mi.combine(key) {
+			return
+		}
+		mi.cur(iterator.Prev) // skip deleted
+	}
 }
 
 func prevRewind(it iterator) {
@@ -125,20 +197,20 @@ func prevRewind(it iterator) {
 	it.Prev()
 }
 
-// maxIter returns the index of the iterator with the maximum current value
-func (mi *MergeIter) maxIter() int {
-	itMax := -1
+// maxKey returns the maximum current key of the iterators
+func (mi *MergeIter) maxKey() (string, bool) {
 	var keyMax string
-	for i, it := range mi.iters {
+	found := false
+	for _, it := range mi.iters {
 		if !it.Eof() {
 			key, _ := it.Cur()
-			if itMax == -1 || key > keyMax {
-				itMax = i
+			if !found || key > keyMax {
 				keyMax = key
+				found = true
 			}
 		}
 	}
-	return itMax
+	return keyMax, found
 }
 
 func (mi *MergeIter) Rewind() {
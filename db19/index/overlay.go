@@ -56,6 +56,12 @@ func (ov *Overlay) Insert(key string, off uint64) {
 	ov.mut.Insert(key, off)
 }
 
+// Update either combines with the key in the mutable ixbuf.T
+// or inserts an update entry into the mutable ixbuf.T.
+func (ov *Overlay) Update(key string, off uint64) {
+	ov.mut.Update(key, off)
+}
+
 // Delete either deletes the key/offset from the mutable ixbuf.T
 // or inserts a tombstone into the mutable ixbuf.T.
 func (ov *Overlay) Delete(key string, off uint64) {
@@ -153,6 +159,78 @@ outer:
 	}
 }
 
+// Iterator returns a bidirectional iterator over the overlay
+// that merges the fbtree and the ixbuf layers
+func (ov *Overlay) Iterator() *MergeIter {
+	iters := make([]iterator, 0, len(ov.layers)+2)
+	iters = append(iters, ov.fb.Iterator())
+	for _, ib := range ov.layers {
+		iters = append(iters, ib.Iterator())
+	}
+	if ov.mut != nil {
+		iters = append(iters, ov.mut.Iterator())
+	}
+	return &MergeIter{iters: iters}
+}
+
+// Lookup returns the offset for a key, or 0 if the key is not found.
+// It checks the ixbuf layers from newest to oldest, then the fbtree.
+func (ov *Overlay) Lookup(key string) uint64 {
+	if ov.mut != nil {
+		if off := ov.mut.Lookup(key); off != 0 {
+			return lookupResult(off)
+		}
+	}
+	for i := len(ov.layers) - 1; i >= 0; i-- {
+		if off := ov.layers[i].Lookup(key); off != 0 {
+			return lookupResult(off)
+		}
+	}
+	return ov.fb.Lookup(key)
+}
+
+func lookupResult(off uint64) uint64 {
+	if off&ixbuf.Delete != 0 {
+		return 0
+	}
+	return off &^ ixbuf.Update
+}
+
+// RangeFrac returns an estimate of the fraction of the keys
+// in the range from org (inclusive) to end (exclusive).
+// nrows is the total number of keys, used to weight the fbtree
+// against the ixbuf layers.
+func (ov *Overlay) RangeFrac(org, end string, nrows int) float64 {
+	nib := 0
+	count := 0
+	for _, ib := range ov.ibufs() {
+		nib += ib.Len()
+		count += ib.RangeCount(org, end)
+	}
+	nfb := nrows - nib
+	if nfb < 0 {
+		nfb = 0
+	}
+	total := nfb + nib
+	if total == 0 {
+		return 0
+	}
+	frac := (ov.fb.RangeFrac(org, end)*float64(nfb) + float64(count)) /
+		float64(total)
+	if frac > 1 {
+		return 1
+	}
+	return frac
+}
+
+// ibufs returns the ixbuf layers including mut (if not nil)
+func (ov *Overlay) ibufs() []*ixbuf.T {
+	if ov.mut == nil {
+		return ov.layers
+	}
+	return append(ov.layers[:len(ov.layers):len(ov.layers)], ov.mut)
+}
+
 //-------------------------------------------------------------------
 
 func (ov *Overlay) StorSize() int {
@@ -185,6 +263,14 @@ func (ov *Overlay) UpdateWith(latest *Overlay) {
 	assert.That(len(ov.layers) >= 2)
 }
 
+// Freeze returns an immutable Overlay with the changes from mut
+// as its base ixbuf. ov must be a Mutable of an Overlay with no changes.
+// It is used to catch up an index that was built from a snapshot.
+func (ov *Overlay) Freeze() *Overlay {
+	assert.That(ov.mut != nil && len(ov.layers) == 1 && ov.layers[0].Len() == 0)
+	return &Overlay{fb: ov.fb, layers: []*ixbuf.T{ov.mut}}
+}
+
 //-------------------------------------------------------------------
 
 type MergeResult = *ixbuf.T
@@ -203,6 +289,22 @@ func (ov *Overlay) WithMerged(mr MergeResult, nmerged int) *Overlay {
 	return &Overlay{fb: ov.fb, layers: layers}
 }
 
+// Nlayers returns the number of ixbuf layers (not including mut)
+func (ov *Overlay) Nlayers() int {
+	return len(ov.layers)
+}
+
+// Flatten returns an Overlay with all the layers merged into the base ixbuf.
+// It is used by schema changes.
+func (ov *Overlay) Flatten() *Overlay {
+	assert.That(ov.mut == nil)
+	if len(ov.layers) <= 1 {
+		return ov
+	}
+	n := len(ov.layers) - 1
+	return ov.WithMerged(ov.Merge(n), n)
+}
+
 //-------------------------------------------------------------------
 
 type SaveResult = *fbtree.T
@@ -154,3 +154,120 @@ func checkData(t *testing.T, bi *ixbuf.T, data []string) {
 	}
 	assert.T(t).This(n).Is(len(data))
 }
+
+func TestOverlayIterator(t *testing.T) {
+	assert := assert.T(t)
+	o2k := map[uint64]string{}
+	k2o := map[string]uint64{}
+	fbtree.GetLeafKey = func(_ *stor.Stor, _ *ixkey.Spec, off uint64) string {
+		return o2k[off]
+	}
+	defer func(mns int) { fbtree.MaxNodeSize = mns }(fbtree.MaxNodeSize)
+	fbtree.MaxNodeSize = 64
+	nextOff := uint64(0)
+	newOff := func(key string) uint64 {
+		nextOff++
+		o2k[nextOff] = key
+		k2o[key] = nextOff
+		return nextOff
+	}
+	randKey := str.UniqueRandomOf(3, 6, "abcdef")
+	var keys []string
+	for i := 0; i < 200; i++ {
+		keys = append(keys, randKey())
+	}
+	sort.Strings(keys)
+	bldr := fbtree.Builder(stor.HeapStor(8192))
+	for _, key := range keys {
+		bldr.Add(key, newOff(key))
+	}
+	ov := &Overlay{fb: bldr.Finish(), layers: []*ixbuf.T{{}}}
+	ov = ov.Mutable()
+	// randomly add, update, and delete in base layer and mutable
+	for _, ib := range []*ixbuf.T{ov.layers[0], ov.mut} {
+		for i := 0; i < 100; i++ {
+			switch rand.Intn(3) {
+			case 0:
+				key := randKey()
+				ib.Insert(key, newOff(key))
+			case 1:
+				key := keys[rand.Intn(len(keys))]
+				if _, ok := k2o[key]; ok {
+					ib.Update(key, newOff(key))
+				}
+			case 2:
+				key := keys[rand.Intn(len(keys))]
+				if off, ok := k2o[key]; ok {
+					ib.Delete(key, off)
+					delete(k2o, key)
+				}
+			}
+		}
+	}
+	keys = keys[:0]
+	for key := range k2o {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		assert.This(ov.Lookup(key)).Is(k2o[key])
+	}
+	assert.This(ov.Lookup("z")).Is(0)
+
+	it := ov.Iterator()
+	test := func(key string) {
+		k, o := it.Cur()
+		assert.This(k).Is(key)
+		assert.This(o).Is(k2o[key])
+	}
+	for _, key := range keys {
+		it.Next()
+		test(key)
+	}
+	it.Next()
+	assert.That(it.Eof())
+	it.Rewind()
+	for i := len(keys) - 1; i >= 0; i-- {
+		it.Prev()
+		test(keys[i])
+	}
+	it.Prev()
+	assert.That(it.Eof())
+
+	// change direction
+	it.Rewind()
+	for i := 0; i < 10; i++ {
+		it.Next()
+	}
+	it.Prev()
+	test(keys[8])
+	it.Next()
+	test(keys[9])
+
+	// ranges
+	for i := 0; i < 100; i++ {
+		org := randKey()
+		end := org + "c"
+		it.Range(ixkey.Range{Org: org, End: end})
+		var expected []string
+		for _, key := range keys {
+			if org <= key && key < end {
+				expected = append(expected, key)
+			}
+		}
+		for _, key := range expected {
+			it.Next()
+			test(key)
+		}
+		it.Next()
+		assert.That(it.Eof())
+		it.Rewind()
+		for i := len(expected) - 1; i >= 0; i-- {
+			it.Prev()
+			test(expected[i])
+		}
+		it.Prev()
+		assert.That(it.Eof())
+	}
+}
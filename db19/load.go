@@ -15,6 +15,7 @@ import (
 	"github.com/apmckinlay/gsuneido/db19/index"
 	"github.com/apmckinlay/gsuneido/db19/index/fbtree"
 	"github.com/apmckinlay/gsuneido/db19/meta"
+	"github.com/apmckinlay/gsuneido/db19/meta/schema"
 	"github.com/apmckinlay/gsuneido/db19/stor"
 	"github.com/apmckinlay/gsuneido/util/assert"
 	"github.com/apmckinlay/gsuneido/util/cksum"
@@ -144,26 +145,41 @@ func buildIndexes(ts *meta.Schema, list *sortlist.Builder, store *stor.Stor, nre
 	ts.Ixspecs()
 	ov := make([]*index.Overlay, len(ts.Indexes))
 	for i := range ts.Indexes {
-		ix := ts.Indexes[i]
+		ix := &ts.Indexes[i]
 		trace(ix)
-		if i > 0 || ix.Mode != 'k' {
-			list.Sort(mkcmp(store, &ix.Ixspec))
-		}
 		before := store.Size()
-		bldr := fbtree.Builder(store)
-		iter := list.Iter()
-		n := 0
-		for off := iter(); off != 0; off = iter() {
-			bldr.Add(getLeafKey(store, &ix.Ixspec, off), off)
-			n++
-		}
-		ov[i] = index.OverlayFor(bldr.Finish())
-		assert.This(n).Is(nrecs)
+		ov[i] = buildIndex(ix, i > 0 || ix.Mode != 'k', list, store, nrecs)
 		trace("size", store.Size()-before)
 	}
 	return ov
 }
 
+// buildIndex creates an index from a list of record offsets.
+// If sort is false the list must already be in key order.
+func buildIndex(ix *schema.Index, sort bool, list *sortlist.Builder,
+	store *stor.Stor, nrecs int) *index.Overlay {
+	if sort {
+		list.Sort(mkcmp(store, &ix.Ixspec))
+	}
+	bldr := fbtree.Builder(store)
+	iter := list.Iter()
+	n := 0
+	prev := ""
+	for off := iter(); off != 0; off = iter() {
+		key := getLeafKey(store, &ix.Ixspec, off)
+		if n > 0 && key == prev {
+			panic("duplicate key: " + strings.Join(ix.Columns, ","))
+		}
+		bldr.Add(key, off)
+		prev = key
+		n++
+	}
+	assert.This(n).Is(nrecs)
+	ov := index.OverlayFor(bldr.Finish())
+	ov.SetIxspec(&ix.Ixspec)
+	return ov
+}
+
 func ck(err error) {
 	if err != nil {
 		panic(err.Error())
@@ -7,6 +7,7 @@ import (
 	"github.com/apmckinlay/gsuneido/db19/index"
 	"github.com/apmckinlay/gsuneido/db19/stor"
 	"github.com/apmckinlay/gsuneido/util/hash"
+	"github.com/apmckinlay/gsuneido/util/ints"
 )
 
 type Info struct {
@@ -83,6 +84,13 @@ type MergeUpdate struct {
 func (m *Meta) Merge(table string, nmerge int) MergeUpdate {
 	// fmt.Println("Merge", table, tns)
 	ti := m.info.MustGet(table)
+	if len(ti.Indexes) > 0 {
+		// a schema change may have flattened the layers
+		nmerge = ints.Min(nmerge, ti.Indexes[0].Nlayers()-1)
+	}
+	if nmerge == 0 {
+		return MergeUpdate{table: table}
+	}
 	results := make([]MergeResult, len(ti.Indexes))
 	for j, ov := range ti.Indexes {
 		results[j] = ov.Merge(nmerge)
@@ -95,6 +103,9 @@ func (m *Meta) ApplyMerge(updates []MergeUpdate) {
 	t2 := m.info.Mutable()
 	for _, up := range updates {
 		// fmt.Println("applyMerge", up.table)
+		if up.nmerged == 0 {
+			continue
+		}
 		ti := *t2.MustGet(up.table)                          // copy
 		ti.Indexes = append(ti.Indexes[:0:0], ti.Indexes...) // copy
 		for i, ov := range ti.Indexes {
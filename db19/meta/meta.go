@@ -102,12 +102,22 @@ func (m *Meta) DropTable(table string) *Meta {
 	return &ov2
 }
 
+// ForEachSchema calls fn for each table, skipping dropped tables
 func (m *Meta) ForEachSchema(fn func(*Schema)) {
-	m.schema.ForEach(fn)
+	m.schema.ForEach(func(ts *Schema) {
+		if !ts.isTomb() {
+			fn(ts)
+		}
+	})
 }
 
+// ForEachInfo calls fn for each table, skipping dropped tables
 func (m *Meta) ForEachInfo(fn func(*Info)) {
-	m.info.ForEach(fn)
+	m.info.ForEach(func(ti *Info) {
+		if !ti.isTomb() {
+			fn(ti)
+		}
+	})
 }
 
 //-------------------------------------------------------------------
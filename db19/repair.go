@@ -11,8 +11,12 @@ import (
 	"os"
 	"time"
 
+	"github.com/apmckinlay/gsuneido/db19/index"
 	"github.com/apmckinlay/gsuneido/db19/meta"
 	"github.com/apmckinlay/gsuneido/db19/stor"
+	"github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/cksum"
+	"github.com/apmckinlay/gsuneido/util/sortlist"
 )
 
 const dtfmt = "20060102.150405"
@@ -20,6 +24,13 @@ const dtfmt = "20060102.150405"
 func Repair(dbfile string, err error) error {
 	ec, _ := err.(*ErrCorrupt)
 	fmt.Println("repair", err, ec.Table())
+	if ec.Table() != "" {
+		err := rebuild(dbfile, ec.Table())
+		if err == nil {
+			return nil
+		}
+		fmt.Println("rebuild failed", err)
+	}
 	store, err := stor.MmapStor(dbfile, stor.READ)
 	if err != nil {
 		return err
@@ -47,6 +58,110 @@ func Repair(dbfile string, err error) error {
 	}
 }
 
+// rebuild attempts to fix the most recent state
+// by rebuilding the indexes of the damaged tables from their data records.
+// Unlike truncating, this keeps all the commits.
+// It fails if the most recent state can't be read
+// or if no index of a damaged table gives intact data records.
+func rebuild(dbfile string, table string) (err error) {
+	store, err := stor.MmapStor(dbfile, stor.UPDATE)
+	if err != nil {
+		return err
+	}
+	off, state, _ := prevState(store, store.Size())
+	if state == nil {
+		store.Close()
+		return errors.New("no readable state")
+	}
+	db, err := openState(store, stor.UPDATE, off, false)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			err = newErrCorrupt(e)
+		}
+		if err != nil && db.store != nil {
+			db.store.Close() // don't write a state
+		}
+	}()
+	rebuilt := map[string]bool{}
+	for table != "" && !rebuilt[table] {
+		fmt.Println("rebuilding", table)
+		rebuildTable(db, table)
+		rebuilt[table] = true
+		ec := checkState(db.GetState(), table)
+		if ec == nil {
+			db.Close()
+			return nil
+		}
+		table = ec.Table()
+		err = ec
+	}
+	return err
+}
+
+// rebuildTable replaces the indexes of a table with ones built
+// (the same as load) from the records of an intact index.
+// It prefers an index whose count matches the table's Nrows,
+// otherwise it uses the largest intact index.
+func rebuildTable(db *Database, table string) {
+	state := db.GetState()
+	ts := *state.meta.GetRoSchema(table) // copy
+	ts.Indexes = append(ts.Indexes[:0:0], ts.Indexes...)
+	ts.Ixspecs()
+	info := state.meta.GetRoInfo(table)
+	var list *sortlist.Builder
+	nrecs := -1
+	var size uint64
+	for _, ix := range info.Indexes {
+		if l, n, sz, ok := tableRecords(db.store, ix); ok {
+			if n == info.Nrows {
+				list, nrecs, size = l, n, sz
+				break
+			}
+			if n > nrecs {
+				list, nrecs, size = l, n, sz
+			}
+		}
+	}
+	if list == nil {
+		panic("no intact index for " + table)
+	}
+	if nrecs != info.Nrows {
+		fmt.Println("using the largest index,", nrecs, "records,",
+			"expected", info.Nrows)
+	}
+	ov := make([]*index.Overlay, len(ts.Indexes))
+	for i := range ts.Indexes {
+		ov[i] = buildIndex(&ts.Indexes[i], true, list, db.store, nrecs)
+	}
+	ti := &meta.Info{Table: table, Nrows: nrecs, Size: size, Indexes: ov}
+	db.LoadedTable(&ts, ti)
+}
+
+// tableRecords returns a list of the record offsets from an index.
+// ok is false if the index or any of the records are damaged.
+func tableRecords(store *stor.Stor, ix *index.Overlay) (
+	list *sortlist.Builder, n int, size uint64, ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			ok = false
+		}
+	}()
+	list = sortlist.NewUnsorted()
+	n = ix.Check(func(off uint64) {
+		buf := store.Data(off)
+		sz := runtime.RecLen(buf)
+		cksum.MustCheck(buf[:sz+cksum.Len])
+		size += uint64(sz)
+		list.Add(off)
+	})
+	list.Finish()
+	return list, n, size, true
+}
+
 func prevState(store *stor.Stor, off uint64) (off2 uint64, state *DbState, t time.Time) {
 	off2 = store.LastOffset(off, magic1)
 	if off2 == 0 {
@@ -88,10 +203,14 @@ func checkState(state *DbState, table string) (ec *ErrCorrupt) {
 }
 
 func truncate(dbfile string, store *stor.Stor, off uint64) error {
+	store.Close()
 	if off+uint64(stateLen) == store.Size() {
-		return nil // nothing to do
+		// e.g. after a crash the size at the start was not updated
+		if err := writeSize(dbfile, off+uint64(stateLen)); err != nil {
+			return err
+		}
+		return ensureFlat(dbfile)
 	}
-	store.Close()
 	src, err := os.Open(dbfile)
 	if err != nil {
 		return err
@@ -119,6 +238,25 @@ func truncate(dbfile string, store *stor.Stor, off uint64) error {
 	return ensureFlat(dbfile)
 }
 
+// writeSize sets the size at the start of the file
+// and truncates the file to it
+func writeSize(dbfile string, size uint64) error {
+	f, err := os.OpenFile(dbfile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, stor.SmallOffsetLen)
+	stor.WriteSmallOffset(buf, size)
+	if _, err = f.WriteAt(buf, int64(len(magic))); err != nil {
+		return err
+	}
+	if err = f.Truncate(int64(size)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
 func renameBak(from string, to string) error {
 	err := os.Remove(to + ".bak")
 	if err != nil && !os.IsNotExist(err) {
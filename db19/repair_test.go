@@ -5,7 +5,16 @@ package db19
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 	"testing"
+
+	"github.com/apmckinlay/gsuneido/db19/index"
+	"github.com/apmckinlay/gsuneido/db19/meta"
+	"github.com/apmckinlay/gsuneido/db19/meta/schema"
+	"github.com/apmckinlay/gsuneido/util/assert"
+	"github.com/apmckinlay/gsuneido/util/cksum"
+	"github.com/apmckinlay/gsuneido/util/sortlist"
 )
 
 func TestRepair(*testing.T) {
@@ -15,3 +24,111 @@ func TestRepair(*testing.T) {
 	err := Repair("../suneido.db", nil)
 	fmt.Println(err)
 }
+
+func TestRepairRebuild(t *testing.T) {
+	const nrecs = 1000
+	os.Remove("tmp.db.bak")
+	for damaged := 0; damaged < 2; damaged++ {
+		db, err := CreateDatabase("tmp.db")
+		ck(err)
+		ts := &meta.Schema{Schema: schema.Schema{
+			Table:   "mytable",
+			Columns: []string{"one", "two"},
+			Indexes: []schema.Index{
+				{Columns: []string{"one"}, Mode: 'k'},
+				{Columns: []string{"two"}, Mode: 'i'}},
+		}}
+		list := sortlist.NewUnsorted()
+		for i := 0; i < nrecs; i++ {
+			rec := mkrec(fmt.Sprintf("%06d", i), strconv.Itoa(i%7))
+			off, buf := db.store.Alloc(len(rec) + cksum.Len)
+			copy(buf, rec)
+			cksum.Update(buf)
+			list.Add(off)
+		}
+		list.Finish()
+		ov := buildIndexes(ts, list, db.store, nrecs)
+		db.LoadedTable(ts, &meta.Info{Table: "mytable", Nrows: nrecs, Indexes: ov})
+		db.Persist(&execPersistSingle{}, true)
+		// simulate losing the contents of one of the indexes
+		ov = append(ov[:0:0], ov...)
+		ov[damaged] = index.NewOverlay(db.store, &ts.Indexes[damaged].Ixspec)
+		ov[damaged].Save()
+		db.LoadedTable(ts, &meta.Info{Table: "mytable", Nrows: nrecs, Indexes: ov})
+		db.Close()
+
+		err = CheckDatabase("tmp.db")
+		assert.T(t).That(err != nil)
+		assert.T(t).This(err.(*ErrCorrupt).Table()).Is("mytable")
+		ck(Repair("tmp.db", err))
+		_, err = os.Stat("tmp.db.bak")
+		assert.T(t).That(os.IsNotExist(err)) // didn't truncate
+
+		db, err = OpenDatabase("tmp.db")
+		ck(err)
+		assert.T(t).That(db.Check() == nil)
+		assert.T(t).This(db.GetState().meta.GetRoInfo("mytable").Nrows).Is(nrecs)
+		rt := db.NewReadTran()
+		for i := 0; i < nrecs; i++ {
+			key := mkrec(fmt.Sprintf("%06d", i)).GetRaw(0)
+			assert.T(t).That(rt.Lookup("mytable", 0, key) != 0)
+		}
+		db.Close()
+		os.Remove("tmp.db")
+	}
+}
+
+func TestRebuildTableChoice(t *testing.T) {
+	assert := assert.T(t)
+	db, err := CreateDatabase("tmp.db")
+	ck(err)
+	defer os.Remove("tmp.db")
+	defer db.Close()
+	mkts := func() *meta.Schema {
+		return &meta.Schema{Schema: schema.Schema{
+			Table:   "mytable",
+			Columns: []string{"one", "two"},
+			Indexes: []schema.Index{
+				{Columns: []string{"one"}, Mode: 'k'},
+				{Columns: []string{"two"}, Mode: 'k'}},
+		}}
+	}
+	const nrecs = 10
+	var offs []uint64
+	for i := 0; i <= nrecs; i++ {
+		rec := mkrec(strconv.Itoa(i), strconv.Itoa(i))
+		off, buf := db.store.Alloc(len(rec) + cksum.Len)
+		copy(buf, rec)
+		cksum.Update(buf)
+		offs = append(offs, off)
+	}
+	build := func(nrows int) {
+		// the first index is missing the last record
+		ts := mkts()
+		ts.Ixspecs()
+		ov := make([]*index.Overlay, 2)
+		for i := range ov {
+			list := sortlist.NewUnsorted()
+			n := nrecs + i
+			for _, off := range offs[:n] {
+				list.Add(off)
+			}
+			list.Finish()
+			ov[i] = buildIndex(&ts.Indexes[i], true, list, db.store, n)
+		}
+		db.LoadedTable(ts, &meta.Info{Table: "mytable", Nrows: nrows, Indexes: ov})
+	}
+	nrows := func() int {
+		return db.GetState().meta.GetRoInfo("mytable").Nrows
+	}
+
+	// prefers the index that matches Nrows
+	build(nrecs)
+	rebuildTable(db, "mytable")
+	assert.This(nrows()).Is(nrecs)
+
+	// otherwise uses the largest
+	build(nrecs + 5)
+	rebuildTable(db, "mytable")
+	assert.This(nrows()).Is(nrecs + 1)
+}
@@ -68,6 +68,8 @@ type mergefn func(*DbState, *mergeList) []meta.MergeUpdate
 // Merge updates the base ixbuf's with the ones from transactions
 // It is called by concur.go merger.
 func (db *Database) Merge(fn mergefn, merges *mergeList) {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
 	updates := fn(db.GetState(), merges) // outside UpdateState
 	db.UpdateState(func(state *DbState) {
 		// updates := fn(state, merges)
@@ -86,6 +88,8 @@ type persistfn func(*DbState) []meta.PersistUpdate
 // flatten applies to the schema and info chains.
 func (db *Database) Persist(exec execPersist, flatten bool) uint64 {
 	// fmt.Println("Persist", flatten)
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
 	var off uint64
 	db.GetState().meta.Persist(exec.Submit) // outside UpdateState
 	updates := exec.Results()
@@ -0,0 +1,112 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package stor
+
+import (
+	"math/bits"
+	"sync"
+
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+// faultStor is an in-memory storage for testing crash recovery.
+// Only the data that has been flushed survives a crash (see Crash).
+// It can also tear a flush (see CrashDuring) and corrupt bytes.
+//
+// A flush is a series of Flush calls followed by Sync (see Stor.Flush)
+type faultStor struct {
+	heapStor
+	lock sync.Mutex
+	// disk is the flushed data
+	disk []byte
+	// syncs is the number of completed flushes
+	syncs int
+	// crashAt is the flush to crash during, 0 for none
+	crashAt int
+	// keep is how many bytes of the crashAt flush are written
+	keep    int
+	crashed bool
+}
+
+// FaultStor returns an empty in-memory stor for crash testing
+func FaultStor(chunksize int) *Stor {
+	assert.That(bits.OnesCount(uint(chunksize)) == 1)
+	fs := NewStor(&faultStor{heapStor: heapStor{chunksize}},
+		uint64(chunksize), 0)
+	fs.chunks.Store([][]byte{make([]byte, chunksize)})
+	return fs
+}
+
+func (fs *faultStor) Flush(off uint64, data []byte) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.crashed {
+		return
+	}
+	if fs.syncs+1 == fs.crashAt {
+		if len(data) >= fs.keep {
+			data = data[:fs.keep]
+			fs.crashed = true
+		}
+		fs.keep -= len(data)
+	}
+	if end := int(off) + len(data); end > len(fs.disk) {
+		fs.disk = append(fs.disk, make([]byte, end-len(fs.disk))...)
+	}
+	copy(fs.disk[off:], data)
+}
+
+func (fs *faultStor) Sync() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.syncs++
+	if fs.syncs == fs.crashAt {
+		fs.crashed = true // after the whole flush, before it returns
+	}
+}
+
+func (s *Stor) faults() *faultStor {
+	return s.impl.(*faultStor)
+}
+
+// CrashDuring makes the n'th following flush crash
+// after writing keep bytes of it, i.e. tearing the flush.
+// Nothing is flushed after the crash.
+// The stor must be from FaultStor.
+func (s *Stor) CrashDuring(n, keep int) {
+	fs := s.faults()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.crashAt = fs.syncs + n
+	fs.keep = keep
+}
+
+// Crashed returns whether a crash from CrashDuring has happened.
+// The stor must be from FaultStor.
+func (s *Stor) Crashed() bool {
+	fs := s.faults()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.crashed
+}
+
+// Corrupt inverts the flushed byte at the given offset, if any.
+// The stor must be from FaultStor.
+func (s *Stor) Corrupt(off uint64) {
+	fs := s.faults()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if off < uint64(len(fs.disk)) {
+		fs.disk[off] = ^fs.disk[off]
+	}
+}
+
+// Crash returns a copy of the data that would survive a crash at this point,
+// i.e. what has been flushed. The stor must be from FaultStor.
+func (s *Stor) Crash() []byte {
+	fs := s.faults()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return append([]byte(nil), fs.disk...)
+}
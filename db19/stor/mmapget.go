@@ -7,6 +7,8 @@ package stor
 
 import (
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 // NOTE: no provision for unmapping (same as Java)
@@ -32,3 +34,16 @@ func (ms *mmapStor) Close(size int64) {
 	ms.file.Truncate(size)
 	ms.file.Close()
 }
+
+func (ms *mmapStor) Flush(_ uint64, data []byte) {
+	if err := unix.Msync(data, unix.MS_SYNC); err != nil {
+		panic(err)
+	}
+}
+
+// Sync writes the file metadata e.g. size (see Get)
+func (ms *mmapStor) Sync() {
+	if err := ms.file.Sync(); err != nil {
+		panic(err)
+	}
+}
@@ -60,3 +60,18 @@ func (ms mmapStor) Close(size int64) {
 	ms.file.Truncate(size)
 	ms.file.Close()
 }
+
+func (ms mmapStor) Flush(_ uint64, data []byte) {
+	err := syscall.FlushViewOfFile(uintptr(unsafe.Pointer(&data[0])),
+		uintptr(len(data)))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Sync waits for the data to be written
+func (ms mmapStor) Sync() {
+	if err := ms.file.Sync(); err != nil {
+		panic(err)
+	}
+}
@@ -56,7 +56,9 @@ func MmapStor(filename string, mode Mode) (*Stor, error) {
 	if mode == READ {
 		remainder := size % MMAP_CHUNKSIZE
 		if remainder > 0 {
-			chunks[last] = chunks[last][:remainder] // last chunk not full
+			// last chunk not full, limit capacity as well as length
+			// so a corrupt size can't reslice past the end of the file
+			chunks[last] = chunks[last][:remainder:remainder]
 		}
 	}
 	// trim trailing zero bytes (from memory mapping)
@@ -47,6 +47,9 @@ type Stor struct {
 	// with at least one chunk if size is 0
 	chunks atomic.Value // [][]byte
 	lock   sync.Mutex
+	// flushed is the size at the last Flush, guarded by flushLock
+	flushed   uint64
+	flushLock sync.Mutex
 }
 
 func NewStor(impl storage, chunksize uint64, size uint64) *Stor {
@@ -54,7 +57,7 @@ func NewStor(impl storage, chunksize uint64, size uint64) *Stor {
 	assert.That(1<<shift == chunksize) // chunksize must be power of 2
 	threshold := chunksize * 3 / 4     // ???
 	return &Stor{impl: impl, chunksize: chunksize, threshold: threshold,
-		shift: shift, size: size}
+		shift: shift, size: size, flushed: size}
 }
 
 // Alloc allocates n bytes of storage and returns its Offset and byte slice
@@ -157,6 +160,48 @@ func (s *Stor) Write(off uint64, data []byte) {
 	}
 }
 
+// flushable is implemented by storage that must be flushed
+// for writes to be durable
+type flushable interface {
+	// Flush writes data (at the given offset) to permanent storage
+	Flush(off uint64, data []byte)
+	// Sync completes the flush e.g. writing file metadata
+	Sync()
+}
+
+const pageSize = 4096
+
+// Flush writes the data up to the current size to permanent storage
+// and returns the size that is durable.
+// Allocations may continue concurrently
+// but the data being flushed must not be modified.
+func (s *Stor) Flush() uint64 {
+	size := s.Size()
+	f, ok := s.impl.(flushable)
+	if !ok {
+		return size
+	}
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	chunks := s.chunks.Load().([][]byte)
+	// msync requires page alignment
+	for off := s.flushed &^ (pageSize - 1); off < size; {
+		c := s.offsetToChunk(off)
+		i := off & (s.chunksize - 1)
+		n := s.chunksize - i
+		if n > size-off {
+			n = size - off
+		}
+		f.Flush(off, chunks[c][i:i+n])
+		off += n
+	}
+	f.Sync()
+	if size > s.flushed {
+		s.flushed = size
+	}
+	return size
+}
+
 func (s *Stor) Close() {
 	s.impl.Close(int64(s.size))
 }
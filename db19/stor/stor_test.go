@@ -51,6 +51,7 @@ func TestMmapWrite(t *testing.T) {
 	for i := 0; i < N; i++ {
 		buf[i] = byte(i)
 	}
+	assert.T(t).This(ms.Flush()).Is(uint64(N))
 	ms.Close()
 
 	ms, _ = MmapStor("stor_test.tmp", UPDATE)
@@ -121,3 +122,45 @@ func TestStress(*testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestCrash(t *testing.T) {
+	assert := assert.T(t).This
+	fs := FaultStor(64)
+	_, buf := fs.Alloc(12)
+	copy(buf, "hello world!")
+	assert(len(fs.Crash())).Is(0)
+	assert(fs.Flush()).Is(uint64(12))
+	_, buf = fs.Alloc(60) // new chunk
+	copy(buf, "unflushed")
+	assert(string(fs.Crash())).Is("hello world!")
+	fs.Flush()
+	data := fs.Crash()
+	assert(len(data)).Is(124)
+	assert(string(data[64:73])).Is("unflushed")
+
+	fs.Corrupt(0)
+	assert(string(fs.Crash()[:5])).Is("\x97ello")
+}
+
+func TestCrashDuring(t *testing.T) {
+	assert := assert.T(t).This
+	fs := FaultStor(64)
+	_, buf := fs.Alloc(40)
+	copy(buf, "first")
+	fs.CrashDuring(2, 67)
+	fs.Flush()
+	assert(fs.Crashed()).Is(false)
+	_, buf = fs.Alloc(40) // new chunk
+	copy(buf, "second")
+	// the flush restarts from offset 0 (page aligned)
+	// so it writes the first chunk and 3 bytes of the second
+	fs.Flush()
+	assert(fs.Crashed()).Is(true)
+	_, buf = fs.Alloc(10)
+	copy(buf, "lost")
+	fs.Flush()
+	data := fs.Crash()
+	assert(len(data)).Is(67)
+	assert(string(data[:5])).Is("first")
+	assert(string(data[64:])).Is("sec")
+}
@@ -4,7 +4,12 @@
 package db19
 
 import (
+	"strings"
+
+	"github.com/apmckinlay/gsuneido/db19/index"
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
 	"github.com/apmckinlay/gsuneido/db19/meta"
+	"github.com/apmckinlay/gsuneido/db19/stor"
 	rt "github.com/apmckinlay/gsuneido/runtime"
 	"github.com/apmckinlay/gsuneido/util/cksum"
 )
@@ -12,6 +17,19 @@ import (
 type tran struct {
 	db   *Database
 	meta *meta.Meta
+	// store is from the same state as meta.
+	// It is normally db.store, but may differ after an online Compact.
+	store *stor.Stor
+	// ended is set by end
+	ended bool
+}
+
+// end allows the store to be closed if it has been replaced by Compact
+func (t *tran) end() {
+	if !t.ended {
+		t.ended = true
+		t.db.endTran(t.store)
+	}
 }
 
 type ReadTran struct {
@@ -19,28 +37,112 @@ type ReadTran struct {
 }
 
 func (db *Database) NewReadTran() *ReadTran {
-	state := db.GetState()
-	return &ReadTran{tran: tran{db: db, meta: state.meta}}
+	state := db.startTran()
+	return &ReadTran{tran: tran{db: db, meta: state.meta, store: state.store}}
+}
+
+// Complete ends a read transaction.
+// It is not required, but otherwise, after an online Compact,
+// the old database file is not closed until the database is closed.
+func (t *ReadTran) Complete() {
+	t.end()
+}
+
+// Lookup returns the offset of the record with the given key
+// in the specified index, or 0 if the key is not found.
+func (t *tran) Lookup(table string, iIndex int, key string) uint64 {
+	return t.getIndex(table, iIndex).Lookup(key)
+}
+
+// RangeIter returns an iterator over a range of the specified index
+func (t *tran) RangeIter(table string, iIndex int,
+	rng ixkey.Range) *index.MergeIter {
+	it := t.getIndex(table, iIndex).Iterator()
+	it.Range(rng)
+	return it
+}
+
+// RangeFrac returns an estimate of the fraction of the records
+// in a range of the specified index. It is used by query optimization.
+func (t *tran) RangeFrac(table string, iIndex int, org, end string) float64 {
+	ti := t.meta.GetRoInfo(table)
+	if ti == nil {
+		panic("table not found: " + table)
+	}
+	return t.getIndex(table, iIndex).RangeFrac(org, end, ti.Nrows)
+}
+
+// GetRecord returns the record at the given offset
+func (t *tran) GetRecord(off uint64) rt.Record {
+	return offToRec(t.store, off)
+}
+
+// GetSchema returns the schema for a table, or nil if it does not exist
+func (t *tran) GetSchema(table string) *meta.Schema {
+	return t.meta.GetRoSchema(table)
+}
+
+// GetInfo returns the info for a table, or nil if it does not exist
+func (t *tran) GetInfo(table string) *meta.Info {
+	return t.meta.GetRoInfo(table)
+}
+
+func (t *tran) getIndex(table string, iIndex int) *index.Overlay {
+	ti := t.meta.GetRoInfo(table)
+	if ti == nil {
+		panic("table not found: " + table)
+	}
+	if iIndex < 0 || iIndex >= len(ti.Indexes) {
+		panic("index not found")
+	}
+	return ti.Indexes[iIndex]
+}
+
+func (t *ReadTran) Output(string, rt.Record) {
+	panic("can't output to read-only transaction")
+}
+
+func (t *ReadTran) Update(string, uint64, rt.Record) uint64 {
+	panic("can't update in read-only transaction")
+}
+
+func (t *ReadTran) Delete(string, uint64) {
+	panic("can't delete in read-only transaction")
 }
 
 type UpdateTran struct {
 	tran
 	ct *CkTran
+	// fkrefs caches the foreign key references to each table
+	fkrefs map[string][]fkref
 }
 
 func (db *Database) NewUpdateTran() *UpdateTran {
-	state := db.GetState()
-	meta := state.meta.Mutable()
+	// start the checker transaction before getting the state
+	// so that schema changes in between will be detected
 	ct := db.ck.StartTran()
-	return &UpdateTran{ct: ct, tran: tran{db: db, meta: meta}}
+	if ct == nil {
+		panic("too many overlapping update transactions")
+	}
+	state := db.startTran()
+	meta := state.meta.Mutable()
+	return &UpdateTran{ct: ct,
+		tran: tran{db: db, meta: meta, store: state.store}}
 }
 
 func (t *UpdateTran) Commit() {
+	defer t.end()
 	// send commit request to checker
 	// which starts the pipeline to merger to persister
 	t.ck(t.db.ck.Commit(t))
 }
 
+// Abort rolls back the transaction
+func (t *UpdateTran) Abort() {
+	t.end()
+	t.db.ck.Abort(t.ct)
+}
+
 // commit is internal, called by checker (to serialize)
 func (t *UpdateTran) commit() int {
 	t.db.UpdateState(func(state *DbState) {
@@ -53,17 +155,33 @@ func (t *UpdateTran) num() int {
 	return t.ct.start
 }
 
+// Lookup is the same as tran.Lookup but records the read
+// so the conflict checker can detect read/write conflicts.
+func (t *UpdateTran) Lookup(table string, iIndex int, key string) uint64 {
+	t.ck(t.db.ck.Read(t.ct, table, iIndex, key, key))
+	return t.tran.Lookup(table, iIndex, key)
+}
+
+// RangeIter is the same as tran.RangeIter but records the range read
+// so the conflict checker can detect read/write conflicts.
+func (t *UpdateTran) RangeIter(table string, iIndex int,
+	rng ixkey.Range) *index.MergeIter {
+	t.ck(t.db.ck.Read(t.ct, table, iIndex, rng.Org, rng.End))
+	return t.tran.RangeIter(table, iIndex, rng)
+}
+
 func (t *UpdateTran) Output(table string, rec rt.Record) {
 	ts := t.getSchema(table)
 	ti := t.getInfo(table)
-	n := rec.Len()
-	off, buf := t.db.store.Alloc(n + cksum.Len)
-	copy(buf, rec[:n])
-	cksum.Update(buf)
+	t.fkOutput("output", ts, rec, "")
 	keys := make([]string, len(ts.Indexes))
 	for i := range ts.Indexes {
 		is := ts.Indexes[i].Ixspec
 		keys[i] = is.Key(rec)
+		t.dupCheck(ts, i, keys[i], rec)
+	}
+	off := t.save(rec)
+	for i := range ts.Indexes {
 		ti.Indexes[i].Insert(keys[i], off)
 	}
 	t.ck(t.db.ck.Write(t.ct, table, keys))
@@ -71,6 +189,93 @@ func (t *UpdateTran) Output(table string, rec rt.Record) {
 	ti.Size += uint64(len(rec))
 }
 
+// Delete removes the record at off from all the indexes of the table.
+// Rows that reference it by a foreign key block the delete,
+// or are deleted if the foreign key cascades deletes.
+func (t *UpdateTran) Delete(table string, off uint64) {
+	ts := t.getSchema(table)
+	ti := t.getInfo(table)
+	rec := offToRec(t.store, off)
+	t.fkBlock("delete", ts, rec, "")
+	keys := make([]string, len(ts.Indexes))
+	for i := range ts.Indexes {
+		is := ts.Indexes[i].Ixspec
+		keys[i] = is.Key(rec)
+		ti.Indexes[i].Delete(keys[i], off)
+	}
+	t.ck(t.db.ck.Write(t.ct, table, keys))
+	ti.Nrows--
+	ti.Size -= uint64(len(rec))
+	t.fkCascade(ts, rec, "")
+}
+
+// Update replaces the record at oldoff with newrec.
+// Indexes where the key is unchanged just get the new offset,
+// otherwise the old key is deleted and the new key is inserted.
+// Foreign keys are handled like Output and Delete,
+// except that references are updated if the foreign key cascades updates.
+// It returns the offset of the new record.
+func (t *UpdateTran) Update(table string, oldoff uint64, newrec rt.Record) uint64 {
+	ts := t.getSchema(table)
+	ti := t.getInfo(table)
+	oldrec := offToRec(t.store, oldoff)
+	t.fkOutput("update", ts, newrec, oldrec)
+	t.fkBlock("update", ts, oldrec, newrec)
+	oldkeys := make([]string, len(ts.Indexes))
+	newkeys := make([]string, len(ts.Indexes))
+	for i := range ts.Indexes {
+		is := ts.Indexes[i].Ixspec
+		oldkeys[i] = is.Key(oldrec)
+		newkeys[i] = is.Key(newrec)
+		if oldkeys[i] != newkeys[i] {
+			t.dupCheck(ts, i, newkeys[i], newrec)
+		}
+	}
+	newoff := t.save(newrec)
+	for i := range ts.Indexes {
+		if oldkeys[i] == newkeys[i] {
+			ti.Indexes[i].Update(newkeys[i], newoff)
+		} else {
+			ti.Indexes[i].Delete(oldkeys[i], oldoff)
+			ti.Indexes[i].Insert(newkeys[i], newoff)
+		}
+	}
+	t.ck(t.db.ck.Write(t.ct, table, oldkeys))
+	t.ck(t.db.ck.Write(t.ct, table, newkeys))
+	ti.Size += uint64(len(newrec)) - uint64(len(oldrec))
+	t.fkCascade(ts, oldrec, newrec)
+	return newoff
+}
+
+// dupCheck panics if a key or unique index already contains key.
+// It uses Lookup so the read is recorded by the conflict checker
+// and a concurrent transaction outputting the same key will conflict.
+// Unique indexes allow multiple empty values
+// because Fields2 adds the key fields to empty keys.
+func (t *UpdateTran) dupCheck(ts *meta.Schema, i int, key string, rec rt.Record) {
+	ix := &ts.Indexes[i]
+	if ix.Mode != 'k' && ix.Mode != 'u' {
+		return
+	}
+	if t.Lookup(ts.Table, i, key) != 0 {
+		vals := fieldVals(ts, ix.Columns, rec)
+		for j, v := range vals {
+			vals[j] = rt.Unpack(v).String()
+		}
+		panic("duplicate key: " + ts.Table + " " +
+			strings.Join(ix.Columns, ",") + "=" + strings.Join(vals, ","))
+	}
+}
+
+// save writes a record (plus checksum) to the database store
+func (t *UpdateTran) save(rec rt.Record) uint64 {
+	n := rec.Len()
+	off, buf := t.store.Alloc(n + cksum.Len)
+	copy(buf, rec[:n])
+	cksum.Update(buf)
+	return off
+}
+
 func (t *UpdateTran) getInfo(table string) *meta.Info {
 	if ti := t.meta.GetRwInfo(table); ti != nil {
 		return ti
@@ -6,6 +6,7 @@ package db19
 import (
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -97,9 +98,173 @@ func TestTran(t *testing.T) {
 	os.Remove("tmp.db")
 }
 
+func TestDeleteUpdate(t *testing.T) {
+	assert := assert.T(t)
+	db := createDb()
+	db.ck = NewCheck()
+	commit := func(ut *UpdateTran) {
+		tables := db.ck.(*Check).commit(ut)
+		ut.commit()
+		merges := &mergeList{}
+		merges.add(tables)
+		db.Merge(mergeSingle, merges)
+		db.Persist(&execPersistSingle{}, true)
+	}
+	offs := func() []uint64 {
+		var list []uint64
+		ti := db.NewReadTran().meta.GetRoInfo("mytable")
+		iter := ti.Indexes[0].Iter(true)
+		for _, off, ok := iter(); ok; _, off, ok = iter() {
+			list = append(list, off)
+		}
+		return list
+	}
+	const nout = 10
+	ut := db.NewUpdateTran()
+	for i := 0; i < nout; i++ {
+		ut.Output("mytable", mkrec(strconv.Itoa(i), "data"))
+	}
+	commit(ut)
+	list := offs()
+	assert.This(len(list)).Is(nout)
+
+	ut = db.NewUpdateTran()
+	ut.Delete("mytable", list[1])
+	ut.Delete("mytable", list[3])
+	ut.Update("mytable", list[5], mkrec("5", "updated")) // same key
+	ut.Update("mytable", list[7], mkrec("a", "updated")) // new key
+	// output, then delete and update the new records in a separate transaction
+	ut.Output("mytable", mkrec("b", "data"))
+	ut.Output("mytable", mkrec("c", "data"))
+	commit(ut)
+	ut = db.NewUpdateTran()
+	list = offs()
+	ut.Delete("mytable", list[len(list)-2])
+	ut.Update("mytable", list[len(list)-1], mkrec("d", "data"))
+	commit(ut)
+
+	ck(db.Check())
+	ti := db.NewReadTran().meta.GetRoInfo("mytable")
+	assert.This(ti.Nrows).Is(nout - 1)
+	var data []string
+	var size uint64
+	for _, off := range offs() {
+		rec := offToRec(db.store, off)
+		data = append(data, rt.ToStr(rec.GetVal(0))+"="+rt.ToStr(rec.GetVal(1)))
+		size += uint64(len(rec))
+	}
+	assert.This(ti.Size).Is(size)
+	assert.This(strings.Join(data, " ")).
+		Is("0=data 2=data 4=data 5=updated 6=data 8=data 9=data " +
+			"a=updated d=data")
+	db.Close()
+	ck(CheckDatabase("tmp.db"))
+	os.Remove("tmp.db")
+}
+
+func TestDuplicate(t *testing.T) {
+	assert := assert.T(t)
+	db, err := CreateDatabase("tmp.db")
+	ck(err)
+	defer os.Remove("tmp.db")
+	db.ck = NewCheck()
+	DoAdmin(db, "create tbl (a,b,c) key(a) index unique(b) index(c)")
+	commit := func(ut *UpdateTran) {
+		db.ck.(*Check).commit(ut)
+		ut.commit()
+	}
+	ut := db.NewUpdateTran()
+	ut.Output("tbl", mkrec("a1", "b1", "c"))
+	ut.Output("tbl", mkrec("a2", "", "c"))
+	assert.This(func() { ut.Output("tbl", mkrec("a1", "b9", "c")) }).
+		Panics(`duplicate key: tbl a="a1"`)
+	commit(ut)
+
+	ut = db.NewUpdateTran()
+	// committed
+	assert.This(func() { ut.Output("tbl", mkrec("a1", "b9", "c")) }).
+		Panics(`duplicate key: tbl a="a1"`)
+	assert.This(func() { ut.Output("tbl", mkrec("a9", "b1", "c")) }).
+		Panics(`duplicate key: tbl b="b1"`)
+	// unique indexes allow multiple empty values
+	ut.Output("tbl", mkrec("a3", "", "c"))
+	// update
+	off := ut.Lookup("tbl", 0, mkrec("a3").GetRaw(0))
+	assert.This(func() { ut.Update("tbl", off, mkrec("a2", "", "c")) }).
+		Panics(`duplicate key: tbl a="a2"`)
+	off = ut.Update("tbl", off, mkrec("a3", "b3", "c"))
+	assert.This(func() { ut.Update("tbl", off, mkrec("a3", "b1", "c")) }).
+		Panics(`duplicate key: tbl b="b1"`)
+
+	// concurrent transactions conflict
+	defer func(b bool) { checkerAbortT1 = b }(checkerAbortT1)
+	checkerAbortT1 = true
+	ut2 := db.NewUpdateTran()
+	assert.This(func() { ut2.Output("tbl", mkrec("a3", "", "c")) }).
+		Panics("transaction aborted")
+	db.Close()
+}
+
+func TestLookupRange(t *testing.T) {
+	assert := assert.T(t)
+	db := createDb()
+	db.ck = NewCheck()
+	is := ixkey.Spec{Fields: []int{0}}
+	key := func(s string) string { return is.Key(mkrec(s)) }
+	ut := db.NewUpdateTran()
+	for _, s := range []string{"a", "c", "e", "g"} {
+		ut.Output("mytable", mkrec(s, "data"))
+	}
+	db.ck.(*Check).commit(ut)
+	ut.commit()
+
+	scan := func(it *index.MergeIter, dir func()) string {
+		s := ""
+		for dir(); !it.Eof(); dir() {
+			_, off := it.Cur()
+			s += rt.ToStr(db.NewReadTran().GetRecord(off).GetVal(0))
+		}
+		return s
+	}
+	ut = db.NewUpdateTran()
+	ut.Output("mytable", mkrec("b", "data"))
+	ut.Output("mytable", mkrec("f", "data"))
+	ut.Delete("mytable", ut.Lookup("mytable", 0, key("c")))
+	assert.This(ut.Lookup("mytable", 0, key("c"))).Is(0)
+	assert.That(ut.Lookup("mytable", 0, key("f")) != 0)
+	it := ut.RangeIter("mytable", 0, ixkey.All)
+	assert.This(scan(it, it.Next)).Is("abefg")
+	it.Rewind()
+	assert.This(scan(it, it.Prev)).Is("gfeba")
+	it = ut.RangeIter("mytable", 0, ixkey.Range{Org: key("b"), End: key("f")})
+	assert.This(scan(it, it.Next)).Is("be")
+
+	// read transactions don't see uncommitted changes
+	tran := db.NewReadTran()
+	assert.That(tran.Lookup("mytable", 0, key("c")) != 0)
+	assert.This(tran.Lookup("mytable", 0, key("f"))).Is(0)
+	it = tran.RangeIter("mytable", 0, ixkey.All)
+	assert.This(scan(it, it.Next)).Is("aceg")
+
+	// a write within a range read by another transaction conflicts
+	defer func(b bool) { checkerAbortT1 = b }(checkerAbortT1)
+	checkerAbortT1 = true
+	ut2 := db.NewUpdateTran()
+	assert.This(func() { ut2.Output("mytable", mkrec("d", "data")) }).
+		Panics("conflicted with read")
+	db.Close()
+	os.Remove("tmp.db")
+}
+
 func createDb() *Database {
 	db, err := CreateDatabase("tmp.db")
 	ck(err)
+	createTable(db)
+	return db
+}
+
+// createTable adds mytable to the database
+func createTable(db *Database) {
 	is := ixkey.Spec{Fields: []int{0}}
 	ts := &meta.Schema{Schema: schema.Schema{
 		Table:   "mytable",
@@ -113,7 +278,6 @@ func createDb() *Database {
 		Indexes: []*index.Overlay{ov},
 	}
 	db.LoadedTable(ts, ti)
-	return db
 }
 
 var recnum int32
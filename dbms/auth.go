@@ -0,0 +1,161 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package dbms
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19"
+	"github.com/apmckinlay/gsuneido/dbms/commands"
+	qry "github.com/apmckinlay/gsuneido/dbms/query"
+	. "github.com/apmckinlay/gsuneido/runtime"
+)
+
+// Authorization
+//
+// If the database has a users table, server connections must be authorized
+// before they can do anything other than the noAuth commands
+// (enough to run the login code).
+// Auth authorizes a connection with either:
+//	- a token from Token on another authorized connection
+//	  (single use, expires after tokenLife)
+//	- user + "\x00" + hash where hash is the Sha1 or Sha256
+//	  of the connection's nonce + the user's passhash from the users table
+
+const nonceSize = 8
+const tokenSize = 16
+
+// tokenLife is how long a token is valid
+var tokenLife = time.Minute
+
+// noAuth are the commands allowed on connections that are not authorized
+var noAuth = map[commands.Command]bool{
+	commands.Auth:      true,
+	commands.Compress:  true,
+	commands.LibGet:    true,
+	commands.Libraries: true,
+	commands.Log:       true,
+	commands.Nonce:     true,
+	commands.Profile:   true,
+	commands.SessionId: true,
+	commands.Timestamp: true,
+}
+
+// authRequired returns whether the database has a users table
+func authRequired(db *db19.Database) bool {
+	return getSchema(db, "users") != nil
+}
+
+// tokenSet holds the outstanding tokens and the user they were issued to.
+// It is shared by all the connections so it must be locked.
+type tokenSet struct {
+	lock   sync.Mutex
+	tokens map[string]tokenUser
+}
+
+type tokenUser struct {
+	user    string
+	expires time.Time
+}
+
+var tokens = tokenSet{tokens: make(map[string]tokenUser)}
+
+// add adds a token, removing any expired tokens
+func (ts *tokenSet) add(token, user string) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	now := time.Now()
+	for tok, tu := range ts.tokens {
+		if now.After(tu.expires) {
+			delete(ts.tokens, tok)
+		}
+	}
+	ts.tokens[token] = tokenUser{user: user, expires: now.Add(tokenLife)}
+}
+
+// clear removes all the tokens
+func (ts *tokenSet) clear() {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.tokens = make(map[string]tokenUser)
+}
+
+// use removes a token, returning its user and whether it was valid
+func (ts *tokenSet) use(token string) (string, bool) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	tu, ok := ts.tokens[token]
+	if !ok {
+		return "", false
+	}
+	delete(ts.tokens, token)
+	if time.Now().After(tu.expires) {
+		return "", false
+	}
+	return tu.user, true
+}
+
+// random returns a string of n random bytes
+func random(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic("random: " + err.Error())
+	}
+	return string(buf)
+}
+
+// auth returns the user and whether data is a valid token
+// or a valid user and password hash for nonce
+func auth(db *db19.Database, nonce, data string) (string, bool) {
+	if len(data) == tokenSize {
+		if user, ok := tokens.use(data); ok {
+			return user, true
+		}
+	}
+	if nonce == "" {
+		return "", false
+	}
+	i := strings.IndexByte(data, 0)
+	if i == -1 {
+		return "", false
+	}
+	user, hash := data[:i], data[i+1:]
+	passhash, ok := getPasshash(db, user)
+	if !ok {
+		return "", false
+	}
+	var expected []byte
+	switch len(hash) {
+	case sha1.Size:
+		h := sha1.Sum([]byte(nonce + passhash))
+		expected = h[:]
+	case sha256.Size:
+		h := sha256.Sum256([]byte(nonce + passhash))
+		expected = h[:]
+	default:
+		return "", false
+	}
+	return user, subtle.ConstantTimeCompare([]byte(hash), expected) == 1
+}
+
+// getPasshash returns the passhash for a user from the users table
+func getPasshash(db *db19.Database, user string) (string, bool) {
+	rt := db.NewReadTran()
+	defer rt.Complete()
+	if rt.GetSchema("users") == nil {
+		return "", false
+	}
+	row, hdr := qry.GetOne(rt, "users where user = "+SuStr(user).String(), Next)
+	if row == nil {
+		return "", false
+	}
+	hdr.EnsureMap()
+	return ToStr(row.Get(hdr, "passhash")), true
+}
@@ -0,0 +1,33 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package dbms
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestTokenExpiry(t *testing.T) {
+	assert := assert.T(t)
+	defer func(d time.Duration) { tokenLife = d }(tokenLife)
+	tokenLife = 10 * time.Millisecond
+	ts := tokenSet{tokens: make(map[string]tokenUser)}
+	ts.add("one", "bob")
+	ts.add("two", "sue")
+	user, ok := ts.use("one")
+	assert.That(ok)
+	assert.This(user).Is("bob")
+	_, ok = ts.use("one") // single use
+	assert.That(!ok)
+	time.Sleep(20 * time.Millisecond)
+	_, ok = ts.use("two") // expired
+	assert.That(!ok)
+	ts.add("three", "bob")
+	ts.add("four", "sue")
+	time.Sleep(20 * time.Millisecond)
+	ts.add("five", "bob") // removes the expired tokens
+	assert.This(len(ts.tokens)).Is(1)
+}
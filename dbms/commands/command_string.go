@@ -48,11 +48,15 @@ func _() {
 	_ = x[Transactions-37]
 	_ = x[Update-38]
 	_ = x[WriteCount-39]
+	_ = x[Compress-40]
+	_ = x[Profile-41]
+	_ = x[Backup-42]
+	_ = x[Compact-43]
 }
 
-const _Command_name = "AbortAdminAuthCheckCloseCommitConnectionsCursorCursorsDumpEraseExecStrategyFinalGetGet1HeaderInfoKeysKillLibGetLibrariesLoadLogNonceOrderOutputQueryReadCountRequestRewindRunSessionIdSizeTimestampTokenTransactionTransactionsUpdateWriteCount"
+const _Command_name = "AbortAdminAuthCheckCloseCommitConnectionsCursorCursorsDumpEraseExecStrategyFinalGetGet1HeaderInfoKeysKillLibGetLibrariesLoadLogNonceOrderOutputQueryReadCountRequestRewindRunSessionIdSizeTimestampTokenTransactionTransactionsUpdateWriteCountCompressProfileBackupCompact"
 
-var _Command_index = [...]uint8{0, 5, 10, 14, 19, 24, 30, 41, 47, 54, 58, 63, 67, 75, 80, 83, 87, 93, 97, 101, 105, 111, 120, 124, 127, 132, 137, 143, 148, 157, 164, 170, 173, 182, 186, 195, 200, 211, 223, 229, 239}
+var _Command_index = [...]uint16{0, 5, 10, 14, 19, 24, 30, 41, 47, 54, 58, 63, 67, 75, 80, 83, 87, 93, 97, 101, 105, 111, 120, 124, 127, 132, 137, 143, 148, 157, 164, 170, 173, 182, 186, 195, 200, 211, 223, 229, 239, 247, 254, 260, 267}
 
 func (i Command) String() string {
 	if i >= Command(len(_Command_index)-1) {
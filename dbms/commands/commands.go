@@ -51,4 +51,9 @@ const (
 	Transactions
 	Update
 	WriteCount
+	// the following are only in gSuneido
+	Compress
+	Profile
+	Backup
+	Compact
 )
@@ -5,6 +5,7 @@ package csio
 
 import (
 	"bufio"
+	"compress/zlib"
 	"io"
 	"log"
 
@@ -22,13 +23,113 @@ import (
 type ReadWrite struct {
 	r *bufio.Reader
 	w *bufio.Writer
+	// out is what w writes to
+	out *output
+	// zw is set by Compress
+	zw *zlib.Writer
+	// errfn is called for i/o errors, the default is fatal (for the client)
+	errfn func(error)
+	// cnt counts the bytes on the connection, for profiling
+	cnt *counter
+	// cmd and arg are the last command and its first string argument,
+	// for profiling
+	cmd commands.Command
+	arg string
+	// argFrom is put for the client, get for the server, or 0 when done
+	argFrom byte
+}
+
+// counter counts the bytes read and written
+type counter struct {
+	rw      io.ReadWriter
+	read    int64
+	written int64
+}
+
+func (c *counter) Read(buf []byte) (int, error) {
+	n, err := c.rw.Read(buf)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *counter) Write(buf []byte) (int, error) {
+	n, err := c.rw.Write(buf)
+	c.written += int64(n)
+	return n, err
+}
+
+// output passes the buffered output to dst, the connection or zw.
+// n is the number of bytes passed since the last Flush,
+// i.e. from the buffer overflowing.
+type output struct {
+	dst io.Writer
+	n   int
+}
+
+func (o *output) Write(buf []byte) (int, error) {
+	n, err := o.dst.Write(buf)
+	o.n += n
+	return n, err
 }
 
 const maxio = 1024 * 1024 // 1 mb
 
 // NewReadWrite returns a new ReadWrite
 func NewReadWrite(rw io.ReadWriter) *ReadWrite {
-	return &ReadWrite{r: bufio.NewReader(rw), w: bufio.NewWriter(rw)}
+	cnt := &counter{rw: rw}
+	out := &output{dst: cnt}
+	return &ReadWrite{r: bufio.NewReader(cnt), w: bufio.NewWriter(out),
+		out: out, cnt: cnt, errfn: fatal}
+}
+
+// Counts returns the number of bytes read and written on the connection
+// (after compression)
+func (rw *ReadWrite) Counts() (read, written int64) {
+	return rw.cnt.read, rw.cnt.written
+}
+
+// LastRequest returns the command and the (abbreviated) first string argument
+// of the last request sent or received
+func (rw *ReadWrite) LastRequest() (commands.Command, string) {
+	return rw.cmd, rw.arg
+}
+
+const (
+	put = 'p'
+	get = 'g'
+)
+
+// request records the command for LastRequest
+func (rw *ReadWrite) request(cmd commands.Command, from byte) {
+	rw.cmd, rw.arg, rw.argFrom = cmd, "", from
+}
+
+// argument records the first string argument for LastRequest
+func (rw *ReadWrite) argument(s string, from byte) {
+	if rw.argFrom == from {
+		rw.arg, rw.argFrom = abbrev(s), 0
+	}
+}
+
+// Compress switches to zlib compression in both directions.
+// Both ends must call it at the same point in the protocol.
+// zlib.NewReader reads the header, so each end writes its header first,
+// otherwise they would both wait for the other.
+func (rw *ReadWrite) Compress() {
+	rw.Flush()
+	rw.zw = zlib.NewWriter(rw.out.dst)
+	rw.out.dst = rw.zw
+	rw.Flush()
+	zr, err := zlib.NewReader(rw.r)
+	rw.ck(err)
+	rw.r = bufio.NewReader(zr)
+}
+
+// OnError sets the function to call for i/o errors.
+// The server uses this so a lost connection doesn't end the process.
+func (rw *ReadWrite) OnError(fn func(error)) *ReadWrite {
+	rw.errfn = fn
+	return rw
 }
 
 // PutCmd writes a command byte
@@ -36,6 +137,7 @@ func (rw *ReadWrite) PutCmd(cmd commands.Command) *ReadWrite {
 	if options.Trace&options.TraceClientServer != 0 {
 		Trace(">>>", cmd)
 	}
+	rw.request(cmd, put)
 	rw.w.WriteByte(byte(cmd))
 	return rw
 }
@@ -64,6 +166,7 @@ func (rw *ReadWrite) PutStr(s string) *ReadWrite {
 	if options.Trace&options.TraceClientServer != 0 {
 		Trace(s)
 	}
+	rw.argument(s, put)
 	return rw
 }
 
@@ -75,6 +178,12 @@ func (rw *ReadWrite) PutRec(r Record) *ReadWrite {
 	return rw
 }
 
+// PutRaw writes a string without a size prefix (e.g. for LibGet)
+func (rw *ReadWrite) PutRaw(s string) *ReadWrite {
+	rw.w.WriteString(s)
+	return rw
+}
+
 // PutInt writes a zig zag encoded varint
 func (rw *ReadWrite) PutInt(i int) *ReadWrite {
 	return rw.PutInt64(int64(i))
@@ -101,7 +210,7 @@ func (rw *ReadWrite) PutVal(v Value) *ReadWrite {
 
 // GetBool reads a boolean
 func (rw *ReadWrite) GetBool() bool {
-	b := rw.getByte()
+	b := rw.GetByte()
 	switch b {
 	case 0:
 		return false
@@ -112,18 +221,30 @@ func (rw *ReadWrite) GetBool() bool {
 	}
 }
 
-func (rw *ReadWrite) getByte() byte {
+// GetByte reads a byte
+func (rw *ReadWrite) GetByte() byte {
 	b, err := rw.r.ReadByte()
-	ck(err)
+	rw.ck(err)
 	return b
 }
 
-func ck(err error) {
+// GetCmd reads a command byte
+func (rw *ReadWrite) GetCmd() commands.Command {
+	cmd := commands.Command(rw.GetByte())
+	rw.request(cmd, get)
+	return cmd
+}
+
+func (rw *ReadWrite) ck(err error) {
 	if err != nil {
-		log.Fatalln("client:", err)
+		rw.errfn(err)
 	}
 }
 
+func fatal(err error) {
+	log.Fatalln("client:", err)
+}
+
 // GetInt reads a zig zag encoded varint
 func (rw *ReadWrite) GetInt() int {
 	n := rw.GetInt64()
@@ -136,7 +257,7 @@ func (rw *ReadWrite) GetInt64() int64 {
 	shift := uint(0)
 	n := uint64(0)
 	for {
-		b := rw.getByte()
+		b := rw.GetByte()
 		n |= uint64(b&0x7f) << shift
 		shift += 7
 		if 0 == (b & 0x80) {
@@ -152,7 +273,7 @@ func (rw *ReadWrite) GetInt64() int64 {
 func (rw *ReadWrite) GetN(n int) string {
 	buf := make([]byte, n)
 	_, err := io.ReadFull(rw.r, buf)
-	ck(err)
+	rw.ck(err)
 	return hacks.BStoS(buf) // safe since buf doesn't escape
 }
 
@@ -164,7 +285,9 @@ func (rw *ReadWrite) GetSize() int {
 // GetStr reads a size prefixed string
 func (rw *ReadWrite) GetStr() string {
 	n := rw.GetSize()
-	return rw.GetN(n)
+	s := rw.GetN(n)
+	rw.argument(s, get)
+	return s
 }
 
 // GetVal reads a packed value
@@ -180,9 +303,23 @@ func (rw *ReadWrite) ValueResult() Value {
 	return nil
 }
 
-// Flush flushes the Writer
+// Flush flushes the Writer (and the compression if any)
 func (rw *ReadWrite) Flush() {
-	rw.w.Flush()
+	rw.ck(rw.w.Flush())
+	if rw.zw != nil {
+		rw.ck(rw.zw.Flush())
+	}
+	rw.out.n = 0
+}
+
+// ResetWrite discards any buffered output that has not been flushed.
+// The server uses this to discard a partial response after an error.
+// It returns false if the buffer overflowed since the last Flush,
+// in which case part of the output has already been sent
+// and the connection can not continue.
+func (rw *ReadWrite) ResetWrite() bool {
+	rw.w.Reset(rw.out)
+	return rw.out.n == 0
 }
 
 // limit panics if the size is negative or greater than maxio
@@ -196,7 +333,7 @@ func limit(n int64) int {
 // Request does Flush and GetBool for the result.
 // If the result is false, it does GetStr for the error and panics with it.
 func (rw *ReadWrite) Request() {
-	ck(rw.w.Flush())
+	rw.Flush()
 	if !rw.GetBool() {
 		err := rw.GetStr()
 		if options.Trace&options.TraceClientServer != 0 {
@@ -5,8 +5,13 @@ package csio
 
 import (
 	"bytes"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/apmckinlay/gsuneido/dbms/commands"
 	"github.com/apmckinlay/gsuneido/util/assert"
 )
 
@@ -44,3 +49,83 @@ func TestStr(t *testing.T) {
 	rw.Flush()
 	assert.T(t).This(func() { rw.GetStr() }).Panics("bad io size")
 }
+
+func TestCompress(t *testing.T) {
+	assert := assert.T(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.That(err == nil)
+	defer l.Close()
+	done := make(chan bool)
+	big := strings.Repeat("hello world ", 10000)
+	var nread int64
+	go func() {
+		conn, err := l.Accept()
+		assert.That(err == nil)
+		defer conn.Close()
+		server := NewReadWrite(countReader{conn, &nread})
+		assert.This(server.GetStr()).Is("before")
+		server.Compress()
+		assert.This(server.GetStr()).Is(big)
+		server.PutStr("after").Flush()
+		done <- true
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.That(err == nil)
+	defer conn.Close()
+	client := NewReadWrite(conn)
+	client.PutStr("before").Flush()
+	client.Compress()
+	client.PutStr(big).Flush()
+	assert.This(client.GetStr()).Is("after")
+	<-done
+	assert.That(atomic.LoadInt64(&nread) < int64(len(big)/10))
+}
+
+func TestProfile(t *testing.T) {
+	assert := assert.T(t)
+	var buf bytes.Buffer
+	rw := NewReadWrite(&buf)
+	rw.PutCmd(commands.Query).PutInt(1).PutStr("tables\nwhere table = 1").
+		PutStr("second").Flush()
+	cmd, arg := rw.LastRequest()
+	assert.This(cmd).Is(commands.Query)
+	assert.This(arg).Is("tables...")
+	_, written := rw.Counts()
+	assert.This(written).Is(buf.Len())
+	assert.This(rw.GetCmd()).Is(commands.Query)
+	rw.GetInt()
+	assert.This(rw.GetStr()).Is("tables\nwhere table = 1")
+	rw.GetStr()
+	cmd, arg = rw.LastRequest()
+	assert.This(cmd).Is(commands.Query)
+	assert.This(arg).Is("tables...")
+
+	rt := &RoundTrip{Cmd: commands.Get1, Arg: "tables", ReqBytes: 12,
+		RespBytes: 100, Total: 3 * time.Millisecond,
+		Server: 1 * time.Millisecond, Who: "MyFunc"}
+	assert.This(rt.String()).Is(`Get1 "tables" 12/100 bytes 3ms ` +
+		`(server 1ms network 2ms) MyFunc`)
+	rt.Server = -1
+	assert.This(rt.String()).Is(`Get1 "tables" 12/100 bytes 3ms MyFunc`)
+
+	ProfileReset()
+	Profile("client", rt)
+	Profile("client", rt)
+	s := ProfileSummary()
+	assert.That(strings.Contains(s, "client Get1"))
+	assert.That(strings.Contains(s, " 2 "))
+	ProfileReset()
+	assert.That(!strings.Contains(ProfileSummary(), "Get1"))
+}
+
+// countReader counts the bytes read from the connection
+type countReader struct {
+	net.Conn
+	n *int64
+}
+
+func (cr countReader) Read(buf []byte) (int, error) {
+	n, err := cr.Conn.Read(buf)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
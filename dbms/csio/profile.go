@@ -0,0 +1,146 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package csio
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/dbms/commands"
+	"github.com/apmckinlay/gsuneido/options"
+	. "github.com/apmckinlay/gsuneido/runtime"
+)
+
+// Protocol profiling
+//
+// If options.TraceProtocol is set, the client and the server
+// each Trace one line per round trip
+// and accumulate a per command summary (see ProfileSummary).
+// The server time comes from the server (see commands.Profile),
+// the rest of the total time is the network latency.
+
+// Profiling returns whether protocol profiling is enabled
+func Profiling() bool {
+	return options.Trace&options.TraceProtocol != 0
+}
+
+// RoundTrip is the information about one request and its response
+type RoundTrip struct {
+	Cmd commands.Command
+	// Arg is the first string argument of the request, abbreviated
+	Arg       string
+	ReqBytes  int64
+	RespBytes int64
+	// Total is the time for the request and response
+	Total time.Duration
+	// Server is the time on the server, -1 if unknown
+	Server time.Duration
+	// Who is the calling function on the client,
+	// or the session id on the server
+	Who string
+}
+
+// String returns the trace line for a round trip
+func (rt *RoundTrip) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%v", rt.Cmd)
+	if rt.Arg != "" {
+		fmt.Fprintf(&sb, " %q", rt.Arg)
+	}
+	fmt.Fprintf(&sb, " %d/%d bytes %v", rt.ReqBytes, rt.RespBytes,
+		rt.Total.Round(time.Microsecond))
+	if rt.Server >= 0 && rt.Server != rt.Total {
+		fmt.Fprintf(&sb, " (server %v network %v)",
+			rt.Server.Round(time.Microsecond),
+			(rt.Total - rt.Server).Round(time.Microsecond))
+	}
+	if rt.Who != "" {
+		sb.WriteString(" " + rt.Who)
+	}
+	return sb.String()
+}
+
+// cmdStats are the totals for one command (on one side)
+type cmdStats struct {
+	side      string
+	cmd       commands.Command
+	count     int
+	reqBytes  int64
+	respBytes int64
+	total     time.Duration
+	server    time.Duration
+}
+
+type profile struct {
+	lock  sync.Mutex
+	stats map[string]*cmdStats
+}
+
+var prof = profile{stats: make(map[string]*cmdStats)}
+
+// Profile traces a round trip and adds it to the summary.
+// side is "client" or "server"
+func Profile(side string, rt *RoundTrip) {
+	Trace(side, rt)
+	prof.lock.Lock()
+	defer prof.lock.Unlock()
+	key := side + rt.Cmd.String()
+	cs, ok := prof.stats[key]
+	if !ok {
+		cs = &cmdStats{side: side, cmd: rt.Cmd}
+		prof.stats[key] = cs
+	}
+	cs.count++
+	cs.reqBytes += rt.ReqBytes
+	cs.respBytes += rt.RespBytes
+	cs.total += rt.Total
+	if rt.Server > 0 {
+		cs.server += rt.Server
+	}
+}
+
+// ProfileSummary returns the per command totals,
+// largest total time first
+func ProfileSummary() string {
+	prof.lock.Lock()
+	defer prof.lock.Unlock()
+	list := make([]*cmdStats, 0, len(prof.stats))
+	for _, cs := range prof.stats {
+		list = append(list, cs)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].total > list[j].total
+	})
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-6s %-12s %8s %12s %12s %12s %12s\n", "side",
+		"command", "count", "req bytes", "resp bytes", "total", "server")
+	for _, cs := range list {
+		fmt.Fprintf(&sb, "%-6s %-12v %8d %12d %12d %12v %12v\n", cs.side,
+			cs.cmd, cs.count, cs.reqBytes, cs.respBytes,
+			cs.total.Round(time.Microsecond), cs.server.Round(time.Microsecond))
+	}
+	return sb.String()
+}
+
+// ProfileReset clears the summary
+func ProfileReset() {
+	prof.lock.Lock()
+	defer prof.lock.Unlock()
+	prof.stats = make(map[string]*cmdStats)
+}
+
+// abbrev returns a single line prefix of s for Arg
+func abbrev(s string) string {
+	const max = 60
+	if i := strings.IndexAny(s, "\r\n"); i != -1 {
+		s = s[:i] + "..."
+	}
+	if len(s) > max {
+		s = s[:max] + "..."
+	}
+	return string([]byte(s)) // copy so we don't keep a large buffer
+}
@@ -5,6 +5,8 @@ package dbms
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -19,6 +21,7 @@ import (
 	. "github.com/apmckinlay/gsuneido/runtime"
 	"github.com/apmckinlay/gsuneido/util/ascii"
 	"github.com/apmckinlay/gsuneido/util/str"
+	"github.com/apmckinlay/gsuneido/util/tlsconf"
 )
 
 // token is to authorize the next connection
@@ -27,52 +30,172 @@ var token string
 // tokenLock guards token
 var tokenLock sync.Mutex
 
+// Reconnecting
+//
+// If the connection to the server is lost (e.g. the server restarts)
+// the client reconnects, restoring the session id and re-authorizing
+// with the token. Tokens do not survive a server restart,
+// in which case the connection is not authorized
+// and the request panics with errReauth, Auth must be called again.
+// Requests that are safe to repeat are retried (see retry).
+// Otherwise, or if the request used a transaction, query, or cursor
+// from the lost connection, it panics with lostConnection
+// so the error can be caught.
+// The heartbeat detects a lost connection while the client is idle.
+
+// lostConnection is the start of the errors for a lost connection
+const lostConnection = "lost connection to server"
+
+// errReauth is returned by connect if the token was not accepted.
+// Retrying will not help.
+var errReauth = errors.New("re-authentication required")
+
+// these are variables so tests can change them
+var (
+	heartbeatInterval = time.Minute
+	heartbeatTimeout  = 10 * time.Second
+	reconnectTries    = 10
+	reconnectDelay    = time.Second
+)
+
 type dbmsClient struct {
 	*csio.ReadWrite
 	conn      net.Conn
 	sessionId string
+	addr      string
+	port      string
+	// lock serializes requests with the heartbeat
+	lock sync.Mutex
+	// gen is incremented when the connection is lost.
+	// Transactions, queries, and cursors from another gen are no longer valid.
+	gen int
+	// lastUse is the time of the last request, for the heartbeat
+	lastUse time.Time
+	// stop ends the heartbeat
+	stop chan struct{}
+	// hello is from the server, it lists optional features
+	hello string
+	// profiling is set when the server has been sent Profile
+	// so responses are followed by the server time (see do)
+	profiling bool
+	// thread is the last Thread to use this client, for profiling
+	thread *Thread
+	// pinging is set during the heartbeat request, for profiling
+	pinging bool
+	// reauth is set when the heartbeat reconnects without authorization
+	// so the next request can report it (see checkReauth)
+	reauth bool
 }
 
 // helloSize is the size of the initial connection message from the server
 // the size must match cSuneido and jSuneido
 const helloSize = 50
 
+// helloCompress in the hello means the server supports Compress
+const helloCompress = "compress"
+
+// helloProfile in the hello means the server supports Profile
+const helloProfile = "profile"
+
 func NewDbmsClient(addr string, port string) *dbmsClient {
-	conn, err := net.Dial("tcp", addr+":"+port)
-	if err != nil {
+	dc := &dbmsClient{addr: addr, port: port, stop: make(chan struct{})}
+	if err := dc.connect(); err != nil && err != errReauth {
 		checkServerStatus(addr, port)
 		cantConnect(err.Error())
 	}
-	if !checkHello(conn) {
-		cantConnect("invalid response from server")
+	go dc.heartbeat()
+	return dc
+}
+
+// connect makes the connection to the server.
+// If there was a previous connection
+// it restores the session id and re-authorizes with the token.
+func (dc *dbmsClient) connect() error {
+	conn, err := dial(dc.addr, dc.port)
+	if err != nil {
+		return err
+	}
+	hello, err := checkHello(conn)
+	if err != nil {
+		conn.Close()
+		return err
 	}
-	c := &dbmsClient{ReadWrite: csio.NewReadWrite(conn), conn: conn}
-	c.sessionId = c.SessionId("")
-	tokenLock.Lock()
-	defer tokenLock.Unlock()
-	if token != "" {
-		c.auth(token)
-		token = c.Token()
+	dc.conn = conn
+	dc.ReadWrite = csio.NewReadWrite(conn).OnError(dc.lostConn)
+	dc.hello = hello
+	dc.profiling = false
+	// each request is done separately (see do)
+	// and compression is started before profiling
+	// so the server time is not sent before the switch to compression
+	ok := dc.try(func() {
+		if options.Compress && strings.Contains(hello, helloCompress) {
+			dc.PutCmd(commands.Compress).Request()
+			dc.Compress()
+		}
+	}) && dc.do(func() {
+		dc.sessionId = dc.sessionIdReq(dc.sessionId)
+	})
+	var authErr error
+	if ok {
+		tokenLock.Lock()
+		defer tokenLock.Unlock()
+		if token != "" {
+			authed := false
+			ok = dc.do(func() { authed = dc.auth(token) })
+			if ok && authed {
+				ok = dc.do(func() { token = dc.tokenReq() })
+			} else if ok {
+				token = "" // so later connections don't try it
+				authErr = errReauth
+			}
+		}
 	}
-	return c
+	if !ok {
+		conn.Close()
+		return errors.New("connection closed by server")
+	}
+	return authErr
+}
+
+// dial connects to the server, using TLS if options.TLS is set
+func dial(addr string, port string) (net.Conn, error) {
+	if !options.TLS {
+		return net.Dial("tcp", addr+":"+port)
+	}
+	config, err := tlsconf.Client(options.TLSCA, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", addr+":"+port, config)
 }
 
 func cantConnect(s string) {
 	Fatal("Can't connect. " + s)
 }
 
-func checkHello(conn net.Conn) bool {
+// checkHello reads the hello from the server and returns it.
+// Unless options.IgnoreVersion, the server must have the same built date.
+func checkHello(conn net.Conn) (string, error) {
 	var buf [helloSize]byte
 	n, err := io.ReadFull(conn, buf[:])
 	if n != helloSize || err != nil {
-		return false
+		return "", errors.New("invalid response from server")
 	}
 	s := string(buf[:])
 	if !strings.HasPrefix(s, "Suneido ") {
-		return false
+		return "", errors.New("invalid response from server")
 	}
-	//TODO built date check
-	return true
+	if !options.IgnoreVersion {
+		built := strings.TrimPrefix(s, "Suneido ")
+		if i := strings.Index(built, "\r\n"); i != -1 {
+			built = built[:i]
+		}
+		if built != options.BuiltDate {
+			return "", errors.New("version mismatch, server is " + built +
+				", client is " + options.BuiltDate)
+		}
+	}
+	return s, nil
 }
 
 func checkServerStatus(addr string, port string) {
@@ -97,24 +220,272 @@ func checkServerStatus(addr string, port string) {
 	}
 }
 
+// lostConn handles i/o errors on the connection (see do)
+func (dc *dbmsClient) lostConn(err error) {
+	panic(connLost{err})
+}
+
+// try runs fn, returning false if the connection was lost.
+// Other panics are passed through.
+func (dc *dbmsClient) try(fn func()) (ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, lost := e.(connLost); !lost {
+				panic(e)
+			}
+			ok = false
+		}
+	}()
+	fn()
+	return true
+}
+
+// do runs a single request, returning false if the connection was lost.
+// When profiling, the response is followed by the server time
+// so fn must only do one request.
+// Other panics (e.g. errors from the server) are passed through.
+// It must be called with the lock held (except from connect).
+func (dc *dbmsClient) do(fn func()) (ok bool) {
+	var ps *profStart
+	defer func() {
+		e := recover()
+		if _, lost := e.(connLost); lost {
+			ok = false
+			return
+		}
+		if ps != nil && (e == nil || fromServer(e)) {
+			if !dc.endProfile(ps) {
+				ok = false
+				return
+			}
+		}
+		if e != nil {
+			panic(e)
+		}
+	}()
+	dc.lastUse = time.Now()
+	ps = dc.startProfile()
+	fn()
+	return true
+}
+
+// profStart is the starting time and byte counts for a request
+type profStart struct {
+	start   time.Time
+	read    int64
+	written int64
+}
+
+// startProfile sends Profile to the server the first time it's needed.
+// It returns nil if not profiling.
+func (dc *dbmsClient) startProfile() *profStart {
+	if !csio.Profiling() && !dc.profiling {
+		return nil
+	}
+	if !dc.profiling && strings.Contains(dc.hello, helloProfile) {
+		dc.PutCmd(commands.Profile).Request()
+		dc.GetInt64() // server time
+		dc.profiling = true
+	}
+	read, written := dc.Counts()
+	return &profStart{start: time.Now(), read: read, written: written}
+}
+
+// endProfile reads the server time that follows the response (if any)
+// and adds the round trip to the profile.
+// It returns false if the connection was lost.
+func (dc *dbmsClient) endProfile(ps *profStart) bool {
+	server := time.Duration(-1)
+	if dc.profiling {
+		if !dc.try(func() {
+			server = time.Duration(dc.GetInt64()) * time.Microsecond
+		}) {
+			return false
+		}
+	}
+	if csio.Profiling() {
+		read, written := dc.Counts()
+		cmd, arg := dc.LastRequest()
+		rt := &csio.RoundTrip{Cmd: cmd, Arg: arg,
+			ReqBytes: written - ps.written, RespBytes: read - ps.read,
+			Total: time.Since(ps.start), Server: server}
+		if dc.pinging {
+			rt.Who = "heartbeat"
+		} else if dc.thread != nil {
+			rt.Who = dc.thread.Caller()
+		}
+		csio.Profile("client", rt)
+	}
+	return true
+}
+
+// fromServer returns whether a panic is an error returned by the server
+// (see csio.Request) in which case the response is complete
+func fromServer(e interface{}) bool {
+	s, ok := e.(string)
+	return ok && strings.HasSuffix(s, "(from server)")
+}
+
+// SetThread is called by Thread.Dbms so profiling can report the caller
+func (dc *dbmsClient) SetThread(t *Thread) {
+	dc.thread = t
+}
+
+// retry does a request that is safe to repeat.
+// If the connection is lost it reconnects and tries again.
+func (dc *dbmsClient) retry(fn func()) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.checkReauth()
+	if dc.do(fn) {
+		return
+	}
+	dc.mustReconnect("")
+	if !dc.do(fn) {
+		dc.mustReconnect("")
+		panic(lostConnection)
+	}
+}
+
+// once does a request that is not safe to repeat.
+// If the connection is lost it reconnects
+// but panics since the request may or may not have been done.
+func (dc *dbmsClient) once(fn func()) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.checkReauth()
+	if !dc.do(fn) {
+		dc.mustReconnect("")
+		panic(lostConnection + ", request may not have completed")
+	}
+}
+
+// state does a request that uses a transaction, query, or cursor
+// from connection gen.
+// If it is from a lost connection or the connection is lost it panics.
+func (dc *dbmsClient) state(gen int, what string, fn func()) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	invalid := ", " + what + " is no longer valid"
+	dc.checkReauth()
+	if gen != dc.gen {
+		panic(lostConnection + invalid)
+	}
+	if !dc.do(fn) {
+		dc.mustReconnect(invalid)
+		panic(lostConnection + invalid)
+	}
+}
+
+// valid returns whether gen is the current connection,
+// used to ignore Abort and Close of state from a lost connection
+func (dc *dbmsClient) valid(gen int) bool {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	return gen == dc.gen
+}
+
+// mustReconnect panics if it can't reconnect
+func (dc *dbmsClient) mustReconnect(what string) {
+	if err := dc.reconnect(); err != nil {
+		panic(lostConnection + what + ", " + err.Error())
+	}
+}
+
+// checkReauth panics if the heartbeat reconnected without authorization
+func (dc *dbmsClient) checkReauth() {
+	if dc.reauth {
+		dc.reauth = false
+		panic(lostConnection + ", " + errReauth.Error())
+	}
+}
+
+// reconnect replaces a lost connection, retrying if the server is not up.
+// If the token is not accepted it returns errReauth without retrying,
+// the new connection is usable but not authorized.
+// It is called with the lock held.
+func (dc *dbmsClient) reconnect() error {
+	dc.gen++
+	dc.conn.Close()
+	var err error
+	for i := 0; i < reconnectTries; i++ {
+		if i > 0 {
+			time.Sleep(reconnectDelay)
+		}
+		if err = dc.connect(); err == nil || err == errReauth {
+			return err
+		}
+	}
+	return err
+}
+
+// heartbeat checks the connection when the client is idle
+// so a lost connection is detected and replaced
+func (dc *dbmsClient) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dc.stop:
+			return
+		case <-ticker.C:
+			dc.ping()
+		}
+	}
+}
+
+func (dc *dbmsClient) ping() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	if time.Since(dc.lastUse) < heartbeatInterval || dc.closed() {
+		return
+	}
+	conn := dc.conn
+	conn.SetDeadline(time.Now().Add(heartbeatTimeout))
+	defer conn.SetDeadline(time.Time{})
+	dc.pinging = true
+	defer func() { dc.pinging = false }()
+	if !dc.do(func() { dc.sessionIdReq("") }) {
+		// if it fails, the next request will try again
+		dc.reauth = dc.reconnect() == errReauth
+	}
+}
+
+func (dc *dbmsClient) closed() bool {
+	select {
+	case <-dc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 // Dbms interface
 
 var _ IDbms = (*dbmsClient)(nil)
 
 func (dc *dbmsClient) Admin(request string) {
-	dc.PutCmd(commands.Admin).PutStr(request).Request()
+	dc.once(func() {
+		dc.PutCmd(commands.Admin).PutStr(request).Request()
+	})
 }
 
-func (dc *dbmsClient) Auth(s string) bool {
-	if !dc.auth(s) {
-		return false
-	}
-	tokenLock.Lock()
-	defer tokenLock.Unlock()
-	if token == "" {
-		token = dc.Token()
+// Auth gets a token if it doesn't have one
+// so other connections (and reconnects) can be authorized.
+// Like connect, it locks tokenLock after the client lock.
+// Auth and Token are separate requests for profiling (see do).
+func (dc *dbmsClient) Auth(s string) (result bool) {
+	dc.once(func() { result = dc.auth(s) })
+	if result {
+		dc.once(func() {
+			tokenLock.Lock()
+			defer tokenLock.Unlock()
+			if token == "" {
+				token = dc.tokenReq()
+			}
+		})
 	}
-	return true
+	return
 }
 
 func (dc *dbmsClient) auth(s string) bool {
@@ -125,53 +496,101 @@ func (dc *dbmsClient) auth(s string) bool {
 	return dc.GetBool()
 }
 
-func (dc *dbmsClient) Check() string {
-	dc.PutCmd(commands.Check).Request()
-	return dc.GetStr()
+func (dc *dbmsClient) Backup(to string) (result string) {
+	dc.once(func() {
+		dc.PutCmd(commands.Backup).PutStr(to).Request()
+		result = dc.GetStr()
+	})
+	return
+}
+
+func (dc *dbmsClient) Check() (result string) {
+	dc.retry(func() {
+		dc.PutCmd(commands.Check).Request()
+		result = dc.GetStr()
+	})
+	return
+}
+
+func (dc *dbmsClient) Compact() (result string) {
+	dc.once(func() {
+		dc.PutCmd(commands.Compact).Request()
+		result = dc.GetStr()
+	})
+	return
 }
 
 func (dc *dbmsClient) Close() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	if !dc.closed() {
+		close(dc.stop)
+	}
 	dc.conn.Close()
 }
 
 func (dc *dbmsClient) Connections() Value {
-	dc.PutCmd(commands.Connections).Request()
-	ob := dc.GetVal().(*SuObject)
+	var ob *SuObject
+	dc.retry(func() {
+		dc.PutCmd(commands.Connections).Request()
+		ob = dc.GetVal().(*SuObject)
+	})
 	ob.SetReadOnly()
 	return ob
 }
 
 func (dc *dbmsClient) Cursor(query string) ICursor {
-	dc.PutCmd(commands.Cursor).PutStr(query).Request()
-	cn := dc.GetInt()
-	return newClientCursor(dc, cn)
+	var c ICursor
+	dc.retry(func() {
+		dc.PutCmd(commands.Cursor).PutStr(query).Request()
+		cn := dc.GetInt()
+		c = newClientCursor(dc, cn)
+	})
+	return c
 }
 
-func (dc *dbmsClient) Cursors() int {
-	dc.PutCmd(commands.Cursors).Request()
-	return dc.GetInt()
+func (dc *dbmsClient) Cursors() (result int) {
+	dc.retry(func() {
+		dc.PutCmd(commands.Cursors).Request()
+		result = dc.GetInt()
+	})
+	return
 }
 
-func (dc *dbmsClient) Dump(table string) string {
-	dc.PutCmd(commands.Dump).PutStr(table).Request()
-	return dc.GetStr()
+func (dc *dbmsClient) Dump(table string) (result string) {
+	dc.once(func() {
+		dc.PutCmd(commands.Dump).PutStr(table).Request()
+		result = dc.GetStr()
+	})
+	return
 }
 
-func (dc *dbmsClient) Exec(_ *Thread, args Value) Value {
-	dc.PutCmd(commands.Exec)
-	if options.Trace&options.TraceClientServer != 0 {
-		Trace(args)
-	}
-	dc.PutVal(args).Request()
-	return dc.ValueResult()
+func (dc *dbmsClient) Exec(_ *Thread, args Value) (result Value) {
+	dc.once(func() {
+		dc.PutCmd(commands.Exec)
+		if options.Trace&options.TraceClientServer != 0 {
+			Trace(args)
+		}
+		dc.PutVal(args).Request()
+		result = dc.ValueResult()
+	})
+	return
+}
+
+func (dc *dbmsClient) Final() (result int) {
+	dc.retry(func() {
+		dc.PutCmd(commands.Final).Request()
+		result = dc.GetInt()
+	})
+	return
 }
 
-func (dc *dbmsClient) Final() int {
-	dc.PutCmd(commands.Final).Request()
-	return dc.GetInt()
+func (dc *dbmsClient) Get(tn int, query string, dir Dir) (row Row, hdr *Header) {
+	dc.retry(func() { row, hdr = dc.get(tn, query, dir) })
+	return
 }
 
-func (dc *dbmsClient) Get(tn int, query string, dir Dir) (Row, *Header) {
+func (dc *dbmsClient) get(tn int, query string, dir Dir) (Row, *Header) {
 	dc.PutCmd(commands.Get1).PutByte(byte(dir)).PutInt(tn).PutStr(query).Request()
 	if !dc.GetBool() {
 		return nil, nil
@@ -182,43 +601,59 @@ func (dc *dbmsClient) Get(tn int, query string, dir Dir) (Row, *Header) {
 	return row, hdr
 }
 
-func (dc *dbmsClient) Info() Value {
-	dc.PutCmd(commands.Info).Request()
-	return dc.GetVal()
+func (dc *dbmsClient) Info() (result Value) {
+	dc.retry(func() {
+		dc.PutCmd(commands.Info).Request()
+		result = dc.GetVal()
+	})
+	return
 }
 
-func (dc *dbmsClient) Kill(sessionid string) int {
-	dc.PutCmd(commands.Kill).PutStr(sessionid).Request()
-	return dc.GetInt()
+func (dc *dbmsClient) Kill(sessionid string) (result int) {
+	dc.once(func() {
+		dc.PutCmd(commands.Kill).PutStr(sessionid).Request()
+		result = dc.GetInt()
+	})
+	return
 }
 
-func (dc *dbmsClient) Load(table string) int {
-	dc.PutCmd(commands.Load).PutStr(table).Request()
-	return dc.GetInt()
+func (dc *dbmsClient) Load(table string) (result int) {
+	dc.once(func() {
+		dc.PutCmd(commands.Load).PutStr(table).Request()
+		result = dc.GetInt()
+	})
+	return
 }
 
 func (dc *dbmsClient) Log(s string) {
-	dc.PutCmd(commands.Log).PutStr(s).Request()
+	dc.once(func() {
+		dc.PutCmd(commands.Log).PutStr(s).Request()
+	})
 }
 
-func (dc *dbmsClient) LibGet(name string) []string {
-	dc.PutCmd(commands.LibGet).PutStr(name).Request()
-	n := dc.GetSize()
-	v := make([]string, 2*n)
-	sizes := make([]int, n)
-	for i := 0; i < 2*n; i += 2 {
-		v[i] = dc.GetStr() // library
-		sizes[i/2] = dc.GetSize()
-	}
-	for i := 1; i < 2*n; i += 2 {
-		v[i] = dc.GetN(sizes[i/2]) // text
-	}
-	return v
+func (dc *dbmsClient) LibGet(name string) (v []string) {
+	dc.retry(func() {
+		dc.PutCmd(commands.LibGet).PutStr(name).Request()
+		n := dc.GetSize()
+		v = make([]string, 2*n)
+		sizes := make([]int, n)
+		for i := 0; i < 2*n; i += 2 {
+			v[i] = dc.GetStr() // library
+			sizes[i/2] = dc.GetSize()
+		}
+		for i := 1; i < 2*n; i += 2 {
+			v[i] = dc.GetN(sizes[i/2]) // text
+		}
+	})
+	return
 }
 
-func (dc *dbmsClient) Libraries() *SuObject {
-	dc.PutCmd(commands.Libraries).Request()
-	return dc.getStrings()
+func (dc *dbmsClient) Libraries() (ob *SuObject) {
+	dc.retry(func() {
+		dc.PutCmd(commands.Libraries).Request()
+		ob = dc.getStrings()
+	})
+	return
 }
 
 func (dc *dbmsClient) getStrings() *SuObject {
@@ -230,52 +665,86 @@ func (dc *dbmsClient) getStrings() *SuObject {
 	return ob
 }
 
-func (dc *dbmsClient) Nonce() string {
-	dc.PutCmd(commands.Nonce).Request()
-	return dc.GetStr()
+func (dc *dbmsClient) Nonce() (result string) {
+	dc.retry(func() {
+		dc.PutCmd(commands.Nonce).Request()
+		result = dc.GetStr()
+	})
+	return
 }
 
-func (dc *dbmsClient) Run(code string) Value {
-	dc.PutCmd(commands.Run).PutStr(code).Request()
-	return dc.ValueResult()
+func (dc *dbmsClient) Run(code string) (result Value) {
+	dc.once(func() {
+		dc.PutCmd(commands.Run).PutStr(code).Request()
+		result = dc.ValueResult()
+	})
+	return
 }
 
 func (dc *dbmsClient) SessionId(id string) string {
-	if id != "" || dc.sessionId == "" {
-		dc.PutCmd(commands.SessionId).PutStr(id).Request()
-		dc.sessionId = dc.GetStr()
+	// lock since reconnect (e.g. from the heartbeat) sets sessionId
+	dc.lock.Lock()
+	sid := dc.sessionId
+	dc.lock.Unlock()
+	if id != "" || sid == "" {
+		dc.retry(func() {
+			dc.sessionId = dc.sessionIdReq(id)
+			sid = dc.sessionId
+		})
 	} // else use cached value
-	return dc.sessionId
+	return sid
 }
 
-func (dc *dbmsClient) Size() int64 {
-	dc.PutCmd(commands.Size).Request()
-	return dc.GetInt64()
+func (dc *dbmsClient) sessionIdReq(id string) string {
+	dc.PutCmd(commands.SessionId).PutStr(id).Request()
+	return dc.GetStr()
 }
 
-func (dc *dbmsClient) Timestamp() SuDate {
-	dc.PutCmd(commands.Timestamp).Request()
-	return dc.GetVal().(SuDate)
+func (dc *dbmsClient) Size() (result int64) {
+	dc.retry(func() {
+		dc.PutCmd(commands.Size).Request()
+		result = dc.GetInt64()
+	})
+	return
 }
 
-func (dc *dbmsClient) Token() string {
+func (dc *dbmsClient) Timestamp() (result SuDate) {
+	dc.retry(func() {
+		dc.PutCmd(commands.Timestamp).Request()
+		result = dc.GetVal().(SuDate)
+	})
+	return
+}
+
+func (dc *dbmsClient) Token() (result string) {
+	dc.once(func() { result = dc.tokenReq() })
+	return
+}
+
+func (dc *dbmsClient) tokenReq() string {
 	dc.PutCmd(commands.Token).Request()
 	return dc.GetStr()
 }
 
 func (dc *dbmsClient) Transaction(update bool) ITran {
-	dc.PutCmd(commands.Transaction).PutBool(update).Request()
-	tn := dc.GetInt()
-	return &TranClient{dc: dc, tn: tn}
+	var tran ITran
+	dc.retry(func() {
+		dc.PutCmd(commands.Transaction).PutBool(update).Request()
+		tn := dc.GetInt()
+		tran = &TranClient{dc: dc, tn: tn, gen: dc.gen}
+	})
+	return tran
 }
 
-func (dc *dbmsClient) Transactions() *SuObject {
-	dc.PutCmd(commands.Transactions).Request()
-	ob := NewSuObject()
-	for n := dc.GetInt(); n > 0; n-- {
-		ob.Add(IntVal(dc.GetInt()))
-	}
-	return ob
+func (dc *dbmsClient) Transactions() (ob *SuObject) {
+	dc.retry(func() {
+		dc.PutCmd(commands.Transactions).Request()
+		ob = NewSuObject()
+		for n := dc.GetInt(); n > 0; n-- {
+			ob.Add(IntVal(dc.GetInt()))
+		}
+	})
+	return
 }
 
 func (dc *dbmsClient) Unuse(lib string) bool {
@@ -318,55 +787,90 @@ func (dc *dbmsClient) getRow(adr int) Row {
 type TranClient struct {
 	dc *dbmsClient
 	tn int
+	// gen is the connection the transaction is from
+	gen int
 }
 
 var _ ITran = (*TranClient)(nil)
 
-func (tc *TranClient) Abort() {
-	tc.dc.PutCmd(commands.Abort).PutInt(tc.tn).Request()
+// state does a request using the transaction
+func (tc *TranClient) state(fn func()) {
+	tc.dc.state(tc.gen, tc.String(), fn)
 }
 
-func (tc *TranClient) Complete() string {
-	tc.dc.PutCmd(commands.Commit).PutInt(tc.tn).Request()
-	if tc.dc.GetBool() {
-		return ""
+// Abort does nothing if the connection was lost
+// since the server will have aborted the transaction
+func (tc *TranClient) Abort() {
+	if !tc.dc.valid(tc.gen) {
+		return
 	}
-	return tc.dc.GetStr()
+	tc.state(func() {
+		tc.dc.PutCmd(commands.Abort).PutInt(tc.tn).Request()
+	})
+}
+
+func (tc *TranClient) Complete() (result string) {
+	tc.state(func() {
+		tc.dc.PutCmd(commands.Commit).PutInt(tc.tn).Request()
+		if !tc.dc.GetBool() {
+			result = tc.dc.GetStr()
+		}
+	})
+	return
 }
 
 func (tc *TranClient) Erase(adr int) {
-	tc.dc.PutCmd(commands.Erase).PutInt(tc.tn).PutInt(adr).Request()
+	tc.state(func() {
+		tc.dc.PutCmd(commands.Erase).PutInt(tc.tn).PutInt(adr).Request()
+	})
 }
 
-func (tc *TranClient) Get(query string, dir Dir) (Row, *Header) {
-	return tc.dc.Get(tc.tn, query, dir)
+func (tc *TranClient) Get(query string, dir Dir) (row Row, hdr *Header) {
+	tc.state(func() { row, hdr = tc.dc.get(tc.tn, query, dir) })
+	return
 }
 
 func (tc *TranClient) Query(query string) IQuery {
-	tc.dc.PutCmd(commands.Query).PutInt(tc.tn).PutStr(query).Request()
-	qn := tc.dc.GetInt()
-	return newClientQuery(tc.dc, qn)
+	var q IQuery
+	tc.state(func() {
+		tc.dc.PutCmd(commands.Query).PutInt(tc.tn).PutStr(query).Request()
+		qn := tc.dc.GetInt()
+		q = newClientQuery(tc.dc, qn)
+	})
+	return q
 }
 
-func (tc *TranClient) ReadCount() int {
-	tc.dc.PutCmd(commands.ReadCount).PutInt(tc.tn).Request()
-	return tc.dc.GetInt()
+func (tc *TranClient) ReadCount() (result int) {
+	tc.state(func() {
+		tc.dc.PutCmd(commands.ReadCount).PutInt(tc.tn).Request()
+		result = tc.dc.GetInt()
+	})
+	return
 }
 
-func (tc *TranClient) Request(request string) int {
-	tc.dc.PutCmd(commands.Request).PutInt(tc.tn).PutStr(request).Request()
-	return tc.dc.GetInt()
+func (tc *TranClient) Request(request string) (result int) {
+	tc.state(func() {
+		tc.dc.PutCmd(commands.Request).PutInt(tc.tn).PutStr(request).Request()
+		result = tc.dc.GetInt()
+	})
+	return
 }
 
-func (tc *TranClient) Update(adr int, rec Record) int {
-	tc.dc.PutCmd(commands.Update).
-		PutInt(tc.tn).PutInt(adr).PutRec(rec).Request()
-	return tc.dc.GetInt()
+func (tc *TranClient) Update(adr int, rec Record) (result int) {
+	tc.state(func() {
+		tc.dc.PutCmd(commands.Update).
+			PutInt(tc.tn).PutInt(adr).PutRec(rec).Request()
+		result = tc.dc.GetInt()
+	})
+	return
 }
 
-func (tc *TranClient) WriteCount() int {
-	tc.dc.PutCmd(commands.WriteCount).PutInt(tc.tn).Request()
-	return tc.dc.GetInt()
+func (tc *TranClient) WriteCount() (result int) {
+	tc.state(func() {
+		tc.dc.PutCmd(commands.WriteCount).PutInt(tc.tn).Request()
+		result = tc.dc.GetInt()
+	})
+	return
 }
 
 func (tc *TranClient) String() string {
@@ -382,6 +886,8 @@ type clientQueryCursor struct {
 	qc   qcType
 	hdr  *Header
 	keys *SuObject // cache
+	// gen is the connection the query or cursor is from
+	gen int
 }
 
 type qcType byte
@@ -391,47 +897,75 @@ const (
 	cursor qcType = 'c'
 )
 
+// state does a request using the query or cursor
+func (qc *clientQueryCursor) state(fn func()) {
+	what := "query"
+	if qc.qc == cursor {
+		what = "cursor"
+	}
+	qc.dc.state(qc.gen, what, fn)
+}
+
+// Close does nothing if the connection was lost
 func (qc *clientQueryCursor) Close() {
-	qc.dc.PutCmd(commands.Close).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
+	if !qc.dc.valid(qc.gen) {
+		return
+	}
+	qc.state(func() {
+		qc.dc.PutCmd(commands.Close).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
+	})
 }
 
 func (qc *clientQueryCursor) Header() *Header {
 	if qc.hdr == nil { // cached
-		qc.dc.PutCmd(commands.Header).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
-		qc.hdr = qc.dc.getHdr()
+		qc.state(func() {
+			qc.dc.PutCmd(commands.Header).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
+			qc.hdr = qc.dc.getHdr()
+		})
 	}
 	return qc.hdr
 }
 
 func (qc *clientQueryCursor) Keys() *SuObject {
 	if qc.keys == nil { // cached
-		qc.dc.PutCmd(commands.Keys).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
-		qc.keys = NewSuObject()
-		nk := qc.dc.GetInt()
-		for ; nk > 0; nk-- {
-			cb := str.CommaBuilder{}
-			n := qc.dc.GetInt()
-			for ; n > 0; n-- {
-				cb.Add(qc.dc.GetStr())
+		qc.state(func() {
+			qc.dc.PutCmd(commands.Keys).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
+			keys := NewSuObject()
+			nk := qc.dc.GetInt()
+			for ; nk > 0; nk-- {
+				cb := str.CommaBuilder{}
+				n := qc.dc.GetInt()
+				for ; n > 0; n-- {
+					cb.Add(qc.dc.GetStr())
+				}
+				keys.Add(SuStr(cb.String()))
 			}
-			qc.keys.Add(SuStr(cb.String()))
-		}
+			qc.keys = keys
+		})
 	}
 	return qc.keys
 }
 
-func (qc *clientQueryCursor) Order() *SuObject {
-	qc.dc.PutCmd(commands.Order).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
-	return qc.dc.getStrings()
+func (qc *clientQueryCursor) Order() (ob *SuObject) {
+	qc.state(func() {
+		qc.dc.PutCmd(commands.Order).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
+		ob = qc.dc.getStrings()
+	})
+	return
 }
 
 func (qc *clientQueryCursor) Rewind() {
-	qc.dc.PutCmd(commands.Rewind).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
+	qc.state(func() {
+		qc.dc.PutCmd(commands.Rewind).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
+	})
 }
 
-func (qc *clientQueryCursor) Strategy() string {
-	qc.dc.PutCmd(commands.Strategy).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
-	return qc.dc.GetStr()
+func (qc *clientQueryCursor) Strategy() (result string) {
+	qc.state(func() {
+		qc.dc.PutCmd(commands.Strategy).PutInt(qc.id).PutByte(byte(qc.qc)).Request()
+		result = qc.dc.GetStr()
+	})
+	return
 }
 
 // clientQuery implements IQuery ------------------------------------
@@ -440,24 +974,27 @@ type clientQuery struct {
 }
 
 func newClientQuery(dc *dbmsClient, qn int) *clientQuery {
-	return &clientQuery{clientQueryCursor{dc: dc, id: qn, qc: query}}
+	return &clientQuery{clientQueryCursor{dc: dc, id: qn, qc: query, gen: dc.gen}}
 }
 
 var _ IQuery = (*clientQuery)(nil)
 
-func (q *clientQuery) Get(dir Dir) Row {
-	q.dc.PutCmd(commands.Get).
-		PutByte(byte(dir)).PutInt(0).PutInt(q.id).Request()
-	if !q.dc.GetBool() {
-		return nil
-	}
-	adr := q.dc.GetInt()
-	row := q.dc.getRow(adr)
-	return row
+func (q *clientQuery) Get(dir Dir) (row Row) {
+	q.state(func() {
+		q.dc.PutCmd(commands.Get).
+			PutByte(byte(dir)).PutInt(0).PutInt(q.id).Request()
+		if q.dc.GetBool() {
+			adr := q.dc.GetInt()
+			row = q.dc.getRow(adr)
+		}
+	})
+	return
 }
 
 func (q *clientQuery) Output(rec Record) {
-	q.dc.PutCmd(commands.Output).PutInt(q.id).PutRec(rec).Request()
+	q.state(func() {
+		q.dc.PutCmd(commands.Output).PutInt(q.id).PutRec(rec).Request()
+	})
 }
 
 // clientCursor implements IQuery ------------------------------------
@@ -466,18 +1003,22 @@ type clientCursor struct {
 }
 
 func newClientCursor(dc *dbmsClient, cn int) *clientCursor {
-	return &clientCursor{clientQueryCursor{dc: dc, id: cn, qc: cursor}}
+	return &clientCursor{clientQueryCursor{dc: dc, id: cn, qc: cursor, gen: dc.gen}}
 }
 
 var _ ICursor = (*clientCursor)(nil)
 
-func (q *clientCursor) Get(tran ITran, dir Dir) Row {
+func (q *clientCursor) Get(tran ITran, dir Dir) (row Row) {
 	t := tran.(*TranClient)
-	q.dc.PutCmd(commands.Get).PutByte(byte(dir)).PutInt(t.tn).PutInt(q.id).Request()
-	if !q.dc.GetBool() {
-		return nil
+	if t.gen != q.gen {
+		panic(lostConnection + ", " + t.String() + " is no longer valid")
 	}
-	adr := q.dc.GetInt()
-	row := q.dc.getRow(adr)
-	return row
+	q.state(func() {
+		q.dc.PutCmd(commands.Get).PutByte(byte(dir)).PutInt(t.tn).PutInt(q.id).Request()
+		if q.dc.GetBool() {
+			adr := q.dc.GetInt()
+			row = q.dc.getRow(adr)
+		}
+	})
+	return
 }
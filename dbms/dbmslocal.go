@@ -5,13 +5,15 @@ package dbms
 
 import (
 	"fmt"
-	"hash/adler32"
-	"io/ioutil"
 	"log"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/apmckinlay/gsuneido/db19"
+	"github.com/apmckinlay/gsuneido/db19/meta"
+	qry "github.com/apmckinlay/gsuneido/dbms/query"
 	. "github.com/apmckinlay/gsuneido/runtime"
 	"github.com/apmckinlay/gsuneido/util/str"
 )
@@ -19,46 +21,95 @@ import (
 // DbmsLocal implements the Dbms interface using a local database
 // i.e. standalone
 type DbmsLocal struct {
-	db        *db19.Database
-	libraries []string //TODO concurrency
+	db *db19.Database
+	// libraries is the list of libraries in use, starting with stdlib.
+	// It is replaced, not modified, so readers can use it without locking.
+	// It is persisted in the uselibs table.
+	libraries atomic.Value // []string
+	// libLock serializes Use and Unuse
+	libLock sync.Mutex
+	// sessionId is the standalone session id
+	sessionId atomic.Value // string
 }
 
 func NewDbmsLocal(db *db19.Database) IDbms {
-	return &DbmsLocal{db: db}
+	dbms := &DbmsLocal{db: db}
+	dbms.libraries.Store(loadLibraries(db))
+	return dbms
 }
 
 // Dbms interface
 
 var _ IDbms = (*DbmsLocal)(nil)
 
-func (DbmsLocal) Admin(string) {
-	panic("DbmsLocal Admin not implemented")
+func (dbms *DbmsLocal) Admin(request string) {
+	db19.DoAdmin(dbms.db, request)
 }
 
-func (DbmsLocal) Auth(string) bool {
+func (*DbmsLocal) Auth(string) bool {
 	panic("Auth only allowed on clients")
 }
 
-func (dbms DbmsLocal) Check() string {
+func (dbms *DbmsLocal) Backup(to string) string {
+	if _, err := dbms.db.Backup(to); err != nil {
+		return fmt.Sprint(err)
+	}
+	return ""
+}
+
+func (dbms *DbmsLocal) Check() string {
 	if err := dbms.db.Check(); err != nil {
 		return fmt.Sprint(err)
 	}
 	return ""
 }
 
-func (DbmsLocal) Connections() Value {
-	return EmptyObject
+func (dbms *DbmsLocal) Compact() string {
+	if _, err := dbms.db.Compact(); err != nil {
+		return fmt.Sprint(err)
+	}
+	return ""
+}
+
+// Connections returns the session ids of the server connections.
+// It is empty when standalone.
+func (*DbmsLocal) Connections() Value {
+	ids := serverConns.sessionIds()
+	list := make([]Value, len(ids))
+	for i, id := range ids {
+		list[i] = SuStr(id)
+	}
+	return NewSuObject(list...)
 }
 
-func (DbmsLocal) Cursor(string) ICursor {
-	panic("DbmsLocal Cursor not implemented")
+func (dbms *DbmsLocal) Cursor(query string) ICursor {
+	return dbms.cursor(query, nil)
+}
+
+// cursor is Cursor restricted by perms (nil for unrestricted).
+// The query is built with a read transaction,
+// each Get sets the transaction to use.
+func (dbms *DbmsLocal) cursor(query string, p *perms) ICursor {
+	rt := dbms.db.NewReadTran()
+	defer rt.Complete()
+	var tran qry.Tran = rt
+	if p != nil {
+		tran = permTran{Tran: tran, perms: p}
+	}
+	q := qry.NewQuery(tran, query)
+	atomic.AddInt32(&ncursors, 1)
+	return &cursorLocal{queryCursorLocal{q: q}}
 }
 
-func (DbmsLocal) Cursors() int {
-	panic("DbmsLocal Cursors not implemented")
+// ncursors is the number of open cursors
+var ncursors int32
+
+// Cursors returns the number of open cursors
+func (*DbmsLocal) Cursors() int {
+	return int(atomic.LoadInt32(&ncursors))
 }
 
-func (dbms DbmsLocal) Dump(table string) string {
+func (dbms *DbmsLocal) Dump(table string) string {
 	var err error
 	if table == "" {
 		_, err = dbms.db.Dump("database.su")
@@ -71,7 +122,7 @@ func (dbms DbmsLocal) Dump(table string) string {
 	return ""
 }
 
-func (DbmsLocal) Exec(t *Thread, v Value) Value {
+func (*DbmsLocal) Exec(t *Thread, v Value) Value {
 	fname := ToStr(ToContainer(v).ListGet(0))
 	if i := strings.IndexByte(fname, '.'); i != -1 {
 		ob := Global.GetName(t, fname[:i])
@@ -82,88 +133,128 @@ func (DbmsLocal) Exec(t *Thread, v Value) Value {
 	return t.CallEach1(fn, v)
 }
 
-func (DbmsLocal) Final() int {
+func (*DbmsLocal) Final() int {
 	panic("DbmsLocal Final not implemented")
 }
 
-func (DbmsLocal) Get(int, string, Dir) (Row, *Header) {
-	panic("DbmsLocal Get not implemented")
+func (dbms *DbmsLocal) Get(_ int, query string, dir Dir) (Row, *Header) {
+	return dbms.get(query, dir, nil)
+}
+
+// get is Get restricted by perms (nil for unrestricted)
+func (dbms *DbmsLocal) get(query string, dir Dir, p *perms) (Row, *Header) {
+	rt := dbms.db.NewReadTran()
+	defer rt.Complete()
+	var tran qry.Tran = rt
+	if p != nil {
+		tran = permTran{Tran: tran, perms: p}
+	}
+	return qry.GetOne(tran, query, dir)
 }
 
-func (DbmsLocal) Info() Value {
+func (*DbmsLocal) Info() Value {
 	panic("DbmsLocal Info not implemented")
 }
 
-func (DbmsLocal) Kill(string) int {
-	panic("DbmsLocal Kill not implemented")
+// Kill ends the server connections with the given session id,
+// rolling back their transactions.
+// It returns the number of connections.
+func (*DbmsLocal) Kill(sessionId string) int {
+	return serverConns.kill(sessionId)
 }
 
-func (DbmsLocal) Load(string) int {
+func (*DbmsLocal) Load(string) int {
 	panic("DbmsLocal Load not implemented")
 }
 
-func (DbmsLocal) LibGet(name string) (result []string) {
-	// Temporary version that reads from text files
-	defer func() {
-		if e := recover(); e != nil {
-			panic("error loading " + name + " " + fmt.Sprint(e))
+// LibGet returns the definitions of name from the libraries in use.
+// Definitions are the records with group -1,
+// other records are the folders.
+func (dbms *DbmsLocal) LibGet(name string) (result []string) {
+	rt := dbms.db.NewReadTran()
+	defer rt.Complete()
+	for _, lib := range dbms.libs() {
+		if !isLibrary(rt.GetSchema(lib)) {
+			continue
 		}
-	}()
-	dir := "../stdlib/"
-	hash := adler32.Checksum([]byte(name))
-	name = strings.ReplaceAll(name, "?", "Q")
-	file := dir + name + "_" + strconv.FormatUint(uint64(hash), 16)
-	s, err := ioutil.ReadFile(file)
-	if err != nil {
-		if !strings.HasPrefix(name, "Rule_") {
-			fmt.Println("LOAD", file, "NOT FOUND")
+		row, hdr := qry.GetOne(rt, lib+" where name = "+SuStr(name).String()+
+			" and group = -1", Next)
+		if row == nil {
+			continue
 		}
-		return nil
+		hdr.EnsureMap()
+		result = append(result, lib, ToStr(row.Get(hdr, "text")))
+	}
+	return result
+}
+
+func (dbms *DbmsLocal) Libraries() *SuObject {
+	libs := dbms.libs()
+	list := make([]Value, len(libs))
+	for i, lib := range libs {
+		list[i] = SuStr(lib)
 	}
-	// fmt.Println("LOAD", name, "SUCCEEDED")
-	return []string{"stdlib", string(s)}
+	return NewSuObject(list...)
 }
 
-func (DbmsLocal) Libraries() *SuObject {
-	return NewSuObject()
+func (dbms *DbmsLocal) libs() []string {
+	return dbms.libraries.Load().([]string)
 }
 
-func (DbmsLocal) Log(s string) {
+func (*DbmsLocal) Log(s string) {
 	log.Println(s)
 }
 
-func (DbmsLocal) Nonce() string {
+func (*DbmsLocal) Nonce() string {
 	panic("nonce only allowed on clients")
 }
 
-func (DbmsLocal) Run(string) Value {
+func (*DbmsLocal) Run(string) Value {
 	panic("DbmsLocal Run not implemented")
 }
 
-var sessionId string
-
-func (DbmsLocal) SessionId(id string) string {
+// SessionId is only used standalone,
+// server connections each have their own session id (see cmdSessionId)
+func (dbms *DbmsLocal) SessionId(id string) string {
 	if id != "" {
-		sessionId = id
+		dbms.sessionId.Store(id)
 	}
-	return sessionId
+	s, _ := dbms.sessionId.Load().(string)
+	return s
 }
 
-func (DbmsLocal) Size() int64 {
+func (*DbmsLocal) Size() int64 {
 	panic("DbmsLocal Size not implemented")
 }
 
-func (DbmsLocal) Token() string {
+func (*DbmsLocal) Token() string {
 	panic("DbmsLocal Token not implemented")
 }
 
-func (DbmsLocal) Transaction(bool) ITran {
-	panic("DbmsLocal Transaction not implemented")
+func (dbms *DbmsLocal) Transaction(update bool) ITran {
+	return dbms.transaction(update, nil)
+}
+
+// transaction is Transaction restricted by perms (nil for unrestricted)
+func (dbms *DbmsLocal) transaction(update bool, p *perms) ITran {
+	tl := &TranLocal{num: newNum()}
+	if update {
+		p.checkUpdate()
+		tl.ut = dbms.db.NewUpdateTran()
+		tl.tran = tl.ut
+	} else {
+		tl.rt = dbms.db.NewReadTran()
+		tl.tran = tl.rt
+	}
+	if p != nil {
+		tl.tran = permTran{Tran: tl.tran, perms: p}
+	}
+	return tl
 }
 
 var prevTimestamp SuDate
 
-func (DbmsLocal) Timestamp() SuDate {
+func (*DbmsLocal) Timestamp() SuDate {
 	t := Now()
 	if t.Equal(prevTimestamp) {
 		t = t.Plus(0, 0, 0, 0, 0, 0, 1)
@@ -172,26 +263,251 @@ func (DbmsLocal) Timestamp() SuDate {
 	return t
 }
 
-func (DbmsLocal) Transactions() *SuObject {
+func (*DbmsLocal) Transactions() *SuObject {
 	panic("DbmsLocal Transactions not implemented")
 }
 
-func (dbms DbmsLocal) Unuse(lib string) bool {
-	if lib == "stdlib" || !str.List(dbms.libraries).Has(lib) {
+func (dbms *DbmsLocal) Unuse(lib string) bool {
+	dbms.libLock.Lock()
+	defer dbms.libLock.Unlock()
+	libs := dbms.libs()
+	if lib == "stdlib" || !str.List(libs).Has(lib) {
 		return false
 	}
-	dbms.libraries = str.List(dbms.libraries).Without(lib)
+	dbms.setLibraries(str.List(libs).Without(lib))
 	return true
 }
 
-func (dbms DbmsLocal) Use(lib string) bool {
-	if str.List(dbms.libraries).Has(lib) {
+func (dbms *DbmsLocal) Use(lib string) bool {
+	dbms.libLock.Lock()
+	defer dbms.libLock.Unlock()
+	libs := dbms.libs()
+	if str.List(libs).Has(lib) {
 		return false
 	}
-	//TODO check schema
-	dbms.libraries = append(dbms.libraries, lib)
+	if !isLibrary(getSchema(dbms.db, lib)) {
+		panic("Use: invalid library: " + lib)
+	}
+	dbms.setLibraries(append(libs[:len(libs):len(libs)], lib))
 	return true
 }
 
-func (DbmsLocal) Close() {
+// setLibraries saves the list of libraries in use
+// and then makes it visible to LibGet and Libraries.
+// It is called with libLock held.
+func (dbms *DbmsLocal) setLibraries(libs []string) {
+	saveLibraries(dbms.db, libs)
+	dbms.libraries.Store(libs)
+}
+
+func (*DbmsLocal) Close() {
+}
+
+// getSchema returns the schema for a table, or nil if it does not exist
+func getSchema(db *db19.Database, table string) *meta.Schema {
+	rt := db.NewReadTran()
+	defer rt.Complete()
+	return rt.GetSchema(table)
+}
+
+// ------------------------------------------------------------------
+
+// TranLocal implements ITran using a db19 ReadTran or UpdateTran
+type TranLocal struct {
+	tran qry.Tran
+	// ut is nil for read-only transactions
+	ut *db19.UpdateTran
+	// rt is nil for update transactions
+	rt  *db19.ReadTran
+	num int
+	// tables are the tables that updateable queries have read from,
+	// Erase and Update look for the record in them (see table)
+	tables []string
+	reads  int
+	writes int
+}
+
+var _ ITran = (*TranLocal)(nil)
+
+func (tl *TranLocal) Abort() {
+	if tl.ut != nil {
+		tl.ut.Abort()
+	} else {
+		tl.rt.Complete()
+	}
+}
+
+// Complete commits the transaction.
+// It returns "" if successful, otherwise the reason for the conflict.
+func (tl *TranLocal) Complete() (result string) {
+	if tl.ut == nil {
+		tl.rt.Complete()
+		return ""
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			result = fmt.Sprint(e)
+		}
+	}()
+	tl.ut.Commit()
+	return ""
+}
+
+func (tl *TranLocal) Erase(adr int) {
+	tl.tran.Delete(tl.table(adr), uint64(adr))
+	tl.writes++
+}
+
+func (tl *TranLocal) Update(adr int, rec Record) int {
+	newadr := int(tl.tran.Update(tl.table(adr), uint64(adr), rec))
+	tl.writes++
+	return newadr
+}
+
+// table returns the table containing the record at adr.
+// Rather than recording the table for every row that is read,
+// it looks up the record's key in each of the tables that have been read.
+func (tl *TranLocal) table(adr int) string {
+	if tl.ut == nil {
+		panic("can't modify a read-only transaction")
+	}
+	if adr > 0 {
+		rec := tl.ut.GetRecord(uint64(adr))
+		for _, table := range tl.tables {
+			if tl.contains(table, rec, uint64(adr)) {
+				return table
+			}
+		}
+	}
+	panic("record not found in this transaction")
+}
+
+// contains returns whether the key of rec in the first key of table
+// refers to the record at adr
+func (tl *TranLocal) contains(table string, rec Record, adr uint64) bool {
+	ts := tl.ut.GetSchema(table)
+	for i := range ts.Indexes {
+		if ix := &ts.Indexes[i]; ix.Mode == 'k' {
+			return tl.ut.Lookup(table, i, ix.Ixspec.Key(rec)) == adr
+		}
+	}
+	return false
+}
+
+func (tl *TranLocal) Get(query string, dir Dir) (Row, *Header) {
+	q := qry.NewQuery(tl.tran, query)
+	row, hdr := qry.Get(q, query, dir)
+	tl.read(q.Updateable(), row)
+	return row, hdr
+}
+
+// read counts a row and records the table of an updateable query
+func (tl *TranLocal) read(table string, row Row) {
+	if row == nil {
+		return
+	}
+	tl.reads++
+	if table != "" && !str.List(tl.tables).Has(table) {
+		tl.tables = append(tl.tables, table)
+	}
+}
+
+func (tl *TranLocal) Query(query string) IQuery {
+	return &queryLocal{queryCursorLocal{q: qry.NewQuery(tl.tran, query)}, tl}
+}
+
+func (tl *TranLocal) ReadCount() int {
+	return tl.reads
+}
+
+func (tl *TranLocal) Request(request string) int {
+	n := qry.DoRequest(tl.tran, request)
+	tl.writes += n
+	return n
+}
+
+func (tl *TranLocal) WriteCount() int {
+	return tl.writes
+}
+
+func (tl *TranLocal) String() string {
+	return "Transaction" + strconv.Itoa(tl.num)
+}
+
+// queryCursorLocal is the common stuff for queryLocal and cursorLocal
+type queryCursorLocal struct {
+	q qry.Query
+}
+
+func (ql *queryCursorLocal) Header() *Header {
+	return ql.q.Header()
+}
+
+func (ql *queryCursorLocal) Keys() *SuObject {
+	keys := NewSuObject()
+	for _, key := range ql.q.Keys() {
+		keys.Add(SuStr(strings.Join(key, ",")))
+	}
+	return keys
+}
+
+func (ql *queryCursorLocal) Order() *SuObject {
+	order := NewSuObject()
+	for _, col := range ql.q.Order() {
+		order.Add(SuStr(col))
+	}
+	return order
+}
+
+func (ql *queryCursorLocal) Rewind() {
+	ql.q.Rewind()
+}
+
+func (ql *queryCursorLocal) Strategy() string {
+	return ql.q.String()
+}
+
+// queryLocal implements IQuery ------------------------------------
+
+type queryLocal struct {
+	queryCursorLocal
+	tl *TranLocal
+}
+
+var _ IQuery = (*queryLocal)(nil)
+
+func (ql *queryLocal) Close() {
+	qry.Close(ql.q)
+}
+
+func (ql *queryLocal) Get(dir Dir) Row {
+	row := ql.q.Get(dir)
+	ql.tl.read(ql.q.Updateable(), row)
+	return row
+}
+
+func (ql *queryLocal) Output(rec Record) {
+	ql.q.Output(rec)
+	ql.tl.writes++
+}
+
+// cursorLocal implements ICursor -----------------------------------
+
+type cursorLocal struct {
+	queryCursorLocal
+}
+
+var _ ICursor = (*cursorLocal)(nil)
+
+func (cl *cursorLocal) Close() {
+	qry.Close(cl.q)
+	atomic.AddInt32(&ncursors, -1)
+}
+
+func (cl *cursorLocal) Get(tran ITran, dir Dir) Row {
+	tl := tran.(*TranLocal)
+	cl.q.SetTran(tl.tran)
+	row := cl.q.Get(dir)
+	tl.read(cl.q.Updateable(), row)
+	return row
 }
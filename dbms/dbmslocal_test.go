@@ -0,0 +1,122 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package dbms
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestCursor(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+
+	dbms := NewDbmsLocal(db)
+	dbms.Admin("create tbl (a, b) key(a)")
+	tran := dbms.Transaction(true)
+	for _, a := range []string{"1", "2", "3", "4"} {
+		tran.Request("insert { a: " + a + " } into tbl")
+	}
+	assert.This(tran.Complete()).Is("")
+
+	c := dbms.Cursor("tbl")
+	assert.This(dbms.Cursors()).Is(1)
+	hdr := c.Header()
+	hdr.EnsureMap()
+	get := func(tran ITran, dir Dir) Value {
+		row := c.Get(tran, dir)
+		if row == nil {
+			return False
+		}
+		return row.Get(hdr, "a")
+	}
+
+	// each Get uses a different transaction, the position is maintained
+	t1 := dbms.Transaction(false)
+	assert.This(get(t1, Next)).Is(One)
+	assert.This(t1.Complete()).Is("")
+	t2 := dbms.Transaction(true)
+	t2.Request("insert { a: 5 } into tbl")
+	t2.Request("delete tbl where a = 3")
+	assert.This(get(t2, Next)).Is(IntVal(2))
+	assert.This(t2.Complete()).Is("")
+	t3 := dbms.Transaction(true)
+	assert.This(get(t3, Next)).Is(IntVal(4)) // sees the committed delete
+	assert.This(get(t3, Prev)).Is(IntVal(2))
+	assert.This(get(t3, Next)).Is(IntVal(4))
+	row := c.Get(t3, Next)
+	assert.This(row.Get(hdr, "a")).Is(IntVal(5))
+	t3.Erase(row[0].Adr) // rows read by a cursor can be updated
+	assert.This(get(t3, Next)).Is(False)
+	assert.This(t3.Complete()).Is("")
+
+	// after eof it starts from the beginning
+	t4 := dbms.Transaction(false)
+	assert.This(get(t4, Prev)).Is(IntVal(4))
+	c.Rewind()
+	assert.This(get(t4, Next)).Is(One)
+	assert.This(t4.Complete()).Is("")
+
+	c.Close()
+	assert.This(dbms.Cursors()).Is(0)
+}
+
+func TestTranLocalUpdate(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+
+	dbms := NewDbmsLocal(db)
+	dbms.Admin("create one (a, b) key(a)")
+	dbms.Admin("create two (c, d) key(c) index(d)")
+	tran := dbms.Transaction(true)
+	for _, x := range []string{"1", "2", "3"} {
+		tran.Request("insert { a: " + x + ", b: " + x + " } into one")
+		tran.Request("insert { c: " + x + ", d: 0 } into two")
+	}
+	assert.This(tran.Complete()).Is("")
+
+	rt := dbms.Transaction(false)
+	row, _ := rt.Get("one where a = 1", Only)
+	assert.This(func() { rt.Erase(row[0].Adr) }).Panics("read-only")
+	assert.This(rt.Complete()).Is("")
+
+	ut := dbms.Transaction(true).(*TranLocal)
+	q := ut.Query("two")
+	var rows []Row
+	for row := q.Get(Next); row != nil; row = q.Get(Next) {
+		rows = append(rows, row)
+	}
+	q.Close()
+	row1, hdr := ut.Get("one where a = 1", Only)
+	row2, _ := ut.Get("one where a = 2", Only)
+	assert.This(ut.tables).Is([]string{"two", "one"})
+	ut.Erase(row2[0].Adr)
+	rb := RecordBuilder{}
+	rb.AddRaw(PackValue(One))
+	rb.AddRaw(PackValue(IntVal(9)))
+	adr := ut.Update(row1[0].Adr, rb.Build())
+	assert.This(func() { ut.Update(row1[0].Adr, rb.Build()) }).
+		Panics("record not found")
+	ut.Erase(adr)
+	ut.Erase(rows[2][0].Adr)
+	assert.This(ut.Complete()).Is("")
+
+	rt = dbms.Transaction(false)
+	row, _ = rt.Get("one", Only)
+	assert.This(row.Get(hdr, "a")).Is(IntVal(3))
+	row, _ = rt.Get("two where c = 3", Only)
+	assert.That(row == nil)
+	assert.This(rt.Complete()).Is("")
+}
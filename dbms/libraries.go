@@ -0,0 +1,66 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package dbms
+
+import (
+	"github.com/apmckinlay/gsuneido/db19"
+	"github.com/apmckinlay/gsuneido/db19/meta"
+	qry "github.com/apmckinlay/gsuneido/dbms/query"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// uselibs is the table that records the libraries in use (other than stdlib)
+// so they are still in use after restarting
+const uselibs = "uselibs"
+
+// isLibrary returns whether a table has the columns of a library
+func isLibrary(ts *meta.Schema) bool {
+	return ts != nil && str.List(ts.Columns).HasAll([]string{"name", "text", "group"})
+}
+
+// loadLibraries returns the libraries in use from the uselibs table.
+// stdlib is always first.
+func loadLibraries(db *db19.Database) []string {
+	libs := []string{"stdlib"}
+	rt := db.NewReadTran()
+	defer rt.Complete()
+	if rt.GetSchema(uselibs) == nil {
+		return libs
+	}
+	q := qry.NewQuery(rt, uselibs+" sort num")
+	hdr := q.Header()
+	hdr.EnsureMap()
+	for row := q.Get(Next); row != nil; row = q.Get(Next) {
+		lib := ToStr(row.Get(hdr, "lib"))
+		if !str.List(libs).Has(lib) {
+			libs = append(libs, lib)
+		}
+	}
+	return libs
+}
+
+// saveLibraries replaces the contents of the uselibs table with libs
+func saveLibraries(db *db19.Database, libs []string) {
+	if getSchema(db, uselibs) == nil {
+		db19.DoAdmin(db, "ensure "+uselibs+" (lib, num) key(lib)")
+	}
+	ut := db.NewUpdateTran()
+	defer func() {
+		if e := recover(); e != nil {
+			ut.Abort()
+			panic(e)
+		}
+	}()
+	qry.DoRequest(ut, "delete "+uselibs)
+	for i, lib := range libs {
+		if lib == "stdlib" {
+			continue
+		}
+		var rb RecordBuilder
+		rb.Add(SuStr(lib)).AddRaw(PackValue(IntVal(i)))
+		ut.Output(uselibs, rb.Build())
+	}
+	ut.Commit()
+}
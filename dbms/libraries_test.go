@@ -0,0 +1,54 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package dbms
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19"
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestLibraries(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+
+	dbms := NewDbmsLocal(db)
+	assert.This(dbms.Libraries().String()).Is(`#("stdlib")`)
+	assert.This(dbms.LibGet("Foo")).Is([]string(nil))
+	for _, lib := range []string{"stdlib", "mylib"} {
+		dbms.Admin("create " + lib + " (name, text, group) key(name, group)")
+	}
+	dbms.Admin("create notlib (a) key(a)")
+	tran := dbms.Transaction(true)
+	tran.Request("insert { name: 'Foo', text: 'stdfoo', group: -1 } into stdlib")
+	tran.Request("insert { name: 'Foo', text: '', group: 0 } into stdlib")
+	tran.Request("insert { name: 'Foo', text: 'myfoo', group: -1 } into mylib")
+	tran.Request("insert { name: 'Bar', text: 'mybar', group: -1 } into mylib")
+	assert.This(tran.Complete()).Is("")
+
+	assert.This(dbms.LibGet("Foo")).Is([]string{"stdlib", "stdfoo"})
+	assert.This(dbms.LibGet("Bar")).Is([]string(nil))
+	assert.That(dbms.Use("mylib"))
+	assert.That(!dbms.Use("mylib"))
+	assert.This(func() { dbms.Use("notlib") }).Panics("invalid library")
+	assert.This(dbms.Libraries().String()).Is(`#("stdlib", "mylib")`)
+	assert.This(dbms.LibGet("Foo")).
+		Is([]string{"stdlib", "stdfoo", "mylib", "myfoo"})
+	assert.This(dbms.LibGet("Bar")).Is([]string{"mylib", "mybar"})
+
+	// the libraries in use are persisted
+	dbms = NewDbmsLocal(db)
+	assert.This(dbms.Libraries().String()).Is(`#("stdlib", "mylib")`)
+	assert.That(!dbms.Unuse("stdlib"))
+	assert.That(dbms.Unuse("mylib"))
+	assert.That(!dbms.Unuse("mylib"))
+	dbms = NewDbmsLocal(db)
+	assert.This(dbms.Libraries().String()).Is(`#("stdlib")`)
+}
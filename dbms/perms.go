@@ -0,0 +1,273 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package dbms
+
+import (
+	"github.com/apmckinlay/gsuneido/compile"
+	"github.com/apmckinlay/gsuneido/db19"
+	"github.com/apmckinlay/gsuneido/db19/meta"
+	qry "github.com/apmckinlay/gsuneido/dbms/query"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Permissions
+//
+// If the database has a permissions table (user, table, access)
+// authorized server connections are restricted to what it allows.
+// user is a user name or a role (the role column of the users table).
+// table is a table name or "*" for all the tables.
+// access is "none", "read", "write", or "admin".
+// The most specific rule applies - user and table, role and table,
+// user and "*", role and "*". If there is no rule there is no access.
+// "*" does not apply to the users and permissions tables,
+// they require their own rules.
+// Permissions are loaded when a connection is authorized
+// so changes only apply to new connections.
+// The admin user is not restricted.
+
+const permissions = "permissions"
+
+const adminUser = "admin"
+
+type access int
+
+const (
+	noAccess access = iota
+	readAccess
+	writeAccess
+	adminAccess
+)
+
+var accessNames = []string{"none", "read", "write", "admin"}
+
+func (a access) String() string {
+	return accessNames[a]
+}
+
+func toAccess(s string) access {
+	for i, name := range accessNames {
+		if s == name {
+			return access(i)
+		}
+	}
+	panic("permissions: invalid access: " + s)
+}
+
+// perms are the permissions for a user.
+// nil means unrestricted.
+type perms struct {
+	user string
+	// byUser and byRole map table names (or "*") to access
+	byUser map[string]access
+	byRole map[string]access
+}
+
+// loadPerms returns the permissions for a user,
+// nil if there is no permissions table or the user is the admin user
+func loadPerms(db *db19.Database, user string) *perms {
+	rt := db.NewReadTran()
+	defer rt.Complete()
+	if user == adminUser || rt.GetSchema(permissions) == nil {
+		return nil
+	}
+	role := getRole(rt, user)
+	p := &perms{user: user,
+		byUser: make(map[string]access), byRole: make(map[string]access)}
+	q := qry.NewQuery(rt, permissions)
+	hdr := q.Header()
+	hdr.EnsureMap()
+	for row := q.Get(Next); row != nil; row = q.Get(Next) {
+		table := ToStr(row.Get(hdr, "table"))
+		acc := toAccess(ToStr(row.Get(hdr, "access")))
+		switch ToStr(row.Get(hdr, "user")) {
+		case user:
+			p.byUser[table] = acc
+		case role:
+			p.byRole[table] = acc
+		}
+	}
+	return p
+}
+
+// getRole returns the role column from the users table, or "" if none
+func getRole(rt *db19.ReadTran, user string) string {
+	ts := rt.GetSchema("users")
+	if ts == nil || !str.List(ts.Columns).Has("role") {
+		return ""
+	}
+	row, hdr := qry.GetOne(rt, "users where user = "+SuStr(user).String(), Next)
+	if row == nil {
+		return ""
+	}
+	hdr.EnsureMap()
+	return ToStr(row.Get(hdr, "role"))
+}
+
+// access returns the access the user has to a table
+func (p *perms) access(table string) access {
+	if acc, ok := p.byUser[table]; ok {
+		return acc
+	}
+	if acc, ok := p.byRole[table]; ok {
+		return acc
+	}
+	if table == "users" || table == permissions {
+		return noAccess
+	}
+	if acc, ok := p.byUser["*"]; ok {
+		return acc
+	}
+	return p.byRole["*"] // noAccess if not found
+}
+
+// check panics if the user does not have at least the given access to table
+func (p *perms) check(table string, need access) {
+	if p != nil && p.access(table) < need {
+		p.denied(need, table)
+	}
+}
+
+func (p *perms) denied(need access, table string) {
+	panic("permission denied: " + p.user + " does not have " +
+		need.String() + " access to " + table)
+}
+
+// checkUpdate panics if the user does not have write access to any table
+func (p *perms) checkUpdate() {
+	if p == nil {
+		return
+	}
+	for _, rules := range []map[string]access{p.byUser, p.byRole} {
+		for _, acc := range rules {
+			if acc >= writeAccess {
+				return
+			}
+		}
+	}
+	p.denied(writeAccess, "any table")
+}
+
+// checkAdmin panics if the user does not have admin access
+// to the tables affected by an admin request
+func (p *perms) checkAdmin(request string) {
+	if p == nil {
+		return
+	}
+	rq := compile.ParseRequest(request)
+	if rq.Action == "rename" {
+		for _, rn := range rq.Renames {
+			p.check(rn.From, adminAccess)
+			p.check(rn.To, adminAccess)
+		}
+		return
+	}
+	p.check(rq.Table, adminAccess)
+}
+
+// checkDatabase panics if the user is restricted,
+// for operations on the whole database e.g. Backup
+func (p *perms) checkDatabase() {
+	if p != nil {
+		p.denied(adminAccess, "the database")
+	}
+}
+
+// permDbms wraps DbmsLocal to apply the permissions to code run
+// for a restricted connection (e.g. by Exec)
+type permDbms struct {
+	*DbmsLocal
+	perms *perms
+}
+
+var _ IDbms = (*permDbms)(nil)
+
+func (pd *permDbms) Admin(request string) {
+	pd.perms.checkAdmin(request)
+	pd.DbmsLocal.Admin(request)
+}
+
+func (pd *permDbms) Backup(to string) string {
+	pd.perms.checkDatabase()
+	return pd.DbmsLocal.Backup(to)
+}
+
+func (pd *permDbms) Check() string {
+	pd.perms.checkDatabase()
+	return pd.DbmsLocal.Check()
+}
+
+func (pd *permDbms) Compact() string {
+	pd.perms.checkDatabase()
+	return pd.DbmsLocal.Compact()
+}
+
+func (pd *permDbms) Cursor(query string) ICursor {
+	return pd.DbmsLocal.cursor(query, pd.perms)
+}
+
+func (pd *permDbms) Dump(table string) string {
+	pd.perms.checkDatabase()
+	return pd.DbmsLocal.Dump(table)
+}
+
+func (pd *permDbms) Get(_ int, query string, dir Dir) (Row, *Header) {
+	return pd.DbmsLocal.get(query, dir, pd.perms)
+}
+
+func (pd *permDbms) Kill(sessionId string) int {
+	pd.perms.checkDatabase()
+	return pd.DbmsLocal.Kill(sessionId)
+}
+
+func (pd *permDbms) Load(table string) int {
+	pd.perms.checkDatabase()
+	return pd.DbmsLocal.Load(table)
+}
+
+func (pd *permDbms) Run(s string) Value {
+	pd.perms.checkDatabase()
+	return pd.DbmsLocal.Run(s)
+}
+
+func (pd *permDbms) Transaction(update bool) ITran {
+	return pd.DbmsLocal.transaction(update, pd.perms)
+}
+
+func (pd *permDbms) Unuse(lib string) bool {
+	pd.perms.checkDatabase()
+	return pd.DbmsLocal.Unuse(lib)
+}
+
+func (pd *permDbms) Use(lib string) bool {
+	pd.perms.checkDatabase()
+	return pd.DbmsLocal.Use(lib)
+}
+
+// permTran wraps a transaction to check the permissions
+// for reading (GetSchema) and writing (Output, Update, Delete)
+type permTran struct {
+	qry.Tran
+	perms *perms
+}
+
+func (pt permTran) GetSchema(table string) *meta.Schema {
+	pt.perms.check(table, readAccess)
+	return pt.Tran.GetSchema(table)
+}
+
+func (pt permTran) Output(table string, rec Record) {
+	pt.perms.check(table, writeAccess)
+	pt.Tran.Output(table, rec)
+}
+
+func (pt permTran) Update(table string, oldoff uint64, newrec Record) uint64 {
+	pt.perms.check(table, writeAccess)
+	return pt.Tran.Update(table, oldoff, newrec)
+}
+
+func (pt permTran) Delete(table string, off uint64) {
+	pt.perms.check(table, writeAccess)
+	pt.Tran.Delete(table, off)
+}
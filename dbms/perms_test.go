@@ -0,0 +1,125 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package dbms
+
+import (
+	"crypto/sha1"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestPermissions(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	dbms := NewDbmsLocal(db).(*DbmsLocal)
+	dbms.Admin("create users (user, passhash, role) key(user)")
+	dbms.Admin("create tbl (a) key(a)")
+	dbms.Admin("create secret (a) key(a)")
+	assert.That(loadPerms(db, "bob") == nil) // no permissions table
+
+	dbms.Admin("create permissions (user, table, access) key(user, table)")
+	tran := dbms.Transaction(true)
+	tran.Request("insert { user: 'bob', role: 'staff' } into users")
+	tran.Request("insert { user: 'sue', role: 'staff' } into users")
+	tran.Request("insert { user: 'staff', table: '*', access: 'read' } into permissions")
+	tran.Request("insert { user: 'staff', table: 'secret', access: 'none' } into permissions")
+	tran.Request("insert { user: 'bob', table: 'tbl', access: 'admin' } into permissions")
+	tran.Request("insert { a: 1 } into secret")
+	assert.This(tran.Complete()).Is("")
+	assert.That(loadPerms(db, adminUser) == nil)
+
+	bob := loadPerms(db, "bob")
+	assert.This(bob.access("tbl")).Is(adminAccess)
+	assert.This(bob.access("other")).Is(readAccess)
+	assert.This(bob.access("secret")).Is(noAccess)
+	assert.This(bob.access("users")).Is(noAccess)
+	tran = dbms.transaction(true, bob)
+	assert.This(tran.Request("insert { a: 1 } into tbl")).Is(1)
+	assert.This(func() { tran.Request("insert { a: 2 } into secret") }).
+		Panics("bob does not have read access to secret")
+	assert.This(func() { tran.Request("delete permissions") }).
+		Panics("bob does not have read access to permissions")
+	assert.This(tran.Complete()).Is("")
+	bob.checkAdmin("alter tbl create (b)")
+	assert.This(func() { bob.checkAdmin("drop secret") }).
+		Panics("bob does not have admin access to secret")
+	assert.This(func() { bob.checkAdmin("rename tbl to secret2") }).
+		Panics("bob does not have admin access to secret2")
+
+	// sue is read-only
+	sue := loadPerms(db, "sue")
+	assert.This(func() { dbms.transaction(true, sue) }).
+		Panics("sue does not have write access to any table")
+	tran = dbms.transaction(false, sue)
+	row, hdr := tran.Get("tbl", Next)
+	hdr.EnsureMap()
+	assert.This(row.Get(hdr, "a")).Is(IntVal(1))
+	assert.This(func() { dbms.get("secret", Next, sue) }).
+		Panics("sue does not have read access to secret")
+	assert.This(func() { bob.checkDatabase() }).
+		Panics("bob does not have admin access to the database")
+	assert.This(func() { loadPerms(db, "joe").check("tbl", readAccess) }).
+		Panics("joe does not have read access to tbl")
+}
+
+var _ = Global.Builtin("PermsTestInsert", &SuBuiltin{
+	Fn: func(t *Thread, args []Value) Value {
+		tran := t.Dbms().Transaction(true)
+		tran.Request("insert { a: 9 } into tbl")
+		return SuStr(tran.Complete())
+	},
+	BuiltinParams: BuiltinParams{ParamSpec: ParamSpec0}})
+
+func TestServerPermissions(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	dbms := NewDbmsLocal(db).(*DbmsLocal)
+	dbms.Admin("create users (user, passhash) key(user)")
+	dbms.Admin("create permissions (user, table, access) key(user, table)")
+	dbms.Admin("create tbl (a) key(a)")
+	tran := dbms.Transaction(true)
+	tran.Request("insert { user: 'sue', passhash: 'pw' } into users")
+	tran.Request("insert { user: 'sue', table: 'tbl', access: 'read' } into permissions")
+	assert.This(tran.Complete()).Is("")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.That(err == nil)
+	defer l.Close()
+	go Serve(dbms, l)
+	defer func() { token = "" }()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	dc := NewDbmsClient("127.0.0.1", port)
+	defer dc.Close()
+	h := sha1.Sum([]byte(dc.Nonce() + "pw"))
+	assert.That(dc.Auth("sue\x00" + string(h[:])))
+
+	// code run by Exec has the connection's permissions
+	assert.This(func() { dc.Exec(nil, NewSuObject(SuStr("PermsTestInsert"))) }).
+		Panics("sue does not have write access to any table")
+	row, _ := dc.Get(0, "tbl", Next)
+	assert.That(row == nil)
+	// operations on the whole database require unrestricted access
+	denied := "sue does not have admin access to the database"
+	assert.This(func() { dc.Run("1") }).Panics(denied)
+	assert.This(func() { dc.Dump("") }).Panics(denied)
+	assert.This(func() { dc.Load("tbl") }).Panics(denied)
+	assert.This(func() { dc.Kill("127.0.0.1") }).Panics(denied)
+	assert.This(func() { dc.Check() }).Panics(denied)
+	assert.This(func() { dc.Backup("tmp.bak.db") }).Panics(denied)
+	assert.This(func() { dc.Compact() }).Panics(denied)
+	// the connection continues after the errors
+	assert.This(dc.Connections().String()).Is(`#("127.0.0.1")`)
+}
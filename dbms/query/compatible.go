@@ -0,0 +1,229 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"math"
+
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Compatible is the common code for Union, Minus, and Intersect.
+// Rows are compared on the values of all of the columns,
+// a missing column is treated as empty.
+type Compatible struct {
+	Query2
+	th *Thread
+	// cols are the columns that are compared
+	cols []string
+	// rightKeys is the set of the keys of the right rows
+	rightKeys map[string]bool
+}
+
+func newCompatible(left, right Query, cols []string, th *Thread) Compatible {
+	return Compatible{Query2: Query2{left: left, right: right}, th: th,
+		cols: cols}
+}
+
+// inRight returns whether the right side has a row
+// with the same values as row (from q)
+func (c *Compatible) inRight(q Query, row Row) bool {
+	if c.rightKeys == nil {
+		c.rightKeys = c.keySet(c.right)
+	}
+	return c.rightKeys[rowKey(c.th, q.Header(), row, c.cols)]
+}
+
+func (c *Compatible) keySet(q Query) map[string]bool {
+	hdr := q.Header()
+	set := map[string]bool{}
+	for _, row := range getAll(q) {
+		set[rowKey(c.th, hdr, row, c.cols)] = true
+	}
+	return set
+}
+
+// Select and optimize for Minus and Intersect, which follow the left
+
+func (c *Compatible) Select(cols, vals []string) {
+	c.left.Select(cols, vals)
+}
+
+func (c *Compatible) optimize(index []string) Cost {
+	return c.left.optimize(index) + c.right.optimize(nil) +
+		c.right.nrows()*tempCost
+}
+
+func (c *Compatible) setApproach(index []string) {
+	c.left.setApproach(index)
+	c.right.setApproach(nil)
+}
+
+// Union -----------------------------------------------------------
+
+// Union returns the rows from the left
+// followed by the rows from the right that are not in the left.
+// Since the two sides may have different fields,
+// it returns rows with a single new record.
+type Union struct {
+	Compatible
+	hdr  *Header
+	rows *rowList
+}
+
+func NewUnion(left, right Query, th *Thread) *Union {
+	cols := str.List(left.Header().Columns).Union(right.Header().Columns)
+	return &Union{Compatible: newCompatible(left, right, cols, th),
+		hdr: &Header{Fields: [][]string{cols}, Columns: cols}}
+}
+
+func (u *Union) String() string {
+	return u.left.String() + " union " + parenString(u.right)
+}
+
+func (u *Union) Header() *Header {
+	return u.hdr
+}
+
+func (u *Union) Keys() [][]string {
+	return [][]string{u.cols}
+}
+
+func (u *Union) Order() []string {
+	return nil
+}
+
+func (u *Union) Rewind() {
+	if u.rows != nil {
+		u.rows.rewind()
+	}
+}
+
+func (u *Union) Get(dir Dir) Row {
+	if u.rows == nil {
+		u.rows = &rowList{rows: u.all(), pos: -1}
+	}
+	return u.rows.get(dir)
+}
+
+func (u *Union) Select([]string, []string) {
+	noSelect("union")
+}
+
+func (u *Union) optimize(index []string) Cost {
+	if index != nil {
+		return impossible
+	}
+	return u.left.optimize(nil) + u.right.optimize(nil) + u.nrows()*tempCost
+}
+
+func (u *Union) setApproach([]string) {
+	u.left.setApproach(nil)
+	u.right.setApproach(nil)
+}
+
+func (u *Union) nrows() float64 {
+	return u.left.nrows() + u.right.nrows()
+}
+
+func (u *Union) all() []Row {
+	var rows []Row
+	leftKeys := map[string]bool{}
+	for _, q := range []Query{u.left, u.right} {
+		hdr := q.Header()
+		for _, row := range getAll(q) {
+			key := rowKey(u.th, hdr, row, u.cols)
+			if q == u.left {
+				leftKeys[key] = true
+			} else if leftKeys[key] {
+				continue
+			}
+			rows = append(rows, newRow(u.th, hdr, row, u.cols))
+		}
+	}
+	return rows
+}
+
+// Minus -----------------------------------------------------------
+
+// Minus returns the rows from the left that are not in the right
+type Minus struct {
+	Compatible
+}
+
+func NewMinus(left, right Query, th *Thread) *Minus {
+	return &Minus{Compatible: newCompatible(left, right,
+		left.Header().Columns, th)}
+}
+
+func (m *Minus) String() string {
+	return m.left.String() + " minus " + parenString(m.right)
+}
+
+func (m *Minus) Header() *Header {
+	return m.left.Header()
+}
+
+func (m *Minus) Keys() [][]string {
+	return m.left.Keys()
+}
+
+func (m *Minus) Order() []string {
+	return m.left.Order()
+}
+
+func (m *Minus) nrows() float64 {
+	return m.left.nrows()
+}
+
+func (m *Minus) Get(dir Dir) Row {
+	for {
+		row := m.left.Get(dir)
+		if row == nil || !m.inRight(m.left, row) {
+			return row
+		}
+	}
+}
+
+// Intersect -------------------------------------------------------
+
+// Intersect returns the rows from the left that are also in the right
+type Intersect struct {
+	Compatible
+}
+
+func NewIntersect(left, right Query, th *Thread) *Intersect {
+	return &Intersect{Compatible: newCompatible(left, right,
+		left.Header().Columns, th)}
+}
+
+func (it *Intersect) String() string {
+	return it.left.String() + " intersect " + parenString(it.right)
+}
+
+func (it *Intersect) Header() *Header {
+	return it.left.Header()
+}
+
+func (it *Intersect) Keys() [][]string {
+	return it.left.Keys()
+}
+
+func (it *Intersect) Order() []string {
+	return it.left.Order()
+}
+
+func (it *Intersect) nrows() float64 {
+	return math.Min(it.left.nrows(), it.right.nrows())
+}
+
+func (it *Intersect) Get(dir Dir) Row {
+	for {
+		row := it.left.Get(dir)
+		if row == nil || it.inRight(it.left, row) {
+			return row
+		}
+	}
+}
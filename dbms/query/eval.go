@@ -0,0 +1,212 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"github.com/apmckinlay/gsuneido/compile/ast"
+	tok "github.com/apmckinlay/gsuneido/compile/tokens"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/ascii"
+)
+
+// context is used to evaluate where and extend expressions for a row
+type context struct {
+	th  *Thread
+	hdr *Header
+	row Row
+	// rec is only created if needed to access rules
+	rec *SuRecord
+	// cols and vals are extend columns that have been evaluated
+	cols []string
+	vals []Value
+}
+
+func (c *context) set(hdr *Header, row Row) {
+	hdr.EnsureMap()
+	c.hdr = hdr
+	c.row = row
+	c.rec = nil
+	c.cols = c.cols[:0]
+	c.vals = c.vals[:0]
+}
+
+func (c *context) get(col string) Value {
+	for i, x := range c.cols {
+		if x == col {
+			return c.vals[i]
+		}
+	}
+	if _, ok := c.hdr.Map[col]; ok {
+		return c.row.Get(c.hdr, col)
+	}
+	if c.rec == nil {
+		c.rec = SuRecordFromRow(c.row, c.hdr, nil)
+	}
+	return c.rec.Get(c.th, SuStr(col))
+}
+
+// eval evaluates an expression from the parser.
+// Lower case identifiers are column values,
+// capitalized identifiers are globals.
+func (c *context) eval(e ast.Expr) Value {
+	switch e := e.(type) {
+	case *ast.Constant:
+		return e.Val
+	case *ast.Ident:
+		if ascii.IsUpper(e.Name[0]) {
+			return Global.GetName(c.th, e.Name)
+		}
+		return c.get(e.Name)
+	case *ast.Unary:
+		return c.unary(e)
+	case *ast.Binary:
+		return c.binary(e)
+	case *ast.Nary:
+		return c.nary(e)
+	case *ast.Trinary:
+		if c.eval(e.Cond) == True {
+			return c.eval(e.T)
+		}
+		return c.eval(e.F)
+	case *ast.In:
+		x := c.eval(e.E)
+		for _, e2 := range e.Exprs {
+			if x.Equal(c.eval(e2)) {
+				return True
+			}
+		}
+		return False
+	case *ast.Mem:
+		return c.eval(e.E).Get(c.th, c.eval(e.M))
+	case *ast.RangeTo:
+		from, to := c.rangeArgs(e.From, e.To)
+		return c.eval(e.E).RangeTo(from, to)
+	case *ast.RangeLen:
+		from, n := c.rangeArgs(e.From, e.Len)
+		return c.eval(e.E).RangeLen(from, n)
+	case *ast.Call:
+		return c.call(e)
+	}
+	panic("query: unsupported expression: " + e.String())
+}
+
+func (c *context) rangeArgs(e1, e2 ast.Expr) (int, int) {
+	x, y := 0, int(^uint(0)>>1)
+	if e1 != nil {
+		x = ToInt(c.eval(e1))
+	}
+	if e2 != nil {
+		y = ToInt(c.eval(e2))
+	}
+	return x, y
+}
+
+func (c *context) unary(e *ast.Unary) Value {
+	x := c.eval(e.E)
+	switch e.Tok {
+	case tok.LParen:
+		return x
+	case tok.Not:
+		return OpNot(x)
+	case tok.Add:
+		return OpUnaryPlus(x)
+	case tok.Sub:
+		return OpUnaryMinus(x)
+	case tok.Div:
+		return OpDiv(One, x)
+	case tok.BitNot:
+		return OpBitNot(x)
+	}
+	panic("query: unsupported operator: " + e.Tok.String())
+}
+
+func (c *context) binary(e *ast.Binary) Value {
+	x := c.eval(e.Lhs)
+	y := c.eval(e.Rhs)
+	switch e.Tok {
+	case tok.Is:
+		return OpIs(x, y)
+	case tok.Isnt:
+		return OpIsnt(x, y)
+	case tok.Lt:
+		return OpLt(x, y)
+	case tok.Lte:
+		return OpLte(x, y)
+	case tok.Gt:
+		return OpGt(x, y)
+	case tok.Gte:
+		return OpGte(x, y)
+	case tok.Match:
+		return OpMatch(x, c.th.RxCache.Get(ToStr(y)))
+	case tok.MatchNot:
+		return OpNot(OpMatch(x, c.th.RxCache.Get(ToStr(y))))
+	case tok.Mod:
+		return OpMod(x, y)
+	case tok.LShift:
+		return OpLeftShift(x, y)
+	case tok.RShift:
+		return OpRightShift(x, y)
+	}
+	panic("query: unsupported operator: " + e.Tok.String())
+}
+
+func (c *context) nary(e *ast.Nary) Value {
+	switch e.Tok {
+	case tok.And:
+		for _, e2 := range e.Exprs {
+			if c.eval(e2) != True {
+				return False
+			}
+		}
+		return True
+	case tok.Or:
+		for _, e2 := range e.Exprs {
+			if c.eval(e2) == True {
+				return True
+			}
+		}
+		return False
+	}
+	var op func(x, y Value) Value
+	switch e.Tok {
+	case tok.Add:
+		op = OpAdd
+	case tok.Mul:
+		op = OpMul
+	case tok.Cat:
+		op = func(x, y Value) Value { return OpCat(c.th, x, y) }
+	case tok.BitOr:
+		op = OpBitOr
+	case tok.BitAnd:
+		op = OpBitAnd
+	case tok.BitXor:
+		op = OpBitXor
+	default:
+		panic("query: unsupported operator: " + e.Tok.String())
+	}
+	result := c.eval(e.Exprs[0])
+	for _, e2 := range e.Exprs[1:] {
+		result = op(result, c.eval(e2))
+	}
+	return result
+}
+
+// call handles function and method calls with un-named arguments
+func (c *context) call(e *ast.Call) Value {
+	args := make([]Value, len(e.Args))
+	for i, arg := range e.Args {
+		if arg.Name != nil {
+			panic("query: named arguments are not supported")
+		}
+		args[i] = c.eval(arg.E)
+	}
+	if m, ok := e.Fn.(*ast.Mem); ok {
+		if meth, ok := m.M.(*ast.Constant); ok {
+			this := c.eval(m.E)
+			return c.th.CallLookup(this, ToStr(meth.Val), args...)
+		}
+	}
+	fn := c.eval(e.Fn)
+	return c.th.Call(fn, args...)
+}
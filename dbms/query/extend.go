@@ -0,0 +1,87 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"github.com/apmckinlay/gsuneido/compile/ast"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Extend adds calculated columns.
+// The values are added to each row as an additional record.
+// Columns without an expression are rules.
+type Extend struct {
+	Query1
+	cols  []string
+	exprs []ast.Expr
+	// physical are the columns with expressions
+	physical []string
+	hdr      *Header
+	ctx      context
+}
+
+func NewExtend(src Query, cols []string, exprs []ast.Expr, th *Thread) *Extend {
+	srchdr := src.Header()
+	var physical []string
+	for i, col := range cols {
+		if str.List(srchdr.Columns).Has(col) || str.List(cols[:i]).Has(col) {
+			panic("extend: column already exists: " + col)
+		}
+		if exprs[i] != nil {
+			physical = append(physical, col)
+		}
+	}
+	fields := append(srchdr.Fields[:len(srchdr.Fields):len(srchdr.Fields)],
+		physical)
+	columns := str.List(srchdr.Columns).Union(cols)
+	return &Extend{Query1: Query1{source: src}, cols: cols, exprs: exprs,
+		physical: physical, hdr: &Header{Fields: fields, Columns: columns},
+		ctx: context{th: th}}
+}
+
+func (e *Extend) String() string {
+	s := e.source.String() + " extend "
+	sep := ""
+	for i, col := range e.cols {
+		s += sep + col
+		if e.exprs[i] != nil {
+			s += " = " + e.exprs[i].String()
+		}
+		sep = ", "
+	}
+	return s
+}
+
+func (e *Extend) Header() *Header {
+	return e.hdr
+}
+
+func (e *Extend) Get(dir Dir) Row {
+	row := e.source.Get(dir)
+	if row == nil {
+		return nil
+	}
+	e.ctx.set(e.source.Header(), row)
+	rb := RecordBuilder{}
+	for i, col := range e.cols {
+		if e.exprs[i] != nil {
+			x := e.ctx.eval(e.exprs[i])
+			// later expressions can reference earlier ones
+			e.ctx.cols = append(e.ctx.cols, col)
+			e.ctx.vals = append(e.ctx.vals, x)
+			rb.AddRaw(PackValue(x))
+		}
+	}
+	return append(row[:len(row):len(row)], DbRec{Record: rb.Build()})
+}
+
+func (e *Extend) optimize(index []string) Cost {
+	for _, col := range index {
+		if str.List(e.cols).Has(col) {
+			return impossible
+		}
+	}
+	return e.source.optimize(index)
+}
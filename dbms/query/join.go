@@ -0,0 +1,398 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"math"
+	"strings"
+
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// joinBase is the common code for Join, LeftJoin, and Times.
+// It is a nested loop, for each row from the outer source
+// it selects the matching rows from the inner source.
+// Normally the outer source is the left,
+// the optimizer may swap them for Join (but not for LeftJoin).
+type joinBase struct {
+	Query2
+	cache
+	by  []string
+	hdr *Header
+	th  *Thread
+	// orow is the current outer row, nil if we need a new one
+	orow Row
+	// matched is whether the current outer row has matched (for LeftJoin)
+	matched bool
+	// outer is true for LeftJoin
+	outer bool
+	// swappable is whether the optimizer may swap the sides
+	swappable bool
+	// swap is true if the right side is the outer source
+	swap bool
+	// index is the order of the by columns used to Select the inner source
+	index []string
+	// empty is the row to use when there is no match (for LeftJoin)
+	empty Row
+}
+
+func newJoinBase(left, right Query, by []string, outer bool,
+	th *Thread) joinBase {
+	lhdr := left.Header()
+	rhdr := right.Header()
+	// fields that are not columns (e.g. removed by project)
+	// are renamed to "-" so they don't hide the other side's fields.
+	// by fields in the right side are renamed to "-"
+	// so the values come from the left side (important for LeftJoin)
+	fields := make([][]string, 0, len(lhdr.Fields)+len(rhdr.Fields))
+	fields = append(fields, hideFields(lhdr, nil)...)
+	fields = append(fields, hideFields(rhdr, by)...)
+	cols := str.List(lhdr.Columns).Union(rhdr.Columns)
+	var rb RecordBuilder
+	emptyRec := rb.Build()
+	empty := make(Row, len(rhdr.Fields))
+	for i := range empty {
+		empty[i] = DbRec{Record: emptyRec}
+	}
+	return joinBase{Query2: Query2{left: left, right: right}, by: by,
+		outer: outer, empty: empty, th: th,
+		hdr: &Header{Fields: fields, Columns: cols}}
+}
+
+// hideFields returns a copy of the header fields
+// with the non-columns and the hide fields renamed to "-"
+func hideFields(hdr *Header, hide []string) [][]string {
+	fields := make([][]string, len(hdr.Fields))
+	for i, flds := range hdr.Fields {
+		flds2 := make([]string, len(flds))
+		for j, f := range flds {
+			if str.List(hide).Has(f) || !str.List(hdr.Columns).Has(f) {
+				f = "-"
+			}
+			flds2[j] = f
+		}
+		fields[i] = flds2
+	}
+	return fields
+}
+
+// commonColumns checks that the by columns (if any)
+// match the columns common to both sides
+func commonColumns(which string, left, right Query, by []string) []string {
+	common := str.List(left.Header().Columns).Intersect(right.Header().Columns)
+	if by == nil {
+		by = common
+	} else if len(by) != len(common) || !str.List(common).HasAll(by) {
+		panic(which + ": by does not match common columns")
+	}
+	if len(by) == 0 {
+		panic(which + ": common columns required")
+	}
+	return by
+}
+
+func (jb *joinBase) Header() *Header {
+	return jb.hdr
+}
+
+func (jb *joinBase) Order() []string {
+	outer, _ := jb.sides()
+	return outer.Order()
+}
+
+// sides returns the outer and inner sources
+func (jb *joinBase) sides() (outer, inner Query) {
+	if jb.swap {
+		return jb.right, jb.left
+	}
+	return jb.left, jb.right
+}
+
+func (jb *joinBase) Rewind() {
+	jb.Query2.Rewind()
+	jb.orow = nil
+}
+
+func (jb *joinBase) Get(dir Dir) Row {
+	outer, inner := jb.sides()
+	ohdr := outer.Header()
+	ihdr := inner.Header()
+	for {
+		if jb.orow == nil {
+			jb.orow = outer.Get(dir)
+			if jb.orow == nil {
+				return nil
+			}
+			jb.matched = false
+			jb.selectInner(inner, ohdr)
+		}
+		irow := inner.Get(dir)
+		if irow == nil {
+			orow := jb.orow
+			jb.orow = nil
+			if jb.outer && !jb.matched {
+				return append(orow[:len(orow):len(orow)], jb.empty...)
+			}
+			continue
+		}
+		if jb.match(ohdr, jb.orow, ihdr, irow) {
+			jb.matched = true
+			return jb.output(jb.orow, irow)
+		}
+	}
+}
+
+// selectInner positions the inner source on the rows
+// that match the by values of the current outer row
+func (jb *joinBase) selectInner(inner Query, ohdr *Header) {
+	if jb.index == nil {
+		inner.Rewind()
+		return
+	}
+	vals := make([]string, len(jb.index))
+	for i, col := range jb.index {
+		vals[i] = getRaw(jb.th, ohdr, jb.orow, col)
+	}
+	inner.Select(jb.index, vals)
+}
+
+// output returns the combined row, left first, regardless of swap
+func (jb *joinBase) output(orow, irow Row) Row {
+	left, right := orow, irow
+	if jb.swap {
+		left, right = irow, orow
+	}
+	return append(left[:len(left):len(left)], right...)
+}
+
+func (jb *joinBase) match(hdr1 *Header, row1 Row, hdr2 *Header, row2 Row) bool {
+	hdr1.EnsureMap()
+	hdr2.EnsureMap()
+	for _, col := range jb.by {
+		if row1.GetRaw(hdr1, col) != row2.GetRaw(hdr2, col) {
+			return false
+		}
+	}
+	return true
+}
+
+// String is for tracing the optimizer,
+// Join and LeftJoin have their own String
+func (jb *joinBase) String() string {
+	return parenString(jb.left) + " join by(" + strings.Join(jb.by, ",") +
+		") " + parenString(jb.right)
+}
+
+// cardinality returns e.g. "n:1" for the relationship between the sides
+func (jb *joinBase) cardinality() string {
+	s := "n:n"
+	switch {
+	case jb.keysUnique(jb.left) && jb.keysUnique(jb.right):
+		s = "1:1"
+	case jb.keysUnique(jb.right):
+		s = "n:1"
+	case jb.keysUnique(jb.left):
+		s = "1:n"
+	}
+	return s
+}
+
+func (jb *joinBase) Select(cols, vals []string) {
+	outer, _ := jb.sides()
+	outer.Select(cols, vals)
+	jb.orow = nil
+}
+
+// joinApproach is the strategy chosen by optimize
+type joinApproach struct {
+	swap  bool
+	index []string
+	temp  bool
+}
+
+func (jb *joinBase) optimize(index []string) Cost {
+	return jb.cache.get(jb, index, jb.optimize2)
+}
+
+func (jb *joinBase) optimize2(index []string) (Cost, interface{}) {
+	cost, app := jb.opt(jb.left, jb.right, index)
+	if jb.swappable {
+		cost2, app2 := jb.opt(jb.right, jb.left, index)
+		if cost2 < cost {
+			app2.swap = true
+			return cost2, app2
+		}
+	}
+	return cost, app
+}
+
+// opt returns the cost of reading inner for each row of outer
+// using the best order of the by columns (or a temporary index)
+func (jb *joinBase) opt(outer, inner Query, index []string) (
+	Cost, *joinApproach) {
+	outerCost := outer.optimize(index)
+	if outerCost >= impossible {
+		return impossible, &joinApproach{}
+	}
+	nOuter := outer.nrows()
+	nInner := math.Max(inner.nrows(), 1)
+	if jb.by == nil {
+		return outerCost + nOuter*inner.optimize(nil), &joinApproach{}
+	}
+	// rowsPer is the number of inner rows for each outer row
+	rowsPer := 1.0
+	if !jb.keysUnique(inner) {
+		rowsPer = math.Max(1, nInner/math.Max(nOuter, 1))
+	}
+	best := Cost(impossible)
+	app := &joinApproach{}
+	for _, ix := range permutations(jb.by) {
+		innerCost, temp := optTemp(inner, ix)
+		var cost Cost
+		if temp {
+			cost = innerCost + nOuter*(seekCost+rowsPer*keyCost)
+		} else {
+			cost = nOuter * (seekCost + rowsPer*innerCost/nInner)
+		}
+		if cost < best {
+			best = cost
+			app = &joinApproach{index: ix, temp: temp}
+		}
+	}
+	return outerCost + best, app
+}
+
+func (jb *joinBase) setApproach(index []string) {
+	app := jb.cache.approach(index).(*joinApproach)
+	jb.swap = app.swap
+	outer, inner := jb.sides()
+	outer.setApproach(index)
+	if jb.by == nil {
+		inner.setApproach(nil)
+		return
+	}
+	inner = setTemp(inner, app.index, app.temp, jb.th)
+	if jb.swap {
+		jb.left = inner
+	} else {
+		jb.right = inner
+	}
+	jb.index = app.index
+}
+
+// keysUnique returns whether the by columns contain a key of q
+func (jb *joinBase) keysUnique(q Query) bool {
+	return containsKey(jb.by, q.Keys())
+}
+
+// productKeys returns the combinations of the keys of the two sides
+func productKeys(left, right Query) [][]string {
+	var keys [][]string
+	for _, k1 := range left.Keys() {
+		for _, k2 := range right.Keys() {
+			keys = append(keys, str.List(k1).Union(k2))
+		}
+	}
+	return keys
+}
+
+// Join ------------------------------------------------------------
+
+type Join struct {
+	joinBase
+}
+
+func NewJoin(left, right Query, by []string, th *Thread) *Join {
+	by = commonColumns("join", left, right, by)
+	j := &Join{joinBase: newJoinBase(left, right, by, false, th)}
+	j.swappable = true
+	return j
+}
+
+func (j *Join) String() string {
+	op := " join "
+	if j.swap {
+		op = " join swap "
+	}
+	return j.left.String() + op + j.cardinality() +
+		" by(" + strings.Join(j.by, ",") + ") " + parenString(j.right)
+}
+
+func (j *Join) Keys() [][]string {
+	switch {
+	case j.keysUnique(j.right): // n:1
+		return j.left.Keys()
+	case j.keysUnique(j.left): // 1:n
+		return j.right.Keys()
+	}
+	return productKeys(j.left, j.right)
+}
+
+func (j *Join) nrows() float64 {
+	switch {
+	case j.keysUnique(j.right): // n:1
+		return j.left.nrows()
+	case j.keysUnique(j.left): // 1:n
+		return j.right.nrows()
+	}
+	return math.Max(j.left.nrows(), j.right.nrows())
+}
+
+// LeftJoin --------------------------------------------------------
+
+type LeftJoin struct {
+	joinBase
+}
+
+func NewLeftJoin(left, right Query, by []string, th *Thread) *LeftJoin {
+	by = commonColumns("leftjoin", left, right, by)
+	return &LeftJoin{joinBase: newJoinBase(left, right, by, true, th)}
+}
+
+func (lj *LeftJoin) String() string {
+	return lj.left.String() + " leftjoin " + lj.cardinality() +
+		" by(" + strings.Join(lj.by, ",") + ") " + parenString(lj.right)
+}
+
+func (lj *LeftJoin) Keys() [][]string {
+	if lj.keysUnique(lj.right) {
+		return lj.left.Keys()
+	}
+	return productKeys(lj.left, lj.right)
+}
+
+func (lj *LeftJoin) nrows() float64 {
+	if lj.keysUnique(lj.right) {
+		return lj.left.nrows()
+	}
+	return math.Max(lj.left.nrows(), lj.right.nrows())
+}
+
+// Times -----------------------------------------------------------
+
+// Times is the cartesian product of its sources
+type Times struct {
+	joinBase
+}
+
+func NewTimes(left, right Query, th *Thread) *Times {
+	common := str.List(left.Header().Columns).Intersect(right.Header().Columns)
+	if len(common) > 0 {
+		panic("times: common columns not allowed: " + strings.Join(common, ","))
+	}
+	return &Times{joinBase: newJoinBase(left, right, nil, false, th)}
+}
+
+func (t *Times) String() string {
+	return t.left.String() + " times " + parenString(t.right)
+}
+
+func (t *Times) Keys() [][]string {
+	return productKeys(t.left, t.right)
+}
+
+func (t *Times) nrows() float64 {
+	return t.left.nrows() * t.right.nrows()
+}
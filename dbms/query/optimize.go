@@ -0,0 +1,252 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+	"github.com/apmckinlay/gsuneido/options"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Cost is the estimated cost of executing a query.
+// The units are roughly bytes read.
+type Cost = float64
+
+// impossible is the cost of an order that a query can't provide.
+// It is not MaxFloat64 so that costs can still be added.
+const impossible = Cost(1e300)
+
+const (
+	// keyCost is the cost of reading an index entry
+	keyCost = 20
+	// seekCost is the cost of positioning an index iterator (Select)
+	seekCost = 100
+	// evalCost is the cost of evaluating a where expression for a row
+	evalCost = 10
+	// tempCost is the cost of adding a row to a temporary index
+	tempCost = 50
+)
+
+// optimize chooses the strategy for a query (for any order)
+// and sets it up to be executed.
+func optimize(q Query) {
+	cost := q.optimize(nil)
+	if cost >= impossible {
+		panic("invalid query: " + q.String())
+	}
+	q.setApproach(nil)
+	if tracing(options.TraceQueryOpt) {
+		trace("optimized:", q.String(), "cost", cost)
+	}
+}
+
+// optTemp returns the cost to read q in index order,
+// adding a temporary index if q can't provide the order
+func optTemp(q Query, index []string) (cost Cost, temp bool) {
+	cost = q.optimize(index)
+	if index == nil || cost < impossible {
+		return cost, false
+	}
+	return tempIndexCost(q), true
+}
+
+// setTemp sets q's approach for index,
+// adding a temporary index if optTemp said it was required
+func setTemp(q Query, index []string, temp bool, th *Thread) Query {
+	if !temp {
+		q.setApproach(index)
+		return q
+	}
+	q.setApproach(nil)
+	if tracing(options.TraceTempIndex) {
+		trace("tempindex:", str.Join("(,)", index...), "on", q.String())
+	}
+	return NewTempIndex(q, index, th)
+}
+
+// tempIndexCost is the cost of reading q into a temporary index
+func tempIndexCost(q Query) Cost {
+	n := q.nrows()
+	return q.optimize(nil) + n*tempCost + n*math.Log2(n+1)
+}
+
+// cache records the cost and approach chosen by optimize for each order,
+// since optimize may be called multiple times with the same order
+type cache struct {
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	cost     Cost
+	approach interface{}
+}
+
+// get returns the cached cost of q for index,
+// calling fn to calculate it if it is not already cached
+func (c *cache) get(q fmt.Stringer, index []string,
+	fn func(index []string) (Cost, interface{})) Cost {
+	key := strings.Join(index, ",")
+	if e, ok := c.entries[key]; ok {
+		return e.cost
+	}
+	cost, app := fn(index)
+	if tracing(options.TraceQueryOpt) {
+		trace("optimize:", q.String(), "index", str.Join("(,)", index...),
+			"cost", cost)
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	c.entries[key] = cacheEntry{cost: cost, approach: app}
+	return cost
+}
+
+// approach returns the approach that optimize chose for index
+func (c *cache) approach(index []string) interface{} {
+	return c.entries[strings.Join(index, ",")].approach
+}
+
+// permutations returns the orderings of cols to try as an index,
+// it is limited since the number grows quickly
+func permutations(cols []string) [][]string {
+	if len(cols) <= 1 || len(cols) > 3 {
+		return [][]string{cols}
+	}
+	var perms [][]string
+	for i, c := range cols {
+		rest := make([]string, 0, len(cols)-1)
+		rest = append(rest, cols[:i]...)
+		rest = append(rest, cols[i+1:]...)
+		for _, p := range permutations(rest) {
+			perms = append(perms, append([]string{c}, p...))
+		}
+	}
+	return perms
+}
+
+// noSelect is used by operations that can't provide an order
+// so they should never be selected
+func noSelect(which string) {
+	panic(which + ": select not supported")
+}
+
+// ranges -----------------------------------------------------------
+
+// bound is one end of a range of packed values
+type bound struct {
+	val  string
+	set  bool
+	incl bool
+}
+
+// colRange is the range of values allowed for a column by a where
+type colRange struct {
+	lo bound
+	hi bound
+}
+
+func (cr *colRange) isEq() bool {
+	return cr.lo.set && cr.hi.set && cr.lo.incl && cr.hi.incl &&
+		cr.lo.val == cr.hi.val
+}
+
+// eqRanges returns the colRanges for a Select of cols equal to vals
+func eqRanges(cols, vals []string) map[string]*colRange {
+	conds := make(map[string]*colRange, len(cols))
+	for i, col := range cols {
+		b := bound{val: vals[i], set: true, incl: true}
+		conds[col] = &colRange{lo: b, hi: b}
+	}
+	return conds
+}
+
+// keyRange returns the range of keys (see ixkey)
+// for an index with the given columns that satisfies conds.
+// raw is whether the index keys are not encoded (a single field).
+// It returns false if conds do not restrict the index.
+// The range may include extra keys (e.g. if values are empty)
+// so the results must still be filtered.
+func keyRange(raw bool, cols []string,
+	conds map[string]*colRange) (ixkey.Range, bool) {
+	if raw {
+		c := conds[cols[0]]
+		if c == nil {
+			return ixkey.All, false
+		}
+		rng := ixkey.All
+		if c.lo.set {
+			rng.Org = c.lo.val
+			if !c.lo.incl {
+				rng.Org += "\x00"
+			}
+		}
+		if c.hi.set {
+			rng.End = c.hi.val
+			if c.hi.incl {
+				rng.End += "\x00"
+			}
+		}
+		return rng, true
+	}
+	// encoded, an equal prefix, optionally followed by a range
+	prefix := ""
+	k := 0
+	for ; k < len(cols); k++ {
+		c := conds[cols[k]]
+		if c == nil || !c.isEq() || c.lo.val == "" {
+			break // empty values may be trimmed from keys
+		}
+		if k > 0 {
+			prefix += "\x00\x00"
+		}
+		prefix += escape(c.lo.val)
+	}
+	rng := ixkey.All
+	base := ""
+	if k > 0 {
+		rng = ixkey.Range{Org: prefix, End: prefix + "\x00\x01"}
+		base = prefix + "\x00\x00"
+	}
+	restricted := k > 0
+	if k < len(cols) {
+		if c := conds[cols[k]]; c != nil {
+			if c.lo.set && !(c.lo.incl && c.lo.val == "") {
+				rng.Org = base + escape(c.lo.val)
+				if !c.lo.incl {
+					rng.Org += "\x00\x01"
+				}
+				restricted = true
+			}
+			if c.hi.set {
+				rng.End = base + escape(c.hi.val)
+				if c.hi.incl {
+					rng.End += "\x00\x01"
+				}
+				restricted = true
+			}
+		}
+	}
+	return rng, restricted
+}
+
+// escape encodes zero bytes the same as ixkey.Spec.Key
+func escape(s string) string {
+	return strings.ReplaceAll(s, "\x00", "\x00\x01")
+}
+
+// intersect returns the intersection of two ranges
+func intersect(r1, r2 ixkey.Range) ixkey.Range {
+	if r2.Org > r1.Org {
+		r1.Org = r2.Org
+	}
+	if r2.End < r1.End {
+		r1.End = r2.End
+	}
+	return r1
+}
@@ -0,0 +1,141 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"strings"
+
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Project keeps only the given columns.
+// If the columns do not contain a key of the source,
+// duplicates are removed, which requires reading all of the source.
+type Project struct {
+	Query1
+	columns []string
+	// unique is true if the columns contain a key of the source
+	unique bool
+	hdr    *Header
+	th     *Thread
+	rows   *rowList
+}
+
+func NewProject(src Query, cols []string, th *Thread) *Project {
+	srchdr := src.Header()
+	for _, col := range cols {
+		if !str.List(srchdr.Columns).Has(col) {
+			panic("project: nonexistent column: " + col)
+		}
+	}
+	hdr := &Header{Fields: srchdr.Fields, Columns: cols}
+	return &Project{Query1: Query1{source: src}, columns: cols,
+		unique: containsKey(cols, src.Keys()), hdr: hdr, th: th}
+}
+
+func (p *Project) String() string {
+	s := p.source.String() + " project"
+	if !p.unique {
+		s += "-dups"
+	}
+	return s + " " + strings.Join(p.columns, ",")
+}
+
+func (p *Project) Header() *Header {
+	return p.hdr
+}
+
+func (p *Project) Keys() [][]string {
+	if p.unique {
+		var keys [][]string
+		for _, key := range p.source.Keys() {
+			if str.List(p.columns).HasAll(key) {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	return [][]string{p.columns}
+}
+
+func (p *Project) Order() []string {
+	order := p.source.Order()
+	if str.List(p.columns).HasAll(order) {
+		return order
+	}
+	return nil
+}
+
+func (p *Project) Rewind() {
+	if p.unique {
+		p.source.Rewind()
+	} else if p.rows != nil {
+		p.rows.rewind()
+	}
+}
+
+func (p *Project) Get(dir Dir) Row {
+	if p.unique {
+		return p.source.Get(dir)
+	}
+	if p.rows == nil {
+		p.rows = &rowList{rows: p.distinct(), pos: -1}
+	}
+	return p.rows.get(dir)
+}
+
+// distinct returns the first row for each distinct set of column values,
+// in source order
+func (p *Project) distinct() []Row {
+	hdr := p.source.Header()
+	seen := map[string]bool{}
+	var rows []Row
+	for _, row := range getAll(p.source) {
+		key := rowKey(p.th, hdr, row, p.columns)
+		if !seen[key] {
+			seen[key] = true
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func (p *Project) Output(rec Record) {
+	if !p.unique {
+		panic("project: can't output when duplicates are removed")
+	}
+	p.source.Output(rec)
+}
+
+func (p *Project) Updateable() string {
+	if !p.unique {
+		return ""
+	}
+	return p.source.Updateable()
+}
+
+func (p *Project) Select(cols, vals []string) {
+	if !p.unique {
+		noSelect("project")
+	}
+	p.source.Select(cols, vals)
+}
+
+func (p *Project) optimize(index []string) Cost {
+	if p.unique {
+		return p.source.optimize(index)
+	}
+	if index != nil {
+		return impossible
+	}
+	return p.source.optimize(nil) + p.source.nrows()*tempCost
+}
+
+func (p *Project) nrows() float64 {
+	if p.unique {
+		return p.source.nrows()
+	}
+	return p.source.nrows() / 2 // ???
+}
@@ -0,0 +1,385 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+// Package query implements executing queries for DbmsLocal.
+// The query tree from the parser (compile/qast)
+// is converted to a tree of operations
+// which iterate over a db19 read or update transaction.
+package query
+
+import (
+	"sort"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/compile"
+	"github.com/apmckinlay/gsuneido/compile/qast"
+	"github.com/apmckinlay/gsuneido/db19/index"
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+	"github.com/apmckinlay/gsuneido/db19/meta"
+	"github.com/apmckinlay/gsuneido/options"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Tran is the interface to the database transaction.
+// It is implemented by db19.ReadTran and db19.UpdateTran
+type Tran interface {
+	GetSchema(table string) *meta.Schema
+	GetInfo(table string) *meta.Info
+	RangeIter(table string, iIndex int, rng ixkey.Range) *index.MergeIter
+	GetRecord(off uint64) Record
+	RangeFrac(table string, iIndex int, org, end string) float64
+	Output(table string, rec Record)
+	Update(table string, oldoff uint64, newrec Record) uint64
+	Delete(table string, off uint64)
+}
+
+// Query is the interface to the query operations
+type Query interface {
+	String() string
+
+	// Header returns the fields (physical) and columns (logical)
+	Header() *Header
+
+	// Keys returns the lists of columns that are unique
+	Keys() [][]string
+
+	// Order returns the columns the results are ordered by, or nil
+	Order() []string
+
+	// Rewind resets so the next Get will start from the beginning or end
+	Rewind()
+
+	// Get returns the next or previous row, or nil at eof.
+	// After eof, the query is rewound.
+	Get(dir Dir) Row
+
+	// Output adds a record to the underlying table
+	Output(rec Record)
+
+	// Updateable returns the name of the underlying table
+	// if the rows can be updated, otherwise ""
+	Updateable() string
+
+	// SetTran sets the transaction used to read the rows.
+	// It is used by cursors, which are given a transaction on each Get.
+	// The position is maintained.
+	SetTran(t Tran)
+
+	// Select restricts the rows to those where cols equal vals (packed).
+	// cols must be a prefix of the index the query was optimized for.
+	// nil cols removes the restriction. It rewinds the query.
+	Select(cols, vals []string)
+
+	// optimize returns the estimated cost of reading all the rows
+	// in the order of index (nil for any order),
+	// or impossible if the query can't provide that order.
+	optimize(index []string) Cost
+
+	// setApproach sets up the query to execute
+	// the strategy that optimize found for index
+	setApproach(index []string)
+
+	// nrows returns the estimated number of rows
+	nrows() float64
+}
+
+// NewQuery parses a query, builds the tree of operations, and optimizes it.
+// The result is Timed, see Close.
+func NewQuery(t Tran, src string) Query {
+	start := time.Now()
+	b := builder{tran: t, th: NewThread(), stats: &stats{}}
+	q := b.query(compile.ParseQuery(src))
+	return &Timed{Query: q, src: src, stats: b.stats, time: time.Since(start)}
+}
+
+// Build converts a query tree from the parser to operations
+// and optimizes it
+func Build(t Tran, th *Thread, q qast.Query) Query {
+	b := builder{tran: t, th: th, stats: &stats{}}
+	return b.query(q)
+}
+
+type builder struct {
+	tran  Tran
+	th    *Thread
+	stats *stats
+}
+
+// query builds and optimizes a query
+func (b *builder) query(q qast.Query) Query {
+	query := b.build(q)
+	optimize(query)
+	if tracing(options.TraceQuery) {
+		trace("query:", q.String(), "=>", query.String())
+	}
+	return query
+}
+
+func (b *builder) build(q qast.Query) Query {
+	switch q := q.(type) {
+	case *qast.Table:
+		tbl := NewTable(b.tran, q.Name)
+		tbl.stats = b.stats
+		return tbl
+	case *qast.Where:
+		return NewWhere(b.build(q.Source), q.Expr, b.th)
+	case *qast.Project:
+		return NewProject(b.build(q.Source), q.Columns, b.th)
+	case *qast.Remove:
+		src := b.build(q.Source)
+		return NewProject(src, removeColumns(src, q.Columns), b.th)
+	case *qast.Rename:
+		return NewRename(b.build(q.Source), q.From, q.To)
+	case *qast.Extend:
+		return NewExtend(b.build(q.Source), q.Cols, q.Exprs, b.th)
+	case *qast.Summarize:
+		return NewSummarize(b.build(q.Source), q.By, q.Cols, q.Ops, q.Ons, b.th)
+	case *qast.Sort:
+		return NewSort(b.build(q.Source), q.Reverse, q.Columns, b.th)
+	case *qast.Join:
+		return NewJoin(b.build(q.Left), b.build(q.Right), q.By, b.th)
+	case *qast.LeftJoin:
+		return NewLeftJoin(b.build(q.Left), b.build(q.Right), q.By, b.th)
+	case *qast.Times:
+		return NewTimes(b.build(q.Left), b.build(q.Right), b.th)
+	case *qast.Union:
+		return NewUnion(b.build(q.Left), b.build(q.Right), b.th)
+	case *qast.Minus:
+		return NewMinus(b.build(q.Left), b.build(q.Right), b.th)
+	case *qast.Intersect:
+		return NewIntersect(b.build(q.Left), b.build(q.Right), b.th)
+	case *qast.Insert, *qast.Update, *qast.Delete:
+		panic("query: use QueryDo for insert, update, or delete")
+	}
+	panic("query: unexpected " + q.String())
+}
+
+func removeColumns(src Query, remove []string) []string {
+	cols := src.Header().Columns
+	for _, col := range remove {
+		if !str.List(cols).Has(col) {
+			panic("remove: nonexistent column: " + col)
+		}
+	}
+	return str.List(cols).Difference(remove)
+}
+
+// GetOne returns the first (Next), last (Prev), or only (Only) row
+// of a query, or nil, nil if there are no rows.
+func GetOne(t Tran, src string, dir Dir) (Row, *Header) {
+	return Get(NewQuery(t, src), src, dir)
+}
+
+// Get is GetOne for an existing query, src is used for error messages.
+// It closes the query.
+func Get(q Query, src string, dir Dir) (Row, *Header) {
+	defer Close(q)
+	var row Row
+	if dir == Only {
+		row = q.Get(Next)
+		if row != nil && q.Get(Next) != nil {
+			panic("Query1 not unique: " + src)
+		}
+	} else {
+		row = q.Get(dir)
+	}
+	if row == nil {
+		return nil, nil
+	}
+	return row, q.Header()
+}
+
+// Query1 is the common base for operations with a single source
+type Query1 struct {
+	source Query
+}
+
+func (q *Query1) Header() *Header {
+	return q.source.Header()
+}
+
+func (q *Query1) Keys() [][]string {
+	return q.source.Keys()
+}
+
+func (q *Query1) Order() []string {
+	return q.source.Order()
+}
+
+func (q *Query1) Rewind() {
+	q.source.Rewind()
+}
+
+func (q *Query1) Output(rec Record) {
+	q.source.Output(rec)
+}
+
+func (q *Query1) Updateable() string {
+	return q.source.Updateable()
+}
+
+func (q *Query1) SetTran(t Tran) {
+	q.source.SetTran(t)
+}
+
+func (q *Query1) Select(cols, vals []string) {
+	q.source.Select(cols, vals)
+}
+
+func (q *Query1) optimize(index []string) Cost {
+	return q.source.optimize(index)
+}
+
+func (q *Query1) setApproach(index []string) {
+	q.source.setApproach(index)
+}
+
+func (q *Query1) nrows() float64 {
+	return q.source.nrows()
+}
+
+// Query2 is the common base for operations with two sources
+type Query2 struct {
+	left  Query
+	right Query
+}
+
+func (q *Query2) Rewind() {
+	q.left.Rewind()
+	q.right.Rewind()
+}
+
+func (q *Query2) SetTran(t Tran) {
+	q.left.SetTran(t)
+	q.right.SetTran(t)
+}
+
+func (q *Query2) Output(Record) {
+	panic("can't output to this query")
+}
+
+func (q *Query2) Updateable() string {
+	return ""
+}
+
+// parenString parenthesizes a source that is not a table
+func parenString(q Query) string {
+	if _, ok := q.(*Table); ok {
+		return q.String()
+	}
+	return "(" + q.String() + ")"
+}
+
+// rowList is used by operations that have to read all their source
+// e.g. sort and summarize
+type rowList struct {
+	rows []Row
+	// pos is the current position, -1 means rewound
+	pos int
+}
+
+func (rl *rowList) rewind() {
+	rl.pos = -1
+}
+
+func (rl *rowList) get(dir Dir) Row {
+	if rl.pos == -1 {
+		if dir == Prev {
+			rl.pos = len(rl.rows)
+		}
+	}
+	if dir == Prev {
+		rl.pos--
+	} else {
+		rl.pos++
+	}
+	if rl.pos < 0 || rl.pos >= len(rl.rows) {
+		rl.pos = -1
+		return nil
+	}
+	return rl.rows[rl.pos]
+}
+
+// keyedRows is a rowList that is sorted by keys
+// so it can be restricted to a range of keys (for Select)
+type keyedRows struct {
+	rowList
+	allKeys []string
+	allRows []Row
+}
+
+func newKeyedRows(keys []string, rows []Row) *keyedRows {
+	return &keyedRows{rowList: rowList{rows: rows, pos: -1},
+		allKeys: keys, allRows: rows}
+}
+
+// selectRange restricts the rows to the ones with keys in rng
+func (kr *keyedRows) selectRange(rng ixkey.Range) {
+	lo := sort.SearchStrings(kr.allKeys, rng.Org)
+	hi := sort.SearchStrings(kr.allKeys, rng.End)
+	if hi < lo {
+		hi = lo
+	}
+	kr.rows = kr.allRows[lo:hi]
+	kr.rewind()
+}
+
+// selectAll removes any restriction
+func (kr *keyedRows) selectAll() {
+	kr.rows = kr.allRows
+	kr.rewind()
+}
+
+// getAll reads all the rows from a query
+func getAll(q Query) []Row {
+	q.Rewind()
+	var rows []Row
+	for row := q.Get(Next); row != nil; row = q.Get(Next) {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// rowKey returns a key (see ixkey) for the values of cols,
+// keys compare in the same order as the values
+func rowKey(th *Thread, hdr *Header, row Row, cols []string) string {
+	rb := RecordBuilder{}
+	fields := make([]int, len(cols))
+	for i, col := range cols {
+		rb.AddRaw(getRaw(th, hdr, row, col))
+		fields[i] = i
+	}
+	spec := ixkey.Spec{Fields: fields}
+	return spec.Key(rb.Build())
+}
+
+// getRaw returns the packed value of a column,
+// using SuRecord to handle rules
+func getRaw(th *Thread, hdr *Header, row Row, col string) string {
+	hdr.EnsureMap()
+	if _, ok := hdr.Map[col]; ok {
+		return row.GetRaw(hdr, col)
+	}
+	rec := SuRecordFromRow(row, hdr, nil)
+	return PackValue(rec.Get(th, SuStr(col)))
+}
+
+// newRow builds a row with a single new record with the values of cols
+func newRow(th *Thread, hdr *Header, row Row, cols []string) Row {
+	rb := RecordBuilder{}
+	for _, col := range cols {
+		rb.AddRaw(getRaw(th, hdr, row, col))
+	}
+	return Row{DbRec{Record: rb.Build()}}
+}
+
+// containsKey returns whether cols contains one of the keys
+func containsKey(cols []string, keys [][]string) bool {
+	for _, key := range keys {
+		if str.List(cols).HasAll(key) {
+			return true
+		}
+	}
+	return false
+}
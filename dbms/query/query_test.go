@@ -0,0 +1,232 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19"
+	"github.com/apmckinlay/gsuneido/options"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestQuery(t *testing.T) {
+	db, err := db19.CreateDatabase("tmp.db")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove("tmp.db")
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+
+	db19.DoAdmin(db, "create cus (ck, name) key(ck)")
+	db19.DoAdmin(db, "create inv (ik, ck, amt) key(ik) index(ck)")
+	db19.DoAdmin(db, "create other (ik, ck, amt) key(ik)")
+	ut := db.NewUpdateTran()
+	output := func(table string, vals ...Value) {
+		var rb RecordBuilder
+		for _, v := range vals {
+			rb.AddRaw(PackValue(v))
+		}
+		ut.Output(table, rb.Build())
+	}
+	output("cus", SuStr("c1"), SuStr("joe"))
+	output("cus", SuStr("c2"), SuStr("sue"))
+	output("cus", SuStr("c3"), SuStr("bob"))
+	output("inv", SuStr("i1"), SuStr("c1"), IntVal(10))
+	output("inv", SuStr("i2"), SuStr("c2"), IntVal(20))
+	output("inv", SuStr("i3"), SuStr("c1"), IntVal(30))
+	output("other", SuStr("i2"), SuStr("c2"), IntVal(20))
+	output("other", SuStr("i4"), SuStr("c4"), IntVal(40))
+	ut.Commit()
+
+	rt := db.NewReadTran()
+	// rows returns the rows of a query as a string
+	rows := func(q Query, dir Dir) string {
+		hdr := q.Header()
+		hdr.EnsureMap()
+		var sb strings.Builder
+		for row := q.Get(dir); row != nil; row = q.Get(dir) {
+			sep := ""
+			for _, col := range hdr.Columns {
+				sb.WriteString(sep + col + "=" + row.Get(hdr, col).String())
+				sep = " "
+			}
+			sb.WriteString("; ")
+		}
+		return sb.String()
+	}
+	test := func(query string, expected string) {
+		t.Helper()
+		q := NewQuery(rt, query)
+		assert.T(t).Msg(query).This(rows(q, Next)).Is(expected)
+		// after eof the query is rewound, so we can read it in reverse
+		prev := rows(q, Prev)
+		if expected != "" {
+			list := strings.Split(strings.TrimSuffix(expected, "; "), "; ")
+			for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+				list[i], list[j] = list[j], list[i]
+			}
+			expected = strings.Join(list, "; ") + "; "
+		}
+		assert.T(t).Msg(query + " reverse").This(prev).Is(expected)
+	}
+	test("cus",
+		`ck="c1" name="joe"; ck="c2" name="sue"; ck="c3" name="bob"; `)
+	test("cus where name = 'sue'", `ck="c2" name="sue"; `)
+	test("cus where name > 'c' and ck isnt 'c1'", `ck="c2" name="sue"; `)
+	test("cus where name =~ '^b'", `ck="c3" name="bob"; `)
+	test("cus where ck in ('c1', 'c3') project name",
+		`name="joe"; name="bob"; `)
+	test("inv project ck", `ck="c1"; ck="c2"; `)
+	test("inv remove ik, amt", `ck="c1"; ck="c2"; `)
+	test("cus rename name to who where who = 'joe'", `ck="c1" who="joe"; `)
+	test("inv extend x = amt * 2, y = x + 1 where ik = 'i2'",
+		`ik="i2" ck="c2" amt=20 x=40 y=41; `)
+	test("cus sort name",
+		`ck="c3" name="bob"; ck="c1" name="joe"; ck="c2" name="sue"; `)
+	test("cus sort reverse name",
+		`ck="c2" name="sue"; ck="c1" name="joe"; ck="c3" name="bob"; `)
+	test("inv sort ck",
+		`ik="i1" ck="c1" amt=10; ik="i3" ck="c1" amt=30; ik="i2" ck="c2" amt=20; `)
+	test("cus join inv",
+		`ck="c1" name="joe" ik="i1" amt=10; ck="c1" name="joe" ik="i3" amt=30; `+
+			`ck="c2" name="sue" ik="i2" amt=20; `)
+	test("cus leftjoin by(ck) inv where ck is 'c3'",
+		`ck="c3" name="bob" ik="" amt=""; `)
+	test("cus where ck = 'c1' times (other project amt)",
+		`ck="c1" name="joe" amt=20; ck="c1" name="joe" amt=40; `)
+	test("inv summarize count, total amt",
+		`count=3 total_amt=60; `)
+	test("inv summarize ck, n = count, max amt, list ik",
+		`ck="c1" n=2 max_amt=30 list_ik=#("i1", "i3"); `+
+			`ck="c2" n=1 max_amt=20 list_ik=#("i2"); `)
+	test("inv union other",
+		`ik="i1" ck="c1" amt=10; ik="i2" ck="c2" amt=20; `+
+			`ik="i3" ck="c1" amt=30; ik="i4" ck="c4" amt=40; `)
+	test("inv minus other",
+		`ik="i1" ck="c1" amt=10; ik="i3" ck="c1" amt=30; `)
+	test("inv intersect other", `ik="i2" ck="c2" amt=20; `)
+	test("cus where ck = 'none'", "")
+
+	// strategy checks the optimizer's choices
+	strategy := func(query string, expected string) {
+		t.Helper()
+		assert.T(t).Msg(query).This(NewQuery(rt, query).String()).Is(expected)
+	}
+	strategy("cus where ck = 'c1'", `cus^(ck) where^(ck) Binary(Is ck "c1")`)
+	strategy("inv sort ck", "inv^(ck) sort ck")
+	strategy("inv sort amt", "inv^(ik) tempindex(amt) sort amt")
+	strategy("inv join cus", "inv^(ik) join n:1 by(ck) cus^(ck)")
+	strategy("inv join (cus where ck = 'c1')",
+		`inv^(ck) join swap n:1 by(ck) (cus^(ck) where^(ck) Binary(Is ck "c1"))`)
+	test("inv join (cus where ck = 'c1')",
+		`ik="i1" ck="c1" amt=10 name="joe"; ik="i3" ck="c1" amt=30 name="joe"; `)
+	assert.T(t).This(func() { NewQuery(rt, "inv union other").Select(nil, nil) }).
+		Panics("select not supported")
+
+	q := NewQuery(rt, "cus")
+	q.Header().EnsureMap()
+	assert.T(t).This(q.Get(Next).Get(q.Header(), "ck")).Is(SuStr("c1"))
+	assert.T(t).This(q.Get(Next).Get(q.Header(), "ck")).Is(SuStr("c2"))
+	q.Rewind()
+	assert.T(t).This(q.Get(Prev).Get(q.Header(), "ck")).Is(SuStr("c3"))
+	assert.T(t).This(q.Keys()).Is([][]string{{"ck"}})
+
+	row, hdr := GetOne(rt, "cus where ck = 'c2'", Only)
+	hdr.EnsureMap()
+	assert.T(t).This(row.Get(hdr, "name")).Is(SuStr("sue"))
+	assert.T(t).This(func() { GetOne(rt, "cus", Only) }).
+		Panics("Query1 not unique")
+	row, _ = GetOne(rt, "cus", Prev)
+	assert.T(t).This(row.Get(hdr, "ck")).Is(SuStr("c3"))
+	row, _ = GetOne(rt, "cus where ck = 'c9'", Next)
+	assert.T(t).That(row == nil)
+	assert.T(t).This(func() { NewQuery(rt, "nonexistent") }).
+		Panics("nonexistent table")
+	assert.T(t).This(func() { NewQuery(rt, "cus project xyz") }).
+		Panics("nonexistent column")
+	assert.T(t).This(func() { DoRequest(rt, "delete cus") }).
+		Panics("read-only")
+
+	ut = db.NewUpdateTran()
+	assert.T(t).This(DoRequest(ut, "insert { ck: 'c4', name: 'ann' } into cus")).
+		Is(1)
+	assert.T(t).This(DoRequest(ut, "update cus where ck = 'c1' set name = 'joey'")).
+		Is(1)
+	assert.T(t).This(DoRequest(ut, "delete inv where ck = 'c1'")).Is(2)
+	assert.T(t).This(DoRequest(ut, "insert other where ik = 'i4' into inv")).
+		Is(1)
+	ut.Commit()
+	rt = db.NewReadTran()
+	test("cus",
+		`ck="c1" name="joey"; ck="c2" name="sue"; ck="c3" name="bob"; `+
+			`ck="c4" name="ann"; `)
+	test("inv", `ik="i2" ck="c2" amt=20; ik="i4" ck="c4" amt=40; `)
+
+	// Timed counts the rows read and returned for the slow query log
+	counts := func(query string, nread, nget int) {
+		t.Helper()
+		q := NewQuery(rt, query).(*Timed)
+		rows(q, Next)
+		assert.T(t).Msg(query).This(q.stats.nread).Is(nread)
+		assert.T(t).Msg(query).This(q.nget).Is(nget)
+	}
+	counts("cus", 4, 4)
+	counts("cus where ck = 'c2'", 1, 1)
+	counts("cus where name = 'sue'", 4, 1)
+	counts("inv join cus", 4, 2)
+
+	// tracing
+	var traced []string
+	defer func(fn func(...interface{})) { trace = fn }(trace)
+	trace = func(args ...interface{}) {
+		traced = append(traced, strings.TrimSpace(fmt.Sprintln(args...)))
+	}
+	defer func(t int) { options.Trace = t }(options.Trace)
+	defer func(d time.Duration) { options.SlowQuery = d }(options.SlowQuery)
+	options.Trace = options.TraceQuery | options.TraceTable |
+		options.TraceSelect | options.TraceTempIndex | options.TraceQueryOpt |
+		options.TraceSlowQuery
+	options.SlowQuery = 0
+	q = NewQuery(rt, "inv join cus sort name")
+	assert.T(t).This(rows(q, Next)).
+		Is(`ik="i4" ck="c4" amt=40 name="ann"; ik="i2" ck="c2" amt=20 name="sue"; `)
+	Close(q)
+	// hasTrace returns whether there was a line starting with prefix
+	hasTrace := func(prefix string) bool {
+		for _, s := range traced {
+			if strings.HasPrefix(s, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, x := range []string{"optimize: ", "table: cus^(ck)",
+		"tempindex: (name) on", "optimized: ", "select: cus^(ck) ck=\"c2\"",
+		"query: (inv join cus) sort name => (inv^(ik) join n:1 by(ck) cus^(ck))"} {
+		assert.T(t).Msg(x).That(hasTrace(x))
+	}
+	slow := traced[len(traced)-1]
+	assert.T(t).That(strings.HasPrefix(slow, "slow query: "))
+	assert.T(t).That(strings.HasSuffix(slow, " inv join cus sort name => "+
+		"(inv^(ik) join n:1 by(ck) cus^(ck)) tempindex(name) sort name "+
+		"read 4 returned 2"))
+	// queries faster than SlowQuery are not traced
+	traced = nil
+	options.SlowQuery = time.Hour
+	q = NewQuery(rt, "inv join cus sort name")
+	rows(q, Next)
+	Close(q)
+	assert.T(t).That(hasTrace("query: "))
+	assert.T(t).That(!hasTrace("slow query: "))
+	assert.T(t).This(selectString([]string{"a", "b"},
+		[]string{PackValue(IntVal(1)), PackValue(SuStr("x"))})).Is(`a=1 b="x"`)
+	assert.T(t).This(selectString(nil, nil)).Is("all")
+}
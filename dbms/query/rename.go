@@ -0,0 +1,106 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Rename renames columns, the rows are not changed, only the header
+type Rename struct {
+	Query1
+	from []string
+	to   []string
+	hdr  *Header
+}
+
+func NewRename(src Query, from, to []string) *Rename {
+	srchdr := src.Header()
+	cols := srchdr.Columns
+	for i := range from {
+		if !str.List(cols).Has(from[i]) {
+			panic("rename: nonexistent column: " + from[i])
+		}
+		if str.List(cols).Has(to[i]) {
+			panic("rename: column already exists: " + to[i])
+		}
+		cols = renameList(cols, from[i:i+1], to[i:i+1])
+	}
+	fields := make([][]string, len(srchdr.Fields))
+	for i, flds := range srchdr.Fields {
+		fields[i] = renameList(flds, from, to)
+	}
+	return &Rename{Query1: Query1{source: src}, from: from, to: to,
+		hdr: &Header{Fields: fields, Columns: cols}}
+}
+
+// renameList returns a copy of list with the renames applied in order
+func renameList(list, from, to []string) []string {
+	list2 := make([]string, len(list))
+	copy(list2, list)
+	for i := range from {
+		if j := str.List(list2).Index(from[i]); j != -1 {
+			list2[j] = to[i]
+		}
+	}
+	return list2
+}
+
+func (r *Rename) String() string {
+	s := r.source.String() + " rename "
+	sep := ""
+	for i := range r.from {
+		s += sep + r.from[i] + " to " + r.to[i]
+		sep = ", "
+	}
+	return s
+}
+
+func (r *Rename) Header() *Header {
+	return r.hdr
+}
+
+func (r *Rename) Keys() [][]string {
+	keys := r.source.Keys()
+	keys2 := make([][]string, len(keys))
+	for i, key := range keys {
+		keys2[i] = renameList(key, r.from, r.to)
+	}
+	return keys2
+}
+
+func (r *Rename) Order() []string {
+	return renameList(r.source.Order(), r.from, r.to)
+}
+
+func (r *Rename) Get(dir Dir) Row {
+	return r.source.Get(dir)
+}
+
+// renameBack reverses the renames, for passing columns to the source
+func (r *Rename) renameBack(cols []string) []string {
+	if cols == nil {
+		return nil
+	}
+	cols = append([]string(nil), cols...)
+	for i := len(r.to) - 1; i >= 0; i-- {
+		if j := str.List(cols).Index(r.to[i]); j != -1 {
+			cols[j] = r.from[i]
+		}
+	}
+	return cols
+}
+
+func (r *Rename) Select(cols, vals []string) {
+	r.source.Select(r.renameBack(cols), vals)
+}
+
+func (r *Rename) optimize(index []string) Cost {
+	return r.source.optimize(r.renameBack(index))
+}
+
+func (r *Rename) setApproach(index []string) {
+	r.source.setApproach(r.renameBack(index))
+}
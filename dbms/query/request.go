@@ -0,0 +1,89 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"github.com/apmckinlay/gsuneido/compile"
+	"github.com/apmckinlay/gsuneido/compile/qast"
+	. "github.com/apmckinlay/gsuneido/runtime"
+)
+
+// DoRequest executes an insert, update, or delete (i.e. QueryDo)
+// and returns the number of records processed.
+func DoRequest(t Tran, src string) int {
+	th := NewThread()
+	b := builder{tran: t, th: th}
+	switch q := compile.ParseQuery(src).(type) {
+	case *qast.Insert:
+		return b.insert(q)
+	case *qast.Update:
+		return b.update(q)
+	case *qast.Delete:
+		return b.delete(q)
+	default:
+		return b.insert(&qast.Insert{Source: q})
+	}
+}
+
+func (b *builder) insert(q *qast.Insert) int {
+	if q.Into == nil {
+		panic("query: expecting insert, update, or delete")
+	}
+	into := b.build(q.Into)
+	hdr := into.Header()
+	if q.Record != nil {
+		into.Output(ToContainer(q.Record).ToRecord(b.th, hdr))
+		return 1
+	}
+	src := b.query(q.Source)
+	srchdr := src.Header()
+	n := 0
+	for _, row := range getAll(src) {
+		rec := SuRecordFromRow(row, srchdr, nil)
+		into.Output(rec.ToRecord(b.th, hdr))
+		n++
+	}
+	return n
+}
+
+func (b *builder) update(q *qast.Update) int {
+	src := b.query(q.Query)
+	tbl := updateable(src, "update")
+	tblhdr := tableHeader(b.tran.GetSchema(tbl))
+	hdr := src.Header()
+	ctx := context{th: b.th}
+	// read all the rows first so we don't see our own updates
+	rows := getAll(src)
+	for _, row := range rows {
+		ctx.set(hdr, row)
+		vals := make([]Value, len(q.Cols))
+		for i, e := range q.Exprs {
+			vals[i] = ctx.eval(e)
+		}
+		rec := SuRecordFromRow(row, hdr, nil)
+		for i, col := range q.Cols {
+			rec.Put(b.th, SuStr(col), vals[i])
+		}
+		b.tran.Update(tbl, uint64(row[0].Adr), rec.ToRecord(b.th, tblhdr))
+	}
+	return len(rows)
+}
+
+func (b *builder) delete(q *qast.Delete) int {
+	src := b.query(q.Query)
+	tbl := updateable(src, "delete")
+	rows := getAll(src)
+	for _, row := range rows {
+		b.tran.Delete(tbl, uint64(row[0].Adr))
+	}
+	return len(rows)
+}
+
+func updateable(q Query, which string) string {
+	tbl := q.Updateable()
+	if tbl == "" {
+		panic(which + ": query not updateable")
+	}
+	return tbl
+}
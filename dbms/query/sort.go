@@ -0,0 +1,80 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"strings"
+
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Sort orders the rows by columns.
+// The optimizer either reads the source by an index with the right order
+// or adds a temporary index.
+type Sort struct {
+	Query1
+	cache
+	reverse bool
+	columns []string
+	th      *Thread
+}
+
+func NewSort(src Query, reverse bool, cols []string, th *Thread) *Sort {
+	for _, col := range cols {
+		if !str.List(src.Header().Columns).Has(col) {
+			panic("sort: nonexistent column: " + col)
+		}
+	}
+	return &Sort{Query1: Query1{source: src}, reverse: reverse, columns: cols,
+		th: th}
+}
+
+// hasPrefix returns whether order starts with cols
+func hasPrefix(order, cols []string) bool {
+	return len(order) >= len(cols) && str.List(order[:len(cols)]).Equal(cols)
+}
+
+func (s *Sort) String() string {
+	str := s.source.String() + " sort "
+	if s.reverse {
+		str += "reverse "
+	}
+	return str + strings.Join(s.columns, ",")
+}
+
+func (s *Sort) Order() []string {
+	return s.columns
+}
+
+func (s *Sort) Get(dir Dir) Row {
+	if s.reverse {
+		dir = reverseDir(dir)
+	}
+	return s.source.Get(dir)
+}
+
+func reverseDir(dir Dir) Dir {
+	if dir == Prev {
+		return Next
+	}
+	return Prev
+}
+
+func (s *Sort) optimize(index []string) Cost {
+	if index != nil {
+		return impossible
+	}
+	return s.cache.get(s, index, s.optimize2)
+}
+
+func (s *Sort) optimize2([]string) (Cost, interface{}) {
+	cost, temp := optTemp(s.source, s.columns)
+	return cost, temp
+}
+
+func (s *Sort) setApproach(index []string) {
+	temp := s.cache.approach(index).(bool)
+	s.source = setTemp(s.source, s.columns, temp, s.th)
+}
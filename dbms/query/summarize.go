@@ -0,0 +1,312 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"sort"
+	"strings"
+
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Summarize groups the rows by the by columns
+// and calculates count, total, average, max, min, or list for each group.
+// It reads all of the source and returns the groups ordered by the by columns.
+type Summarize struct {
+	Query1
+	by   []string
+	cols []string
+	ops  []string
+	ons  []string
+	hdr  *Header
+	th   *Thread
+	rows *keyedRows
+	// selCols and selVals are a Select to apply when the rows are read
+	selCols []string
+	selVals []string
+}
+
+func NewSummarize(src Query, by, cols, ops, ons []string,
+	th *Thread) *Summarize {
+	srccols := src.Header().Columns
+	for _, col := range by {
+		if !str.List(srccols).Has(col) {
+			panic("summarize: nonexistent column: " + col)
+		}
+	}
+	cols2 := make([]string, len(cols))
+	for i, col := range cols {
+		if ons[i] != "" && !str.List(srccols).Has(ons[i]) {
+			panic("summarize: nonexistent column: " + ons[i])
+		}
+		if col == "" {
+			col = ops[i]
+			if ons[i] != "" {
+				col += "_" + ons[i]
+			}
+		}
+		cols2[i] = col
+	}
+	flds := append(append([]string{}, by...), cols2...)
+	return &Summarize{Query1: Query1{source: src}, by: by, cols: cols2,
+		ops: ops, ons: ons, th: th,
+		hdr: &Header{Fields: [][]string{flds}, Columns: flds}}
+}
+
+func (su *Summarize) String() string {
+	s := su.source.String() + " summarize "
+	if len(su.by) > 0 {
+		s += strings.Join(su.by, ", ") + ", "
+	}
+	sep := ""
+	for i, col := range su.cols {
+		s += sep + col + " = " + su.ops[i]
+		if su.ons[i] != "" {
+			s += " " + su.ons[i]
+		}
+		sep = ", "
+	}
+	return s
+}
+
+func (su *Summarize) Header() *Header {
+	return su.hdr
+}
+
+func (su *Summarize) Keys() [][]string {
+	return [][]string{su.by}
+}
+
+func (su *Summarize) Order() []string {
+	return su.by
+}
+
+func (su *Summarize) Rewind() {
+	if su.rows != nil {
+		su.rows.rewind()
+	}
+}
+
+func (su *Summarize) Get(dir Dir) Row {
+	if su.rows == nil {
+		su.rows = newKeyedRows(su.summarize())
+		su.Select(su.selCols, su.selVals)
+	}
+	return su.rows.get(dir)
+}
+
+func (su *Summarize) Output(Record) {
+	panic("summarize: can't output")
+}
+
+func (su *Summarize) Updateable() string {
+	return ""
+}
+
+func (su *Summarize) Select(cols, vals []string) {
+	if su.rows == nil {
+		// wait till the rows are read
+		su.selCols, su.selVals = cols, vals
+		return
+	}
+	if cols == nil {
+		su.rows.selectAll()
+		return
+	}
+	rng, _ := keyRange(len(su.by) == 1, cols, eqRanges(cols, vals))
+	su.rows.selectRange(rng)
+}
+
+func (su *Summarize) optimize(index []string) Cost {
+	if !hasPrefix(su.by, index) {
+		return impossible
+	}
+	return su.source.optimize(nil) + su.source.nrows()*tempCost
+}
+
+func (su *Summarize) setApproach([]string) {
+	su.source.setApproach(nil)
+}
+
+func (su *Summarize) nrows() float64 {
+	if len(su.by) == 0 {
+		return 1
+	}
+	return su.source.nrows() / 2 // ???
+}
+
+type sumGroup struct {
+	by   []string // packed
+	vals []summer
+}
+
+// summarize returns the group keys and rows, ordered by the keys
+func (su *Summarize) summarize() ([]string, []Row) {
+	hdr := su.source.Header()
+	groups := map[string]*sumGroup{}
+	var keys []string
+	for _, row := range getAll(su.source) {
+		key := rowKey(su.th, hdr, row, su.by)
+		g, ok := groups[key]
+		if !ok {
+			g = su.newGroup(hdr, row)
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		for i, s := range g.vals {
+			var x Value
+			if su.ons[i] != "" {
+				x = Unpack(getRaw(su.th, hdr, row, su.ons[i]))
+			}
+			s.add(x)
+		}
+	}
+	if len(su.by) == 0 && len(keys) == 0 {
+		// no by columns always gives one row
+		g := su.newGroup(hdr, nil)
+		groups[""] = g
+		keys = append(keys, "")
+	}
+	sort.Strings(keys)
+	rows := make([]Row, len(keys))
+	for i, key := range keys {
+		g := groups[key]
+		rb := RecordBuilder{}
+		for _, b := range g.by {
+			rb.AddRaw(b)
+		}
+		for _, s := range g.vals {
+			rb.AddRaw(PackValue(s.result()))
+		}
+		rows[i] = Row{DbRec{Record: rb.Build()}}
+	}
+	return keys, rows
+}
+
+func (su *Summarize) newGroup(hdr *Header, row Row) *sumGroup {
+	g := &sumGroup{by: make([]string, len(su.by)),
+		vals: make([]summer, len(su.ops))}
+	for i, col := range su.by {
+		g.by[i] = getRaw(su.th, hdr, row, col)
+	}
+	for i, op := range su.ops {
+		g.vals[i] = newSummer(op)
+	}
+	return g
+}
+
+// summer accumulates one summarize operation
+type summer interface {
+	add(x Value)
+	result() Value
+}
+
+func newSummer(op string) summer {
+	switch op {
+	case "count":
+		return &sumCount{}
+	case "total":
+		return &sumTotal{total: Zero}
+	case "average":
+		return &sumAverage{total: Zero}
+	case "max":
+		return &sumMax{}
+	case "min":
+		return &sumMin{}
+	case "list":
+		return &sumList{list: &SuObject{}}
+	}
+	panic("summarize: invalid operation: " + op)
+}
+
+type sumCount struct {
+	count int
+}
+
+func (s *sumCount) add(Value) {
+	s.count++
+}
+
+func (s *sumCount) result() Value {
+	return IntVal(s.count)
+}
+
+type sumTotal struct {
+	total Value
+}
+
+func (s *sumTotal) add(x Value) {
+	s.total = OpAdd(s.total, x)
+}
+
+func (s *sumTotal) result() Value {
+	return s.total
+}
+
+type sumAverage struct {
+	count int
+	total Value
+}
+
+func (s *sumAverage) add(x Value) {
+	s.count++
+	s.total = OpAdd(s.total, x)
+}
+
+func (s *sumAverage) result() Value {
+	if s.count == 0 {
+		return Zero
+	}
+	return OpDiv(s.total, IntVal(s.count))
+}
+
+type sumMax struct {
+	max Value
+}
+
+func (s *sumMax) add(x Value) {
+	if s.max == nil || x.Compare(s.max) > 0 {
+		s.max = x
+	}
+}
+
+func (s *sumMax) result() Value {
+	if s.max == nil {
+		return EmptyStr
+	}
+	return s.max
+}
+
+type sumMin struct {
+	min Value
+}
+
+func (s *sumMin) add(x Value) {
+	if s.min == nil || x.Compare(s.min) < 0 {
+		s.min = x
+	}
+}
+
+func (s *sumMin) result() Value {
+	if s.min == nil {
+		return EmptyStr
+	}
+	return s.min
+}
+
+// sumList is the list of unique values
+type sumList struct {
+	list *SuObject
+}
+
+func (s *sumList) add(x Value) {
+	if s.list.Find(x) == False {
+		s.list.Add(x)
+	}
+}
+
+func (s *sumList) result() Value {
+	return s.list
+}
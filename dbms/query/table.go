@@ -0,0 +1,247 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"github.com/apmckinlay/gsuneido/db19/index"
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+	"github.com/apmckinlay/gsuneido/db19/meta"
+	"github.com/apmckinlay/gsuneido/options"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/ascii"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Table is the leaf of a query, it iterates over one of the table's indexes
+type Table struct {
+	tran   Tran
+	name   string
+	schema *meta.Schema
+	hdr    *Header
+	// iIndex is the index used to read the table
+	iIndex int
+	// rng is the range of the index to read, set by Where
+	rng ixkey.Range
+	// sel is the range set by Select
+	sel  ixkey.Range
+	iter *index.MergeIter
+	// cur is the key of the current row, if within
+	cur    string
+	within bool
+	// resumed is the direction that iter was restricted to
+	// when it was recreated after SetTran, otherwise 0
+	resumed Dir
+	// stats is shared with the rest of the query, it may be nil
+	stats *stats
+}
+
+func NewTable(t Tran, name string) *Table {
+	ts := t.GetSchema(name)
+	if ts == nil {
+		panic("nonexistent table: " + name)
+	}
+	return &Table{tran: t, name: name, schema: ts, hdr: tableHeader(ts),
+		rng: ixkey.All, sel: ixkey.All}
+}
+
+// tableHeader handles derived columns the same as dbmsClient.getHdr
+// i.e. rules are not capitalized and _lower! are columns but not fields
+func tableHeader(ts *meta.Schema) *Header {
+	fields := ts.Columns
+	columns := make([]string, 0, len(ts.Columns)+len(ts.Derived))
+	for _, col := range ts.Columns {
+		if col != "-" {
+			columns = append(columns, col)
+		}
+	}
+	for _, col := range ts.Derived {
+		if ascii.IsUpper(col[0]) {
+			col = str.UnCapitalize(col)
+		}
+		columns = append(columns, col)
+	}
+	return &Header{Fields: [][]string{fields}, Columns: columns}
+}
+
+func (tbl *Table) String() string {
+	return tbl.name + "^" + str.Join("(,)", tbl.Order()...)
+}
+
+func (tbl *Table) Header() *Header {
+	return tbl.hdr
+}
+
+func (tbl *Table) Keys() [][]string {
+	var keys [][]string
+	for i := range tbl.schema.Indexes {
+		ix := &tbl.schema.Indexes[i]
+		if ix.Mode == 'k' {
+			keys = append(keys, ix.Columns)
+		}
+	}
+	return keys
+}
+
+func (tbl *Table) Order() []string {
+	return tbl.schema.Indexes[tbl.iIndex].Columns
+}
+
+// SetIndex chooses the index with the given columns.
+// It returns false if there is no such index.
+func (tbl *Table) SetIndex(cols []string) bool {
+	for i := range tbl.schema.Indexes {
+		if str.List(tbl.schema.Indexes[i].Columns).Equal(cols) {
+			tbl.setIndex(i)
+			return true
+		}
+	}
+	return false
+}
+
+func (tbl *Table) setIndex(i int) {
+	tbl.iIndex = i
+	tbl.newIter()
+	if tracing(options.TraceTable) {
+		trace("table:", tbl.String())
+	}
+}
+
+// setRange restricts the table to a range of the current index
+func (tbl *Table) setRange(rng ixkey.Range) {
+	tbl.rng = rng
+	tbl.newIter()
+}
+
+// newIter discards the iterator and the position
+// so the next Get will start from the beginning or end
+func (tbl *Table) newIter() {
+	tbl.iter = nil
+	tbl.within = false
+	tbl.resumed = 0
+}
+
+// Indexes returns the columns of the table's indexes
+func (tbl *Table) Indexes() [][]string {
+	idxs := make([][]string, len(tbl.schema.Indexes))
+	for i := range tbl.schema.Indexes {
+		idxs[i] = tbl.schema.Indexes[i].Columns
+	}
+	return idxs
+}
+
+func (tbl *Table) Rewind() {
+	if tbl.resumed != 0 {
+		tbl.newIter()
+	} else if tbl.iter != nil {
+		tbl.iter.Rewind()
+	}
+	tbl.within = false
+}
+
+func (tbl *Table) SetTran(t Tran) {
+	if t != tbl.tran {
+		tbl.tran = t
+		tbl.iter = nil // recreated from the current position by Get
+	}
+}
+
+func (tbl *Table) Get(dir Dir) Row {
+	if dir != Prev {
+		dir = Next
+	}
+	if tbl.iter == nil || (tbl.resumed != 0 && tbl.resumed != dir) {
+		tbl.resume(dir)
+	}
+	if dir == Prev {
+		tbl.iter.Prev()
+	} else {
+		tbl.iter.Next()
+	}
+	if tbl.iter.Eof() {
+		tbl.Rewind()
+		return nil
+	}
+	if tbl.stats != nil {
+		tbl.stats.nread++
+	}
+	var off uint64
+	tbl.cur, off = tbl.iter.Cur()
+	tbl.within = true
+	return Row{DbRec{Record: tbl.tran.GetRecord(off), Adr: int(off)}}
+}
+
+// resume creates the iterator.
+// If there is a current position (e.g. after SetTran)
+// the iterator is restricted to continue from it in the direction dir.
+func (tbl *Table) resume(dir Dir) {
+	rng := intersect(tbl.rng, tbl.sel)
+	tbl.resumed = 0
+	if tbl.within {
+		if dir == Prev {
+			rng = intersect(rng, ixkey.Range{Org: "", End: tbl.cur})
+		} else {
+			rng = intersect(rng, ixkey.Range{Org: tbl.cur + "\x00", End: ixkey.Max})
+		}
+		tbl.resumed = dir
+	}
+	tbl.iter = tbl.tran.RangeIter(tbl.name, tbl.iIndex, rng)
+}
+
+func (tbl *Table) Output(rec Record) {
+	tbl.tran.Output(tbl.name, rec)
+}
+
+func (tbl *Table) Updateable() string {
+	return tbl.name
+}
+
+func (tbl *Table) Select(cols, vals []string) {
+	if tracing(options.TraceSelect) {
+		trace("select:", tbl.String(), selectString(cols, vals))
+	}
+	tbl.sel = ixkey.All
+	if cols != nil {
+		tbl.sel, _ = keyRange(tbl.raw(tbl.iIndex), cols, eqRanges(cols, vals))
+	}
+	tbl.newIter()
+}
+
+// raw returns whether the keys of an index are not encoded
+func (tbl *Table) raw(i int) bool {
+	is := tbl.schema.Indexes[i].Ixspec
+	return len(is.Fields) == 1 && len(is.Fields2) == 0
+}
+
+// optimize ------------------------------------------------------------
+
+func (tbl *Table) optimize(index []string) Cost {
+	if tbl.findIndex(index) == -1 {
+		return impossible
+	}
+	return tbl.cost(1)
+}
+
+// findIndex returns the first index that starts with cols, or -1
+func (tbl *Table) findIndex(cols []string) int {
+	for i := range tbl.schema.Indexes {
+		if hasPrefix(tbl.schema.Indexes[i].Columns, cols) {
+			return i
+		}
+	}
+	return -1
+}
+
+// cost returns the cost of reading a fraction of the table
+func (tbl *Table) cost(frac float64) Cost {
+	ti := tbl.tran.GetInfo(tbl.name)
+	return frac * (float64(ti.Size) + float64(ti.Nrows)*keyCost)
+}
+
+func (tbl *Table) setApproach(index []string) {
+	tbl.setIndex(tbl.findIndex(index))
+}
+
+func (tbl *Table) nrows() float64 {
+	return float64(tbl.tran.GetInfo(tbl.name).Nrows)
+}
@@ -0,0 +1,108 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"sort"
+
+	"github.com/apmckinlay/gsuneido/options"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// TempIndex is added by the optimizer when a query must be read
+// in an order that its source can't provide.
+// It reads all of the source and sorts it.
+type TempIndex struct {
+	Query1
+	columns []string
+	th      *Thread
+	rows    *keyedRows
+	// selCols and selVals are a Select to apply when the rows are read
+	selCols []string
+	selVals []string
+}
+
+func NewTempIndex(src Query, cols []string, th *Thread) *TempIndex {
+	return &TempIndex{Query1: Query1{source: src}, columns: cols, th: th}
+}
+
+func (ti *TempIndex) String() string {
+	return parenString(ti.source) + " tempindex" + str.Join("(,)", ti.columns...)
+}
+
+func (ti *TempIndex) Order() []string {
+	return ti.columns
+}
+
+func (ti *TempIndex) Rewind() {
+	if ti.rows != nil {
+		ti.rows.rewind()
+	}
+}
+
+func (ti *TempIndex) Get(dir Dir) Row {
+	ti.build()
+	return ti.rows.get(dir)
+}
+
+func (ti *TempIndex) build() {
+	if ti.rows != nil {
+		return
+	}
+	hdr := ti.source.Header()
+	rows := getAll(ti.source)
+	keys := make([]string, len(rows))
+	for i, row := range rows {
+		keys[i] = rowKey(ti.th, hdr, row, ti.columns)
+	}
+	sort.Stable(byKey{keys: keys, rows: rows})
+	ti.rows = newKeyedRows(keys, rows)
+	ti.Select(ti.selCols, ti.selVals)
+}
+
+type byKey struct {
+	keys []string
+	rows []Row
+}
+
+func (bk byKey) Len() int {
+	return len(bk.keys)
+}
+
+func (bk byKey) Less(i, j int) bool {
+	return bk.keys[i] < bk.keys[j]
+}
+
+func (bk byKey) Swap(i, j int) {
+	bk.keys[i], bk.keys[j] = bk.keys[j], bk.keys[i]
+	bk.rows[i], bk.rows[j] = bk.rows[j], bk.rows[i]
+}
+
+func (ti *TempIndex) Select(cols, vals []string) {
+	if tracing(options.TraceSelect) {
+		trace("select:", ti.String(), selectString(cols, vals))
+	}
+	if ti.rows == nil {
+		// wait till the rows are read
+		ti.selCols, ti.selVals = cols, vals
+		return
+	}
+	if cols == nil {
+		ti.rows.selectAll()
+		return
+	}
+	rng, _ := keyRange(len(ti.columns) == 1, cols, eqRanges(cols, vals))
+	ti.rows.selectRange(rng)
+}
+
+func (ti *TempIndex) optimize(index []string) Cost {
+	if index != nil && !hasPrefix(ti.columns, index) {
+		return impossible
+	}
+	return tempIndexCost(ti.source)
+}
+
+func (ti *TempIndex) setApproach([]string) {
+}
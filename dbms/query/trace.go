@@ -0,0 +1,82 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"strings"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/options"
+	. "github.com/apmckinlay/gsuneido/runtime"
+)
+
+// Query tracing
+//
+// TraceQuery traces each query and the strategy chosen for it,
+// TraceTable the index chosen for each table,
+// TraceSelect each Select, TraceTempIndex each temporary index,
+// and TraceQueryOpt the costs estimated by the optimizer.
+// TraceSlowQuery traces queries that take longer than options.SlowQuery
+// with their strategy and the number of rows read and returned.
+
+// trace outputs the query tracing, tests replace it to capture the output
+var trace = Trace
+
+func tracing(flag int) bool {
+	return options.Trace&flag != 0
+}
+
+// stats are shared by the operations of one query
+type stats struct {
+	// nread is the number of rows read from tables
+	nread int
+}
+
+// Timed is the root of a query from NewQuery.
+// It records the time spent building and reading the query
+// so Close can trace slow queries.
+type Timed struct {
+	Query
+	src   string
+	stats *stats
+	// nget is the number of rows returned
+	nget int
+	time time.Duration
+}
+
+func (t *Timed) Get(dir Dir) Row {
+	start := time.Now()
+	row := t.Query.Get(dir)
+	t.time += time.Since(start)
+	if row != nil {
+		t.nget++
+	}
+	return row
+}
+
+// Close traces the query if it was slow.
+// It should be called when a query from NewQuery is no longer needed.
+func Close(q Query) {
+	if t, ok := q.(*Timed); ok && tracing(options.TraceSlowQuery) &&
+		t.time >= options.SlowQuery {
+		trace("slow query:", t.time.Round(time.Millisecond), t.src,
+			"=>", t.Query.String(),
+			"read", t.stats.nread, "returned", t.nget)
+	}
+}
+
+// selectString formats a Select for tracing
+func selectString(cols, vals []string) string {
+	if cols == nil {
+		return "all"
+	}
+	var sb strings.Builder
+	for i, col := range cols {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(col + "=" + Unpack(vals[i]).String())
+	}
+	return sb.String()
+}
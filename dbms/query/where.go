@@ -0,0 +1,248 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package query
+
+import (
+	"github.com/apmckinlay/gsuneido/compile/ast"
+	tok "github.com/apmckinlay/gsuneido/compile/tokens"
+	"github.com/apmckinlay/gsuneido/db19/index/ixkey"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+)
+
+// Where returns the rows from its source for which the expression is true.
+// If the source is a table, the optimizer uses the conditions
+// on indexed columns to only read a range of an index.
+type Where struct {
+	Query1
+	cache
+	expr ast.Expr
+	ctx  context
+	// conds are the ranges of the columns from the expression
+	conds map[string]*colRange
+	// idx is the index used for a range, nil if none
+	idx []string
+	// nr caches nrows, -1 if not calculated yet
+	nr float64
+}
+
+// whereApproach is the index and range chosen by optimize
+type whereApproach struct {
+	iIndex int
+	rng    ixkey.Range
+}
+
+// whereFrac is the fraction of rows assumed to be selected
+// when the expression can't be estimated from an index
+const whereFrac = .5
+
+func NewWhere(src Query, expr ast.Expr, th *Thread) *Where {
+	w := &Where{Query1: Query1{source: src}, expr: expr,
+		ctx: context{th: th}, nr: -1}
+	w.conds = w.colRanges(expr)
+	return w
+}
+
+func (w *Where) String() string {
+	s := w.source.String() + " where"
+	if w.idx != nil {
+		s += "^" + str.Join("(,)", w.idx...)
+	}
+	return s + " " + w.expr.String()
+}
+
+func (w *Where) Get(dir Dir) Row {
+	hdr := w.source.Header()
+	for {
+		row := w.source.Get(dir)
+		if row == nil {
+			return nil
+		}
+		w.ctx.set(hdr, row)
+		if w.ctx.eval(w.expr) == True {
+			return row
+		}
+	}
+}
+
+// colRanges extracts the ranges of columns
+// from the top level and'ed comparisons of columns to constants
+func (w *Where) colRanges(expr ast.Expr) map[string]*colRange {
+	conds := map[string]*colRange{}
+	exprs := []ast.Expr{expr}
+	if nary, ok := expr.(*ast.Nary); ok && nary.Tok == tok.And {
+		exprs = nary.Exprs
+	}
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *ast.Binary:
+			w.binaryRange(conds, e)
+		case *ast.In:
+			w.inRange(conds, e)
+		}
+	}
+	return conds
+}
+
+func (w *Where) binaryRange(conds map[string]*colRange, e *ast.Binary) {
+	op := e.Tok
+	col, ok1 := w.field(e.Lhs)
+	c, ok2 := e.Rhs.(*ast.Constant)
+	if !ok1 || !ok2 {
+		col, ok1 = w.field(e.Rhs)
+		c, ok2 = e.Lhs.(*ast.Constant)
+		if !ok1 || !ok2 {
+			return
+		}
+		op = reverseOp[op]
+	}
+	val := PackValue(c.Val)
+	var cr colRange
+	switch op {
+	case tok.Is:
+		cr.lo = bound{val: val, set: true, incl: true}
+		cr.hi = cr.lo
+	case tok.Lt, tok.Lte:
+		cr.hi = bound{val: val, set: true, incl: op == tok.Lte}
+	case tok.Gt, tok.Gte:
+		cr.lo = bound{val: val, set: true, incl: op == tok.Gte}
+	default:
+		return
+	}
+	addRange(conds, col, cr)
+}
+
+// reverseOp is used to handle constant < column
+var reverseOp = map[tok.Token]tok.Token{tok.Is: tok.Is,
+	tok.Lt: tok.Gt, tok.Lte: tok.Gte, tok.Gt: tok.Lt, tok.Gte: tok.Lte}
+
+// inRange treats col in (values) as a range from the min to the max
+func (w *Where) inRange(conds map[string]*colRange, e *ast.In) {
+	col, ok := w.field(e.E)
+	if !ok || len(e.Exprs) == 0 {
+		return
+	}
+	var cr colRange
+	for _, e2 := range e.Exprs {
+		c, ok := e2.(*ast.Constant)
+		if !ok {
+			return
+		}
+		val := PackValue(c.Val)
+		if !cr.lo.set || val < cr.lo.val {
+			cr.lo = bound{val: val, set: true, incl: true}
+		}
+		if !cr.hi.set || val > cr.hi.val {
+			cr.hi = bound{val: val, set: true, incl: true}
+		}
+	}
+	addRange(conds, col, cr)
+}
+
+// field returns the column name if e is a physical field of the source
+func (w *Where) field(e ast.Expr) (string, bool) {
+	id, ok := e.(*ast.Ident)
+	if !ok {
+		return "", false
+	}
+	hdr := w.source.Header()
+	hdr.EnsureMap()
+	_, ok = hdr.Map[id.Name]
+	return id.Name, ok
+}
+
+// addRange combines (intersects) a range with any existing one for col
+func addRange(conds map[string]*colRange, col string, cr colRange) {
+	prev, ok := conds[col]
+	if !ok {
+		conds[col] = &cr
+		return
+	}
+	if cr.lo.set && (!prev.lo.set || cr.lo.val > prev.lo.val ||
+		(cr.lo.val == prev.lo.val && !cr.lo.incl)) {
+		prev.lo = cr.lo
+	}
+	if cr.hi.set && (!prev.hi.set || cr.hi.val < prev.hi.val ||
+		(cr.hi.val == prev.hi.val && !cr.hi.incl)) {
+		prev.hi = cr.hi
+	}
+}
+
+// optimize ------------------------------------------------------------
+
+func (w *Where) optimize(index []string) Cost {
+	return w.cache.get(w, index, w.optimize2)
+}
+
+func (w *Where) optimize2(index []string) (Cost, interface{}) {
+	tbl, ok := w.source.(*Table)
+	if !ok {
+		src := w.source.optimize(index)
+		return src + w.source.nrows()*evalCost, nil
+	}
+	best := impossible
+	var app *whereApproach
+	for i, ix := range tbl.schema.Indexes {
+		if index != nil && !hasPrefix(ix.Columns, index) {
+			continue
+		}
+		rng, frac := w.indexRange(tbl, i)
+		cost := tbl.cost(frac) + frac*tbl.nrows()*evalCost
+		if cost < best {
+			best = cost
+			app = &whereApproach{iIndex: i, rng: rng}
+		}
+	}
+	if app == nil {
+		return best, nil
+	}
+	return best, app
+}
+
+// indexRange returns the range of an index that satisfies the conditions
+// and the estimated fraction of the table that it contains
+func (w *Where) indexRange(tbl *Table, i int) (ixkey.Range, float64) {
+	rng, ok := keyRange(tbl.raw(i), tbl.schema.Indexes[i].Columns, w.conds)
+	if !ok {
+		return ixkey.All, 1
+	}
+	return rng, tbl.tran.RangeFrac(tbl.name, i, rng.Org, rng.End)
+}
+
+func (w *Where) setApproach(index []string) {
+	app, ok := w.cache.approach(index).(*whereApproach)
+	if !ok {
+		w.source.setApproach(index)
+		return
+	}
+	tbl := w.source.(*Table)
+	tbl.setIndex(app.iIndex)
+	if app.rng != ixkey.All {
+		tbl.setRange(app.rng)
+		w.idx = tbl.schema.Indexes[app.iIndex].Columns
+	}
+}
+
+// nrows uses the most selective index range if the source is a table
+func (w *Where) nrows() float64 {
+	if w.nr < 0 {
+		w.nr = w.nrows2()
+	}
+	return w.nr
+}
+
+func (w *Where) nrows2() float64 {
+	frac := 1.0
+	if tbl, ok := w.source.(*Table); ok {
+		for i := range tbl.schema.Indexes {
+			if _, f := w.indexRange(tbl, i); f < frac {
+				frac = f
+			}
+		}
+	}
+	if frac == 1 {
+		frac = whereFrac
+	}
+	return w.source.nrows() * frac
+}
@@ -0,0 +1,841 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package dbms
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/dbms/commands"
+	"github.com/apmckinlay/gsuneido/dbms/csio"
+	"github.com/apmckinlay/gsuneido/options"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/str"
+	"github.com/apmckinlay/gsuneido/util/tlsconf"
+)
+
+// serverConn is one client connection to the server.
+// Each connection is handled by its own goroutine
+// so the connection state does not need locking,
+// except for what is reported to other connections by Connections.
+type serverConn struct {
+	*csio.ReadWrite
+	dbms    *DbmsLocal
+	conn    net.Conn
+	id      int
+	thread  *Thread
+	trans   map[int]ITran
+	queries map[int]IQuery
+	cursors map[int]ICursor
+	// remote is the client's address (without the port)
+	remote string
+	// sessionId is initially remote, guarded by serverConns.lock
+	sessionId string
+	// ntrans and ncursors are the number of open transactions and cursors
+	ntrans   int32
+	ncursors int32
+	// lastActive is the time of the last request in unix nanoseconds
+	lastActive int64
+	// auth is whether the connection is authorized, see auth.go
+	auth bool
+	// nonce is from the last Nonce, it is cleared by Auth
+	nonce string
+	// user is the user the connection was authorized for
+	user string
+	// perms restrict the authorized user, nil is unrestricted, see perms.go
+	perms *perms
+	// profile is set by Profile, responses are followed by the server time
+	profile bool
+}
+
+// Server listens for client connections on options.Port
+// and handles each one in its own goroutine. It does not return.
+// If options.TLSCert is set, connections use TLS.
+func Server(dbms *DbmsLocal) {
+	l, err := net.Listen("tcp", ":"+options.Port)
+	if err != nil {
+		log.Fatalln("server:", err)
+	}
+	if options.TLSCert != "" {
+		config, err := tlsconf.Server(options.TLSCert, options.TLSKey)
+		if err != nil {
+			log.Fatalln("server:", err)
+		}
+		l = tls.NewListener(l, config)
+	}
+	if !authRequired(dbms.db) {
+		log.Println("WARNING: no users table, connections are not authorized")
+	}
+	Serve(dbms, l)
+}
+
+// Serve accepts and handles connections from a listener
+// until the listener is closed.
+// Tokens from before it was started are not valid.
+func Serve(dbms *DbmsLocal, l net.Listener) {
+	tokens.clear()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("server:", err)
+				continue
+			}
+			return // listener closed
+		}
+		go newServerConn(dbms, conn).serve()
+	}
+}
+
+func newServerConn(dbms *DbmsLocal, conn net.Conn) *serverConn {
+	remote := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	sc := &serverConn{dbms: dbms, conn: conn, id: newNum(),
+		trans:   make(map[int]ITran),
+		queries: make(map[int]IQuery),
+		cursors: make(map[int]ICursor),
+		remote:  remote, sessionId: remote,
+		lastActive: time.Now().UnixNano()}
+	sc.ReadWrite = csio.NewReadWrite(conn).OnError(sc.lostConn)
+	return sc
+}
+
+// hello returns the initial message sent to the client.
+// It must be helloSize, padded with zero bytes.
+// It is followed by the capabilities of the server,
+// other clients only look at the start.
+func hello() []byte {
+	buf := make([]byte, helloSize)
+	copy(buf, "Suneido "+options.BuiltDate+"\r\n"+
+		helloCompress+" "+helloProfile)
+	return buf
+}
+
+// connLost is the panic value used to end a connection
+type connLost struct {
+	err error
+}
+
+func (sc *serverConn) lostConn(err error) {
+	panic(connLost{err})
+}
+
+func (sc *serverConn) serve() {
+	serverConns.add(sc)
+	defer sc.close()
+	if _, err := sc.conn.Write(hello()); err != nil {
+		return
+	}
+	sc.auth = !authRequired(sc.dbms.db)
+	sc.thread = NewThread()
+	sc.thread.SetDbms(sc.dbms)
+	for {
+		read, written := sc.Counts()
+		sc.request(sc.GetCmd(), read, written)
+	}
+}
+
+// request handles a single request, returning errors to the client.
+// read and written are the byte counts before the request, for profiling.
+func (sc *serverConn) request(cmd commands.Command, read, written int64) {
+	start := time.Now()
+	defer func() {
+		if e := recover(); e != nil {
+			if _, ok := e.(connLost); ok {
+				panic(e) // handled by close
+			}
+			if !sc.ResetWrite() { // discard any partial response
+				// part of the response has been sent
+				log.Println("server:", cmd, e)
+				sc.conn.Close()
+				panic(connLost{})
+			}
+			sc.PutBool(false).PutStr(fmt.Sprint(e))
+		}
+		elapsed := sc.endResponse(start)
+		sc.Flush()
+		if csio.Profiling() {
+			r, w := sc.Counts()
+			_, arg := sc.LastRequest()
+			csio.Profile("server", &csio.RoundTrip{Cmd: cmd, Arg: arg,
+				ReqBytes: r - read, RespBytes: w - written,
+				Total: elapsed, Server: elapsed, Who: sc.sessionId})
+		}
+	}()
+	if int(cmd) >= len(cmds) || cmds[cmd] == nil {
+		sc.conn.Close()
+		panic(connLost{})
+	}
+	atomic.StoreInt64(&sc.lastActive, time.Now().UnixNano())
+	if !sc.auth && !noAuth[cmd] {
+		// the arguments have not been read
+		// so the connection can not continue
+		sc.PutBool(false).PutStr("not authorized")
+		sc.endResponse(start)
+		sc.Flush()
+		sc.conn.Close()
+		panic(connLost{})
+	}
+	sc.thread.Reset()
+	cmds[cmd](sc)
+}
+
+// endResponse adds the server time to the response if profiling.
+// It returns the server time.
+func (sc *serverConn) endResponse(start time.Time) time.Duration {
+	elapsed := time.Since(start)
+	if sc.profile {
+		sc.PutInt64(int64(elapsed / time.Microsecond))
+	}
+	return elapsed
+}
+
+func (sc *serverConn) close() {
+	if e := recover(); e != nil {
+		if _, ok := e.(connLost); !ok {
+			log.Println("server:", e)
+		}
+	}
+	for _, q := range sc.queries {
+		q.Close()
+	}
+	for _, c := range sc.cursors {
+		c.Close()
+	}
+	for _, t := range sc.trans {
+		t.Abort()
+	}
+	if sc.thread != nil {
+		sc.thread.Close()
+	}
+	sc.conn.Close()
+	serverConns.remove(sc)
+}
+
+// connections -----------------------------------------------------
+
+// connRegistry is the set of live connections.
+// It is used by Connections and Kill (from other connections)
+// so it must be locked.
+type connRegistry struct {
+	lock  sync.Mutex
+	conns map[int]*serverConn
+}
+
+var serverConns = connRegistry{conns: make(map[int]*serverConn)}
+
+func (cr *connRegistry) add(sc *serverConn) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.conns[sc.id] = sc
+}
+
+func (cr *connRegistry) remove(sc *serverConn) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	delete(cr.conns, sc.id)
+}
+
+// ConnInfo is the information about a connection returned by ConnInfos
+type ConnInfo struct {
+	SessionId  string
+	RemoteAddr string
+	Trans      int
+	Cursors    int
+	Idle       time.Duration
+}
+
+// ConnInfos returns information about the current connections,
+// ordered by when they connected
+func ConnInfos() []ConnInfo {
+	cr := &serverConns
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	ids := make([]int, 0, len(cr.conns))
+	for id := range cr.conns {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	now := time.Now().UnixNano()
+	infos := make([]ConnInfo, len(ids))
+	for i, id := range ids {
+		sc := cr.conns[id]
+		infos[i] = ConnInfo{SessionId: sc.sessionId, RemoteAddr: sc.remote,
+			Trans:   int(atomic.LoadInt32(&sc.ntrans)),
+			Cursors: int(atomic.LoadInt32(&sc.ncursors)),
+			Idle:    time.Duration(now - atomic.LoadInt64(&sc.lastActive))}
+	}
+	return infos
+}
+
+// sessionIds returns the session ids of the current connections
+func (cr *connRegistry) sessionIds() []string {
+	infos := ConnInfos()
+	ids := make([]string, len(infos))
+	for i, info := range infos {
+		ids[i] = info.SessionId
+	}
+	return ids
+}
+
+// kill closes the connections with the given session id
+// and returns how many there were.
+// Closing the network connection makes the connection's goroutine
+// get an error on its next read, it then aborts its transactions.
+func (cr *connRegistry) kill(sessionId string) int {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	n := 0
+	for _, sc := range cr.conns {
+		if sc.sessionId == sessionId {
+			sc.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// setSessionId sets the session id if id is not "" and returns it
+func (cr *connRegistry) setSessionId(sc *serverConn, id string) string {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if id != "" {
+		sc.sessionId = id
+	}
+	return sc.sessionId
+}
+
+// nextNum is used to assign transaction, query, and cursor numbers
+var nextNum int32
+
+func newNum() int {
+	return int(atomic.AddInt32(&nextNum, 1))
+}
+
+//-------------------------------------------------------------------
+
+var cmds = [...]func(sc *serverConn){
+	commands.Abort:        cmdAbort,
+	commands.Admin:        cmdAdmin,
+	commands.Auth:         cmdAuth,
+	commands.Backup:       cmdBackup,
+	commands.Check:        cmdCheck,
+	commands.Close:        cmdClose,
+	commands.Compact:      cmdCompact,
+	commands.Commit:       cmdCommit,
+	commands.Compress:     cmdCompress,
+	commands.Connections:  cmdConnections,
+	commands.Cursor:       cmdCursor,
+	commands.Cursors:      cmdCursors,
+	commands.Dump:         cmdDump,
+	commands.Erase:        cmdErase,
+	commands.Exec:         cmdExec,
+	commands.Strategy:     cmdStrategy,
+	commands.Final:        cmdFinal,
+	commands.Get:          cmdGet,
+	commands.Get1:         cmdGet1,
+	commands.Header:       cmdHeader,
+	commands.Info:         cmdInfo,
+	commands.Keys:         cmdKeys,
+	commands.Kill:         cmdKill,
+	commands.LibGet:       cmdLibGet,
+	commands.Libraries:    cmdLibraries,
+	commands.Load:         cmdLoad,
+	commands.Log:          cmdLog,
+	commands.Nonce:        cmdNonce,
+	commands.Order:        cmdOrder,
+	commands.Output:       cmdOutput,
+	commands.Profile:      cmdProfile,
+	commands.Query:        cmdQuery,
+	commands.ReadCount:    cmdReadCount,
+	commands.Request:      cmdRequest,
+	commands.Rewind:       cmdRewind,
+	commands.Run:          cmdRun,
+	commands.SessionId:    cmdSessionId,
+	commands.Size:         cmdSize,
+	commands.Timestamp:    cmdTimestamp,
+	commands.Token:        cmdToken,
+	commands.Transaction:  cmdTransaction,
+	commands.Transactions: cmdTransactions,
+	commands.Update:       cmdUpdate,
+	commands.WriteCount:   cmdWriteCount,
+}
+
+func cmdAbort(sc *serverConn) {
+	tn := sc.GetInt()
+	sc.tran(tn).Abort()
+	sc.endTran(tn)
+	sc.PutBool(true)
+}
+
+func cmdAdmin(sc *serverConn) {
+	request := sc.GetStr()
+	sc.perms.checkAdmin(request)
+	sc.dbms.Admin(request)
+	sc.PutBool(true)
+}
+
+// cmdAuth, cmdNonce, and cmdToken are handled by the connection,
+// not the dbms, since authorization is per connection
+
+func cmdAuth(sc *serverConn) {
+	user, result := auth(sc.dbms.db, sc.nonce, sc.GetStr())
+	sc.nonce = "" // a nonce can only be used once
+	if result {
+		sc.auth = true
+		sc.user = user
+		sc.perms = loadPerms(sc.dbms.db, user)
+		// code run by Exec uses the thread's dbms
+		if sc.perms == nil {
+			sc.thread.SetDbms(sc.dbms)
+		} else {
+			sc.thread.SetDbms(&permDbms{DbmsLocal: sc.dbms, perms: sc.perms})
+		}
+	}
+	sc.PutBool(true).PutBool(result)
+}
+
+// cmdCheck requires unrestricted access to the database
+func cmdCheck(sc *serverConn) {
+	sc.perms.checkDatabase()
+	result := sc.dbms.Check()
+	sc.PutBool(true).PutStr(result)
+}
+
+func cmdClose(sc *serverConn) {
+	id := sc.GetInt()
+	switch qcType(sc.GetByte()) {
+	case query:
+		sc.query(id).Close()
+		delete(sc.queries, id)
+	case cursor:
+		sc.cursor(id).Close()
+		delete(sc.cursors, id)
+		atomic.AddInt32(&sc.ncursors, -1)
+	default:
+		panic("invalid query/cursor type")
+	}
+	sc.PutBool(true)
+}
+
+func cmdCommit(sc *serverConn) {
+	tn := sc.GetInt()
+	result := sc.tran(tn).Complete()
+	sc.endTran(tn)
+	sc.PutBool(true)
+	if result == "" {
+		sc.PutBool(true)
+	} else {
+		sc.PutBool(false).PutStr(result)
+	}
+}
+
+// cmdCompress switches the connection to compression
+// after sending the (uncompressed) response, see csio.Compress
+func cmdCompress(sc *serverConn) {
+	sc.PutBool(true)
+	sc.Flush()
+	sc.Compress()
+}
+
+func cmdConnections(sc *serverConn) {
+	result := sc.dbms.Connections()
+	sc.PutBool(true).PutVal(result)
+}
+
+func cmdCursor(sc *serverConn) {
+	cursor := sc.dbms.cursor(sc.GetStr(), sc.perms)
+	cn := newNum()
+	sc.cursors[cn] = cursor
+	atomic.AddInt32(&sc.ncursors, 1)
+	sc.PutBool(true).PutInt(cn)
+}
+
+func cmdCursors(sc *serverConn) {
+	result := sc.dbms.Cursors()
+	sc.PutBool(true).PutInt(result)
+}
+
+// cmdBackup requires unrestricted access to the database
+func cmdBackup(sc *serverConn) {
+	to := sc.GetStr()
+	sc.perms.checkDatabase()
+	result := sc.dbms.Backup(to)
+	sc.PutBool(true).PutStr(result)
+}
+
+// cmdCompact requires unrestricted access to the database
+func cmdCompact(sc *serverConn) {
+	sc.perms.checkDatabase()
+	result := sc.dbms.Compact()
+	sc.PutBool(true).PutStr(result)
+}
+
+// cmdDump requires unrestricted access to the database
+func cmdDump(sc *serverConn) {
+	table := sc.GetStr()
+	sc.perms.checkDatabase()
+	result := sc.dbms.Dump(table)
+	sc.PutBool(true).PutStr(result)
+}
+
+func cmdErase(sc *serverConn) {
+	tran := sc.tran(sc.GetInt())
+	tran.Erase(sc.GetInt())
+	sc.PutBool(true)
+}
+
+func cmdExec(sc *serverConn) {
+	result := sc.dbms.Exec(sc.thread, sc.GetVal())
+	sc.PutBool(true)
+	sc.putResult(result)
+}
+
+func cmdStrategy(sc *serverConn) {
+	result := sc.getQC().Strategy()
+	sc.PutBool(true).PutStr(result)
+}
+
+func cmdFinal(sc *serverConn) {
+	result := sc.dbms.Final()
+	sc.PutBool(true).PutInt(result)
+}
+
+func cmdGet(sc *serverConn) {
+	dir := Dir(sc.GetByte())
+	tn := sc.GetInt()
+	id := sc.GetInt()
+	var row Row
+	var hdr *Header
+	if tn == 0 {
+		q := sc.query(id)
+		row = q.Get(dir)
+		hdr = q.Header()
+	} else {
+		c := sc.cursor(id)
+		row = c.Get(sc.tran(tn), dir)
+		hdr = c.Header()
+	}
+	sc.PutBool(true)
+	if row == nil {
+		sc.PutBool(false)
+		return
+	}
+	sc.PutBool(true).PutInt(rowAdr(row)).PutRec(rowToRecord(row, hdr))
+}
+
+func cmdGet1(sc *serverConn) {
+	dir := Dir(sc.GetByte())
+	tn := sc.GetInt()
+	query := sc.GetStr()
+	var row Row
+	var hdr *Header
+	if tn == 0 {
+		row, hdr = sc.dbms.get(query, dir, sc.perms)
+	} else {
+		row, hdr = sc.tran(tn).Get(query, dir)
+	}
+	sc.PutBool(true)
+	if hdr == nil {
+		sc.PutBool(false)
+		return
+	}
+	sc.PutBool(true).PutInt(rowAdr(row))
+	sc.putHdr(hdr)
+	sc.PutRec(rowToRecord(row, hdr))
+}
+
+func cmdHeader(sc *serverConn) {
+	hdr := sc.getQC().Header()
+	sc.PutBool(true)
+	sc.putHdr(hdr)
+}
+
+func cmdInfo(sc *serverConn) {
+	result := sc.dbms.Info()
+	sc.PutBool(true).PutVal(result)
+}
+
+func cmdKeys(sc *serverConn) {
+	keys := sc.getQC().Keys()
+	sc.PutBool(true).PutInt(keys.ListSize())
+	for i := 0; i < keys.ListSize(); i++ {
+		var cols []string
+		if key := ToStr(keys.ListGet(i)); key != "" {
+			cols = strings.Split(key, ",")
+		}
+		sc.PutInt(len(cols))
+		for _, col := range cols {
+			sc.PutStr(col)
+		}
+	}
+}
+
+// cmdKill requires unrestricted access to the database
+func cmdKill(sc *serverConn) {
+	sessionId := sc.GetStr()
+	sc.perms.checkDatabase()
+	result := sc.dbms.Kill(sessionId)
+	sc.PutBool(true).PutInt(result)
+}
+
+func cmdLibGet(sc *serverConn) {
+	defs := sc.dbms.LibGet(sc.GetStr())
+	sc.PutBool(true).PutInt(len(defs) / 2)
+	for i := 0; i < len(defs); i += 2 {
+		sc.PutStr(defs[i]).PutInt(len(defs[i+1]))
+	}
+	for i := 1; i < len(defs); i += 2 {
+		sc.PutRaw(defs[i])
+	}
+}
+
+func cmdLibraries(sc *serverConn) {
+	libs := sc.dbms.Libraries()
+	sc.PutBool(true)
+	sc.putStrings(libs)
+}
+
+// cmdLoad requires unrestricted access to the database
+func cmdLoad(sc *serverConn) {
+	table := sc.GetStr()
+	sc.perms.checkDatabase()
+	result := sc.dbms.Load(table)
+	sc.PutBool(true).PutInt(result)
+}
+
+func cmdLog(sc *serverConn) {
+	sc.dbms.Log(sc.GetStr())
+	sc.PutBool(true)
+}
+
+func cmdNonce(sc *serverConn) {
+	sc.nonce = random(nonceSize)
+	sc.PutBool(true).PutStr(sc.nonce)
+}
+
+func cmdOrder(sc *serverConn) {
+	order := sc.getQC().Order()
+	sc.PutBool(true)
+	sc.putStrings(order)
+}
+
+func cmdOutput(sc *serverConn) {
+	q := sc.query(sc.GetInt())
+	q.Output(Record(sc.GetStr()))
+	sc.PutBool(true)
+}
+
+// cmdProfile makes the following responses, including this one,
+// be followed by the server time (see endResponse)
+func cmdProfile(sc *serverConn) {
+	sc.profile = true
+	sc.PutBool(true)
+}
+
+func cmdQuery(sc *serverConn) {
+	tran := sc.tran(sc.GetInt())
+	q := tran.Query(sc.GetStr())
+	qn := newNum()
+	sc.queries[qn] = q
+	sc.PutBool(true).PutInt(qn)
+}
+
+func cmdReadCount(sc *serverConn) {
+	result := sc.tran(sc.GetInt()).ReadCount()
+	sc.PutBool(true).PutInt(result)
+}
+
+func cmdRequest(sc *serverConn) {
+	tran := sc.tran(sc.GetInt())
+	result := tran.Request(sc.GetStr())
+	sc.PutBool(true).PutInt(result)
+}
+
+func cmdRewind(sc *serverConn) {
+	sc.getQC().Rewind()
+	sc.PutBool(true)
+}
+
+// cmdRun requires unrestricted access to the database
+// since it does not run with the connection's permissions
+func cmdRun(sc *serverConn) {
+	code := sc.GetStr()
+	sc.perms.checkDatabase()
+	result := sc.dbms.Run(code)
+	sc.PutBool(true)
+	sc.putResult(result)
+}
+
+// cmdSessionId is handled by the connection, not the dbms,
+// since each connection has its own session id
+func cmdSessionId(sc *serverConn) {
+	result := serverConns.setSessionId(sc, sc.GetStr())
+	sc.PutBool(true).PutStr(result)
+}
+
+func cmdSize(sc *serverConn) {
+	result := sc.dbms.Size()
+	sc.PutBool(true).PutInt64(result)
+}
+
+func cmdTimestamp(sc *serverConn) {
+	result := sc.dbms.Timestamp()
+	sc.PutBool(true).PutVal(result)
+}
+
+// cmdToken is not in noAuth so the connection must be authorized
+func cmdToken(sc *serverConn) {
+	token := random(tokenSize)
+	tokens.add(token, sc.user)
+	sc.PutBool(true).PutStr(token)
+}
+
+func cmdTransaction(sc *serverConn) {
+	tran := sc.dbms.transaction(sc.GetBool(), sc.perms)
+	tn := newNum()
+	sc.trans[tn] = tran
+	atomic.AddInt32(&sc.ntrans, 1)
+	sc.PutBool(true).PutInt(tn)
+}
+
+func cmdTransactions(sc *serverConn) {
+	list := sc.dbms.Transactions()
+	sc.PutBool(true).PutInt(list.ListSize())
+	for i := 0; i < list.ListSize(); i++ {
+		sc.PutInt(ToInt(list.ListGet(i)))
+	}
+}
+
+func cmdUpdate(sc *serverConn) {
+	tran := sc.tran(sc.GetInt())
+	adr := sc.GetInt()
+	rec := Record(sc.GetStr())
+	result := tran.Update(adr, rec)
+	sc.PutBool(true).PutInt(result)
+}
+
+func cmdWriteCount(sc *serverConn) {
+	result := sc.tran(sc.GetInt()).WriteCount()
+	sc.PutBool(true).PutInt(result)
+}
+
+//-------------------------------------------------------------------
+
+func (sc *serverConn) tran(tn int) ITran {
+	if tran, ok := sc.trans[tn]; ok {
+		return tran
+	}
+	panic("transaction not found")
+}
+
+// endTran removes a completed or aborted transaction
+func (sc *serverConn) endTran(tn int) {
+	delete(sc.trans, tn)
+	atomic.AddInt32(&sc.ntrans, -1)
+}
+
+func (sc *serverConn) query(qn int) IQuery {
+	if q, ok := sc.queries[qn]; ok {
+		return q
+	}
+	panic("query not found")
+}
+
+func (sc *serverConn) cursor(cn int) ICursor {
+	if c, ok := sc.cursors[cn]; ok {
+		return c
+	}
+	panic("cursor not found")
+}
+
+// getQC reads the id and query/cursor type
+// and returns the corresponding IQueryCursor
+func (sc *serverConn) getQC() IQueryCursor {
+	id := sc.GetInt()
+	switch qcType(sc.GetByte()) {
+	case query:
+		return sc.query(id)
+	case cursor:
+		return sc.cursor(id)
+	}
+	panic("invalid query/cursor type")
+}
+
+func (sc *serverConn) putResult(result Value) {
+	if result == nil {
+		sc.PutBool(false)
+	} else {
+		sc.PutBool(true).PutVal(result)
+	}
+}
+
+func (sc *serverConn) putStrings(list *SuObject) {
+	sc.PutInt(list.ListSize())
+	for i := 0; i < list.ListSize(); i++ {
+		sc.PutStr(ToStr(list.ListGet(i)))
+	}
+}
+
+// putHdr sends the header in the format expected by dbmsClient.getHdr
+// i.e. the fields, followed by the rules capitalized
+func (sc *serverConn) putHdr(hdr *Header) {
+	fields := hdrFields(hdr)
+	rules := hdr.Rules()
+	sc.PutInt(len(fields) + len(rules))
+	for _, fld := range fields {
+		sc.PutStr(fld)
+	}
+	for _, rule := range rules {
+		sc.PutStr(str.Capitalize(rule))
+	}
+}
+
+// hdrFields returns the fields from all the records in a header.
+// Since rows are sent to the client as a single record,
+// this is the order of the fields in the combined record.
+func hdrFields(hdr *Header) []string {
+	if len(hdr.Fields) == 1 {
+		return hdr.Fields[0]
+	}
+	var fields []string
+	for _, flds := range hdr.Fields {
+		fields = append(fields, flds...)
+	}
+	return fields
+}
+
+// rowToRecord combines the records in a row into a single record
+func rowToRecord(row Row, hdr *Header) Record {
+	if len(row) == 1 {
+		return row[0].Record
+	}
+	var rb RecordBuilder
+	for i, flds := range hdr.Fields {
+		for j := range flds {
+			if i < len(row) && row[i].Record != "" {
+				rb.AddRaw(row[i].GetRaw(j))
+			} else {
+				rb.AddRaw("")
+			}
+		}
+	}
+	return rb.Build()
+}
+
+func rowAdr(row Row) int {
+	if len(row) == 0 {
+		return 0
+	}
+	return row[0].Adr
+}
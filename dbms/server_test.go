@@ -0,0 +1,443 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package dbms
+
+import (
+	"crypto/sha1"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19"
+	"github.com/apmckinlay/gsuneido/dbms/commands"
+	"github.com/apmckinlay/gsuneido/dbms/csio"
+	"github.com/apmckinlay/gsuneido/options"
+	. "github.com/apmckinlay/gsuneido/runtime"
+	"github.com/apmckinlay/gsuneido/util/assert"
+)
+
+func TestClientServer(t *testing.T) {
+	dir := t.TempDir()
+	db, err := db19.CreateDatabase(filepath.Join(dir, "tmp.db"))
+	assert.T(t).That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.T(t).That(err == nil)
+	defer l.Close()
+	go Serve(NewDbmsLocal(db).(*DbmsLocal), l)
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	options.Compress = true
+	defer func() { options.Compress = false }()
+	dc := NewDbmsClient("127.0.0.1", port)
+	defer dc.Close()
+	assert.T(t).This(dc.Check()).Is("")
+	ts1 := dc.Timestamp()
+	ts2 := dc.Timestamp()
+	assert.T(t).That(ts1.Compare(ts2) < 0)
+	// errors are returned to the client, connection continues
+	assert.T(t).This(func() { dc.Run("") }).
+		Panics("(from server)")
+	dc.Admin("create tbl (a, b) key(a)")
+	tran := dc.Transaction(true)
+	assert.T(t).This(tran.Request("insert { a: 1, b: 2 } into tbl")).Is(1)
+	assert.T(t).This(tran.Complete()).Is("")
+	tran = dc.Transaction(false)
+	q := tran.Query("tbl")
+	hdr := q.Header()
+	hdr.EnsureMap()
+	assert.T(t).This(q.Get(Next).Get(hdr, "b")).Is(IntVal(2))
+	assert.T(t).That(q.Get(Next) == nil)
+	assert.T(t).This(tran.Complete()).Is("")
+	assert.T(t).This(dc.SessionId("")).Is("127.0.0.1")
+	bakfile := filepath.Join(dir, "tmp.bak.db")
+	assert.T(t).This(dc.Backup(bakfile)).Is("")
+	bak, err := db19.OpenDatabase(bakfile)
+	assert.T(t).That(err == nil)
+	assert.T(t).That(bak.Check() == nil)
+	bak.Close()
+	assert.T(t).This(dc.Compact()).Is("")
+	assert.T(t).This(dc.Check()).Is("")
+	assert.T(t).This(dc.SessionId("foobar")).Is("foobar")
+	assert.T(t).This(dc.SessionId("")).Is("foobar")
+
+	// connections and kill
+	dc2 := NewDbmsClient("127.0.0.1", port)
+	defer dc2.Close()
+	dc2.SessionId("two")
+	assert.T(t).This(dc.Connections().String()).Is(`#("foobar", "two")`)
+	tran = dc2.Transaction(true)
+	tran.Request("insert { a: 2 } into tbl")
+	infos := ConnInfos()
+	assert.T(t).This(infos[1].Trans).Is(1)
+	assert.T(t).This(infos[1].RemoteAddr).Is("127.0.0.1")
+	assert.T(t).This(dc.Kill("two")).Is(1)
+	for i := 0; i < 100 && len(ConnInfos()) > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.T(t).This(dc.Connections().String()).Is(`#("foobar")`)
+	// the killed connection's transaction was rolled back
+	tran = dc.Transaction(true)
+	assert.T(t).This(tran.Request("insert { a: 2 } into tbl")).Is(1)
+	assert.T(t).This(tran.Complete()).Is("")
+}
+
+func TestAuth(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	dbms := NewDbmsLocal(db)
+	dbms.Admin("create users (user, passhash) key(user)")
+	tran := dbms.Transaction(true)
+	tran.Request("insert { user: 'bob', passhash: 'secret' } into users")
+	assert.This(tran.Complete()).Is("")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.That(err == nil)
+	defer l.Close()
+	go Serve(dbms.(*DbmsLocal), l)
+	defer func() { token = "" }()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	// unauthorized requests close the connection
+	dc := NewDbmsClient("127.0.0.1", port)
+	assert.This(func() { dc.Transaction(false) }).Panics("not authorized")
+	dc.Close()
+
+	dc = NewDbmsClient("127.0.0.1", port)
+	defer dc.Close()
+	assert.This(dc.Libraries().String()).Is(`#("stdlib")`)
+	assert.That(!dc.Auth("bob\x00wrong"))
+	hash := func(nonce string) string {
+		h := sha1.Sum([]byte(nonce + "secret"))
+		return string(h[:])
+	}
+	// a nonce can only be used once
+	nonce := dc.Nonce()
+	assert.That(!dc.Auth("joe\x00" + hash(nonce)))
+	assert.That(!dc.Auth("bob\x00" + hash(nonce)))
+	assert.That(dc.Auth("bob\x00" + hash(dc.Nonce())))
+	dc.Transaction(false).Complete()
+
+	// new connections are authorized with the token from Auth
+	dc2 := NewDbmsClient("127.0.0.1", port)
+	defer dc2.Close()
+	dc2.Transaction(false).Complete()
+	// tokens can only be used once
+	tok := dc2.Token()
+	assert.That(dc2.Auth(tok))
+	assert.That(!dc2.Auth(tok))
+}
+
+func TestReconnect(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	dbms := NewDbmsLocal(db).(*DbmsLocal)
+	dbms.Admin("create tbl (a) key(a)")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.That(err == nil)
+	go Serve(dbms, l)
+	defer func(d time.Duration) { reconnectDelay = d }(reconnectDelay)
+	reconnectDelay = 10 * time.Millisecond
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	dc := NewDbmsClient("127.0.0.1", port)
+	defer dc.Close()
+	dc.SessionId("recon")
+	kill := func() {
+		assert.This(serverConns.kill("recon")).Is(1)
+		assert.That(waitFor(func() bool { return len(ConnInfos()) == 0 }))
+	}
+
+	// requests that are safe to repeat are retried
+	tran := dc.Transaction(true)
+	q := tran.Query("tbl")
+	kill()
+	assert.This(dc.Libraries().String()).Is(`#("stdlib")`)
+	assert.This(dc.Connections().String()).Is(`#("recon")`)
+	// state from the lost connection is no longer valid
+	assert.This(func() { tran.Request("insert { a: 1 } into tbl") }).
+		Panics(lostConnection + ", " + tran.String() + " is no longer valid")
+	assert.This(func() { q.Get(Next) }).Panics(lostConnection)
+	tran.Abort() // ignored
+	q.Close()    // ignored
+
+	// state from the new connection is valid
+	tran = dc.Transaction(true)
+	assert.This(tran.Request("insert { a: 1 } into tbl")).Is(1)
+	// losing the connection during a request with state
+	kill()
+	assert.This(func() { tran.Complete() }).
+		Panics(lostConnection + ", " + tran.String() + " is no longer valid")
+	row, _ := dc.Get(0, "tbl", Next)
+	assert.That(row == nil) // was rolled back
+
+	// requests that are not safe to repeat are not retried
+	kill()
+	assert.This(func() { dc.Admin("create tbl2 (b) key(b)") }).
+		Panics(lostConnection + ", request may not have completed")
+	dc.Admin("create tbl2 (b) key(b)")
+
+	// the server restarts
+	l.Close()
+	serverConns.kill("recon")
+	assert.That(waitFor(func() bool { return len(ConnInfos()) == 0 }))
+	restarted := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		l, _ := net.Listen("tcp", "127.0.0.1:"+port)
+		restarted <- l
+		Serve(dbms, l)
+	}()
+	assert.This(dc.Check()).Is("")
+	defer (<-restarted).Close()
+
+	// the heartbeat detects the lost connection while idle
+	defer func(d time.Duration) { heartbeatInterval = d }(heartbeatInterval)
+	heartbeatInterval = 20 * time.Millisecond
+	dc2 := NewDbmsClient("127.0.0.1", port)
+	defer dc2.Close()
+	dc2.SessionId("idle")
+	assert.This(serverConns.kill("idle")).Is(1)
+	time.Sleep(50 * time.Millisecond)
+	assert.That(waitFor(func() bool {
+		for _, ci := range ConnInfos() {
+			if ci.SessionId == "idle" {
+				return true
+			}
+		}
+		return false
+	}))
+}
+
+// waitFor returns whether fn returned true within about a second
+func waitFor(fn func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if fn() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestCheckHello(t *testing.T) {
+	test := func(hello, built string, expected string) {
+		t.Helper()
+		server, client := net.Pipe()
+		go func() {
+			buf := make([]byte, helloSize)
+			copy(buf, hello)
+			server.Write(buf)
+			server.Close()
+		}()
+		defer func(b string) { options.BuiltDate = b }(options.BuiltDate)
+		options.BuiltDate = built
+		_, err := checkHello(client)
+		if expected == "" {
+			assert.T(t).That(err == nil)
+		} else {
+			assert.T(t).This(err.Error()).Like(expected)
+		}
+	}
+	test("Suneido Jan 1 2020\r\n", "Jan 1 2020", "")
+	test("Suneido Jan 1 2020\r\ncompress", "Jan 1 2020", "")
+	test("Suneido Jan 2 2020\r\n", "Jan 1 2020",
+		"version mismatch, server is Jan 2 2020, client is Jan 1 2020")
+	test("hello", "", "invalid response from server")
+	options.IgnoreVersion = true
+	defer func() { options.IgnoreVersion = false }()
+	test("Suneido Jan 2 2020\r\n", "Jan 1 2020", "")
+}
+
+func TestPartialResponse(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.That(err == nil)
+	defer l.Close()
+	// a command that fails after writing, more than the buffer if big
+	big := strings.Repeat("helloworld", 1000)
+	defer func(f func(*serverConn)) { cmds[commands.Timestamp] = f }(
+		cmds[commands.Timestamp])
+	cmds[commands.Timestamp] = func(sc *serverConn) {
+		s := "hello"
+		if sc.GetBool() {
+			s = big
+		}
+		sc.PutBool(true).PutStr(s)
+		panic("failed")
+	}
+	go Serve(NewDbmsLocal(db).(*DbmsLocal), l)
+	defer waitFor(func() bool { return len(ConnInfos()) == 0 })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.That(err == nil)
+	defer conn.Close()
+	_, err = io.ReadFull(conn, make([]byte, helloSize))
+	assert.That(err == nil)
+	rw := csio.NewReadWrite(conn).
+		OnError(func(err error) { panic("lost: " + err.Error()) })
+
+	// the buffered part of the response is discarded
+	rw.PutCmd(commands.Timestamp).PutBool(false)
+	assert.This(func() { rw.Request() }).Panics("failed (from server)")
+
+	// part of the response has been sent so the connection is closed
+	rw.PutCmd(commands.Timestamp).PutBool(true)
+	rw.Request()
+	assert.This(func() { rw.GetStr() }).Panics("lost: unexpected EOF")
+}
+
+func TestProtocolProfile(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.That(err == nil)
+	defer l.Close()
+	go Serve(NewDbmsLocal(db).(*DbmsLocal), l)
+
+	// set and restored when there are no server connections
+	assert.That(waitFor(func() bool { return len(ConnInfos()) == 0 }))
+	defer func(t int) { options.Trace = t }(options.Trace)
+	options.Trace |= options.TraceProtocol
+	csio.ProfileReset()
+	defer csio.ProfileReset()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	dc := NewDbmsClient("127.0.0.1", port)
+	defer waitFor(func() bool { return len(ConnInfos()) == 0 })
+	defer dc.Close()
+	dc.Admin("create tbl (a) key(a)")
+	// the server time follows errors as well
+	assert.This(func() { dc.Run("") }).Panics("(from server)")
+	tran := dc.Transaction(true)
+	assert.This(tran.Request("insert { a: 1 } into tbl")).Is(1)
+	assert.This(tran.Complete()).Is("")
+	// the server adds to the profile after it sends the response
+	assert.That(waitFor(func() bool {
+		return strings.Contains(csio.ProfileSummary(), "server Commit")
+	}))
+	s := csio.ProfileSummary()
+	for _, x := range []string{"client Admin", "server Admin",
+		"client Run", "server Run", "client Request", "client Commit",
+		"server Commit", "server Profile"} {
+		assert.Msg(x).That(strings.Contains(s, x))
+	}
+	assert.That(!strings.Contains(s, "client Profile"))
+
+	// profiling continues after a reconnect
+	serverConns.kill("127.0.0.1")
+	assert.That(waitFor(func() bool { return len(ConnInfos()) == 0 }))
+	dc.Timestamp()
+	assert.That(dc.profiling)
+}
+
+func TestProtocolProfileAuth(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	dbms := NewDbmsLocal(db)
+	dbms.Admin("create users (user, passhash) key(user)")
+	tran := dbms.Transaction(true)
+	tran.Request("insert { user: 'bob', passhash: 'secret' } into users")
+	assert.This(tran.Complete()).Is("")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.That(err == nil)
+	defer l.Close()
+	go Serve(dbms.(*DbmsLocal), l)
+	defer func() { token = "" }()
+
+	assert.That(waitFor(func() bool { return len(ConnInfos()) == 0 }))
+	defer func(t int) { options.Trace = t }(options.Trace)
+	options.Trace |= options.TraceProtocol
+	options.Compress = true
+	defer func() { options.Compress = false }()
+	csio.ProfileReset()
+	defer csio.ProfileReset()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	dc := NewDbmsClient("127.0.0.1", port)
+	defer waitFor(func() bool { return len(ConnInfos()) == 0 })
+	defer dc.Close()
+	h := sha1.Sum([]byte(dc.Nonce() + "secret"))
+	assert.That(dc.Auth("bob\x00" + string(h[:])))
+	assert.This(dc.Libraries().String()).Is(`#("stdlib")`)
+
+	// reconnecting authorizes with the token
+	serverConns.kill("127.0.0.1")
+	assert.That(waitFor(func() bool { return len(ConnInfos()) == 0 }))
+	assert.This(dc.Libraries().String()).Is(`#("stdlib")`)
+	dc.Transaction(false).Complete()
+	assert.This(dc.SessionId("")).Is("127.0.0.1")
+	assert.That(strings.Contains(csio.ProfileSummary(), "client Auth"))
+}
+
+func TestReauth(t *testing.T) {
+	assert := assert.T(t)
+	db, err := db19.CreateDatabase(filepath.Join(t.TempDir(), "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	dbms := NewDbmsLocal(db).(*DbmsLocal)
+	dbms.Admin("create users (user, passhash) key(user)")
+	tran := dbms.Transaction(true)
+	tran.Request("insert { user: 'bob', passhash: 'secret' } into users")
+	assert.This(tran.Complete()).Is("")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.That(err == nil)
+	go Serve(dbms, l)
+	defer func() { token = "" }()
+	defer func(d time.Duration) { reconnectDelay = d }(reconnectDelay)
+	reconnectDelay = time.Second
+
+	assert.That(waitFor(func() bool { return len(ConnInfos()) == 0 }))
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	dc := NewDbmsClient("127.0.0.1", port)
+	defer dc.Close()
+	auth := func() bool {
+		h := sha1.Sum([]byte(dc.Nonce() + "secret"))
+		return dc.Auth("bob\x00" + string(h[:]))
+	}
+	assert.That(auth())
+	assert.That(token != "")
+
+	// the server restarts, the token is no longer valid
+	l.Close()
+	serverConns.kill("127.0.0.1")
+	assert.That(waitFor(func() bool { return len(ConnInfos()) == 0 }))
+	l, err = net.Listen("tcp", "127.0.0.1:"+port)
+	assert.That(err == nil)
+	defer l.Close()
+	go Serve(dbms, l)
+	assert.That(waitFor(func() bool {
+		tokens.lock.Lock()
+		defer tokens.lock.Unlock()
+		return len(tokens.tokens) == 0
+	}))
+	start := time.Now()
+	assert.This(func() { dc.Libraries() }).
+		Panics(lostConnection + ", re-authentication required")
+	assert.That(time.Since(start) < reconnectDelay) // did not retry
+	assert.This(token).Is("")
+
+	// the new connection works, but is not authorized
+	assert.This(func() { dc.Transaction(false) }).Panics("not authorized")
+	assert.That(auth())
+	dc.Transaction(false).Complete()
+}
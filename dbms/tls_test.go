@@ -0,0 +1,90 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+package dbms
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apmckinlay/gsuneido/db19"
+	"github.com/apmckinlay/gsuneido/options"
+	"github.com/apmckinlay/gsuneido/util/assert"
+	"github.com/apmckinlay/gsuneido/util/tlsconf"
+)
+
+func TestTLS(t *testing.T) {
+	assert := assert.T(t)
+	dir := t.TempDir()
+	certFile, keyFile := selfSigned(t, dir)
+
+	db, err := db19.CreateDatabase(filepath.Join(dir, "tmp.db"))
+	assert.That(err == nil)
+	db19.StartConcur(db, 50*time.Millisecond)
+	defer db.Close()
+	config, err := tlsconf.Server(certFile, keyFile)
+	assert.That(err == nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.That(err == nil)
+	defer l.Close()
+	go Serve(NewDbmsLocal(db).(*DbmsLocal), tls.NewListener(l, config))
+
+	options.TLS, options.TLSCA = true, certFile
+	defer func() { options.TLS, options.TLSCA = false, "" }()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	dc := NewDbmsClient("127.0.0.1", port)
+	defer dc.Close()
+	_, ok := dc.conn.(*tls.Conn)
+	assert.That(ok)
+	assert.This(dc.Check()).Is("")
+	assert.This(dc.SessionId("")).Is("127.0.0.1")
+
+	// without the self-signed certificate the server is not trusted
+	options.TLSCA = ""
+	_, err = dial("127.0.0.1", port)
+	assert.That(err != nil)
+}
+
+// selfSigned creates a self-signed certificate for 127.0.0.1
+// and returns the names of the certificate and key files
+func selfSigned(t *testing.T, dir string) (string, string) {
+	assert := assert.T(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.That(err == nil)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"test"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	assert.That(err == nil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.That(err == nil)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	assert.That(err == nil)
+	err = ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	assert.That(err == nil)
+	return certFile, keyFile
+}
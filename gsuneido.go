@@ -10,9 +10,11 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/apmckinlay/gsuneido/builtin"
@@ -27,15 +29,23 @@ var builtDate = "Dec 16 2019" // set by: go build -ldflags "-X main.builtDate=..
 var mode = ""                 // set by: go build -ldflags "-X main.mode=gui"
 
 var help = `options:
+	-asof date-time|offset (dump or check a previous state)
 	-check
 	-c[lient] [ipaddress] (default 127.0.0.1)
+	-compress (client)
 	-d[ump] [table]
+	-durability async|group|sync (default async)
+	-i[gnore]v[ersion] (client)
 	-l[oad] [table]
 	-n[o]r[elaunch]
 	-p[ort] # (default 3147)
 	-repair
 	-r[epl]
 	-s[erver]
+	-slowquery ms (trace queries taking longer)
+	-tls (client)
+	-tlsca file (client, implies -tls)
+	-tlscert file -tlskey file (server)
 	-u[nattended]
 	-v[ersion]`
 
@@ -69,13 +79,13 @@ func main() {
 	case "dump":
 		t := time.Now()
 		if options.Arg == "" {
-			ntables, err := db19.DumpDatabase("suneido.db", "database.su")
+			ntables, err := dumpDatabase()
 			ck(err)
 			fmt.Println("dumped", ntables, "tables in",
 				time.Since(t).Round(time.Millisecond))
 		} else {
 			table := strings.TrimSuffix(options.Arg, ".su")
-			nrecs, err := db19.DumpTable("suneido.db", table, table+".su")
+			nrecs, err := dumpTable(table)
 			ck(err)
 			fmt.Println("dumped", nrecs, "records from", table,
 				"in", time.Since(t).Round(time.Millisecond))
@@ -103,7 +113,7 @@ func main() {
 		os.Exit(0)
 	case "check":
 		t := time.Now()
-		ck(db19.CheckDatabase("suneido.db"))
+		ck(checkDatabase())
 		fmt.Println("checked database in", time.Since(t).Round(time.Millisecond))
 		os.Exit(0)
 	case "repair":
@@ -155,6 +165,44 @@ func main() {
 	}
 }
 
+// dumpDatabase, dumpTable, and checkDatabase
+// use the state as of options.AsOf if it is specified
+
+func dumpDatabase() (int, error) {
+	if options.AsOf == "" {
+		return db19.DumpDatabase("suneido.db", "database.su")
+	}
+	db, err := db19.OpenAsOf("suneido.db", options.AsOf)
+	if err != nil {
+		return 0, err
+	}
+	return db.Dump("database.su") // closes db
+}
+
+func dumpTable(table string) (int, error) {
+	if options.AsOf == "" {
+		return db19.DumpTable("suneido.db", table, table+".su")
+	}
+	db, err := db19.OpenAsOf("suneido.db", options.AsOf)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return db.DumpTable(table, table+".su")
+}
+
+func checkDatabase() error {
+	if options.AsOf == "" {
+		return db19.CheckDatabase("suneido.db")
+	}
+	db, err := db19.OpenAsOf("suneido.db", options.AsOf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Check()
+}
+
 func ck(err error) {
 	if err != nil {
 		log.Fatalln(err)
@@ -213,9 +261,22 @@ func clientErrorLog() {
 }
 
 func startServer() {
+	log.SetFlags(log.Ldate | log.Ltime)
+	Libload = libload // dependency injection
 	openDbms()
-	//TODO
-	closeDbms()
+	defer closeDbms()
+	mainThread = NewThread()
+	defer mainThread.Close()
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Println("server stopping")
+		closeDbms()
+		os.Exit(0)
+	}()
+	log.Println("server starting on port", options.Port)
+	dbms.Server(dbmsLocal.(*dbms.DbmsLocal))
 }
 
 var db *db19.Database
@@ -231,6 +292,12 @@ func openDbms() {
 		}
 		os.Exit(0)
 	}
+	if options.Durability != "" {
+		dur, err := db19.ParseDurability(options.Durability)
+		ck(err)
+		db.SetDurability(dur)
+	}
+	db19.StartConcur(db, 10*time.Second)
 	dbmsLocal = dbms.NewDbmsLocal(db)
 	GetDbms = func() IDbms { return dbmsLocal }
 }
@@ -5,6 +5,8 @@
 // including command line flags
 package options
 
+import "time"
+
 var BuiltDate string
 
 // command line flags
@@ -16,6 +18,26 @@ var (
 	Port       string
 	Unattended bool
 	NoRelaunch bool
+	// IgnoreVersion allows a client to connect to a server
+	// with a different built date
+	IgnoreVersion bool
+	// TLSCert and TLSKey are the PEM files for a server to use TLS
+	TLSCert string
+	TLSKey  string
+	// Compress makes the client compress the connection
+	// if the server supports it
+	Compress bool
+	// TLS makes the client connect with TLS
+	TLS bool
+	// TLSCA is a PEM file of the certificate authority for TLS clients,
+	// e.g. for a self-signed server certificate.
+	// If it is "" the system certificate authorities are used.
+	TLSCA string
+	// AsOf is a date-time (yyyymmdd.hhmmss) or state offset
+	// for -dump or -check of a previous state of the database
+	AsOf string
+	// Durability is async, group, or sync, see db19.Durability
+	Durability string
 )
 
 // CmdLine is the remaining command line arguments
@@ -39,6 +61,10 @@ var Coverage int64
 
 var Trace = 0
 
+// SlowQuery is the minimum time for a query to be logged
+// when TraceSlowQuery is set, see dbms/query/trace.go
+var SlowQuery = 5 * time.Second
+
 const (
 	TraceFunctions = 1 << iota
 	TraceStatements
@@ -62,4 +88,7 @@ const (
 	TraceGlobals
 
 	TraceJoinOpt
+
+	// TraceProtocol profiles the client-server round trips (see csio)
+	TraceProtocol
 )
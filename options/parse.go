@@ -5,7 +5,9 @@ package options
 
 import (
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Parse processes the command line options
@@ -18,16 +20,25 @@ loop:
 			continue
 		}
 		switch {
+		// -compress and -check must be matched before -c
+		case match(&args, "-compress"):
+			Compress = true
+		case match(&args, "-check"):
+			setAction("check")
 		case match(&args, "-client"), match(&args, "-c"):
 			setAction("client")
 			Arg = "127.0.0.1"
 			args = optionalArg(args)
-		case match(&args, "-check"):
-			setAction("check")
+		case match(&args, "-asof"):
+			args = requiredArg(args, &AsOf, "-asof date-time or offset required")
 		case match(&args, "-repair"):
 			setAction("repair")
 		case match(&args, "-compact"):
 			setAction("compact")
+		// -durability must be matched before -d
+		case match(&args, "-durability"):
+			args = requiredArg(args, &Durability,
+				"-durability async, group, or sync required")
 		case match(&args, "-dump"), match(&args, "-d"):
 			setAction("dump")
 			args = optionalArg(args)
@@ -41,11 +52,26 @@ loop:
 				setAction("repl")
 			}
 		case match(&args, "-port"), match(&args, "-p"):
-			if len(args) > 0 && args[0][0] != '-' {
-				Port = args[0]
-				args = args[1:]
-			} else {
-				error("port number required")
+			args = requiredArg(args, &Port, "port number required")
+		// the longer -tls options must be matched before -tls
+		case match(&args, "-tlscert"):
+			args = requiredArg(args, &TLSCert, "-tlscert file required")
+		case match(&args, "-tlskey"):
+			args = requiredArg(args, &TLSKey, "-tlskey file required")
+		case match(&args, "-tlsca"):
+			TLS = true
+			args = requiredArg(args, &TLSCA, "-tlsca file required")
+		case match(&args, "-tls"):
+			TLS = true
+		// -slowquery must be matched before -s
+		case match(&args, "-slowquery"):
+			var ms string
+			args = requiredArg(args, &ms, "-slowquery milliseconds required")
+			if n, err := strconv.Atoi(ms); err == nil && n >= 0 {
+				SlowQuery = time.Duration(n) * time.Millisecond
+				Trace |= TraceSlowQuery | TraceLogFile
+			} else if ms != "" {
+				error("invalid -slowquery milliseconds: " + ms)
 			}
 		case match(&args, "-server"), match(&args, "-s"):
 			setAction("server")
@@ -54,7 +80,7 @@ loop:
 		case match(&args, "-version"), match(&args, "-v"):
 			Action = "version"
 		case match(&args, "-ignoreversion"), match(&args, "-iv"):
-			// for compatibility with cSuneido
+			IgnoreVersion = true
 		case match(&args, "-norelaunch"), match(&args, "-nr"):
 			NoRelaunch = true
 		case match(&args, "--"):
@@ -70,6 +96,14 @@ loop:
 		error("port should only be specifed with -server or -client, not " +
 			Action)
 	}
+	if AsOf != "" && Action != "dump" && Action != "check" {
+		error("-asof should only be specified with -dump or -check")
+	}
+	if (TLSCert == "") != (TLSKey == "") {
+		error("-tlscert and -tlskey must be used together")
+	} else if TLSCert != "" && Action != "server" {
+		error("-tlscert and -tlskey should only be specified with -server")
+	}
 	if Port == "" && (Action == "client" || Action == "server") {
 		Port = "3147"
 	}
@@ -92,6 +126,15 @@ func match(pargs *[]string, s string) bool {
 	return false
 }
 
+func requiredArg(args []string, dst *string, err string) []string {
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		*dst = args[0]
+		return args[1:]
+	}
+	error(err)
+	return args
+}
+
 func setAction(action string) {
 	if Action == "" {
 		Action = action
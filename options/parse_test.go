@@ -6,6 +6,7 @@ package options
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/apmckinlay/gsuneido/util/assert"
 )
@@ -13,6 +14,9 @@ import (
 func TestParse(t *testing.T) {
 	test := func(args ...string) func(string) {
 		Action, Arg, Port, CmdLine = "", "", "", ""
+		TLSCert, TLSKey, TLS, TLSCA = "", "", false, ""
+		SlowQuery, Trace = 5*time.Second, 0
+		AsOf, Durability = "", ""
 		Parse(args)
 		s := Action
 		if Arg != "" {
@@ -21,6 +25,21 @@ func TestParse(t *testing.T) {
 		if Port != "3147" && Port != "" {
 			s += " port " + Port
 		}
+		if TLSCert != "" {
+			s += " cert " + TLSCert + " key " + TLSKey
+		}
+		if TLS {
+			s += strings.TrimRight(" tls "+TLSCA, " ")
+		}
+		if Trace&TraceSlowQuery != 0 {
+			s += " slowquery " + SlowQuery.String()
+		}
+		if Durability != "" {
+			s += " durability " + Durability
+		}
+		if AsOf != "" {
+			s += " asof " + AsOf
+		}
 		if CmdLine != "" {
 			s += " | " + CmdLine
 		}
@@ -63,7 +82,28 @@ func TestParse(t *testing.T) {
 	test("-dump", "stdlib")("dump stdlib")
 	test("-server")("server")
 	test("-repair")("repair")
+	test("-check")("check")
 	test("-xyz")("error")
+	test("-s", "-tlscert", "c.pem", "-tlskey", "k.pem")("server cert c.pem key k.pem")
+	test("-s", "-tlscert", "c.pem")("error")
+	test("-s", "-tlskey")("error")
+	test("-c", "-tlscert", "c.pem", "-tlskey", "k.pem")("error")
+	test("-compress", "-c")("client 127.0.0.1")
+	test("-c", "-tls")("client 127.0.0.1 tls")
+	test("-c", "-tlsca", "ca.pem")("client 127.0.0.1 tls ca.pem")
+	test("-s", "-slowquery", "500")("server slowquery 500ms")
+	test("-slowquery2000", "-s")("server slowquery 2s")
+	test("-s", "-slowquery")("error")
+	test("-s", "-slowquery", "x")("error")
+	test("-c", "-tlsca")("error")
+	test("-dump", "-asof", "20260102.030405")("dump asof 20260102.030405")
+	test("-asof", "12345", "-dump", "stdlib")("dump stdlib asof 12345")
+	test("-check", "-asof12345")("check asof 12345")
+	test("-check", "-asof")("error")
+	test("-s", "-asof", "12345")("error")
+	test("-durability", "group", "-s")("server durability group")
+	test("-durabilitysync")("durability sync")
+	test("-durability", "-s")("error")
 }
 
 func TestEscapeArg(t *testing.T) {
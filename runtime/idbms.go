@@ -12,10 +12,18 @@ type IDbms interface {
 	// Auth authorizes the connection with the server
 	Auth(string) bool
 
+	// Backup copies the database to a file while it is in use.
+	// It returns "" or an error message.
+	Backup(to string) string
+
 	// Check checks the database like -check
 	// It returns "" or an error message.
 	Check() string
 
+	// Compact compacts the database file while it is in use.
+	// It returns "" or an error message.
+	Compact() string
+
 	// Close ends a dbms connection
 	Close()
 
@@ -151,7 +159,7 @@ type IQuery interface {
 }
 
 // ICursor is the interface to a database query,
-// either local (not implemented yet) or QueryClient.
+// either local or QueryClient.
 type ICursor interface {
 	IQueryCursor
 
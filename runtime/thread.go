@@ -203,9 +203,33 @@ func (t *Thread) Dbms() IDbms {
 	if t.dbms == nil {
 		t.dbms = GetDbms()
 	}
+	if ts, ok := t.dbms.(threadSetter); ok {
+		ts.SetThread(t) // may be shared by SubThread
+	}
 	return t.dbms
 }
 
+// SetDbms sets the dbms for the thread.
+// It is used by server connections to apply the connection's permissions.
+func (t *Thread) SetDbms(dbms IDbms) {
+	t.dbms = dbms
+}
+
+// threadSetter is implemented by the client dbms
+// so protocol profiling can report the calling function (see Caller)
+type threadSetter interface {
+	SetThread(t *Thread)
+}
+
+// Caller returns the name of the currently executing Suneido function,
+// or "" if there isn't one
+func (t *Thread) Caller() string {
+	if t.fp == 0 || t.frames[t.fp-1].fn == nil {
+		return ""
+	}
+	return t.frames[t.fp-1].fn.Name
+}
+
 func (t *Thread) Close() {
 	if t.dbms != nil {
 		t.dbms.Close()
@@ -29,6 +29,19 @@ func Index(data []int, value int) int {
 	return -1
 }
 
+// Equal returns true if the slices have the same values in the same order
+func Equal(x []int, y []int) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i, v := range x {
+		if v != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // Compare returns -1 if x < y, 0 if x == y, and +1 if x > y
 func Compare(x int, y int) int {
 	if x < y {
@@ -50,3 +50,63 @@ func (list List) Reverse() {
 		list[i], list[j] = list[j], list[i]
 	}
 }
+
+// Equal returns true if the lists have the same elements in the same order
+func (list List) Equal(list2 []string) bool {
+	if len(list) != len(list2) {
+		return false
+	}
+	for i, s := range list {
+		if s != list2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HasAll returns true if the list contains all of the strings in list2
+func (list List) HasAll(list2 []string) bool {
+	for _, s := range list2 {
+		if !list.Has(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// Union returns a new slice with the elements of list
+// followed by the elements of list2 that are not in list
+func (list List) Union(list2 []string) []string {
+	dest := make([]string, 0, len(list)+len(list2))
+	dest = append(dest, list...)
+	for _, s := range list2 {
+		if !list.Has(s) {
+			dest = append(dest, s)
+		}
+	}
+	return dest
+}
+
+// Difference returns a new slice with the elements of list
+// that are not in list2, maintaining the existing order.
+func (list List) Difference(list2 []string) []string {
+	dest := make([]string, 0, len(list))
+	for _, s := range list {
+		if !List(list2).Has(s) {
+			dest = append(dest, s)
+		}
+	}
+	return dest
+}
+
+// Intersect returns a new slice with the elements of list
+// that are also in list2, maintaining the existing order.
+func (list List) Intersect(list2 []string) []string {
+	dest := make([]string, 0, len(list))
+	for _, s := range list {
+		if List(list2).Has(s) {
+			dest = append(dest, s)
+		}
+	}
+	return dest
+}
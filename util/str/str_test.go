@@ -99,6 +99,19 @@ func TestList_Reverse(t *testing.T) {
 	assert.T(t).This(list).Is([]string{"three", "two", "one"})
 }
 
+func TestList_Sets(t *testing.T) {
+	assert := assert.T(t).This
+	list := List([]string{"one", "two", "three"})
+	assert(list.HasAll([]string{"three", "one"})).Is(true)
+	assert(list.HasAll([]string{"one", "four"})).Is(false)
+	assert(list.Union([]string{"four", "two"})).
+		Is([]string{"one", "two", "three", "four"})
+	assert(list.Difference([]string{"two", "four"})).
+		Is([]string{"one", "three"})
+	assert(list.Intersect([]string{"three", "four", "one"})).
+		Is([]string{"one", "three"})
+}
+
 func TestCmpLower(t *testing.T) {
 	test := func(s1, s2 string, result int) {
 		assert.T(t).Msg(s1, "<=>", s2).This(CmpLower(s1, s2)).Is(result)
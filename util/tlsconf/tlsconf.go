@@ -0,0 +1,44 @@
+// Copyright Suneido Software Corp. All rights reserved.
+// Governed by the MIT license found in the LICENSE file.
+
+// Package tlsconf builds TLS configurations from certificate files
+// for the client-server connections and the sockets
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// Server returns a server configuration using the certificate and key
+// from PEM files
+func Server(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert},
+		MinVersion: tls.VersionTLS12}, nil
+}
+
+// Client returns a client configuration for connecting to host.
+// If caFile is not "" the server certificate must be signed by it
+// (e.g. a self-signed certificate),
+// otherwise the system certificate authorities are used.
+func Client(caFile, host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}